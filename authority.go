@@ -0,0 +1,150 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneAuthority is the result of Resolver.AuthoritativeServers.
+type ZoneAuthority struct {
+	// Zone is the zone that contains the name in question. The trailing dot
+	// is omitted.
+	Zone string
+
+	// TTL is the TTL of the NS records of Zone.
+	TTL time.Duration
+
+	// NameServers contains the name servers of Zone, in the order of its NS
+	// records.
+	NameServers []AuthoritativeServer
+
+	// Trace contains all queries that have been sent for the lookup.
+	Trace *Trace
+}
+
+// AuthoritativeServer is a name server of a zone; see ZoneAuthority.
+type AuthoritativeServer struct {
+	// Name is the fully qualified name of the name server, as in the NS
+	// records of the zone.
+	Name string
+
+	// Addrs contains the IPv6 and IPv4 addresses of the name server, and
+	// TTL is the smallest TTL of the address records.
+	Addrs []string
+	TTL   time.Duration
+
+	// Err is the error that has occurred while resolving Name, if no
+	// addresses have been found.
+	Err error
+}
+
+// AuthoritativeServers returns the zone that contains name, the names of its
+// name servers, and their addresses. This is cheaper than CheckDelegation,
+// which queries every name server, and answers the question of who is
+// authoritative for a name without having to look up any of its records.
+// name doesn't have to exist; the zone that would contain it is returned
+// nonetheless.
+//
+// The zone is determined by the SOA record in the response to a query for
+// the SOA records of name, which is either the SOA record of name itself, or
+// the SOA record of the zone that proves that name has no such records. If
+// the response doesn't include one, the zone that has been delegated to last
+// is used; see RecordSet.ZoneCuts.
+//
+// Name servers whose addresses can't be resolved are included with Err set.
+// An error is returned only if the zone or its NS records couldn't be
+// determined.
+func (R *Resolver) AuthoritativeServers(ctx context.Context, name string) (ZoneAuthority, error) {
+	fqdn := dns.CanonicalName(name)
+	auth := ZoneAuthority{
+		Trace: R.newTrace(),
+	}
+
+	zone, err := R.enclosingZone(ctx, fqdn, auth.Trace)
+	if err != nil {
+		return auth, fmt.Errorf("authoritative servers of %s: %w", trimTrailingDot(fqdn), err)
+	}
+	auth.Zone = trimTrailingDot(zone)
+
+	rs, err := R.Query(ctx, "NS", zone)
+	auth.Trace.append(rs.Trace)
+	if err != nil {
+		return auth, fmt.Errorf("authoritative servers of %s: %w", trimTrailingDot(fqdn), err)
+	}
+	auth.TTL = rs.TTL
+
+	for _, rr := range rs.records() {
+		if ns, ok := rr.(*dns.NS); ok {
+			auth.NameServers = append(auth.NameServers, R.authoritativeServer(ctx, ns.Ns, auth.Trace))
+		}
+	}
+	if len(auth.NameServers) == 0 {
+		return auth, fmt.Errorf("authoritative servers of %s: no NS records for %s", trimTrailingDot(fqdn), auth.Zone)
+	}
+
+	return auth, nil
+}
+
+// enclosingZone returns the zone that contains fqdn.
+func (R *Resolver) enclosingZone(ctx context.Context, fqdn string, trace *Trace) (string, error) {
+	rs, err := R.Query(WithoutFollowingCNAMEs(ctx), "SOA", fqdn)
+	trace.append(rs.Trace)
+	if err != nil && !errors.Is(err, ErrNXDomain) {
+		return "", err
+	}
+
+	for _, rrs := range [][]dns.RR{rs.Raw.Answer, rs.Raw.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, fqdn) {
+				return dns.CanonicalName(soa.Hdr.Name), nil
+			}
+		}
+	}
+	if n := len(rs.ZoneCuts); n > 0 {
+		return rs.ZoneCuts[n-1].Zone, nil
+	}
+
+	return "", errors.New("no SOA record in response")
+}
+
+// authoritativeServer resolves the addresses of the name server called name.
+func (R *Resolver) authoritativeServer(ctx context.Context, name string, trace *Trace) AuthoritativeServer {
+	s := AuthoritativeServer{Name: name}
+
+	types := make([]string, 0, 2)
+	if !R.DisableIP6 {
+		types = append(types, "AAAA")
+	}
+	if !R.DisableIP4 {
+		types = append(types, "A")
+	}
+
+	for _, typ := range types {
+		rs, err := R.Query(ctx, typ, name)
+		trace.append(rs.Trace)
+		if err != nil {
+			s.Err = fmt.Errorf("resolve %s: %w", trimTrailingDot(name), err)
+			if errors.Is(err, ErrNXDomain) {
+				break
+			}
+			continue
+		}
+		if len(rs.Values) == 0 {
+			continue
+		}
+
+		s.Addrs = append(s.Addrs, rs.Values...)
+		if s.TTL == 0 || rs.TTL < s.TTL {
+			s.TTL = rs.TTL
+		}
+	}
+	if len(s.Addrs) > 0 {
+		s.Err = nil
+	}
+
+	return s
+}
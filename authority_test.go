@@ -0,0 +1,90 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_AuthoritativeServers(t *testing.T) {
+	soa := func(zone string) dns.RR {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns1." + zone,
+			Mbox:   "hostmaster." + zone,
+			Minttl: 60,
+		}
+	}
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("* *.com.").AnyTimes().DelegateTo("com.", comSrv.IP()).ViaAuthoritySection()
+	rootSrv.ExpectQuery("A ns.other.test.").AnyTimes().Respond().
+		Answer(A(t, "ns.other.test.", 120, "192.0.2.2"))
+	rootSrv.ExpectQuery("AAAA ns.other.test.").AnyTimes().Respond().
+		Answer(AAAA(t, "ns.other.test.", 60, "2001:db8::2"))
+	rootSrv.ExpectQuery("* missing.test.").AnyTimes().Respond().
+		Status(dns.RcodeNameError).
+		Authority(soa("test."))
+
+	comSrv.ExpectQuery("* *.com.").AnyTimes().Respond().NonAuthoritative().
+		Authority(NS(t, "example.com.", 300, "ns1.example.com.")).
+		Additional(A(t, "ns1.example.com.", 300, expSrv.IP()))
+
+	expSrv.ExpectQuery("SOA example.com.").AnyTimes().Respond().
+		Answer(soa("example.com."))
+	expSrv.ExpectQuery("NS example.com.").AnyTimes().Respond().
+		Answer(
+			NS(t, "example.com.", 600, "ns1.example.com."),
+			NS(t, "example.com.", 600, "ns.other.test."),
+			NS(t, "example.com.", 600, "missing.test."),
+		)
+	expSrv.ExpectQuery("A ns1.example.com.").AnyTimes().Respond().
+		Answer(A(t, "ns1.example.com.", 300, expSrv.IP()))
+	expSrv.ExpectQuery("* www.example.com.").AnyTimes().Respond().
+		Answer(CNAME(t, "www.example.com.", 300, "web.example.net."))
+	expSrv.ExpectQuery("* ns1.example.com.").AnyTimes().Respond().
+		Authority(soa("example.com."))
+	expSrv.ExpectQuery("* web.example.com.").AnyTimes().Respond().
+		Authority(soa("example.com."))
+	expSrv.ExpectQuery("* *.example.com.").AnyTimes().Respond().
+		Status(dns.RcodeNameError).
+		Authority(soa("example.com."))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"Example.com", "web.example.com.", "www.example.com", "nx.example.com"} {
+		auth, err := r.AuthoritativeServers(ctx, name)
+		require.NoError(t, err, name)
+		t.Logf("Trace:\n%s", auth.Trace.Dump())
+
+		assert.Equal(t, "example.com", auth.Zone, name)
+		assert.Equal(t, 600*time.Second, auth.TTL, name)
+		require.Len(t, auth.NameServers, 3, name)
+
+		assert.Equal(t, AuthoritativeServer{
+			Name:  "ns1.example.com.",
+			Addrs: []string{"127.0.0.101"},
+			TTL:   300 * time.Second,
+		}, auth.NameServers[0], name)
+		assert.Equal(t, AuthoritativeServer{
+			Name:  "ns.other.test.",
+			Addrs: []string{"2001:db8::2", "192.0.2.2"},
+			TTL:   60 * time.Second,
+		}, auth.NameServers[1], name)
+		assert.Equal(t, "missing.test.", auth.NameServers[2].Name, name)
+		assert.Empty(t, auth.NameServers[2].Addrs, name)
+		assert.ErrorIs(t, auth.NameServers[2].Err, ErrNXDomain, name)
+	}
+}
@@ -0,0 +1,73 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CAARecord is a parsed CAA record, as described in RFC 8659.
+type CAARecord struct {
+	// Flags is the flags octet of the record. Use Critical to test for the
+	// issuer critical flag.
+	Flags uint8
+
+	// Tag is the property tag, such as "issue", "issuewild", or "iodef".
+	Tag string
+
+	// Value is the property value, without quotes.
+	Value string
+}
+
+// Critical reports whether the issuer critical flag is set.
+func (c CAARecord) Critical() bool {
+	return c.Flags&128 != 0
+}
+
+// LookupCAA determines the relevant CAA record set for domainName, as
+// described in RFC 8659, Section 3: CAA records are queried for domainName
+// and then for each of its parent domains in turn, until a non-empty record
+// set is found. The root zone is never queried.
+//
+// The returned RecordSet is the one that contains the relevant CAA records;
+// its Name field is the domain name the records have been found at. Its
+// Trace, however, contains the queries for all domain names that have been
+// tried. If no CAA records exist at all, LookupCAA returns no records and the
+// RecordSet for the top-level domain.
+//
+// NXDOMAIN responses are not considered an error; the search continues with
+// the parent domain.
+func (r *Resolver) LookupCAA(ctx context.Context, domainName string) ([]CAARecord, RecordSet, error) {
+	trace := &Trace{}
+
+	name := strings.TrimSuffix(dns.CanonicalName(domainName), ".")
+	for {
+		rs, err := r.Query(ctx, "CAA", name)
+		trace.append(rs.Trace)
+		rs.Trace = trace
+
+		if err != nil && !errors.Is(err, ErrNXDomain) {
+			return nil, rs, err
+		}
+
+		var records []CAARecord
+		for _, rr := range rs.records() {
+			if rr, ok := rr.(*dns.CAA); ok {
+				records = append(records, CAARecord{
+					Flags: rr.Flag,
+					Tag:   rr.Tag,
+					Value: rr.Value,
+				})
+			}
+		}
+
+		i := strings.IndexByte(name, '.')
+		if len(records) > 0 || i < 0 {
+			return records, rs, nil
+		}
+
+		name = name[i+1:]
+	}
+}
@@ -0,0 +1,51 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_LookupCAA(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("CAA www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("CAA www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("CAA www.example.com.").Respond().Status(dns.RcodeNameError)
+
+	// The delegation to example.com. is cached after the first query.
+	expSrv.ExpectQuery("CAA example.com.").Respond().
+		Answer(
+			CAA(t, "example.com.", 321, 0, "issue", "ca.example.net"),
+			CAA(t, "example.com.", 321, 128, "tbs", "unknown"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	records, rs, err := r.LookupCAA(ctx, "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []CAARecord{
+		{Flags: 0, Tag: "issue", Value: "ca.example.net"},
+		{Flags: 128, Tag: "tbs", Value: "unknown"},
+	}, records)
+	assert.False(t, records[0].Critical())
+	assert.True(t, records[1].Critical())
+
+	assert.Equal(t, "example.com", rs.Name)
+	assert.Len(t, rs.Trace.Queries, 6)
+}
@@ -4,17 +4,22 @@ import (
 	"container/list"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// const maxCacheSize = 10_000
+// maxShards is the number of shards of a Cache, unless the cache is too small
+// to be split up this much. Each shard has its own lock, so that concurrent
+// queries rarely contend for the same one.
+const maxShards = 16
 
 type cacheItem struct {
 	msg     *dns.Msg
 	addedAt time.Time
 	ttl     time.Duration
+	size    int
 	elem    *list.Element
 }
 
@@ -23,29 +28,214 @@ type cacheKey struct {
 	q    dns.Question
 }
 
+// hash returns the FNV-1a hash of the key.
+func (k cacheKey) hash() uint32 {
+	const prime = 16777619
+
+	h := uint32(2166136261)
+	for i := 0; i < len(k.addr); i++ {
+		h = (h ^ uint32(k.addr[i])) * prime
+	}
+	for i := 0; i < len(k.q.Name); i++ {
+		h = (h ^ uint32(k.q.Name[i])) * prime
+	}
+	for _, x := range [...]uint16{k.q.Qtype, k.q.Qclass} {
+		h = (h ^ uint32(x&0xff)) * prime
+		h = (h ^ uint32(x>>8)) * prime
+	}
+
+	return h
+}
+
+// Cache is an LRU cache of DNS responses. Keys are distributed over several
+// shards, which are LRU caches of their own, so the least recently used
+// entry of the shard is evicted when a shard is full.
+//
+// The cache is bounded by the number of entries and, optionally, by the sum
+// of the wire lengths of the cached responses; see SetMaxBytes.
 type Cache struct {
-	maxSize int
-	mu      sync.Mutex
-	cache   map[cacheKey]cacheItem
-	lru     *list.List // list of cacheKey
+	shards []shard
+	hooks  atomic.Value // Hooks
+}
+
+// Key identifies a cache entry: the question of a query and the address of
+// the name server that it has been sent to.
+type Key struct {
+	Addr     string
+	Question dns.Question
+}
+
+// Hooks are called when entries are added to or removed from a Cache; see
+// Cache.SetHooks. ttl is the duration for which the entry has been, or was
+// supposed to be, cached. Any of the hooks may be nil.
+//
+// The hooks are called synchronously, but without holding any locks, so
+// they may use the cache. They must be safe for concurrent use.
+type Hooks struct {
+	// OnInsert is called when an entry has been added, or replaced with a
+	// new response.
+	OnInsert func(key Key, ttl time.Duration)
+
+	// OnExpire is called when an entry has been removed because its TTL
+	// has passed. Expired entries are detected lazily, when they are looked
+	// up or would be evicted.
+	OnExpire func(key Key, ttl time.Duration)
+
+	// OnEvict is called when an entry has been removed before its TTL has
+	// passed to make room for other entries, because the cache is full or
+	// exceeds its byte budget.
+	OnEvict func(key Key, ttl time.Duration)
+}
+
+// event is a call of a hook that is due after a shard has been unlocked.
+type event struct {
+	hook func(Key, time.Duration)
+	key  cacheKey
+	ttl  time.Duration
+}
+
+type shard struct {
+	maxSize  int
+	maxBytes int // zero if unlimited
+	bytes    int
+	mu       sync.Mutex
+	cache    map[cacheKey]cacheItem
+	lru      *list.List // list of cacheKey
 }
 
 func New(maxSize int) *Cache {
-	return &Cache{
-		maxSize: maxSize,
-		cache:   map[cacheKey]cacheItem{},
-		lru:     list.New(),
+	return newSharded(maxSize, maxShards)
+}
+
+// newSharded returns a cache with at most n shards. maxSize is distributed
+// evenly over the shards.
+func newSharded(maxSize, n int) *Cache {
+	for n > 1 && n > maxSize {
+		n /= 2
+	}
+
+	c := &Cache{
+		shards: make([]shard, n),
+	}
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.maxSize = maxSize / n
+		if i < maxSize%n {
+			s.maxSize++
+		}
+		s.cache = map[cacheKey]cacheItem{}
+		s.lru = list.New()
+	}
+
+	return c
+}
+
+// MaxSize returns the maximum number of entries, as passed to New.
+func (c *Cache) MaxSize() int {
+	n := 0
+	for i := range c.shards {
+		n += c.shards[i].maxSize
+	}
+
+	return n
+}
+
+// SetMaxBytes limits the sum of the wire lengths of the cached responses to
+// approximately n bytes, in addition to the number of entries. The budget
+// is distributed evenly over the shards; responses that exceed the budget
+// of a shard on their own are not cached at all. If n is zero or negative,
+// the size of the responses is not limited. Entries are evicted as
+// necessary to meet the new budget.
+func (c *Cache) SetMaxBytes(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	hooks := c.getHooks()
+	now := time.Now()
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.maxBytes = n / len(c.shards)
+		if n > 0 && s.maxBytes == 0 {
+			s.maxBytes = 1
+		}
+		events := s.prune(hooks, now, nil)
+		s.mu.Unlock()
+
+		fire(events)
 	}
 }
 
+// Bytes returns the sum of the wire lengths of the cached responses.
+func (c *Cache) Bytes() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += s.bytes
+		s.mu.Unlock()
+	}
+
+	return n
+}
+
+// SetHooks installs hooks that are called when entries are added or
+// removed, which is useful to monitor the churn of the cache, or to mirror
+// its entries. Clear doesn't call any hooks.
+func (c *Cache) SetHooks(h Hooks) {
+	c.hooks.Store(h)
+}
+
+func (c *Cache) getHooks() Hooks {
+	h, _ := c.hooks.Load().(Hooks)
+	return h
+}
+
+// fire calls the hooks of the events, if any.
+func fire(events []event) {
+	for _, e := range events {
+		if e.hook != nil {
+			e.hook(Key{Addr: e.key.addr, Question: e.key.q}, e.ttl)
+		}
+	}
+}
+
+func (c *Cache) shard(key cacheKey) *shard {
+	return &c.shards[key.hash()%uint32(len(c.shards))]
+}
+
 func (c *Cache) Clear() {
-	c.mu.Lock()
-	c.cache = map[cacheKey]cacheItem{}
-	c.lru.Init()
-	c.mu.Unlock()
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		s.cache = map[cacheKey]cacheItem{}
+		s.lru.Init()
+		s.bytes = 0
+		s.mu.Unlock()
+	}
+}
+
+func (c *Cache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.Lock()
+		n += len(s.cache)
+		s.mu.Unlock()
+	}
+
+	return n
 }
 
 func (c *Cache) Lookup(q dns.Question, addr string) (*dns.Msg, time.Duration, time.Duration) {
+	msg, rtt, age, _ := c.LookupTTL(q, addr)
+	return msg, rtt, age
+}
+
+// LookupTTL is like Lookup, but additionally returns the time that remains
+// until the entry expires, or zero if there is no such entry.
+func (c *Cache) LookupTTL(q dns.Question, addr string) (*dns.Msg, time.Duration, time.Duration, time.Duration) {
 	now := time.Now()
 
 	key := cacheKey{
@@ -53,24 +243,29 @@ func (c *Cache) Lookup(q dns.Question, addr string) (*dns.Msg, time.Duration, ti
 		q:    q,
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	s := c.shard(key)
+	s.mu.Lock()
 
-	ci, ok := c.cache[key]
+	ci, ok := s.cache[key]
 	if !ok {
-		return nil, 0, -1 * time.Second
+		s.mu.Unlock()
+		return nil, 0, -1 * time.Second, 0
 	}
 
-	if ci.addedAt.Add(ci.ttl).Before(now) {
-		c.lru.Remove(ci.elem)
-		delete(c.cache, key)
+	if ci.expired(now) {
+		s.remove(key, ci)
+		s.mu.Unlock()
 
-		return nil, 0, -1 * time.Second
+		fire([]event{{c.getHooks().OnExpire, key, ci.ttl}})
+
+		return nil, 0, -1 * time.Second, 0
 	}
 
-	c.lru.MoveToBack(ci.elem)
+	s.lru.MoveToBack(ci.elem)
+	msg := ci.msg
+	s.mu.Unlock()
 
-	return ci.msg.Copy(), time.Since(now), time.Since(ci.addedAt)
+	return msg.Copy(), time.Since(now), time.Since(ci.addedAt), ci.addedAt.Add(ci.ttl).Sub(now)
 }
 
 func (c *Cache) Update(q dns.Question, addr string, resp *dns.Msg, ttl time.Duration) {
@@ -83,34 +278,85 @@ func (c *Cache) Update(q dns.Question, addr string, resp *dns.Msg, ttl time.Dura
 		q:    q,
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	// Copy and measure before locking to keep the critical section short.
+	msg := resp.Copy()
+	size := msg.Len()
+
+	hooks := c.getHooks()
+	now := time.Now()
+
+	s := c.shard(key)
+	s.mu.Lock()
+
+	ci, ok := s.cache[key]
+	if s.maxBytes > 0 && size > s.maxBytes {
+		// Caching the response would evict everything else.
+		var events []event
+		if ok {
+			s.remove(key, ci)
+			events = append(events, ci.removal(hooks, key, now))
+		}
+		s.mu.Unlock()
 
-	ci := c.cache[key]
-	ci.msg = resp.Copy()
-	ci.addedAt = time.Now()
+		fire(events)
+		return
+	}
+
+	s.bytes += size - ci.size
+	ci.msg = msg
+	ci.addedAt = now
 	ci.ttl = ttl
+	ci.size = size
 	if ci.elem == nil {
-		ci.elem = c.lru.PushBack(key)
+		ci.elem = s.lru.PushBack(key)
 	} else {
-		c.lru.MoveToBack(ci.elem)
+		s.lru.MoveToBack(ci.elem)
 	}
 
-	c.cache[key] = ci
+	s.cache[key] = ci
 
-	c.prune()
+	events := s.prune(hooks, now, []event{{hooks.OnInsert, key, ttl}})
 
-	if c.lru.Len() != len(c.cache) {
-		panic(fmt.Sprintf("map and list out of sync: len(map)=%d, len(list)=%d", len(c.cache), c.lru.Len()))
+	if s.lru.Len() != len(s.cache) {
+		s.mu.Unlock()
+		panic(fmt.Sprintf("map and list out of sync: len(map)=%d, len(list)=%d", len(s.cache), s.lru.Len()))
 	}
+	s.mu.Unlock()
+
+	fire(events)
 }
 
-func (c *Cache) prune() {
-	for len(c.cache) > c.maxSize {
-		elem := c.lru.Front()
+func (ci cacheItem) expired(now time.Time) bool {
+	return ci.addedAt.Add(ci.ttl).Before(now)
+}
+
+// removal returns the event for the removal of ci to make room for other
+// entries: OnExpire if ci has expired anyway, OnEvict otherwise.
+func (ci cacheItem) removal(hooks Hooks, key cacheKey, now time.Time) event {
+	if ci.expired(now) {
+		return event{hooks.OnExpire, key, ci.ttl}
+	}
+
+	return event{hooks.OnEvict, key, ci.ttl}
+}
+
+// prune evicts the least recently used entries until the shard is within its
+// limits, and returns events with the removals appended.
+func (s *shard) prune(hooks Hooks, now time.Time, events []event) []event {
+	for len(s.cache) > s.maxSize || s.maxBytes > 0 && s.bytes > s.maxBytes {
+		elem := s.lru.Front()
 		key := elem.Value.(cacheKey)
+		ci := s.cache[key]
 
-		delete(c.cache, key)
-		c.lru.Remove(elem)
+		s.remove(key, ci)
+		events = append(events, ci.removal(hooks, key, now))
 	}
+
+	return events
+}
+
+func (s *shard) remove(key cacheKey, ci cacheItem) {
+	delete(s.cache, key)
+	s.lru.Remove(ci.elem)
+	s.bytes -= ci.size
 }
@@ -0,0 +1,207 @@
+package cache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCache_LRU(t *testing.T) {
+	c := newSharded(2, 1)
+
+	msg := new(dns.Msg)
+	q := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+
+	c.Update(q("a."), "192.0.2.1:53", msg, time.Minute)
+	c.Update(q("b."), "192.0.2.1:53", msg, time.Minute)
+	if m, _, _ := c.Lookup(q("a."), "192.0.2.1:53"); m == nil {
+		t.Fatal("a. not cached")
+	}
+	c.Update(q("c."), "192.0.2.1:53", msg, time.Minute)
+
+	if m, _, _ := c.Lookup(q("b."), "192.0.2.1:53"); m != nil {
+		t.Error("b. not evicted")
+	}
+	if m, _, _ := c.Lookup(q("a."), "192.0.2.1:53"); m == nil {
+		t.Error("a. evicted")
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	if _, _, _, ttl := c.LookupTTL(q("a."), "192.0.2.1:53"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("remaining TTL of a. = %v, want (0, 1m]", ttl)
+	}
+	if _, _, _, ttl := c.LookupTTL(q("b."), "192.0.2.1:53"); ttl != 0 {
+		t.Errorf("remaining TTL of b. = %v, want 0", ttl)
+	}
+}
+
+func TestCache_MaxSize(t *testing.T) {
+	for _, maxSize := range []int{1, 5, 100} {
+		c := New(maxSize)
+		if n := c.MaxSize(); n != maxSize {
+			t.Errorf("maxSize %d: MaxSize() = %d", maxSize, n)
+		}
+		for i := 0; i < 10*maxSize; i++ {
+			q := dns.Question{Name: strconv.Itoa(i) + ".", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+			c.Update(q, "192.0.2.1:53", new(dns.Msg), time.Minute)
+		}
+		if n := c.Len(); n > maxSize {
+			t.Errorf("maxSize %d: Len() = %d", maxSize, n)
+		}
+
+		c.Clear()
+		if n := c.Len(); n != 0 {
+			t.Errorf("maxSize %d: Len() = %d after Clear", maxSize, n)
+		}
+	}
+}
+
+func TestCache_MaxBytes(t *testing.T) {
+	c := newSharded(100, 1)
+
+	msg := func(n int) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeTXT)
+		for len(m.Answer) < n {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{strconv.Itoa(len(m.Answer))},
+			})
+		}
+		return m
+	}
+	q := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	}
+
+	small, large := msg(1), msg(50)
+	c.Update(q("a."), "192.0.2.1:53", small, time.Minute)
+	c.Update(q("b."), "192.0.2.1:53", small, time.Minute)
+	c.Update(q("c."), "192.0.2.1:53", small, time.Minute)
+	if got, want := c.Bytes(), 3*small.Len(); got != want {
+		t.Fatalf("Bytes() = %d, want %d", got, want)
+	}
+
+	c.SetMaxBytes(2*small.Len() + 1)
+	if n := c.Len(); n != 2 {
+		t.Errorf("Len() = %d, want 2", n)
+	}
+	if m, _, _ := c.Lookup(q("a."), "192.0.2.1:53"); m != nil {
+		t.Error("a. not evicted")
+	}
+
+	// A response that exceeds the budget is not cached, and replaces the
+	// cached response for the same question.
+	c.Update(q("b."), "192.0.2.1:53", large, time.Minute)
+	if m, _, _ := c.Lookup(q("b."), "192.0.2.1:53"); m != nil {
+		t.Error("large response cached")
+	}
+	if got, want := c.Bytes(), small.Len(); got != want {
+		t.Errorf("Bytes() = %d, want %d", got, want)
+	}
+
+	c.SetMaxBytes(0)
+	c.Update(q("b."), "192.0.2.1:53", large, time.Minute)
+	if got, want := c.Bytes(), small.Len()+large.Len(); got != want {
+		t.Errorf("Bytes() = %d, want %d", got, want)
+	}
+
+	c.Clear()
+	if n := c.Bytes(); n != 0 {
+		t.Errorf("Bytes() = %d after Clear", n)
+	}
+}
+
+func TestCache_Hooks(t *testing.T) {
+	c := newSharded(2, 1)
+
+	var events []string
+	record := func(kind string) func(Key, time.Duration) {
+		return func(key Key, ttl time.Duration) {
+			events = append(events, fmt.Sprintf("%s %s %v", kind, key.Question.Name, ttl))
+		}
+	}
+	c.SetHooks(Hooks{
+		OnInsert: record("insert"),
+		OnExpire: record("expire"),
+		OnEvict:  record("evict"),
+	})
+
+	msg := new(dns.Msg)
+	q := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+
+	c.Update(q("a."), "192.0.2.1:53", msg, time.Nanosecond)
+	c.Update(q("b."), "192.0.2.1:53", msg, time.Minute)
+	time.Sleep(time.Millisecond)
+	c.Update(q("c."), "192.0.2.1:53", msg, time.Minute) // a. has expired
+	c.Update(q("d."), "192.0.2.1:53", msg, time.Hour)   // b. is evicted
+	c.Update(q("e."), "192.0.2.1:53", msg, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	c.Lookup(q("e."), "192.0.2.1:53")
+
+	// Hooks may use the cache.
+	c.SetHooks(Hooks{OnInsert: func(key Key, ttl time.Duration) { c.Len() }})
+	c.Update(q("f."), "192.0.2.1:53", msg, time.Minute)
+
+	if got, want := strings.Join(events, "\n"), strings.Join([]string{
+		"insert a. 1ns",
+		"insert b. 1m0s",
+		"insert c. 1m0s",
+		"expire a. 1ns",
+		"insert d. 1h0m0s",
+		"evict b. 1m0s",
+		"insert e. 1ns",
+		"evict c. 1m0s",
+		"expire e. 1ns",
+	}, "\n"); got != want {
+		t.Errorf("events:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// BenchmarkCache compares a cache with a single shard, which corresponds to
+// a single global lock, to the default number of shards under concurrent
+// access. Run with -cpu to vary the concurrency.
+func BenchmarkCache(b *testing.B) {
+	const keys = 4096
+
+	questions := make([]dns.Question, keys)
+	for i := range questions {
+		questions[i] = dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+
+	for _, shards := range []int{1, maxShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newSharded(keys, shards)
+			for _, q := range questions {
+				c.Update(q, "192.0.2.1:53", msg, time.Hour)
+			}
+
+			var seed uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddUint32(&seed, 7919))
+				for pb.Next() {
+					q := questions[i%keys]
+					if i%10 == 0 {
+						c.Update(q, "192.0.2.1:53", msg, time.Hour)
+					} else {
+						c.Lookup(q, "192.0.2.1:53")
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,712 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DelegationReport is the result of Resolver.CheckDelegation.
+type DelegationReport struct {
+	// Zone is the zone that has been checked, and Parent the zone that
+	// delegates to it. The trailing dot is omitted.
+	Zone   string
+	Parent string
+
+	// ParentNS is the NS set of Zone according to the referral from a name
+	// server of Parent, and ChildNS the NS set that the name servers of Zone
+	// serve authoritatively, in the order sent by the servers. Glue maps the
+	// names in ParentNS to the addresses in the referral, if any.
+	ParentNS []string
+	ChildNS  []string
+	Glue     map[string][]string
+
+	// Servers contains the outcome of querying each address of each name
+	// server in ParentNS for the NS records of Zone, in the order of
+	// ParentNS.
+	Servers []NameServerCheck
+
+	// Problems contains the problems that have been detected. Use
+	// errors.Is to test for ErrLameDelegation, ErrUnreachable,
+	// ErrMissingGlue, ErrInconsistentGlue, and ErrInconsistentNS.
+	Problems []error
+
+	// Trace contains all queries that have been sent for the check.
+	Trace *Trace
+}
+
+// NameServerCheck is the outcome of querying a name server that a zone has
+// been delegated to; see DelegationReport.
+type NameServerCheck struct {
+	// Name is the name of the name server, as in DelegationReport.ParentNS,
+	// and Addr is the address that has been queried. Addr is empty if Name
+	// couldn't be resolved.
+	Name string
+	Addr string
+
+	// FromGlue reports whether Addr has been taken from the glue records of
+	// the referral.
+	FromGlue bool
+
+	// Reachable reports whether the server has responded, and Authoritative
+	// whether it has responded authoritatively.
+	Reachable     bool
+	Authoritative bool
+
+	// NS is the NS set that the server has responded with, if it has
+	// responded authoritatively.
+	NS []string
+
+	RTT time.Duration
+
+	// Err is the error that has occurred while resolving Name or querying
+	// Addr, if any.
+	Err error
+}
+
+// CheckDelegation checks the delegation of zone from its parent zone, similar
+// to tools such as zonemaster or DNSViz, and reports the parent's and the
+// child's view of the delegation, whether each name server is reachable and
+// authoritative, and any problems that have been detected:
+//
+//   - name servers that don't respond (ErrUnreachable),
+//   - name servers that respond, but not authoritatively (ErrLameDelegation),
+//   - name servers within zone without glue records in the referral
+//     (ErrMissingGlue),
+//   - glue records that differ from the addresses that the zone's name
+//     servers serve for the same names (ErrInconsistentGlue),
+//   - NS sets of the parent and the child that differ (ErrInconsistentNS).
+//
+// CheckDelegation returns an error only if the check couldn't be performed,
+// for instance because the parent zone couldn't be determined or none of its
+// name servers responded with the delegation. Problems with the delegation
+// itself are reported in DelegationReport.Problems. Forwarders are not
+// supported, since they don't expose delegations.
+func (R *Resolver) CheckDelegation(ctx context.Context, zone string) (DelegationReport, error) {
+	fqdn := dns.CanonicalName(zone)
+	report, err := R.delegation(ctx, fqdn)
+	if err != nil {
+		return report, fmt.Errorf("check delegation %s: %w", report.Zone, err)
+	}
+
+	R.checkGlue(ctx, fqdn, &report)
+
+	if len(report.ChildNS) > 0 && !sameStrings(report.ParentNS, report.ChildNS) {
+		report.Problems = append(report.Problems, fmt.Errorf("%w: parent: %s; child: %s", ErrInconsistentNS,
+			strings.Join(report.ParentNS, " "), strings.Join(report.ChildNS, " ")))
+	}
+
+	return report, nil
+}
+
+// delegation fetches the delegation of fqdn from the parent zone's name
+// servers and queries each name server of fqdn for its NS records. It fills
+// in all fields of the report except for the problems that are detected by
+// comparing the results.
+func (R *Resolver) delegation(ctx context.Context, fqdn string) (DelegationReport, error) {
+	report := DelegationReport{
+		Zone:  trimTrailingDot(fqdn),
+		Glue:  map[string][]string{},
+		Trace: R.newTrace(),
+	}
+
+	if fqdn == "." {
+		return report, errors.New("the root zone isn't delegated")
+	}
+
+	parent, parentAddrs, err := R.parentServers(ctx, fqdn, report.Trace)
+	if err != nil {
+		return report, err
+	}
+	report.Parent = trimTrailingDot(parent)
+
+	referral, err := R.referral(ctx, fqdn, parentAddrs, report.Trace)
+	if err != nil {
+		return report, err
+	}
+	report.ParentNS = delegationNS(referral, fqdn)
+	for _, rr := range referral.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		switch rr := rr.(type) {
+		case *dns.A:
+			report.Glue[name] = append(report.Glue[name], rr.A.String())
+		case *dns.AAAA:
+			report.Glue[name] = append(report.Glue[name], rr.AAAA.String())
+		}
+	}
+	for name := range report.Glue {
+		if !containsString(report.ParentNS, name) {
+			delete(report.Glue, name)
+		}
+	}
+
+	for _, name := range report.ParentNS {
+		report.Servers = append(report.Servers, R.checkNameServer(ctx, fqdn, name, &report)...)
+	}
+
+	for _, s := range report.Servers {
+		if s.Authoritative {
+			report.ChildNS = append(report.ChildNS, s.NS...)
+		}
+	}
+	report.ChildNS = dedupStrings(report.ChildNS)
+
+	return report, nil
+}
+
+// NSComparison is the result of Resolver.CompareNS.
+type NSComparison struct {
+	// Zone is the zone whose NS records have been compared. The trailing
+	// dot is omitted.
+	Zone string
+
+	// ParentNS and ChildNS are the NS sets of Zone according to the parent
+	// zone and the zone itself, as in DelegationReport.
+	ParentNS []string
+	ChildNS  []string
+
+	// Added contains the names in ChildNS that are missing in ParentNS, and
+	// Removed the names in ParentNS that are missing in ChildNS. Such
+	// differences typically remain after name servers have been changed
+	// on only one side of the delegation.
+	Added   []string
+	Removed []string
+
+	// Mismatches maps the addresses of the name servers of Zone whose NS
+	// set differs from ChildNS to the NS set they serve, which indicates
+	// that zone transfers to these servers are failing.
+	Mismatches map[string][]string
+
+	// Trace contains all queries that have been sent for the comparison.
+	Trace *Trace
+}
+
+// Consistent reports whether no differences have been found.
+func (c NSComparison) Consistent() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Mismatches) == 0
+}
+
+// CompareNS compares the NS records of zone in its parent zone with the NS
+// records that the name servers of zone serve authoritatively, and reports
+// any differences. Names are compared case-insensitively.
+//
+// This is the part of CheckDelegation that is concerned with the NS records
+// only. Name servers that are unreachable or lame are ignored. An error is
+// returned if none of the name servers of zone responds authoritatively, or
+// if the delegation can't be determined, as described for CheckDelegation.
+func (R *Resolver) CompareNS(ctx context.Context, zone string) (NSComparison, error) {
+	fqdn := dns.CanonicalName(zone)
+	report, err := R.delegation(ctx, fqdn)
+	cmp := NSComparison{
+		Zone:     report.Zone,
+		ParentNS: report.ParentNS,
+		ChildNS:  report.ChildNS,
+		Trace:    report.Trace,
+	}
+	if err != nil {
+		return cmp, fmt.Errorf("compare NS %s: %w", cmp.Zone, err)
+	}
+	if len(cmp.ChildNS) == 0 {
+		return cmp, fmt.Errorf("compare NS %s: no authoritative response from the zone's name servers", cmp.Zone)
+	}
+
+	cmp.Added = missingStrings(cmp.ChildNS, cmp.ParentNS)
+	cmp.Removed = missingStrings(cmp.ParentNS, cmp.ChildNS)
+
+	for _, s := range report.Servers {
+		if s.Authoritative && !sameStrings(s.NS, cmp.ChildNS) {
+			if cmp.Mismatches == nil {
+				cmp.Mismatches = map[string][]string{}
+			}
+			cmp.Mismatches[s.Addr] = s.NS
+		}
+	}
+
+	return cmp, nil
+}
+
+// missingStrings returns the strings in a that are missing in b, ignoring
+// case.
+func missingStrings(a, b []string) []string {
+	in := make(map[string]bool, len(b))
+	for _, s := range b {
+		in[strings.ToLower(s)] = true
+	}
+
+	var missing []string
+	for _, s := range a {
+		if !in[strings.ToLower(s)] {
+			missing = append(missing, s)
+		}
+	}
+
+	return missing
+}
+
+// parentServers returns the zone that delegates to fqdn and the addresses of
+// its name servers.
+func (R *Resolver) parentServers(ctx context.Context, fqdn string, trace *Trace) (string, []string, error) {
+	parent := fqdn
+	for parent != "." {
+		i, _ := dns.NextLabel(parent, 0)
+		parent = parent[i:]
+		if parent == "" {
+			parent = "."
+		}
+
+		rs, err := R.Query(ctx, "NS", parent)
+		trace.append(rs.Trace)
+		if errors.Is(err, ErrNXDomain) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		records := rs.records()
+		if len(records) == 0 {
+			// parent is not a zone, but a name within its parent zone.
+			continue
+		}
+
+		var addrs []string
+		for _, rr := range records {
+			if ns, ok := rr.(*dns.NS); ok {
+				x, _ := R.lookupAddrs(ctx, ns.Ns, trace)
+				addrs = append(addrs, x...)
+			}
+		}
+		if len(addrs) == 0 {
+			return "", nil, fmt.Errorf("no addresses for the name servers of %s", parent)
+		}
+
+		return parent, addrs, nil
+	}
+
+	return "", nil, errors.New("no parent zone")
+}
+
+// referral asks the servers at addrs for the NS records of fqdn and returns
+// the first response that contains them.
+func (R *Resolver) referral(ctx context.Context, fqdn string, addrs []string, trace *Trace) (*dns.Msg, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		rs, err := R.QueryServer(ctx, addr, "IN", "NS", fqdn)
+		trace.append(rs.Trace)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if len(delegationNS(&rs.Raw, fqdn)) > 0 {
+			return &rs.Raw, nil
+		}
+		lastErr = fmt.Errorf("no delegation @%s", addr)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no name servers")
+	}
+
+	return nil, lastErr
+}
+
+// delegationNS returns the names of the name servers of fqdn in the
+// AUTHORITY section of m, which is a referral, or in the ANSWER section if
+// the server is authoritative for fqdn as well. The names are returned in
+// canonical form, since servers may preserve the case of the zone file.
+func delegationNS(m *dns.Msg, fqdn string) []string {
+	fqdn = dns.CanonicalName(fqdn)
+
+	var names []string
+	for _, rrs := range [][]dns.RR{m.Ns, m.Answer} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok && dns.CanonicalName(ns.Hdr.Name) == fqdn {
+				names = append(names, dns.CanonicalName(ns.Ns))
+			}
+		}
+	}
+
+	return dedupStrings(names)
+}
+
+// checkNameServer queries each address of the name server called name for
+// the NS records of fqdn, and adds any problems to report.
+func (R *Resolver) checkNameServer(ctx context.Context, fqdn, name string, report *DelegationReport) []NameServerCheck {
+	addrs, fromGlue := report.Glue[name], true
+	if len(addrs) == 0 {
+		if dns.IsSubDomain(fqdn, name) {
+			report.Problems = append(report.Problems, fmt.Errorf("%w: %s", ErrMissingGlue, name))
+		}
+
+		var err error
+		addrs, err = R.lookupAddrs(ctx, name, report.Trace)
+		fromGlue = false
+		if len(addrs) == 0 {
+			if err == nil {
+				err = fmt.Errorf("no addresses for name server %s", name)
+			}
+			report.Problems = append(report.Problems, fmt.Errorf("%w: %s: %v", ErrUnreachable, name, err))
+			return []NameServerCheck{{Name: name, Err: err}}
+		}
+	}
+
+	checks := make([]NameServerCheck, 0, len(addrs))
+	for _, addr := range addrs {
+		rs, err := R.QueryServer(ctx, addr, "IN", "NS", fqdn)
+		report.Trace.append(rs.Trace)
+
+		check := NameServerCheck{
+			Name:          name,
+			Addr:          rs.ServerAddr,
+			FromGlue:      fromGlue,
+			Reachable:     rs.Rcode != "",
+			Authoritative: err == nil && rs.Authoritative,
+			RTT:           rs.RTT,
+			Err:           err,
+		}
+		if check.Addr == "" {
+			check.Addr = addr
+		}
+
+		switch {
+		case !check.Reachable:
+			report.Problems = append(report.Problems, fmt.Errorf("%w: %s @%s: %v", ErrUnreachable, name, check.Addr, err))
+		case !check.Authoritative:
+			report.Problems = append(report.Problems, fmt.Errorf("%w: %s @%s", ErrLameDelegation, fqdn, check.Addr))
+		default:
+			for _, rr := range rs.records() {
+				if ns, ok := rr.(*dns.NS); ok {
+					check.NS = append(check.NS, dns.CanonicalName(ns.Ns))
+				}
+			}
+		}
+
+		checks = append(checks, check)
+	}
+
+	return checks
+}
+
+// checkGlue adds a problem to the report for each name in report.ParentNS
+// whose glue records differ from the addresses that the zone serves; see
+// compareGlue.
+func (R *Resolver) checkGlue(ctx context.Context, fqdn string, report *DelegationReport) {
+	checks, err := R.compareGlue(ctx, fqdn, report)
+	if err != nil {
+		return
+	}
+
+	for _, c := range checks {
+		// Missing glue is reported separately.
+		if len(c.Glue) == 0 || c.Consistent() {
+			continue
+		}
+		report.Problems = append(report.Problems, fmt.Errorf("%w: %s: glue: %s; zone: %s", ErrInconsistentGlue,
+			c.Name, strings.Join(c.Glue, " "), strings.Join(c.Zone, " ")))
+	}
+}
+
+// compareGlue compares the glue records of the names in report.ParentNS
+// that are within fqdn with the addresses that the first authoritative name
+// server of fqdn serves for these names.
+func (R *Resolver) compareGlue(ctx context.Context, fqdn string, report *DelegationReport) ([]GlueCheck, error) {
+	var server string
+	for _, s := range report.Servers {
+		if s.Authoritative {
+			server = s.Addr
+			break
+		}
+	}
+	if server == "" {
+		return nil, errors.New("no authoritative response from the zone's name servers")
+	}
+
+	var checks []GlueCheck
+	for _, name := range report.ParentNS {
+		if !dns.IsSubDomain(fqdn, name) {
+			continue
+		}
+
+		c := GlueCheck{
+			Name: name,
+			Glue: report.Glue[name],
+		}
+		for _, typ := range []string{"AAAA", "A"} {
+			rs, err := R.QueryServer(ctx, server, "IN", typ, name)
+			report.Trace.append(rs.Trace)
+			if err == nil {
+				c.Zone = append(c.Zone, rs.Values...)
+			}
+		}
+		c.Stale = missingStrings(c.Glue, c.Zone)
+		c.Missing = missingStrings(c.Zone, c.Glue)
+
+		checks = append(checks, c)
+	}
+
+	return checks, nil
+}
+
+// GlueCheck is the outcome of comparing the glue records of a name server
+// with the addresses in the zone; see GlueComparison.
+type GlueCheck struct {
+	// Name is the name of the name server.
+	Name string
+
+	// Glue contains the addresses in the referral from the parent zone,
+	// and Zone the addresses that the zone itself serves for Name.
+	Glue []string
+	Zone []string
+
+	// Stale contains the addresses in Glue that are missing in Zone, and
+	// Missing the addresses in Zone that are missing in Glue.
+	Stale   []string
+	Missing []string
+}
+
+// Consistent reports whether the glue records match the addresses in the
+// zone.
+func (c GlueCheck) Consistent() bool {
+	return len(c.Stale) == 0 && len(c.Missing) == 0
+}
+
+// GlueComparison is the result of Resolver.CompareGlue.
+type GlueComparison struct {
+	// Zone is the zone whose glue records have been compared. The trailing
+	// dot is omitted.
+	Zone string
+
+	// Names contains a GlueCheck for each name server of Zone that is within
+	// Zone, in the order of the referral from the parent zone.
+	Names []GlueCheck
+
+	// Trace contains all queries that have been sent for the comparison.
+	Trace *Trace
+}
+
+// Consistent reports whether the glue records of all names match the
+// addresses in the zone.
+func (c GlueComparison) Consistent() bool {
+	for _, n := range c.Names {
+		if !n.Consistent() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CompareGlue compares the glue records in the referral from the parent zone
+// of zone with the A and AAAA records that the name servers of zone serve
+// authoritatively, for each name server of zone that is within zone. Stale
+// glue typically causes intermittent failures, because resolvers use it
+// only until they have learned the authoritative addresses.
+//
+// Name servers without any glue records are included; all their addresses
+// are reported as missing. An error is returned if none of the name servers
+// of zone responds authoritatively, or if the delegation can't be
+// determined, as described for CheckDelegation.
+func (R *Resolver) CompareGlue(ctx context.Context, zone string) (GlueComparison, error) {
+	fqdn := dns.CanonicalName(zone)
+	report, err := R.delegation(ctx, fqdn)
+	cmp := GlueComparison{
+		Zone:  report.Zone,
+		Trace: report.Trace,
+	}
+	if err != nil {
+		return cmp, fmt.Errorf("compare glue %s: %w", cmp.Zone, err)
+	}
+
+	cmp.Names, err = R.compareGlue(ctx, fqdn, &report)
+	if err != nil {
+		return cmp, fmt.Errorf("compare glue %s: %w", cmp.Zone, err)
+	}
+
+	return cmp, nil
+}
+
+// sameStrings reports whether a and b contain the same strings, ignoring
+// order and case.
+func sameStrings(a, b []string) bool {
+	normalize := func(xs []string) []string {
+		ys := make([]string, len(xs))
+		for i, x := range xs {
+			ys[i] = strings.ToLower(x)
+		}
+		sort.Strings(ys)
+		return dedupStrings(ys)
+	}
+
+	a, b = normalize(a), normalize(b)
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dedupStrings removes duplicates from xs, retaining the order of the first
+// occurrences.
+func dedupStrings(xs []string) []string {
+	seen := make(map[string]bool, len(xs))
+	ys := xs[:0]
+	for _, x := range xs {
+		if !seen[x] {
+			seen[x] = true
+			ys = append(ys, x)
+		}
+	}
+
+	return ys
+}
+
+func containsString(xs []string, s string) bool {
+	for _, x := range xs {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SOASerial is the serial number of the SOA record of a zone that a name
+// server has responded with; see SOAComparison.
+type SOASerial struct {
+	// Name is the name of the name server, and Addr the address that has
+	// been queried, as in NameServerCheck.
+	Name string
+	Addr string
+
+	// Serial is the serial number of the SOA record. It is zero if Err is
+	// not nil.
+	Serial uint32
+
+	// Err is the error that has occurred while querying the server, if
+	// any. It wraps ErrLameDelegation if the server has responded
+	// non-authoritatively.
+	Err error
+}
+
+// SOAComparison is the result of Resolver.CompareSOA.
+type SOAComparison struct {
+	// Zone is the zone whose SOA records have been compared. The trailing
+	// dot is omitted.
+	Zone string
+
+	// Servers contains the serial of each address of each name server that
+	// the zone has been delegated to, in the order of the delegation.
+	Servers []SOASerial
+
+	// Latest is the greatest serial in Servers, according to serial number
+	// arithmetic (RFC 1982).
+	Latest uint32
+
+	// Trace contains all queries that have been sent for the comparison.
+	Trace *Trace
+}
+
+// Lagging returns the servers whose serial is less than Latest, according to
+// serial number arithmetic (RFC 1982). These are typically secondary servers
+// that fail to transfer the zone from the primary server. Servers that
+// haven't responded are not included.
+func (c SOAComparison) Lagging() []SOASerial {
+	var lagging []SOASerial
+	for _, s := range c.Servers {
+		if s.Err == nil && s.Serial != c.Latest {
+			lagging = append(lagging, s)
+		}
+	}
+
+	return lagging
+}
+
+// Consistent reports whether all servers that have responded have the same
+// serial.
+func (c SOAComparison) Consistent() bool {
+	return len(c.Lagging()) == 0
+}
+
+// CompareSOA asks every name server that zone has been delegated to for the
+// SOA record of zone and reports their serial numbers. The name servers are
+// determined as described for CheckDelegation, including all addresses of
+// each name server.
+//
+// Servers that don't respond authoritatively are included with an error.
+// An error is returned if none of the name servers of zone responds
+// authoritatively, or if the delegation can't be determined.
+func (R *Resolver) CompareSOA(ctx context.Context, zone string) (SOAComparison, error) {
+	fqdn := dns.CanonicalName(zone)
+	report, err := R.delegation(ctx, fqdn)
+	cmp := SOAComparison{
+		Zone:  report.Zone,
+		Trace: report.Trace,
+	}
+	if err != nil {
+		return cmp, fmt.Errorf("compare SOA %s: %w", cmp.Zone, err)
+	}
+
+	found := false
+	for _, s := range report.Servers {
+		serial := SOASerial{
+			Name: s.Name,
+			Addr: s.Addr,
+			Err:  s.Err,
+		}
+		if s.Reachable {
+			serial.Serial, serial.Err = R.querySerial(ctx, fqdn, s.Addr, cmp.Trace)
+		}
+		if serial.Err == nil {
+			if !found || serialLess(cmp.Latest, serial.Serial) {
+				cmp.Latest = serial.Serial
+			}
+			found = true
+		}
+
+		cmp.Servers = append(cmp.Servers, serial)
+	}
+
+	if !found {
+		return cmp, fmt.Errorf("compare SOA %s: no authoritative response from the zone's name servers", cmp.Zone)
+	}
+
+	return cmp, nil
+}
+
+// querySerial asks the server at addr for the SOA record of the zone fqdn and
+// returns its serial.
+func (R *Resolver) querySerial(ctx context.Context, fqdn, addr string, trace *Trace) (uint32, error) {
+	rs, err := R.QueryServer(WithoutFollowingCNAMEs(ctx), addr, "IN", "SOA", fqdn)
+	trace.append(rs.Trace)
+	if err != nil {
+		return 0, err
+	}
+	if !rs.Raw.Authoritative {
+		return 0, ErrLameDelegation
+	}
+
+	for _, rr := range rs.Raw.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == fqdn {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no SOA record for %s", trimTrailingDot(fqdn))
+}
+
+// serialLess reports whether the serial number a is less than b according to
+// serial number arithmetic (RFC 1982, section 3.2). The comparison is
+// undefined, and serialLess returns false, if a and b are 2^31 apart.
+func serialLess(a, b uint32) bool {
+	return a < b && b-a < 1<<31 || a > b && a-b > 1<<31
+}
@@ -0,0 +1,228 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// delegationServers starts name servers that serve a delegation of
+// example.com with various problems, and configures r to use them.
+// ns2.example.com. is unreachable because nothing listens on its glue
+// address.
+func delegationServers(t *testing.T, r *Resolver) {
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.251:"+r.defaultPort)
+	lameSrv := NewTestServer(t, "127.0.0.103:"+r.defaultPort)
+	zoneSrvs := []*TestServer{
+		NewTestServer(t, "127.0.0.101:"+r.defaultPort), // ns1
+		NewTestServer(t, "127.0.0.104:"+r.defaultPort), // ns3, ns4
+	}
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("NS .").AnyTimes().Respond().
+		Answer(NS(t, ".", 321, "self.test.")).
+		Additional(A(t, "self.test.", 321, rootSrv.IP()))
+	rootSrv.ExpectQuery("* com.").AnyTimes().DelegateTo("com.", comSrv.IP()).ViaAuthoritySection()
+	rootSrv.ExpectQuery("* *.com.").AnyTimes().DelegateTo("com.", comSrv.IP()).ViaAuthoritySection()
+	rootSrv.ExpectQuery("A ns1.test.").AnyTimes().Respond().
+		Answer(A(t, "ns1.test.", 300, comSrv.IP()))
+	rootSrv.ExpectQuery("A lame.other.test.").AnyTimes().Respond().
+		Answer(A(t, "lame.other.test.", 300, lameSrv.IP()))
+	rootSrv.ExpectQuery("AAAA *.test.").AnyTimes().Respond()
+
+	comSrv.ExpectQuery("NS com.").AnyTimes().Respond().
+		Answer(NS(t, "com.", 300, "ns1.test."))
+	// The referral preserves the case of the parent's zone file.
+	comSrv.ExpectQuery("* *.com.").AnyTimes().Respond().NonAuthoritative().
+		Authority(
+			NS(t, "Example.com.", 300, "NS1.example.com."),
+			NS(t, "Example.com.", 300, "ns2.Example.com."),
+			NS(t, "Example.com.", 300, "ns3.example.com."),
+			NS(t, "Example.com.", 300, "lame.other.test."),
+		).
+		Additional(
+			A(t, "NS1.example.com.", 300, "127.0.0.101"),
+			A(t, "ns2.Example.com.", 300, "127.0.0.102"),
+		)
+
+	// The serial of ns1 has wrapped around.
+	serials := []uint32{1, 4294967290}
+	for i, srv := range zoneSrvs {
+		srv.ExpectQuery("NS example.com.").AnyTimes().Respond().
+			Answer(
+				NS(t, "example.com.", 300, "ns1.example.com."),
+				NS(t, "example.com.", 300, "ns2.example.com."),
+				NS(t, "example.com.", 300, "ns3.example.com."),
+				NS(t, "example.com.", 300, "NS4.example.com."),
+			)
+		srv.ExpectQuery("SOA example.com.").AnyTimes().Respond().
+			Answer(&dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+				Ns:     "ns1.example.com.",
+				Mbox:   "hostmaster.example.com.",
+				Serial: serials[i],
+			})
+		srv.ExpectQuery("A ns1.example.com.").AnyTimes().Respond().
+			Answer(A(t, "ns1.example.com.", 300, "127.0.0.101"))
+		srv.ExpectQuery("A ns2.example.com.").AnyTimes().Respond().
+			Answer(A(t, "ns2.example.com.", 300, "127.0.0.120"))
+		srv.ExpectQuery("A ns3.example.com.").AnyTimes().Respond().
+			Answer(A(t, "ns3.example.com.", 300, "127.0.0.104"))
+		srv.ExpectQuery("AAAA *.example.com.").AnyTimes().Respond()
+	}
+
+	lameSrv.ExpectQuery("* *").AnyTimes().Respond().NonAuthoritative()
+}
+
+func TestResolver_CheckDelegation(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	delegationServers(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report, err := r.CheckDelegation(ctx, "example.com")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", report.Trace.Dump())
+
+	assert.Equal(t, "example.com", report.Zone)
+	assert.Equal(t, "com", report.Parent)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com.", "ns3.example.com.", "lame.other.test."}, report.ParentNS)
+	assert.Equal(t, []string{"ns1.example.com.", "ns2.example.com.", "ns3.example.com.", "ns4.example.com."}, report.ChildNS)
+	assert.Equal(t, map[string][]string{
+		"ns1.example.com.": {"127.0.0.101"},
+		"ns2.example.com.": {"127.0.0.102"},
+	}, report.Glue)
+
+	type server struct {
+		Name, Addr                         string
+		FromGlue, Reachable, Authoritative bool
+	}
+	var servers []server
+	for _, s := range report.Servers {
+		servers = append(servers, server{s.Name, s.Addr, s.FromGlue, s.Reachable, s.Authoritative})
+	}
+	assert.Equal(t, []server{
+		{"ns1.example.com.", "127.0.0.101:5354", true, true, true},
+		{"ns2.example.com.", "127.0.0.102:5354", true, false, false},
+		{"ns3.example.com.", "127.0.0.104:5354", false, true, true},
+		{"lame.other.test.", "127.0.0.103:5354", false, true, false},
+	}, servers)
+
+	want := []error{ErrUnreachable, ErrMissingGlue, ErrLameDelegation, ErrInconsistentGlue, ErrInconsistentNS}
+	if assert.Len(t, report.Problems, len(want), "%v", report.Problems) {
+		for i, err := range want {
+			assert.True(t, errors.Is(report.Problems[i], err), "problem %d: %v", i, report.Problems[i])
+		}
+	}
+}
+
+func TestResolver_CompareNS(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	delegationServers(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmp, err := r.CompareNS(ctx, "Example.com.")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", cmp.Trace.Dump())
+
+	assert.Equal(t, "example.com", cmp.Zone)
+	assert.Equal(t, []string{"ns4.example.com."}, cmp.Added)
+	assert.Equal(t, []string{"lame.other.test."}, cmp.Removed)
+	assert.Empty(t, cmp.Mismatches)
+	assert.False(t, cmp.Consistent())
+
+	_, err = r.CompareNS(ctx, ".")
+	assert.Error(t, err)
+}
+
+func TestResolver_CompareGlue(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	delegationServers(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmp, err := r.CompareGlue(ctx, "example.com")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", cmp.Trace.Dump())
+
+	assert.Equal(t, "example.com", cmp.Zone)
+	assert.Equal(t, []GlueCheck{
+		{Name: "ns1.example.com.", Glue: []string{"127.0.0.101"}, Zone: []string{"127.0.0.101"}},
+		{Name: "ns2.example.com.", Glue: []string{"127.0.0.102"}, Zone: []string{"127.0.0.120"}, Stale: []string{"127.0.0.102"}, Missing: []string{"127.0.0.120"}},
+		{Name: "ns3.example.com.", Zone: []string{"127.0.0.104"}, Missing: []string{"127.0.0.104"}},
+	}, cmp.Names)
+	assert.False(t, cmp.Consistent())
+}
+
+func TestResolver_CompareSOA(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	delegationServers(t, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmp, err := r.CompareSOA(ctx, "example.com")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", cmp.Trace.Dump())
+
+	assert.Equal(t, "example.com", cmp.Zone)
+	assert.Equal(t, uint32(1), cmp.Latest)
+
+	type server struct {
+		Name, Addr string
+		Serial     uint32
+		Err        bool
+	}
+	var servers []server
+	for _, s := range cmp.Servers {
+		servers = append(servers, server{s.Name, s.Addr, s.Serial, s.Err != nil})
+	}
+	assert.Equal(t, []server{
+		{"ns1.example.com.", "127.0.0.101:5354", 1, false},
+		{"ns2.example.com.", "127.0.0.102:5354", 0, true},
+		{"ns3.example.com.", "127.0.0.104:5354", 4294967290, false},
+		{"lame.other.test.", "127.0.0.103:5354", 0, true},
+	}, servers)
+
+	lagging := cmp.Lagging()
+	if assert.Len(t, lagging, 1) {
+		assert.Equal(t, "ns3.example.com.", lagging[0].Name)
+	}
+	assert.False(t, cmp.Consistent())
+}
+
+func TestSerialLess(t *testing.T) {
+	testCases := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{4294967295, 0, true},
+		{0, 4294967295, false},
+		{1, 1 + 1<<31 - 1, true},
+		{1 + 1<<31 - 1, 1, false},
+		{1, 1 + 1<<31, false}, // undefined
+		{1 + 1<<31, 1, false}, // undefined
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, serialLess(tc.a, tc.b), "%d < %d", tc.a, tc.b)
+	}
+}
@@ -0,0 +1,287 @@
+// Command dnsresolve resolves a DNS name iteratively, starting at the root
+// name servers, and prints the resulting record set and the trace of all
+// queries that were necessary to find it, similar to "dig +trace".
+//
+// Usage:
+//
+//	dnsresolve [flags] [type] name
+//
+// The type defaults to A. If name is an IP address and type is PTR or
+// omitted, the reverse lookup is performed. Run "dnsresolve -h" for the list
+// of flags.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dnsresolver "github.com/classmarkets/go-dns-resolver"
+	"github.com/miekg/dns"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("dnsresolve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: dnsresolve [flags] [type] name\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	var (
+		bootstrap = flags.String("bootstrap", "", "comma separated `addresses` of the name servers used to discover the root name servers (default: system resolvers)")
+		forward   = flags.String("forward", "", "comma separated `addresses` of recursive resolvers to forward queries to instead of resolving iteratively")
+		odohProxy = flags.String("odoh-proxy", "", "`URL` of an Oblivious DoH proxy through which https:// name servers are queried")
+		cache     = flags.String("cache", "default", "cache `policy`: default, obey, or none")
+		negTTL    = flags.Duration("negative-ttl", 5*time.Minute, "how long to cache NXDOMAIN responses with -cache=obey")
+		port      = flags.Int("port", 53, "default `port` of name servers")
+		only4     = flags.Bool("4", false, "contact name servers via IPv4 only")
+		only6     = flags.Bool("6", false, "contact name servers via IPv6 only")
+		timeout   = flags.Duration("timeout", 30*time.Second, "overall timeout")
+		asJSON    = flags.Bool("json", false, "print the result as JSON")
+		noTrace   = flags.Bool("notrace", false, "don't print the trace")
+		digTrace  = flags.Bool("dig", false, "print the trace in the format of \"dig +trace\"")
+		noFollow  = flags.Bool("nofollow", false, "print CNAME records instead of the records they refer to")
+	)
+
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	recordType, name, err := parseArgs(flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, "dnsresolve:", err)
+		flags.Usage()
+		return 2
+	}
+
+	if *only4 && *only6 {
+		fmt.Fprintln(stderr, "dnsresolve: -4 and -6 are mutually exclusive")
+		return 2
+	}
+
+	r := dnsresolver.New()
+	r.SetDefaultPort(*port)
+	r.DisableIP4 = *only6
+	r.DisableIP6 = *only4
+	r.ODoHProxy = *odohProxy
+
+	switch *cache {
+	case "default":
+	case "obey":
+		r.CachePolicy = dnsresolver.ObeyResponderAdvice(*negTTL)
+	case "none":
+		r.CachePolicy = func(dnsresolver.RecordSet) time.Duration { return 0 }
+		r.DelegationTTL = -1
+	default:
+		fmt.Fprintf(stderr, "dnsresolve: unknown cache policy: %s\n", *cache)
+		return 2
+	}
+
+	if *bootstrap != "" {
+		if err := r.SetBootstrapServers(strings.Split(*bootstrap, ",")...); err != nil {
+			fmt.Fprintln(stderr, "dnsresolve: -bootstrap:", err)
+			return 2
+		}
+	}
+
+	if *forward != "" {
+		if err := r.SetForwarders(strings.Split(*forward, ",")...); err != nil {
+			fmt.Fprintln(stderr, "dnsresolve: -forward:", err)
+			return 2
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if *noFollow {
+		ctx = dnsresolver.WithoutFollowingCNAMEs(ctx)
+	}
+
+	rs, err := r.Query(ctx, recordType, name)
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(newResult(rs, err, !*noTrace)); encErr != nil {
+			fmt.Fprintln(stderr, "dnsresolve:", encErr)
+			return 1
+		}
+	} else {
+		format := dnsresolver.DumpDefault
+		if *digTrace {
+			format = dnsresolver.DumpDig
+		}
+		printText(stdout, rs, err, !*noTrace, format)
+	}
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// parseArgs returns the record type and name from the positional arguments.
+func parseArgs(args []string) (recordType, name string, err error) {
+	switch len(args) {
+	case 1:
+		name = args[0]
+		recordType = "A"
+		if net.ParseIP(name) != nil {
+			recordType = "PTR"
+		}
+	case 2:
+		recordType = strings.ToUpper(args[0])
+		name = args[1]
+	default:
+		return "", "", errors.New("expected one or two arguments")
+	}
+
+	if _, ok := dns.StringToType[recordType]; !ok && !isGenericType(recordType) {
+		return "", "", fmt.Errorf("unsupported record type: %s", args[0])
+	}
+
+	return recordType, name, nil
+}
+
+// isGenericType reports whether recordType is of the form "TYPE65534", which
+// allows to query types unknown to package dns (RFC 3597).
+func isGenericType(recordType string) bool {
+	if !strings.HasPrefix(recordType, "TYPE") {
+		return false
+	}
+	_, err := strconv.ParseUint(strings.TrimPrefix(recordType, "TYPE"), 10, 16)
+
+	return err == nil
+}
+
+func printText(w io.Writer, rs dnsresolver.RecordSet, err error, withTrace bool, format dnsresolver.DumpFormat) {
+	if withTrace && rs.Trace != nil {
+		fmt.Fprintln(w, rs.Trace.DumpWith(dnsresolver.DumpOptions{Format: format}))
+	}
+
+	fmt.Fprintf(w, "%s %s @%s (ttl=%v, rtt=%v)\n", rs.Type, rs.Name, rs.ServerAddr, rs.TTL, rs.RTT)
+	if len(rs.Chain) > 0 {
+		fmt.Fprintf(w, "  via %s\n", strings.Join(rs.Chain, " -> "))
+	}
+	for _, v := range rs.Values {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+	for _, warning := range rs.Warnings {
+		fmt.Fprintf(w, "warning: %v\n", warning)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "error: %v\n", err)
+	}
+}
+
+type result struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	TTL      float64      `json:"ttl"`
+	Values   []string     `json:"values"`
+	Chain    []string     `json:"chain,omitempty"`
+	Server   string       `json:"server,omitempty"`
+	RTT      float64      `json:"rtt"`
+	Warnings []string     `json:"warnings,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Trace    []*traceNode `json:"trace,omitempty"`
+}
+
+type traceNode struct {
+	Question string       `json:"question"`
+	Server   string       `json:"server"`
+	RTT      float64      `json:"rtt"`
+	Age      float64      `json:"age"`
+	Cached   bool         `json:"cached,omitempty"`
+	Rcode    string       `json:"rcode,omitempty"`
+	Error    string       `json:"error,omitempty"`
+	Answer   []string     `json:"answer,omitempty"`
+	Ns       []string     `json:"authority,omitempty"`
+	Extra    []string     `json:"additional,omitempty"`
+	Children []*traceNode `json:"children,omitempty"`
+}
+
+// newResult converts rs and err to their JSON representation. Durations are
+// expressed in seconds.
+func newResult(rs dnsresolver.RecordSet, err error, withTrace bool) result {
+	x := result{
+		Name:   rs.Name,
+		Type:   rs.Type,
+		TTL:    rs.TTL.Seconds(),
+		Values: rs.Values,
+		Chain:  rs.Chain,
+		Server: rs.ServerAddr,
+		RTT:    rs.RTT.Seconds(),
+	}
+	if x.Values == nil {
+		x.Values = []string{}
+	}
+	for _, w := range rs.Warnings {
+		x.Warnings = append(x.Warnings, w.Error())
+	}
+	if err != nil {
+		x.Error = err.Error()
+	}
+	if withTrace && rs.Trace != nil {
+		x.Trace = newTraceNodes(rs.Trace.Queries)
+	}
+
+	return x
+}
+
+func newTraceNodes(nodes []*dnsresolver.TraceNode) []*traceNode {
+	var out []*traceNode
+	for _, n := range nodes {
+		x := &traceNode{
+			Server:   n.Server,
+			RTT:      n.RTT.Seconds(),
+			Age:      n.Age.Seconds(),
+			Cached:   n.CacheHit,
+			Children: newTraceNodes(n.Children),
+		}
+		if n.Error != nil {
+			x.Error = n.Error.Error()
+		}
+		if m := n.Message; m != nil {
+			if len(m.Question) > 0 {
+				q := m.Question[0]
+				x.Question = q.Name + " " + dns.ClassToString[q.Qclass] + " " + dns.TypeToString[q.Qtype]
+			}
+			if m.Response {
+				x.Rcode = dns.RcodeToString[m.Rcode]
+			}
+			x.Answer = rrStrings(m.Answer)
+			x.Ns = rrStrings(m.Ns)
+			x.Extra = rrStrings(m.Extra)
+		}
+		out = append(out, x)
+	}
+
+	return out
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		out = append(out, strings.Join(strings.Fields(rr.String()), " "))
+	}
+
+	return out
+}
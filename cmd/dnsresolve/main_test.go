@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/classmarkets/go-dns-resolver/dnsresolvertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	rootSrv := dnsresolvertest.NewRootServer(t, "127.0.2.250:5354")
+	comSrv := dnsresolvertest.NewServer(t, "127.0.2.100:5354")
+
+	// Each run bootstraps a new resolver, so the root server receives a
+	// second NS query.
+	rootSrv.ExpectQuery("NS .").Respond().
+		Answer(dnsresolvertest.NS(t, ".", 321, "self.test.")).
+		Additional(dnsresolvertest.A(t, "self.test.", 321, rootSrv.IP()))
+
+	for i := 0; i < 2; i++ {
+		rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+		comSrv.ExpectQuery("A www.example.com.").Respond().
+			Answer(dnsresolvertest.A(t, "www.example.com.", 300, "192.0.2.1"))
+	}
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-port", "5354", "-bootstrap", "127.0.2.250", "www.example.com"}, &stdout, &stderr)
+	t.Log(stdout.String())
+	assert.Equal(t, 0, code, stderr.String())
+	assert.Contains(t, stdout.String(), "? www.example.com. IN A @127.0.2.100:5354")
+	assert.Contains(t, stdout.String(), "A www.example.com @127.0.2.100:5354 (ttl=5m0s")
+	assert.True(t, strings.HasSuffix(stdout.String(), "\n  192.0.2.1\n"))
+
+	stdout.Reset()
+	code = run([]string{"-port", "5354", "-bootstrap", "127.0.2.250", "-json", "A", "www.example.com"}, &stdout, &stderr)
+	assert.Equal(t, 0, code, stderr.String())
+
+	var x result
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &x))
+	assert.Equal(t, []string{"192.0.2.1"}, x.Values)
+	assert.Equal(t, "127.0.2.100:5354", x.Server)
+	if assert.Len(t, x.Trace, 3) {
+		assert.Equal(t, "www.example.com. IN A", x.Trace[2].Question)
+		assert.Equal(t, []string{"www.example.com. 300 IN A 192.0.2.1"}, x.Trace[2].Answer)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	typ, name, err := parseArgs([]string{"192.0.2.1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "PTR", typ)
+	assert.Equal(t, "192.0.2.1", name)
+
+	typ, _, err = parseArgs([]string{"mx", "example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "MX", typ)
+
+	typ, _, err = parseArgs([]string{"type65534", "example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, "TYPE65534", typ)
+
+	_, _, err = parseArgs([]string{"BOGUS", "example.com"})
+	assert.EqualError(t, err, "unsupported record type: BOGUS")
+
+	_, _, err = parseArgs(nil)
+	assert.EqualError(t, err, "expected one or two arguments")
+}
@@ -0,0 +1,101 @@
+package dnsresolver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// config is the part of the configuration of a Resolver that is changed with
+// methods such as SetForwarders. A config is never modified once it has been
+// stored in a Resolver; changes store a modified copy instead, so that Query
+// can read the configuration without locking, and reconfiguration doesn't
+// affect queries in progress.
+type config struct {
+	systemServerAddrs []string
+
+	// forwarders are the addresses of the recursive resolvers that all
+	// queries are forwarded to, if any. See SetForwarders.
+	forwarders []string
+
+	// zoneForwarders maps zones to the recursive resolvers that queries for
+	// names in those zones are forwarded to. See SetZoneForwarders.
+	zoneForwarders map[string][]string
+
+	// zonePolicies maps zones to the policies that override those of the
+	// Resolver for names in those zones. See SetZonePolicy.
+	zonePolicies map[string]ZonePolicy
+
+	// static maps canonical names to the records that answer queries for
+	// those names locally. See AddStatic.
+	static map[string][]dns.RR
+
+	// dns64Prefix is the prefix that AAAA records are synthesized with, or
+	// nil if DNS64 is disabled. See SetDNS64Prefix.
+	dns64Prefix *net.IPNet
+
+	// negativeTrustAnchors are the zones that are not to be validated by
+	// forwarders. See SetNegativeTrustAnchors.
+	negativeTrustAnchors []string
+
+	// middleware wraps Transport; see Use.
+	middleware []Middleware
+
+	// exchangeSlots limits the number of concurrent exchanges with name
+	// servers to its capacity, or is nil. See SetMaxConcurrentExchanges.
+	exchangeSlots chan struct{}
+
+	// serverSlots limits the number of concurrent exchanges with each name
+	// server, or is nil. See SetMaxExchangesPerServer.
+	serverSlots *serverSlots
+
+	// serverNames maps the addresses of TLS and HTTPS name servers that
+	// have been specified by host name to that name, which their
+	// certificates are verified against.
+	serverNames map[string]string
+}
+
+// config returns the current configuration of R, which must not be
+// modified.
+func (R *Resolver) config() *config {
+	if c, ok := R.cfg.Load().(*config); ok {
+		return c
+	}
+
+	return &config{}
+}
+
+// withServerNames returns a copy of c with additional serverNames, or c
+// itself if there are none.
+func (c *config) withServerNames(serverNames map[string]string) *config {
+	if len(serverNames) == 0 {
+		return c
+	}
+
+	names := make(map[string]string, len(c.serverNames)+len(serverNames))
+	for addr, name := range c.serverNames {
+		names[addr] = name
+	}
+	for addr, name := range serverNames {
+		names[addr] = name
+	}
+
+	cp := *c
+	cp.serverNames = names
+	return &cp
+}
+
+// updateConfig replaces the configuration of R with a copy that has been
+// modified by f, and returns the new configuration. Slices and maps in the
+// copy are shared with the current configuration, so f must replace them
+// instead of modifying them.
+func (R *Resolver) updateConfig(f func(*config)) *config {
+	R.mu.Lock()
+	defer R.mu.Unlock()
+
+	c := *R.config()
+	f(&c)
+	R.cfg.Store(&c)
+
+	return &c
+}
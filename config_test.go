@@ -0,0 +1,75 @@
+package dnsresolver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_ConcurrentReconfiguration(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.CachePolicy = func(RecordSet) time.Duration { return 0 }
+	r.DelegationTTL = -1
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	fwdSrv := NewTestServer(t, "127.0.0.54:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// Nothing is cached, so the root servers are discovered for every
+	// query.
+	rootSrv.ExpectQuery("NS .").AnyTimes().Respond().
+		Answer(
+			NS(t, ".", 321, "self.test."),
+		).
+		Additional(
+			A(t, "self.test.", 321, rootSrv.IP()),
+		)
+	rootSrv.ExpectQuery("A www.example.com.").AnyTimes().Respond().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+	fwdSrv.ExpectQuery("A www.example.com.").AnyTimes().Respond().
+		NonAuthoritative().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.2"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rs, err := r.Query(ctx, "A", "www.example.com")
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Contains(t, [][]string{{"192.0.2.1"}, {"192.0.2.2"}}, rs.Values)
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		if i%2 == 0 {
+			assert.NoError(t, r.SetForwarders(fwdSrv.IP()))
+		} else {
+			assert.NoError(t, r.SetForwarders())
+		}
+		r.Use(func(next Exchanger) Exchanger { return next })
+	}
+
+	wg.Wait()
+
+	assert.NoError(t, r.SetForwarders(fwdSrv.IP()))
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, rs.Values)
+}
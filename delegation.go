@@ -0,0 +1,228 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDelegations limits the number of zones in a delegationCache.
+const maxDelegations = 10_000
+
+// delegationCache remembers the addresses of the name servers of zones, as
+// learned from referrals, so that queries for names in those zones don't
+// have to start at the root name servers. See Resolver.DelegationTTL.
+type delegationCache struct {
+	mu    sync.Mutex
+	zones map[string]delegation
+}
+
+type delegation struct {
+	addrs   []string
+	expires time.Time
+}
+
+// ZoneCut is a delegation that has been followed to resolve a name; see
+// RecordSet.ZoneCuts.
+type ZoneCut struct {
+	// Zone is the fully qualified name of the zone, such as "com.", and
+	// Parent the zone that has delegated to it, such as ".".
+	Zone   string
+	Parent string
+
+	// Server is the address of the name server of Parent that has referred
+	// to Zone, and NameServers are the names of the name servers of Zone in
+	// the referral. Parent, Server, and NameServers are empty for the zone
+	// that resolution has started at.
+	Server      string
+	NameServers []string
+}
+
+func newDelegationCache() *delegationCache {
+	return &delegationCache{
+		zones: map[string]delegation{},
+	}
+}
+
+// lookup returns the addresses of the name servers for zone, or nil if they
+// are unknown or expired.
+func (c *delegationCache) lookup(zone string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.zones[zone]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(c.zones, zone)
+		return nil
+	}
+
+	return append([]string{}, d.addrs...)
+}
+
+func (c *delegationCache) update(zone string, addrs []string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.zones[zone]; !ok && len(c.zones) >= maxDelegations {
+		now := time.Now()
+		for z, d := range c.zones {
+			if now.After(d.expires) {
+				delete(c.zones, z)
+			}
+		}
+		if len(c.zones) >= maxDelegations {
+			c.zones = map[string]delegation{}
+		}
+	}
+
+	c.zones[zone] = delegation{
+		addrs:   append([]string{}, addrs...),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+func (c *delegationCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.zones)
+}
+
+func (c *delegationCache) clear() {
+	c.mu.Lock()
+	c.zones = map[string]delegation{}
+	c.mu.Unlock()
+}
+
+// delegationTTL returns how long the delegation to zone in the referral m
+// may be cached: the smallest TTL of the NS records for zone and of the
+// address records in m, but at most max.
+func delegationTTL(m *dns.Msg, zone string, max time.Duration) time.Duration {
+	ttl := max
+	for _, rr := range append(append([]dns.RR{}, m.Ns...), m.Extra...) {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeNS:
+			if hdr.Name != zone {
+				continue
+			}
+		case dns.TypeA, dns.TypeAAAA:
+		default:
+			continue
+		}
+
+		if x := time.Duration(hdr.Ttl) * time.Second; x < ttl {
+			ttl = x
+		}
+	}
+
+	return ttl
+}
+
+// maxDelegationTTL returns the effective DelegationTTL, which is negative if
+// the delegation cache is disabled.
+func (R *Resolver) maxDelegationTTL() time.Duration {
+	if R.DelegationTTL == 0 {
+		return time.Hour
+	}
+
+	return R.DelegationTTL
+}
+
+// delegatedAddrs returns the cached addresses of the name servers of the
+// closest zone that contains fqdn, and that zone. If no such delegation is
+// cached, delegatedAddrs returns nil.
+func (r *resolver) delegatedAddrs(fqdn string) ([]string, string) {
+	if r.delegations == nil {
+		return nil, ""
+	}
+
+	for name := dns.CanonicalName(fqdn); name != "."; name = parentName(name) {
+		if addrs := r.delegations.lookup(name); len(addrs) > 0 {
+			return addrs, name
+		}
+	}
+
+	return nil, ""
+}
+
+// Prime resolves the delegations of the given zones ahead of time, so that
+// the first queries for names in these zones don't have to pay for it: the
+// addresses of the name servers of each zone, and of its parent zones, are
+// added to the delegation cache (see DelegationTTL). This is useful for
+// latency-sensitive services, which can call Prime when they start.
+//
+// Prime resolves all zones, even if some of them fail, and returns the
+// first error that has occurred.
+func (R *Resolver) Prime(ctx context.Context, zones ...string) error {
+	maxTTL := R.maxDelegationTTL()
+
+	if maxTTL < 0 {
+		return errors.New("prime: delegation cache disabled")
+	}
+
+	var firstErr error
+	for _, zone := range zones {
+		if err := R.prime(ctx, zone, maxTTL); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("prime %s: %w", zone, err)
+		}
+	}
+
+	return firstErr
+}
+
+func (R *Resolver) prime(ctx context.Context, zone string, maxTTL time.Duration) error {
+	// Resolving the NS records follows the referrals from the root name
+	// servers down to the zone, which caches all delegations that include
+	// glue records.
+	rs, err := R.Query(ctx, "NS", zone)
+	if err != nil {
+		return err
+	}
+
+	fqdn := dns.CanonicalName(rs.Raw.Question[0].Name)
+	if len(R.delegations.lookup(fqdn)) > 0 {
+		return nil
+	}
+
+	// The delegation to zone doesn't include glue records, so resolve the
+	// addresses of the name servers explicitly.
+	var (
+		addrs   []string
+		lastErr error
+	)
+	for _, rr := range rs.records() {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		x, err := R.lookupAddrs(ctx, ns.Ns, rs.Trace)
+		if err != nil {
+			lastErr = err
+		}
+		addrs = append(addrs, x...)
+	}
+	if len(addrs) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no name server addresses")
+		}
+		return lastErr
+	}
+
+	ttl := maxTTL
+	if rs.TTL < ttl {
+		ttl = rs.TTL
+	}
+
+	R.delegations.update(fqdn, addrs, ttl)
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_Query_DelegationCache(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(0)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []ZoneCut{
+		{Zone: "."},
+		{Zone: "com.", Parent: ".", Server: "127.0.0.250:5354", NameServers: []string{"ns1.test."}},
+		{Zone: "example.com.", Parent: "com.", Server: "127.0.0.100:5354", NameServers: []string{"ns1.test."}},
+	}, rs.ZoneCuts)
+
+	// Queries for other names in example.com. are sent to the servers of
+	// example.com. right away.
+	expSrv.ExpectQuery("A mail.example.com.").Respond().
+		Answer(
+			A(t, "mail.example.com.", 321, "192.0.2.2"),
+		)
+
+	rs, err = r.Query(ctx, "A", "mail.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, rs.Values)
+	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
+	assert.Equal(t, []ZoneCut{{Zone: "example.com."}}, rs.ZoneCuts)
+
+	// Answers served from the cache start at the closest zone, too.
+	rs, err = r.Query(ctx, "A", "mail.example.com")
+	assert.NoError(t, err)
+	assert.True(t, rs.Trace.Queries[len(rs.Trace.Queries)-1].CacheHit)
+	assert.Equal(t, []ZoneCut{{Zone: "example.com."}}, rs.ZoneCuts)
+
+	// DS records are served by the parent zone.
+	comSrv.ExpectQuery("DS example.com.").Respond()
+
+	rs, err = r.Query(ctx, "DS", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.100:5354", rs.ServerAddr)
+}
+
+func TestResolver_Prime(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	netSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// The delegation to example.com. doesn't include glue records.
+	rootSrv.ExpectQuery("NS example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("NS example.com.").DelegateTo("example.com.", "ns1.example.net.")
+	rootSrv.ExpectQuery("A ns1.example.net.").DelegateTo("net.", netSrv.IP())
+	netSrv.ExpectQuery("A ns1.example.net.").Times(2).Respond().
+		Answer(
+			A(t, "ns1.example.net.", 321, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("NS example.com.").Respond().
+		Answer(
+			NS(t, "example.com.", 321, "ns1.example.net."),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	assert.NoError(t, r.Prime(ctx, "example.com"))
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	comSrv.AssertNoOutstandingExpectations(t)
+	netSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	r.DelegationTTL = -1
+	assert.EqualError(t, r.Prime(ctx, "example.com"), "prime: delegation cache disabled")
+}
+
+func TestResolver_OnDelegation(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(0)
+	r.DelegationTTL = -1
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.251:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(NS(t, "com.", 300, "a.gtld.test.")).
+		Additional(A(t, "a.gtld.test.", 300, comSrv.IP()))
+	comSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(NS(t, "example.com.", 300, "ns1.example.com.")).
+		Additional(A(t, "ns1.example.com.", 300, expSrv.IP()))
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.100"))
+
+	var (
+		mu   sync.Mutex
+		cuts []ZoneCut
+	)
+	errForbidden := errors.New("forbidden")
+	r.OnDelegation = func(cut ZoneCut) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		cuts = append(cuts, cut)
+		if cut.Zone == "example.com." {
+			return errForbidden
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.example.com")
+	assert.ErrorIs(t, err, errForbidden)
+	assert.Equal(t, []ZoneCut{
+		{Zone: "com.", Parent: ".", Server: "127.0.0.250:5354", NameServers: []string{"a.gtld.test."}},
+		{Zone: "example.com.", Parent: "com.", Server: "127.0.0.251:5354", NameServers: []string{"ns1.example.com."}},
+	}, cuts)
+
+	r.OnDelegation = func(cut ZoneCut) error { return nil }
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	comSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
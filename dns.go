@@ -15,14 +15,280 @@ func empty(m *dns.Msg) bool {
 		len(m.Answer)+len(m.Ns)+len(m.Extra) == 0
 }
 
+// rrValue returns the RDATA of rr in presentation format, i.e. as in a zone
+// file, without the owner name, TTL, class, and type.
+//
+// Records without a presentation format of their own, such as records of
+// types that are unknown to package dns and NULL records, are formatted
+// generically as described in RFC 3597, section 5: "\#", the length of the
+// RDATA in bytes, and the RDATA in hex, for instance "\# 3 abcdef".
 func rrValue(rr dns.RR) string {
-	return strings.TrimPrefix(rr.String(), rr.Header().String())
+	if _, ok := rr.(*dns.RFC3597); !ok {
+		s, hdr := rr.String(), rr.Header().String()
+		if strings.HasPrefix(s, hdr) {
+			return strings.TrimPrefix(s, hdr)
+		}
+	}
+
+	return genericRdata(rr)
+}
+
+// genericRdata returns the RDATA of rr in the generic format of RFC 3597.
+func genericRdata(rr dns.RR) string {
+	u, ok := rr.(*dns.RFC3597)
+	if !ok {
+		u = new(dns.RFC3597)
+		if err := u.ToRFC3597(rr); err != nil {
+			return rr.String()
+		}
+	}
+
+	if u.Rdata == "" {
+		return `\# 0`
+	}
+	return `\# ` + strconv.Itoa(len(u.Rdata)/2) + " " + u.Rdata
+}
+
+// parseType returns the record type s, which is either a mnemonic such as
+// "AAAA" or of the form "TYPE65534" (RFC 3597, section 5), which also allows
+// to query types that are unknown to this package.
+func parseType(s string) (uint16, bool) {
+	if t, ok := dns.StringToType[s]; ok {
+		return t, true
+	}
+
+	return parseGeneric(s, "TYPE")
+}
+
+// parseClass returns the class s, which is either a mnemonic such as "IN" or
+// of the form "CLASS32" (RFC 3597, section 5).
+func parseClass(s string) (uint16, bool) {
+	if c, ok := dns.StringToClass[s]; ok {
+		return c, true
+	}
+
+	return parseGeneric(s, "CLASS")
+}
+
+func parseGeneric(s, prefix string) (uint16, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(s[len(prefix):], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+
+	return uint16(n), true
+}
+
+// isNoData reports whether m is a NODATA response (RFC 2308, section 2.2):
+// NOERROR without records of the type in question, and with the SOA record of
+// the zone that contains the name in question in the AUTHORITY section.
+func isNoData(m *dns.Msg) bool {
+	return noDataSOA(m) != nil
+}
+
+// noDataSOA returns the SOA record that makes m a NODATA response, or nil if
+// m is not a NODATA response.
+func noDataSOA(m *dns.Msg) *dns.SOA {
+	if m == nil || m.Rcode != dns.RcodeSuccess || len(m.Question) == 0 {
+		return nil
+	}
+
+	q := m.Question[0]
+	for _, rr := range m.Answer {
+		if hdr := rr.Header(); hdr.Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			return nil
+		}
+	}
+
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, q.Name) {
+			return soa
+		}
+	}
+
+	return nil
+}
+
+// isEmptyNonTerminal reports whether the NODATA response m proves that the
+// name in question is an empty non-terminal, i.e. a name that doesn't own any
+// records but has names below it, such as _tcp.example.com if only
+// _sip._tcp.example.com exists. A NODATA response to an ANY query is proof
+// enough: the name exists, but doesn't own any records. Otherwise, the proof
+// requires NSEC or NSEC3 records, which signed zones include in responses to
+// queries with the DO bit: an NSEC record whose next name is below the name
+// in question (RFC 4035, section 3.1.3.2), or a matching NSEC3 record without
+// types (RFC 5155, section 7.2.3).
+func isEmptyNonTerminal(m *dns.Msg) bool {
+	soa := noDataSOA(m)
+	if soa == nil {
+		return false
+	}
+
+	name := dns.CanonicalName(m.Question[0].Name)
+	if dns.CanonicalName(soa.Hdr.Name) == name {
+		return false // zone apexes always own records
+	}
+	if m.Question[0].Qtype == dns.TypeANY {
+		return true
+	}
+
+	for _, rr := range m.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			next := dns.CanonicalName(rr.NextDomain)
+			if dns.CanonicalName(rr.Hdr.Name) != name && next != name && dns.IsSubDomain(name, next) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) && len(rr.TypeBitMap) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
 }
 
 func isAuthoritative(m *dns.Msg) bool {
 	return m != nil && m.Authoritative
 }
 
+// cnameTarget returns the name that the question in m is an alias of,
+// according to the CNAME records in m, or the empty string if there are no such
+// CNAME records.
+func cnameTarget(m *dns.Msg) string {
+	if len(m.Question) == 0 {
+		return ""
+	}
+
+	name := m.Question[0].Name
+	seen := map[string]bool{}
+	for !seen[name] {
+		seen[name] = true
+		for _, rr := range m.Answer {
+			if rr, ok := rr.(*dns.CNAME); ok && rr.Hdr.Name == name {
+				name = rr.Target
+				break
+			}
+		}
+	}
+
+	if name == m.Question[0].Name {
+		return ""
+	}
+
+	return name
+}
+
+// cnameChain returns the question name in m followed by the targets of the
+// CNAME records in m that the question name is an alias of, in order. The
+// chain ends before the first repetition. cnameChain returns a single name if
+// there are no such CNAME records.
+func cnameChain(m *dns.Msg) []string {
+	if len(m.Question) == 0 {
+		return nil
+	}
+
+	name := m.Question[0].Name
+	chain := []string{name}
+	seen := map[string]bool{name: true}
+	for {
+		next := ""
+		for _, rr := range m.Answer {
+			if rr, ok := rr.(*dns.CNAME); ok && rr.Hdr.Name == name {
+				next = rr.Target
+				break
+			}
+		}
+		if next == "" || seen[next] {
+			return chain
+		}
+
+		seen[next] = true
+		chain = append(chain, next)
+		name = next
+	}
+}
+
+// referralZone returns the owner name of the NS records in m, i.e. the zone
+// that m delegates to, or the empty string if m contains no NS records.
+func referralZone(m *dns.Msg) string {
+	for _, rr := range append(m.Ns, m.Answer...) {
+		if rr, ok := rr.(*dns.NS); ok {
+			return rr.Hdr.Name
+		}
+	}
+
+	return ""
+}
+
+// referralNameServers returns the names of the name servers of zone in the
+// NS records of m.
+func referralNameServers(m *dns.Msg, zone string) []string {
+	var names []string
+	for _, rr := range append(m.Ns, m.Answer...) {
+		if rr, ok := rr.(*dns.NS); ok && rr.Hdr.Name == zone {
+			names = append(names, rr.Ns)
+		}
+	}
+
+	return names
+}
+
+// isLame reports whether a non-authoritative response from a server for
+// currentZone, which contained the referrals addrs and names to referredZone,
+// indicates a lame delegation. This is the case if the response doesn't refer
+// anywhere, or if it refers to a zone that is not below currentZone.
+func isLame(currentZone, referredZone string, addrs, names []string) bool {
+	if len(addrs) == 0 && len(names) == 0 {
+		return true
+	}
+	if currentZone == "" || referredZone == "" {
+		return false
+	}
+
+	return referredZone == currentZone || !dns.IsSubDomain(currentZone, referredZone)
+}
+
+// unescapeCharString reverses the escaping that miekg/dns applies to
+// character-strings, such as the strings of TXT records: backslashes followed
+// by three decimal digits represent arbitrary bytes, and backslashes followed
+// by any other character represent that character.
+func unescapeCharString(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			n := int(s[i+1]-'0')*100 + int(s[i+2]-'0')*10 + int(s[i+3]-'0')
+			if n <= 255 {
+				b = append(b, byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		b = append(b, s[i+1])
+		i++
+	}
+
+	return string(b)
+}
+
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
+
 func trimTrailingDot(s string) string {
 	if s == "." {
 		return s
@@ -30,28 +296,45 @@ func trimTrailingDot(s string) string {
 	return strings.TrimSuffix(s, ".")
 }
 
+// parentName returns the name of the parent of fqdn, or "." if fqdn is a
+// top-level domain or the root itself.
+func parentName(fqdn string) string {
+	i, end := dns.NextLabel(fqdn, 0)
+	if end || i >= len(fqdn) {
+		return "."
+	}
+
+	return fqdn[i:]
+}
+
 // normalize returns a copy of m's records with CNAME and NS records replaced
 // with matching records in m.Extra if possible. CNAME and NS records without a
 // match are left as-is. Circular references and duplicate records are removed.
 func normalize(m *dns.Msg) []dns.RR {
-	all := append(append(m.Answer, m.Ns...), m.Extra...)
-
-	mapped := map[string][]string{}
-	for _, rr := range all {
-		switch rr := rr.(type) {
-		case *dns.CNAME:
-			mapped[rr.Target] = append(mapped[rr.Target], rr.Hdr.Name)
-		case *dns.NS:
-			mapped[rr.Ns] = append(mapped[rr.Ns], rr.Hdr.Name)
+	n := len(m.Answer) + len(m.Ns) + len(m.Extra)
+
+	// Index all records by owner name, preserving their order, so that
+	// following CNAME and NS targets doesn't require scanning the whole
+	// message for every target.
+	byName := make(map[string][]dns.RR, n)
+	mapped := map[string]bool{}
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			name := rr.Header().Name
+			byName[name] = append(byName[name], rr)
+
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				mapped[rr.Target] = true
+			case *dns.NS:
+				mapped[rr.Ns] = true
+			}
 		}
 	}
 
-	var xs []dns.RR
+	xs := make([]dns.RR, 0, len(m.Answer)+len(m.Ns))
 	copyRecord := func(rr dns.RR, ttl *uint32, newName string) {
-		x, err := dns.NewRR(rr.String())
-		if err != nil {
-			panic(err)
-		}
+		x := dns.Copy(rr)
 		hdr := x.Header()
 		if ttl != nil && *ttl < hdr.Ttl {
 			hdr.Ttl = *ttl
@@ -71,14 +354,9 @@ func normalize(m *dns.Msg) []dns.RR {
 
 		var rrs []dns.RR
 
-		for _, rr := range all {
-			hdr := rr.Header()
-			if hdr.Name != name {
-				continue
-			}
-
-			if hdr.Ttl < ttl {
-				ttl = rr.Header().Ttl
+		for _, rr := range byName[name] {
+			if hdr := rr.Header(); hdr.Ttl < ttl {
+				ttl = hdr.Ttl
 			}
 			if cname, ok := rr.(*dns.CNAME); ok {
 				xs, newTtl, cycle := findReplacements(cname.Target, ttl, seen)
@@ -99,43 +377,43 @@ func normalize(m *dns.Msg) []dns.RR {
 		return rrs, ttl, false
 	}
 
-	for _, rr := range append(append(m.Answer, m.Ns...)) {
-		if _, ok := mapped[rr.Header().Name]; ok {
-			continue
-		}
-
-		var target string
-		var newHeader dns.RR_Header
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if mapped[rr.Header().Name] {
+				continue
+			}
 
-		switch rr := rr.(type) {
-		case *dns.NS:
-			target = rr.Ns
-			newHeader = rr.Hdr
-		case *dns.CNAME:
-			target = rr.Target
-			newHeader = rr.Hdr
-		default:
-			copyRecord(rr, nil, "")
-			continue
-		}
+			var target string
+			var newHeader dns.RR_Header
+
+			switch rr := rr.(type) {
+			case *dns.NS:
+				target = rr.Ns
+				newHeader = rr.Hdr
+			case *dns.CNAME:
+				target = rr.Target
+				newHeader = rr.Hdr
+			default:
+				copyRecord(rr, nil, "")
+				continue
+			}
 
-		replacements, newTtl, cycle := findReplacements(target, newHeader.Ttl, map[string]bool{})
-		if cycle {
-			continue
-		}
+			replacements, newTtl, cycle := findReplacements(target, newHeader.Ttl, map[string]bool{})
+			if cycle {
+				continue
+			}
 
-		if replacements == nil {
-			copyRecord(rr, nil, "")
-		} else {
-			for _, rr := range replacements {
-				copyRecord(rr, &newTtl, newHeader.Name)
+			if replacements == nil {
+				copyRecord(rr, nil, "")
+			} else {
+				for _, rr := range replacements {
+					copyRecord(rr, &newTtl, newHeader.Name)
+				}
 			}
 		}
 	}
 
-	dns.Dedup(xs, nil)
-
-	return xs
+	return dns.Dedup(xs, nil)
 }
 
 func checkTLDNSSet(msg *dns.Msg) (string, time.Duration, bool) {
@@ -0,0 +1,125 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// SetDNS64Prefix enables DNS64 (RFC 6147) for IPv6-only networks that reach
+// the IPv4 internet via NAT64: if a query for AAAA records yields none, but
+// the name has A records, Query returns AAAA records that are synthesized
+// from the A records by embedding the IPv4 addresses into prefix as
+// described in RFC 6052, and sets RecordSet.DNS64. NXDOMAIN responses and
+// errors are returned as they are.
+//
+// prefix is an IPv6 prefix in CIDR notation with a length of 32, 40, 48,
+// 56, 64, or 96 bits, such as the well-known prefix 64:ff9b::/96. Calling
+// SetDNS64Prefix with an empty string disables DNS64, which is the default.
+func (R *Resolver) SetDNS64Prefix(prefix string) error {
+	var ipnet *net.IPNet
+	if prefix != "" {
+		ip, n, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return err
+		}
+		if ip.To4() != nil {
+			return errors.New("not an IPv6 prefix: " + prefix)
+		}
+		switch ones, _ := n.Mask.Size(); ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return errors.New("unsupported prefix length: " + prefix)
+		}
+		ipnet = n
+	}
+
+	R.updateConfig(func(c *config) {
+		c.dns64Prefix = ipnet
+	})
+
+	return nil
+}
+
+// embedIPv4 returns the IPv6 address that consists of prefix and ip4 (RFC
+// 6052, section 2.2). Bits 64 to 71 of the address are always zero.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:ones/8])
+
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+
+	return ip
+}
+
+// synthesizeAAAA performs DNS64 if it is enabled and rs, which is the result
+// of a query for AAAA records, is empty: A records are queried with query,
+// which is the record set that has been passed to Query for rs, and AAAA
+// records are synthesized from them. The A query is added to the trace of
+// rs.
+func (r *resolver) synthesizeAAAA(ctx context.Context, query, rs RecordSet, err error) (RecordSet, error) {
+	if r.dns64Prefix == nil || err != nil || len(rs.Values) > 0 || rs.Raw.Question[0].Qtype != dns.TypeAAAA {
+		return rs, err
+	}
+
+	q := query.Raw.Question[0]
+	q.Qtype = dns.TypeA
+	query.Raw = dns.Msg{Question: []dns.Question{q}}
+	query.Type = "A"
+
+	// The A query starts over, so it repeats some queries of the AAAA
+	// query, such as the one for the root name servers.
+	query.Trace = rs.Trace.fork()
+	query.Trace.seen = nil
+	a, aErr := r.Query(ctx, "A", q.Name, query)
+	rs.Trace.adopt(query.Trace)
+	if aErr != nil || len(a.Values) == 0 {
+		return rs, err
+	}
+
+	// The TTL of the synthesized records doesn't exceed the negative TTL
+	// of the AAAA response (RFC 6147, section 5.1.7).
+	maxTTL := ^uint32(0)
+	if soa := noDataSOA(&rs.Raw); soa != nil {
+		maxTTL = soa.Minttl
+		if soa.Hdr.Ttl < maxTTL {
+			maxTTL = soa.Hdr.Ttl
+		}
+	}
+
+	resp := a.Raw.Copy()
+	resp.Question[0].Qtype = dns.TypeAAAA
+	for i, rr := range resp.Answer {
+		rec, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		hdr := rec.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		hdr.Rdlength = 0
+		if hdr.Ttl > maxTTL {
+			hdr.Ttl = maxTTL
+		}
+		resp.Answer[i] = &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(r.dns64Prefix, rec.A)}
+	}
+
+	out := query
+	out.Type = "AAAA"
+	out.Trace = rs.Trace
+	out.fromResponse(resp, a.ServerAddr, a.RTT, a.Age, false)
+	out.ServersTried = a.ServersTried
+	out.DNS64 = true
+
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbedIPv4(t *testing.T) {
+	// Examples from RFC 6052, section 2.4.
+	testCases := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	}
+
+	for _, tc := range testCases {
+		_, prefix, err := net.ParseCIDR(tc.prefix)
+		require.NoError(t, err)
+		got := embedIPv4(prefix, net.ParseIP("192.0.2.33"))
+		assert.Equal(t, net.ParseIP(tc.want).String(), got.String(), tc.prefix)
+	}
+}
+
+func TestResolver_SetDNS64Prefix(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	aaaa := RR(t, dns.TypeAAAA, "dual.example.", 300)
+	aaaa.(*dns.AAAA).AAAA = net.ParseIP("2001:db8::1")
+
+	rootSrv.ExpectQuery("AAAA v4only.example.").Times(3).Respond().
+		Authority(&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Minttl: 60,
+		})
+	rootSrv.ExpectQuery("ANY v4only.example.").Times(3).Respond().
+		Answer(A(t, "v4only.example.", 300, "192.0.2.33"))
+	rootSrv.ExpectQuery("A v4only.example.").Respond().
+		Answer(A(t, "v4only.example.", 300, "192.0.2.33"))
+	rootSrv.ExpectQuery("AAAA dual.example.").Respond().
+		Answer(aaaa)
+	rootSrv.ExpectQuery("AAAA missing.example.").Respond().
+		Status(dns.RcodeNameError)
+
+	assert.Error(t, r.SetDNS64Prefix("64:ff9b::/80"))
+	assert.Error(t, r.SetDNS64Prefix("192.0.2.0/24"))
+	assert.Error(t, r.SetDNS64Prefix("64:ff9b::"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "AAAA", "v4only.example")
+	require.NoError(t, err)
+	assert.Empty(t, rs.Values)
+	assert.False(t, rs.DNS64)
+
+	require.NoError(t, r.SetDNS64Prefix("64:ff9b::/96"))
+
+	rs, err = r.Query(ctx, "AAAA", "v4only.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"64:ff9b::c000:221"}, rs.Values)
+	assert.Equal(t, "AAAA", rs.Type)
+	assert.Equal(t, 60*time.Second, rs.TTL)
+	assert.True(t, rs.DNS64)
+	assert.Contains(t, rs.Trace.Dump(), "v4only.example. IN A @127.0.0.250:5354")
+
+	rs, err = r.Query(ctx, "AAAA", "dual.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2001:db8::1"}, rs.Values)
+	assert.False(t, rs.DNS64)
+
+	_, err = r.Query(ctx, "AAAA", "missing.example")
+	assert.True(t, errors.Is(err, ErrNXDomain), "%v", err)
+
+	require.NoError(t, r.SetDNS64Prefix(""))
+	rs, err = r.Query(ctx, "AAAA", "v4only.example")
+	require.NoError(t, err)
+	assert.Empty(t, rs.Values)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
@@ -1,7 +1,7 @@
 package dnsresolver
 
 import (
-	"net"
+	"strings"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -9,67 +9,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func RR(t *testing.T, typ uint16, name string, ttl uint32) dns.RR {
-	ctor, ok := dns.TypeToRR[typ]
-	if !ok {
-		t.Fatalf("invalid record type: %d", typ)
-	}
-
-	rr := ctor()
-	hdr := rr.Header()
-	hdr.Name = name
-	hdr.Class = dns.ClassINET
-	hdr.Rrtype = typ
-	hdr.Ttl = ttl
-
-	return rr
-}
-
-func A(t *testing.T, name string, ttl uint32, ipStr string) *dns.A {
-	ip := net.ParseIP(ipStr)
-	if ip.To4() == nil {
-		t.Fatal("invalid ipv4: " + ipStr)
-	}
-
-	rr := RR(t, dns.TypeA, name, ttl).(*dns.A)
-	rr.A = ip
-
-	return rr
-}
-
-func AAAA(t *testing.T, name string, ttl uint32, ipStr string) *dns.AAAA {
-	ip := net.ParseIP(ipStr)
-	if ip.To16() == nil {
-		t.Fatal("invalid ipv6: " + ipStr)
-	}
-
-	rr := RR(t, dns.TypeAAAA, name, ttl).(*dns.AAAA)
-	rr.AAAA = ip
-
-	return rr
-}
-
-func NS(t *testing.T, name string, ttl uint32, target string) *dns.NS {
-	rr := RR(t, dns.TypeNS, name, ttl).(*dns.NS)
-	rr.Ns = target
-
-	return rr
-}
-
-func CNAME(t *testing.T, name string, ttl uint32, target string) *dns.CNAME {
-	rr := RR(t, dns.TypeCNAME, name, ttl).(*dns.CNAME)
-	rr.Target = target
-
-	return rr
-}
-
-func PTR(t *testing.T, name string, ttl uint32, ptr string) *dns.PTR {
-	rr := RR(t, dns.TypePTR, name, ttl).(*dns.PTR)
-	rr.Ptr = ptr
-
-	return rr
-}
-
 func TestNormalize(t *testing.T) {
 	cases := []struct {
 		answer     []dns.RR
@@ -224,6 +163,37 @@ func TestNormalize(t *testing.T) {
 				NS(t, "ns2.", 300, "ns2.example.com."),
 			},
 		},
+		{
+			// Duplicate records are removed, keeping the lowest TTL.
+			answer: []dns.RR{
+				A(t, "foo.", 300, "192.0.2.1"),
+				A(t, "foo.", 300, "192.0.2.2"),
+				A(t, "foo.", 60, "192.0.2.1"),
+			},
+			want: []dns.RR{
+				A(t, "foo.", 60, "192.0.2.1"),
+				A(t, "foo.", 300, "192.0.2.2"),
+			},
+		},
+		{
+			// So are duplicates that result from replacing CNAME and NS
+			// records.
+			answer: []dns.RR{
+				CNAME(t, "www.", 300, "web.example.com."),
+				A(t, "www.", 300, "192.0.2.1"),
+				NS(t, "ns1.", 300, "ns.example.com."),
+				NS(t, "ns1.", 300, "ns.example.net."),
+			},
+			additional: []dns.RR{
+				A(t, "web.example.com.", 300, "192.0.2.1"),
+				A(t, "ns.example.com.", 300, "192.0.2.53"),
+				A(t, "ns.example.net.", 300, "192.0.2.53"),
+			},
+			want: []dns.RR{
+				A(t, "www.", 300, "192.0.2.1"),
+				A(t, "ns1.", 300, "192.0.2.53"),
+			},
+		},
 	}
 
 	t.Parallel()
@@ -283,3 +253,167 @@ func TestIsPublicSuffix(t *testing.T) {
 		})
 	}
 }
+
+func TestUnescapeCharString(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{``, ""},
+		{`plain`, "plain"},
+		{`a\"b`, `a"b`},
+		{`a\\b`, `a\b`},
+		{`\010\255`, "\n\xff"},
+		{`\256`, "256"},
+		{`\01`, "01"},
+		{`trailing\`, `trailing\`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			assert.Equal(t, tc.want, unescapeCharString(tc.in))
+		})
+	}
+}
+
+func TestRRValue(t *testing.T) {
+	mustRR := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: "example.com.", Rrtype: rrtype, Class: dns.ClassINET, Ttl: 300}
+	}
+
+	cases := []struct {
+		rr   dns.RR
+		want string
+	}{
+		{mustRR("example.com. 300 IN A 192.0.2.1"), "192.0.2.1"},
+		{mustRR("example.com. 300 IN MX 10 mx.example.com."), "10 mx.example.com."},
+		{mustRR(`example.com. 300 IN TXT "v=spf1 -all"`), `"v=spf1 -all"`},
+		{mustRR(`example.com. 300 IN TYPE65534 \# 3 abcdef`), `\# 3 abcdef`},
+		{&dns.RFC3597{Hdr: hdr(65534)}, `\# 0`},
+		{&dns.NULL{Hdr: hdr(dns.TypeNULL), Data: "\x01\x02"}, `\# 2 0102`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.rr.String(), func(t *testing.T) {
+			assert.Equal(t, tc.want, rrValue(tc.rr))
+		})
+	}
+}
+
+func TestIsEmptyNonTerminal(t *testing.T) {
+	rr := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+
+	soa := rr("example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 7200 900 1209600 60")
+	hash := dns.HashName("_tcp.example.com.", dns.SHA1, 0, "")
+
+	cases := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		answer    []dns.RR
+		authority []dns.RR
+		noData    bool
+		ent       bool
+	}{
+		{
+			name:      "nodata without proof",
+			qname:     "_tcp.example.com.",
+			authority: []dns.RR{soa},
+			noData:    true,
+		},
+		{
+			name:      "answer",
+			qname:     "_tcp.example.com.",
+			answer:    []dns.RR{rr("_tcp.example.com. 300 IN AAAA 2001:db8::1")},
+			authority: []dns.RR{soa},
+		},
+		{
+			name:  "no soa",
+			qname: "_tcp.example.com.",
+		},
+		{
+			name:      "soa of another zone",
+			qname:     "_tcp.example.org.",
+			authority: []dns.RR{soa},
+		},
+		{
+			name:      "apex",
+			qname:     "example.com.",
+			authority: []dns.RR{soa, rr("example.com. 300 IN NSEC _sip._tcp.example.com. SOA NS NSEC RRSIG")},
+			noData:    true,
+		},
+		{
+			name:      "nsec",
+			qname:     "_tcp.example.com.",
+			authority: []dns.RR{soa, rr("example.com. 300 IN NSEC _sip._tcp.example.com. SOA NS NSEC RRSIG")},
+			noData:    true,
+			ent:       true,
+		},
+		{
+			name:      "nsec of the name",
+			qname:     "_tcp.example.com.",
+			authority: []dns.RR{soa, rr("_tcp.example.com. 300 IN NSEC _sip._tcp.example.com. A NSEC RRSIG")},
+			noData:    true,
+		},
+		{
+			name:      "nsec3",
+			qname:     "_tcp.example.com.",
+			authority: []dns.RR{soa, rr(strings.ToLower(hash) + ".example.com. 300 IN NSEC3 1 0 0 - 00000000000000000000000000000000")},
+			noData:    true,
+			ent:       true,
+		},
+		{
+			name:      "any",
+			qname:     "_tcp.example.com.",
+			qtype:     dns.TypeANY,
+			authority: []dns.RR{soa},
+			noData:    true,
+			ent:       true,
+		},
+		{
+			name:      "any at the apex",
+			qname:     "example.com.",
+			qtype:     dns.TypeANY,
+			authority: []dns.RR{soa},
+			noData:    true,
+		},
+		{
+			name:      "any with answer",
+			qname:     "_tcp.example.com.",
+			qtype:     dns.TypeANY,
+			answer:    []dns.RR{rr("_tcp.example.com. 300 IN TXT foo")},
+			authority: []dns.RR{soa},
+		},
+		{
+			name:      "nsec3 with types",
+			qname:     "_tcp.example.com.",
+			authority: []dns.RR{soa, rr(strings.ToLower(hash) + ".example.com. 300 IN NSEC3 1 0 0 - 00000000000000000000000000000000 A RRSIG")},
+			noData:    true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			qtype := tc.qtype
+			if qtype == 0 {
+				qtype = dns.TypeAAAA
+			}
+			m := new(dns.Msg).SetQuestion(tc.qname, qtype)
+			m.Response = true
+			m.Answer = tc.answer
+			m.Ns = tc.authority
+
+			assert.Equal(t, tc.noData, isNoData(m))
+			assert.Equal(t, tc.ent, isEmptyNonTerminal(m))
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package dnsresolvertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var digReceivedRe = regexp.MustCompile(`^;; Received \d+ bytes from (\S+)#\d+\(([^)]*)\)`)
+
+// ParseDigTrace parses the output of "dig +trace", such as:
+//
+//	; <<>> DiG 9.18.1 <<>> +trace www.example.com
+//	;; global options: +cmd
+//	.                       518400  IN      NS      a.root-servers.net.
+//	;; Received 239 bytes from 127.0.0.53#53(127.0.0.53) in 0 ms
+//
+//	com.                    172800  IN      NS      a.gtld-servers.net.
+//	;; Received 1170 bytes from 198.41.0.4#53(a.root-servers.net) in 20 ms
+//	...
+//
+// The query is taken from the header line, so it must be included. The first
+// block of records is the response to "NS .", and all other blocks are
+// responses to the query.
+//
+// Since dig doesn't print the sections and the header of the responses, they
+// are reconstructed: records of the queried name and type, and the CNAME
+// chain leading to them, are put into the answer section; NS, SOA, DS, and
+// DNSSEC records into the authority section; and address records into the
+// additional section. Responses with answer or SOA records are marked as
+// authoritative. All responses have the NOERROR status; NXDOMAIN responses
+// cannot be told apart from empty responses.
+//
+// dig +trace doesn't print glue records by default. For each name server
+// that appears in a "Received ... from" line, glue records are added to the
+// referrals that contain the name server.
+func ParseDigTrace(r io.Reader) (*Fixture, error) {
+	var (
+		q       *dns.Question
+		block   []dns.RR
+		blocks  [][]dns.RR
+		servers []string
+		glue    = map[string][]net.IP{}
+	)
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "; <<>> DiG"):
+			parts := strings.SplitN(line, "<<>>", 3)
+			if len(parts) != 3 {
+				return nil, fmt.Errorf("line %d: malformed header", lineNo)
+			}
+			x, err := parseDigArgs(strings.Fields(parts[2]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			q = &x
+		case strings.HasPrefix(line, ";; Received"):
+			m := digReceivedRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("line %d: malformed line: %s", lineNo, line)
+			}
+			ip := net.ParseIP(m[1])
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: not an ip address: %s", lineNo, m[1])
+			}
+			if name := dns.CanonicalName(m[2]); net.ParseIP(m[2]) == nil && name != "." {
+				glue[name] = appendIP(glue[name], ip)
+			}
+
+			blocks = append(blocks, block)
+			servers = append(servers, ip.String())
+			block = nil
+		case strings.HasPrefix(line, ";"):
+		default:
+			rr, err := dns.NewRR(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			if rr != nil {
+				block = append(block, rr)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if q == nil {
+		return nil, fmt.Errorf("missing DiG header line")
+	}
+
+	f := &Fixture{}
+	for i, rrs := range blocks {
+		question := *q
+		if i == 0 {
+			question = dns.Question{Name: ".", Qtype: dns.TypeNS, Qclass: dns.ClassINET}
+		}
+
+		f.Exchanges = append(f.Exchanges, Exchange{
+			Server:   servers[i],
+			Response: digResponse(question, rrs, glue),
+		})
+	}
+
+	return f, nil
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, x := range ips {
+		if x.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
+
+// parseDigArgs extracts the query from the command line arguments of dig.
+func parseDigArgs(args []string) (dns.Question, error) {
+	q := dns.Question{
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		next := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing argument for %s", arg)
+			}
+			i++
+			return args[i], nil
+		}
+
+		switch {
+		case arg == "-t", arg == "-c", arg == "-q", arg == "-x":
+			v, err := next()
+			if err != nil {
+				return q, err
+			}
+			switch arg {
+			case "-t":
+				t, ok := dns.StringToType[strings.ToUpper(v)]
+				if !ok {
+					return q, fmt.Errorf("unsupported record type: %s", v)
+				}
+				q.Qtype = t
+			case "-c":
+				c, ok := dns.StringToClass[strings.ToUpper(v)]
+				if !ok {
+					return q, fmt.Errorf("unsupported class: %s", v)
+				}
+				q.Qclass = c
+			case "-q":
+				q.Name = v
+			case "-x":
+				arpa, err := dns.ReverseAddr(v)
+				if err != nil {
+					return q, err
+				}
+				q.Name = arpa
+				q.Qtype = dns.TypePTR
+			}
+		case strings.HasPrefix(arg, "+"), strings.HasPrefix(arg, "@"), strings.HasPrefix(arg, "-"):
+		default:
+			if t, ok := dns.StringToType[strings.ToUpper(arg)]; ok {
+				q.Qtype = t
+			} else if c, ok := dns.StringToClass[strings.ToUpper(arg)]; ok {
+				q.Qclass = c
+			} else if q.Name == "" {
+				q.Name = arg
+			} else {
+				return q, fmt.Errorf("unexpected argument: %s", arg)
+			}
+		}
+	}
+
+	if q.Name == "" {
+		q.Name = "."
+		q.Qtype = dns.TypeNS
+	}
+	q.Name = dns.CanonicalName(q.Name)
+
+	return q, nil
+}
+
+// digResponse reconstructs a response to q that contained rrs. See
+// ParseDigTrace.
+func digResponse(q dns.Question, rrs []dns.RR, glue map[string][]net.IP) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Question[0].Qclass = q.Qclass
+	m.Response = true
+
+	// Follow the CNAME chain starting at the query name.
+	answerNames := map[string]bool{q.Name: true}
+	for changed := true; changed; {
+		changed = false
+		for _, rr := range rrs {
+			cname, ok := rr.(*dns.CNAME)
+			if !ok || !answerNames[dns.CanonicalName(cname.Hdr.Name)] {
+				continue
+			}
+			if target := dns.CanonicalName(cname.Target); !answerNames[target] {
+				answerNames[target] = true
+				changed = true
+			}
+		}
+	}
+
+	isAnswer := func(rr dns.RR) bool {
+		hdr := rr.Header()
+		if !answerNames[dns.CanonicalName(hdr.Name)] {
+			return false
+		}
+
+		typ := hdr.Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			typ = sig.TypeCovered
+		}
+
+		return typ == q.Qtype || typ == dns.TypeCNAME || q.Qtype == dns.TypeANY
+	}
+
+	for _, rr := range rrs {
+		switch {
+		case isAnswer(rr):
+			m.Answer = append(m.Answer, rr)
+		default:
+			switch rr.Header().Rrtype {
+			case dns.TypeNS, dns.TypeSOA, dns.TypeDS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				m.Ns = append(m.Ns, rr)
+			case dns.TypeA, dns.TypeAAAA:
+				m.Extra = append(m.Extra, rr)
+			default:
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+
+	hasSOA := false
+	for _, rr := range m.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			hasSOA = true
+		}
+	}
+	m.Authoritative = len(m.Answer) > 0 || hasSOA
+
+	// Add glue for the name servers in NS records.
+	hasAddr := map[string]bool{}
+	for _, rr := range m.Extra {
+		hasAddr[dns.CanonicalName(rr.Header().Name)] = true
+	}
+	for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Ns...) {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name := dns.CanonicalName(ns.Ns)
+		if hasAddr[name] {
+			continue
+		}
+		hasAddr[name] = true
+
+		for _, ip := range glue[name] {
+			hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: ns.Hdr.Ttl}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				m.Extra = append(m.Extra, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				m.Extra = append(m.Extra, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	}
+
+	return m
+}
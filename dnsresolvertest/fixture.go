@@ -0,0 +1,163 @@
+package dnsresolvertest
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Exchange is a response that has been recorded from a real name server.
+type Exchange struct {
+	// Server is the IP address of the name server.
+	Server string
+
+	// Response is the response sent by the server. The question section
+	// identifies the query.
+	Response *dns.Msg
+}
+
+// Fixture is a list of recorded exchanges, typically created by
+// ParseDigTrace or ParsePcap.
+type Fixture struct {
+	Exchanges []Exchange
+}
+
+// Replay is a set of servers that replay the exchanges of a Fixture.
+type Replay struct {
+	// Bootstrap is the server that answers the "NS ." query of the fixture.
+	// Pass its IP address to dnsresolver.Resolver.SetBootstrapServers.
+	Bootstrap *Server
+
+	// Servers maps the IP addresses of the recorded name servers to the
+	// servers replaying their responses.
+	Servers map[string]*Server
+}
+
+// Replay starts a Server for each name server in f, listening on distinct
+// IPv4 loopback addresses (127.53.0.0/16) and the given port, and makes each
+// server answer the recorded queries with the recorded responses, any number
+// of times.
+//
+// Addresses of the recorded name servers in responses are replaced with the
+// addresses of the replaying servers; AAAA records of recorded name servers
+// are replaced by A records. Glue records of other name servers are removed
+// so that the resolver never contacts a real name server. Consequently, IPv6
+// should be disabled in the resolver, and the resolver must be configured to
+// use port as its default port.
+//
+// The test fails if f contains no response for "NS .", which is required for
+// bootstrapping.
+func (f *Fixture) Replay(t testing.TB, port int) *Replay {
+	var servers []string
+	localIPs := map[string]net.IP{}
+	for _, x := range f.Exchanges {
+		ip := net.ParseIP(x.Server)
+		if ip == nil {
+			t.Fatalf("invalid server address in fixture: %q", x.Server)
+		}
+		key := ip.String()
+		if _, ok := localIPs[key]; ok {
+			continue
+		}
+		n := len(servers) + 1
+		if n > 0xfffe {
+			t.Fatal("too many servers in fixture")
+		}
+		servers = append(servers, key)
+		localIPs[key] = net.IPv4(127, 53, byte(n>>8), byte(n))
+	}
+
+	replay := &Replay{
+		Servers: map[string]*Server{},
+	}
+
+	for _, ip := range servers {
+		addr := net.JoinHostPort(localIPs[ip].String(), fmt.Sprint(port))
+		replay.Servers[ip] = NewServer(t, addr)
+	}
+
+	for _, x := range f.Exchanges {
+		if len(x.Response.Question) != 1 {
+			continue
+		}
+
+		q := x.Response.Question[0]
+		srv := replay.Servers[net.ParseIP(x.Server).String()]
+
+		if q.Qtype == dns.TypeNS && q.Name == "." && replay.Bootstrap == nil {
+			replay.Bootstrap = srv
+		}
+
+		pattern := dns.TypeToString[q.Qtype] + " " + dns.CanonicalName(q.Name)
+		if q.Qclass != dns.ClassINET {
+			pattern = dns.ClassToString[q.Qclass] + " " + pattern
+		}
+
+		srv.ExpectQuery(pattern).AnyTimes().RespondWith(rewriteAddrs(x.Response, localIPs))
+	}
+
+	if replay.Bootstrap == nil {
+		t.Fatal("fixture contains no response for NS .")
+	}
+
+	return replay
+}
+
+// rewriteAddrs returns a copy of m, with the addresses of the name servers in
+// localIPs replaced by the corresponding local addresses, and glue records of
+// any other name servers removed.
+func rewriteAddrs(m *dns.Msg, localIPs map[string]net.IP) *dns.Msg {
+	m = m.Copy()
+
+	rewrite := func(rrs []dns.RR, glue bool) []dns.RR {
+		var out []dns.RR
+		seen := map[string]bool{}
+
+		for _, rr := range rrs {
+			switch x := rr.(type) {
+			case *dns.A:
+				if ip, ok := localIPs[x.A.String()]; ok {
+					x.A = ip
+				} else if glue {
+					continue
+				}
+			case *dns.AAAA:
+				ip, ok := localIPs[x.AAAA.String()]
+				if !ok {
+					if glue {
+						continue
+					}
+					break
+				}
+				if !glue {
+					continue
+				}
+				rr = &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   x.Hdr.Name,
+						Rrtype: dns.TypeA,
+						Class:  x.Hdr.Class,
+						Ttl:    x.Hdr.Ttl,
+					},
+					A: ip,
+				}
+			}
+
+			if seen[rr.String()] {
+				continue
+			}
+			seen[rr.String()] = true
+			out = append(out, rr)
+		}
+
+		return out
+	}
+
+	m.Answer = rewrite(m.Answer, false)
+	m.Ns = rewrite(m.Ns, false)
+	m.Extra = rewrite(m.Extra, true)
+
+	return m
+}
@@ -0,0 +1,199 @@
+package dnsresolvertest_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dnsresolver "github.com/classmarkets/go-dns-resolver"
+	"github.com/classmarkets/go-dns-resolver/dnsresolvertest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const digTrace = `
+; <<>> DiG 9.18.1 <<>> +trace www.example.com
+;; global options: +cmd
+.			518400	IN	NS	a.root-servers.net.
+.			518400	IN	NS	b.root-servers.net.
+;; Received 239 bytes from 127.0.0.53#53(127.0.0.53) in 0 ms
+
+com.			172800	IN	NS	a.gtld-servers.net.
+com.			172800	IN	NS	b.gtld-servers.net.
+com.			86400	IN	DS	30909 8 2 E2D3C916F6DEEAC73294E8268FB5885044A833FC5459588F4A9184CF C41A5766
+;; Received 1170 bytes from 198.51.100.1#53(a.root-servers.net) in 20 ms
+
+example.com.		172800	IN	NS	a.iana-servers.net.
+;; Received 635 bytes from 198.51.100.2#53(a.gtld-servers.net) in 30 ms
+
+www.example.com.	86400	IN	CNAME	web.example.com.
+web.example.com.	86400	IN	A	192.0.2.1
+;; Received 56 bytes from 198.51.100.3#53(a.iana-servers.net) in 20 ms
+`
+
+func TestParseDigTrace(t *testing.T) {
+	f, err := dnsresolvertest.ParseDigTrace(strings.NewReader(digTrace))
+	require.NoError(t, err)
+	require.Len(t, f.Exchanges, 4)
+
+	root := f.Exchanges[1]
+	assert.Equal(t, "198.51.100.1", root.Server)
+	assert.Equal(t, "www.example.com.", root.Response.Question[0].Name)
+	assert.False(t, root.Response.Authoritative)
+	assert.Len(t, root.Response.Answer, 0)
+	assert.Len(t, root.Response.Ns, 3)
+	if assert.Len(t, root.Response.Extra, 1) {
+		assert.Equal(t, "a.gtld-servers.net.\t172800\tIN\tA\t198.51.100.2", root.Response.Extra[0].String())
+	}
+
+	final := f.Exchanges[3]
+	assert.True(t, final.Response.Authoritative)
+	assert.Len(t, final.Response.Answer, 2)
+
+	r := dnsresolver.New()
+	r.SetDefaultPort(5354)
+	r.DisableIP6 = true
+
+	replay := f.Replay(t, 5354)
+	require.NoError(t, r.SetBootstrapServers(replay.Bootstrap.IP()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, replay.Servers["198.51.100.3"].IP()+":5354", rs.ServerAddr)
+}
+
+func TestParseDigTrace_Errors(t *testing.T) {
+	_, err := dnsresolvertest.ParseDigTrace(strings.NewReader("com. 300 IN NS a.gtld-servers.net.\n"))
+	assert.EqualError(t, err, "missing DiG header line")
+
+	_, err = dnsresolvertest.ParseDigTrace(strings.NewReader("; <<>> DiG 9.18.1 <<>> -t BOGUS example.com\n"))
+	assert.EqualError(t, err, "line 1: unsupported record type: BOGUS")
+}
+
+func TestParsePcap(t *testing.T) {
+	A, AAAA, NS := dnsresolvertest.A, dnsresolvertest.AAAA, dnsresolvertest.NS
+
+	response := func(name string, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		m := new(dns.Msg)
+		m.SetReply(q)
+		return m
+	}
+
+	bootstrap := response(".", dns.TypeNS)
+	bootstrap.Answer = []dns.RR{NS(t, ".", 300, "a.root-servers.net.")}
+	bootstrap.Extra = []dns.RR{A(t, "a.root-servers.net.", 300, "198.51.100.1")}
+
+	root := response("www.example.com.", dns.TypeA)
+	root.Ns = []dns.RR{
+		NS(t, "com.", 300, "a.gtld-servers.net."),
+		NS(t, "com.", 300, "b.gtld-servers.net."),
+	}
+	root.Extra = []dns.RR{
+		A(t, "a.gtld-servers.net.", 300, "198.51.100.2"),
+		AAAA(t, "a.gtld-servers.net.", 300, "2001:db8::2"),
+		A(t, "b.gtld-servers.net.", 300, "198.51.100.99"), // not captured
+	}
+
+	com := response("www.example.com.", dns.TypeA)
+	com.Authoritative = true
+	com.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.com.", dns.TypeA)
+
+	var buf bytes.Buffer
+	writePcapHeader(t, &buf)
+	writeUDPPacket(t, &buf, "192.0.2.200", 40000, "198.51.100.53", 53, query) // ignored
+	writeUDPPacket(t, &buf, "198.51.100.53", 53, "192.0.2.200", 40000, bootstrap)
+	writeUDPPacket(t, &buf, "198.51.100.1", 53, "192.0.2.200", 40000, root)
+	writeUDPPacket(t, &buf, "2001:db8::2", 53, "2001:db8::200", 40000, com)
+
+	f, err := dnsresolvertest.ParsePcap(&buf)
+	require.NoError(t, err)
+	require.Len(t, f.Exchanges, 3)
+	assert.Equal(t, "198.51.100.53", f.Exchanges[0].Server)
+	assert.Equal(t, "2001:db8::2", f.Exchanges[2].Server)
+
+	r := dnsresolver.New()
+	r.SetDefaultPort(5354)
+	r.DisableIP6 = true
+
+	replay := f.Replay(t, 5354)
+	require.NoError(t, r.SetBootstrapServers(replay.Bootstrap.IP()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, replay.Servers["2001:db8::2"].IP()+":5354", rs.ServerAddr)
+}
+
+func TestParsePcap_Errors(t *testing.T) {
+	_, err := dnsresolvertest.ParsePcap(strings.NewReader("\x0a\x0d\x0d\x0a\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	assert.EqualError(t, err, "pcap: unsupported file format")
+}
+
+// writePcapHeader writes the header of a little endian pcap file with raw IP
+// packets.
+func writePcapHeader(t *testing.T, buf *bytes.Buffer) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], 65535)
+	binary.LittleEndian.PutUint32(hdr[20:], 101) // LINKTYPE_RAW
+	buf.Write(hdr)
+}
+
+func writeUDPPacket(t *testing.T, buf *bytes.Buffer, src string, srcPort uint16, dst string, dstPort uint16, m *dns.Msg) {
+	payload, err := m.Pack()
+	require.NoError(t, err)
+
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	var ip []byte
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], srcIP.To4())
+		copy(ip[16:], dstIP.To4())
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+		ip[6] = 17
+		ip[7] = 64
+		copy(ip[8:], srcIP.To16())
+		copy(ip[24:], dstIP.To16())
+	}
+	packet := append(ip, udp...)
+
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(packet)))
+	buf.Write(rec)
+	buf.Write(packet)
+}
@@ -0,0 +1,166 @@
+package dnsresolvertest
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Link types of pcap files, see https://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+// ParsePcap reads a capture file in the classic pcap format, as written by
+// tcpdump -w, and returns all DNS responses that have been sent via UDP from
+// port 53. The pcapng format, TCP, and fragmented IP packets are not
+// supported. Packets that cannot be decoded are skipped.
+func ParsePcap(r io.Reader) (*Fixture, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("pcap: reading file header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch {
+	case isPcapMagic(binary.LittleEndian.Uint32(hdr)):
+		order = binary.LittleEndian
+	case isPcapMagic(binary.BigEndian.Uint32(hdr)):
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("pcap: unsupported file format")
+	}
+
+	linkType := order.Uint32(hdr[20:]) & 0x0fffffff
+
+	f := &Fixture{}
+	recHdr := make([]byte, 16)
+	for {
+		_, err := io.ReadFull(r, recHdr)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("pcap: reading packet header: %w", err)
+		}
+
+		n := order.Uint32(recHdr[8:])
+		if n > 1<<18 {
+			return nil, fmt.Errorf("pcap: packet too large: %d bytes", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("pcap: reading packet: %w", err)
+		}
+
+		src, payload, ok := udpFrom53(linkType, data)
+		if !ok {
+			continue
+		}
+
+		m := new(dns.Msg)
+		if err := m.Unpack(payload); err != nil || !m.Response || len(m.Question) != 1 {
+			continue
+		}
+
+		f.Exchanges = append(f.Exchanges, Exchange{
+			Server:   src.String(),
+			Response: m,
+		})
+	}
+
+	return f, nil
+}
+
+func isPcapMagic(x uint32) bool {
+	return x == 0xa1b2c3d4 || x == 0xa1b23c4d // micro- and nanosecond timestamps
+}
+
+// udpFrom53 decodes a captured frame and returns the source address and the
+// payload if the frame is a UDP datagram from port 53.
+func udpFrom53(linkType uint32, data []byte) (net.IP, []byte, bool) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeNull, linkTypeLoop:
+		data = skip(data, 4)
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		for etherType == 0x8100 && len(data) >= 4 { // 802.1Q VLAN tag
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		data = skip(data, 16)
+	case linkTypeSLL2:
+		data = skip(data, 20)
+	default:
+		return nil, nil, false
+	}
+
+	if len(data) == 0 {
+		return nil, nil, false
+	}
+
+	var (
+		src   net.IP
+		proto byte
+	)
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, nil, false
+		}
+		ihl := int(data[0]&0x0f) * 4
+		flagsAndOffset := binary.BigEndian.Uint16(data[6:])
+		if ihl < 20 || flagsAndOffset&0x3fff != 0 { // MF flag or fragment offset
+			return nil, nil, false
+		}
+		proto = data[9]
+		src = net.IP(append([]byte{}, data[12:16]...))
+		data = skip(data, ihl)
+	case 6:
+		if len(data) < 40 {
+			return nil, nil, false
+		}
+		proto = data[6]
+		src = net.IP(append([]byte{}, data[8:24]...))
+		data = data[40:]
+	default:
+		return nil, nil, false
+	}
+
+	if proto != 17 || len(data) < 8 { // UDP
+		return nil, nil, false
+	}
+	if binary.BigEndian.Uint16(data[0:]) != 53 {
+		return nil, nil, false
+	}
+
+	if n := int(binary.BigEndian.Uint16(data[4:])); n >= 8 && n <= len(data) {
+		data = data[:n] // strip link layer padding
+	}
+
+	return src, data[8:], true
+}
+
+func skip(data []byte, n int) []byte {
+	if len(data) < n {
+		return nil
+	}
+	return data[n:]
+}
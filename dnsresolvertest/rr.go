@@ -0,0 +1,123 @@
+package dnsresolvertest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// RR returns an empty resource record of the given type in the IN class. The
+// test fails if typ is not supported by the dns package.
+func RR(t testing.TB, typ uint16, name string, ttl uint32) dns.RR {
+	ctor, ok := dns.TypeToRR[typ]
+	if !ok {
+		t.Fatalf("invalid record type: %d", typ)
+	}
+
+	rr := ctor()
+	hdr := rr.Header()
+	hdr.Name = name
+	hdr.Class = dns.ClassINET
+	hdr.Rrtype = typ
+	hdr.Ttl = ttl
+
+	return rr
+}
+
+// A returns an A record. The test fails if ipStr is not an IPv4 address.
+func A(t testing.TB, name string, ttl uint32, ipStr string) *dns.A {
+	ip := net.ParseIP(ipStr)
+	if ip.To4() == nil {
+		t.Fatal("invalid ipv4: " + ipStr)
+	}
+
+	rr := RR(t, dns.TypeA, name, ttl).(*dns.A)
+	rr.A = ip
+
+	return rr
+}
+
+// AAAA returns an AAAA record. The test fails if ipStr is not an IP address.
+func AAAA(t testing.TB, name string, ttl uint32, ipStr string) *dns.AAAA {
+	ip := net.ParseIP(ipStr)
+	if ip.To16() == nil {
+		t.Fatal("invalid ipv6: " + ipStr)
+	}
+
+	rr := RR(t, dns.TypeAAAA, name, ttl).(*dns.AAAA)
+	rr.AAAA = ip
+
+	return rr
+}
+
+// NS returns an NS record.
+func NS(t testing.TB, name string, ttl uint32, target string) *dns.NS {
+	rr := RR(t, dns.TypeNS, name, ttl).(*dns.NS)
+	rr.Ns = target
+
+	return rr
+}
+
+// CNAME returns a CNAME record.
+func CNAME(t testing.TB, name string, ttl uint32, target string) *dns.CNAME {
+	rr := RR(t, dns.TypeCNAME, name, ttl).(*dns.CNAME)
+	rr.Target = target
+
+	return rr
+}
+
+// PTR returns a PTR record.
+func PTR(t testing.TB, name string, ttl uint32, ptr string) *dns.PTR {
+	rr := RR(t, dns.TypePTR, name, ttl).(*dns.PTR)
+	rr.Ptr = ptr
+
+	return rr
+}
+
+// MX returns an MX record.
+func MX(t testing.TB, name string, ttl uint32, pref uint16, host string) *dns.MX {
+	rr := RR(t, dns.TypeMX, name, ttl).(*dns.MX)
+	rr.Preference = pref
+	rr.Mx = host
+
+	return rr
+}
+
+// TXT returns a TXT record with one character string per element of txt.
+func TXT(t testing.TB, name string, ttl uint32, txt ...string) *dns.TXT {
+	rr := RR(t, dns.TypeTXT, name, ttl).(*dns.TXT)
+	rr.Txt = txt
+
+	return rr
+}
+
+// HINFO returns an HINFO record.
+func HINFO(t testing.TB, name string, ttl uint32, cpu, os string) *dns.HINFO {
+	rr := RR(t, dns.TypeHINFO, name, ttl).(*dns.HINFO)
+	rr.Cpu = cpu
+	rr.Os = os
+
+	return rr
+}
+
+// CAA returns a CAA record.
+func CAA(t testing.TB, name string, ttl uint32, flag uint8, tag, value string) *dns.CAA {
+	rr := RR(t, dns.TypeCAA, name, ttl).(*dns.CAA)
+	rr.Flag = flag
+	rr.Tag = tag
+	rr.Value = value
+
+	return rr
+}
+
+// SRV returns an SRV record.
+func SRV(t testing.TB, name string, ttl uint32, prio, weight, port uint16, target string) *dns.SRV {
+	rr := RR(t, dns.TypeSRV, name, ttl).(*dns.SRV)
+	rr.Priority = prio
+	rr.Weight = weight
+	rr.Port = port
+	rr.Target = target
+
+	return rr
+}
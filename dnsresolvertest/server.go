@@ -0,0 +1,624 @@
+// Package dnsresolvertest provides fake name servers for testing code that
+// uses the dnsresolver package.
+//
+// A Server listens on a local UDP address and answers queries according to
+// the expectations registered with ExpectQuery. By default, each expectation
+// is used for exactly one query (see Expectation.Times and
+// Expectation.AnyTimes), and queries that don't match any expectation (see
+// Server.OnUnexpectedQuery), as well as expectations that were not used up,
+// are reported as test failures.
+//
+// Because referrals contain only IP addresses, all servers of a test must
+// listen on the same port. Configure the resolver accordingly:
+//
+//	r := dnsresolver.New()
+//	r.SetDefaultPort(5354)
+//
+//	rootSrv := dnsresolvertest.NewRootServer(t, "127.0.0.250:5354")
+//	comSrv := dnsresolvertest.NewServer(t, "127.0.0.100:5354")
+//	expSrv := dnsresolvertest.NewServer(t, "127.0.0.101:5354")
+//
+//	r.SetBootstrapServers(rootSrv.IP())
+//
+//	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+//	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+//	expSrv.ExpectQuery("A www.example.com.").Respond().
+//		Answer(dnsresolvertest.A(t, "www.example.com.", 300, "192.0.2.1"))
+//
+//	rs, err := r.Query(ctx, "A", "www.example.com")
+//
+// Instead of writing expectations by hand, recorded real-world resolutions
+// can be replayed; see ParseDigTrace, ParsePcap, and Fixture.Replay.
+package dnsresolvertest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type handler interface {
+	ServeDNS(testing.TB, dns.ResponseWriter, *dns.Msg)
+}
+
+// Server is a fake name server. Servers are safe for concurrent use.
+type Server struct {
+	dns.Server
+
+	t            testing.TB
+	mu           sync.Mutex
+	expectations []*Expectation
+	unexpected   UnexpectedQueryPolicy
+	inShutdown   chan (struct{})
+}
+
+// UnexpectedQueryPolicy determines how a Server handles queries that don't
+// match any expectation.
+type UnexpectedQueryPolicy int
+
+const (
+	// FailUnexpected causes unexpected queries to be reported as test
+	// failures and answered with NOTIMP. This is the default.
+	FailUnexpected UnexpectedQueryPolicy = iota
+
+	// NXDOMAINUnexpected causes unexpected queries to be answered with an
+	// authoritative NXDOMAIN response, without failing the test.
+	NXDOMAINUnexpected
+)
+
+// NewServer starts a new Server that listens on the UDP address addr. The
+// server is stopped automatically when the test completes.
+func NewServer(t testing.TB, addr string) *Server {
+	srv := &Server{
+		t: t,
+	}
+
+	t.Logf("Starting name server on %s/udp", addr)
+	ln, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Server = dns.Server{
+		PacketConn: ln,
+		Handler:    srv,
+	}
+
+	srv.Start()
+
+	return srv
+}
+
+// NewRootServer is like NewServer, but the returned server expects one query
+// for "NS .", and responds with itself as the only root name server. Such a
+// server can be passed to dnsresolver.Resolver.SetBootstrapServers.
+func NewRootServer(t testing.TB, addr string) *Server {
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(t, addr)
+
+	srv.ExpectQuery("NS .").Respond().
+		Answer(
+			NS(t, ".", 321, "self.test."),
+		).
+		Additional(
+			A(t, "self.test.", 321, ip),
+		)
+
+	return srv
+}
+
+// Start starts serving queries. It is called by NewServer and must only be
+// called again after Stop.
+func (ts *Server) Start() {
+	ts.inShutdown = make(chan struct{})
+
+	ts.t.Cleanup(ts.Stop)
+
+	go func() {
+		err := ts.ActivateAndServe()
+		select {
+		case <-ts.inShutdown:
+		default:
+			if err != nil {
+				ts.t.Error(err)
+			}
+		}
+	}()
+}
+
+// Stop stops the server and reports any outstanding expectations as test
+// failures.
+func (ts *Server) Stop() {
+	select {
+	case <-ts.inShutdown:
+		return
+	default:
+	}
+
+	close(ts.inShutdown)
+	ts.Shutdown()
+	ts.AssertNoOutstandingExpectations(ts.t)
+}
+
+// OnUnexpectedQuery sets the policy for queries that don't match any
+// expectation.
+func (ts *Server) OnUnexpectedQuery(p UnexpectedQueryPolicy) *Server {
+	ts.mu.Lock()
+	ts.unexpected = p
+	ts.mu.Unlock()
+
+	return ts
+}
+
+// AssertNoOutstandingExpectations reports a test failure for each pattern
+// for which expected queries haven't been received yet. Expectations with
+// AnyTimes are never outstanding.
+func (ts *Server) AssertNoOutstandingExpectations(t testing.TB) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	var patterns []string
+	outstanding := map[string]int{}
+	for _, h := range ts.expectations {
+		if h.remaining <= 0 {
+			continue
+		}
+		if _, ok := outstanding[h.pattern]; !ok {
+			patterns = append(patterns, h.pattern)
+		}
+		outstanding[h.pattern] += h.remaining
+	}
+
+	for _, pattern := range patterns {
+		switch n := outstanding[pattern]; n {
+		case 1:
+			t.Errorf("Expected one more query for %s @%s", pattern, ts.PacketConn.LocalAddr())
+		default:
+			t.Errorf("Expected %d more query for %s @%s", n, pattern, ts.PacketConn.LocalAddr())
+		}
+	}
+}
+
+// IP returns the IP address the server listens on.
+func (ts *Server) IP() string {
+	addr := ts.PacketConn.LocalAddr().String()
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return ip
+}
+
+// Expectation is an expected query. Call either Respond or DelegateTo to
+// specify the response.
+type Expectation struct {
+	handler
+
+	// mu is the mutex of the server, which guards handler and remaining,
+	// as well as the configuration of the handler.
+	mu *sync.Mutex
+
+	pattern string
+	class   uint16
+	qtype   uint16 // zero matches any type
+	name    string // "*" matches any name, "*.example.com." any subdomain
+
+	// remaining is the number of queries this expectation still accepts,
+	// or -1 for any number.
+	remaining int
+}
+
+// ExpectQuery registers an expectation for one query that matches pattern.
+// The pattern consists of the record type and the fully qualified name, such
+// as "A www.example.com.". For classes other than IN, the class is prepended,
+// as in "CH TXT version.bind.".
+//
+// The type may be "*" to match any record type. The name may be "*" to match
+// any name, or start with "*." to match any name below the remaining suffix;
+// for instance, "*.example.com." matches "www.example.com." and
+// "a.b.example.com." but not "example.com.".
+//
+// Expectations without wildcards take precedence over expectations with
+// wildcards. Otherwise, multiple expectations matching the same query are
+// used in the order they have been registered.
+func (ts *Server) ExpectQuery(pattern string) *Expectation {
+	h := &Expectation{
+		mu:        &ts.mu,
+		pattern:   pattern,
+		class:     dns.ClassINET,
+		remaining: 1,
+	}
+
+	fields := strings.Fields(pattern)
+	if len(fields) == 3 {
+		class, ok := dns.StringToClass[fields[0]]
+		if !ok {
+			ts.t.Fatalf("invalid class in pattern %q", pattern)
+		}
+		h.class = class
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		ts.t.Fatalf("invalid pattern: %q", pattern)
+	}
+
+	if fields[0] != "*" {
+		qtype, ok := dns.StringToType[fields[0]]
+		if !ok {
+			ts.t.Fatalf("invalid type in pattern %q", pattern)
+		}
+		h.qtype = qtype
+	}
+
+	h.name = fields[1]
+	if h.name != "*" {
+		h.name = dns.CanonicalName(h.name)
+	}
+
+	ts.mu.Lock()
+	ts.expectations = append(ts.expectations, h)
+	ts.mu.Unlock()
+
+	return h
+}
+
+// Times causes the expectation to be used for exactly n queries instead of
+// one.
+func (h *Expectation) Times(n int) *Expectation {
+	h.mu.Lock()
+	h.remaining = n
+	h.mu.Unlock()
+
+	return h
+}
+
+// AnyTimes causes the expectation to be used for any number of queries,
+// including none.
+func (h *Expectation) AnyTimes() *Expectation {
+	h.mu.Lock()
+	h.remaining = -1
+	h.mu.Unlock()
+
+	return h
+}
+
+// setHandler sets the handler that responds to the expected query.
+func (h *Expectation) setHandler(x handler) {
+	h.mu.Lock()
+	h.handler = x
+	h.mu.Unlock()
+}
+
+func (h *Expectation) hasWildcard() bool {
+	return h.qtype == 0 || strings.HasPrefix(h.name, "*")
+}
+
+func (h *Expectation) matches(q dns.Question) bool {
+	if h.class != q.Qclass {
+		return false
+	}
+	if h.qtype != 0 && h.qtype != q.Qtype {
+		return false
+	}
+
+	name := dns.CanonicalName(q.Name)
+	switch {
+	case h.name == "*":
+		return true
+	case strings.HasPrefix(h.name, "*."):
+		suffix := h.name[2:]
+		return name != suffix && dns.IsSubDomain(suffix, name)
+	default:
+		return h.name == name
+	}
+}
+
+// match returns the expectation to use for q and consumes one use of it. The
+// second return value is false if there is no such expectation. ts.mu must be
+// locked by the caller.
+func (ts *Server) match(q dns.Question) (*Expectation, bool) {
+	var found *Expectation
+	for _, h := range ts.expectations {
+		if h.remaining == 0 || !h.matches(q) {
+			continue
+		}
+		if !h.hasWildcard() {
+			found = h
+			break
+		}
+		if found == nil {
+			found = h
+		}
+	}
+
+	if found == nil {
+		return nil, false
+	}
+	if found.remaining > 0 {
+		found.remaining--
+	}
+
+	return found, true
+}
+
+// ServeDNS implements dns.Handler.
+func (ts *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if !ts.validate(w, r) {
+		return
+	}
+
+	q := r.Question[0]
+
+	pattern := fmt.Sprintf("%s %s",
+		dns.TypeToString[q.Qtype], q.Name,
+	)
+	if q.Qclass != dns.ClassINET {
+		pattern = dns.ClassToString[q.Qclass] + " " + pattern
+	}
+
+	ts.mu.Lock()
+	h, ok := ts.match(q)
+	var x handler
+	if ok {
+		x = h.handler
+	}
+	policy := ts.unexpected
+	ts.mu.Unlock()
+
+	if !ok {
+		m := new(dns.Msg)
+
+		switch policy {
+		case NXDOMAINUnexpected:
+			ts.t.Logf("Unexpected query: %s @%s",
+				pattern, ts.PacketConn.LocalAddr())
+
+			m.SetRcode(r, dns.RcodeNameError)
+			m.Authoritative = true
+		default:
+			ts.t.Errorf("Unexpected query: %s @%s",
+				pattern, ts.PacketConn.LocalAddr())
+
+			m.SetRcode(r, dns.RcodeNotImplemented)
+		}
+
+		w.WriteMsg(m)
+
+		return
+	}
+
+	if x == nil {
+		ts.t.Errorf("No response specified for %s @%s",
+			pattern, ts.PacketConn.LocalAddr())
+
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+
+		return
+	}
+
+	x.ServeDNS(ts.t, w, r)
+}
+
+func (ts *Server) validate(w dns.ResponseWriter, r *dns.Msg) bool {
+	errCode := func(w dns.ResponseWriter, r *dns.Msg, code int) {
+		m := new(dns.Msg)
+		m.SetRcode(r, code)
+		w.WriteMsg(m)
+	}
+
+	switch r.Opcode {
+	case dns.OpcodeQuery:
+	default:
+		ts.t.Logf("opcode %v is not supported", r.Opcode)
+		errCode(w, r, dns.RcodeNotImplemented)
+		return false
+	}
+
+	if len(r.Question) == 0 {
+		ts.t.Logf("no question")
+		errCode(w, r, dns.RcodeFormatError)
+		return false
+	}
+
+	if len(r.Question) > 1 {
+		ts.t.Logf("multiple questions are not supported")
+		errCode(w, r, dns.RcodeNotImplemented)
+		return false
+	}
+
+	return true
+}
+
+// Response is an authoritative response to an expected query. Without
+// further configuration it is an empty NOERROR response.
+type Response struct {
+	mu         *sync.Mutex // the server's
+	code       int
+	nonAuth    bool
+	answer     []dns.RR
+	authority  []dns.RR
+	additional []dns.RR
+}
+
+// Respond causes the expected query to be answered with the returned
+// Response.
+func (h *Expectation) Respond() *Response {
+	x := &Response{mu: h.mu}
+	h.setHandler(x)
+
+	return x
+}
+
+// Status sets the response code, such as dns.RcodeNameError.
+func (h *Response) Status(code int) *Response {
+	h.mu.Lock()
+	h.code = code
+	h.mu.Unlock()
+
+	return h
+}
+
+// NonAuthoritative causes the response to be sent without the AA flag.
+func (h *Response) NonAuthoritative() *Response {
+	h.mu.Lock()
+	h.nonAuth = true
+	h.mu.Unlock()
+
+	return h
+}
+
+// Answer sets the records in the answer section. Records with a wildcard
+// owner name, such as "*.example.com.", are sent with the query name as
+// owner, which is convenient for expectations with wildcards.
+func (h *Response) Answer(rrs ...dns.RR) *Response {
+	h.mu.Lock()
+	h.answer = rrs
+	h.mu.Unlock()
+
+	return h
+}
+
+// Authority sets the records in the authority section.
+func (h *Response) Authority(rrs ...dns.RR) *Response {
+	h.mu.Lock()
+	h.authority = rrs
+	h.mu.Unlock()
+
+	return h
+}
+
+// Additional sets the records in the additional section.
+func (h *Response) Additional(rrs ...dns.RR) *Response {
+	h.mu.Lock()
+	h.additional = rrs
+	h.mu.Unlock()
+
+	return h
+}
+
+// ServeDNS writes the response.
+func (h *Response) ServeDNS(t testing.TB, w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+
+	h.mu.Lock()
+	m.SetRcode(r, h.code)
+	m.Authoritative = !h.nonAuth
+
+	for _, rr := range h.answer {
+		if strings.HasPrefix(rr.Header().Name, "*") {
+			rr = dns.Copy(rr)
+			rr.Header().Name = r.Question[0].Name
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	m.Ns = h.authority
+	m.Extra = h.additional
+	h.mu.Unlock()
+
+	w.WriteMsg(m)
+}
+
+// RespondWith causes the expected query to be answered with a copy of m. The
+// message ID and question section are taken from the query.
+func (h *Expectation) RespondWith(m *dns.Msg) {
+	h.setHandler(recordedHandler{m})
+}
+
+type recordedHandler struct {
+	m *dns.Msg
+}
+
+func (h recordedHandler) ServeDNS(t testing.TB, w dns.ResponseWriter, r *dns.Msg) {
+	m := h.m.Copy()
+	m.Id = r.Id
+	m.Response = true
+	m.Opcode = r.Opcode
+	m.Question = r.Question
+
+	w.WriteMsg(m)
+}
+
+// Delegation is a referral to the name servers of another zone.
+type Delegation struct {
+	mu            *sync.Mutex // the server's
+	zone          string
+	upstreamAddrs []string
+	viaAuthority  bool
+}
+
+// DelegateTo causes the expected query to be answered with a referral to the
+// given zone. Each element of addr is either the IP address of a name server,
+// in which case a name server name and a glue record are made up, or the name
+// of a name server, in which case no glue is included.
+//
+// By default, the NS records are sent in the answer section. Use
+// ViaAuthoritySection to send them in the authority section instead, as
+// most real-world name servers do.
+func (h *Expectation) DelegateTo(zone string, addr ...string) *Delegation {
+	if len(addr) == 0 {
+		panic("no addrs specified")
+	}
+
+	x := &Delegation{
+		mu:            h.mu,
+		zone:          dns.CanonicalName(zone),
+		upstreamAddrs: addr,
+	}
+
+	h.setHandler(x)
+
+	return x
+}
+
+// ViaAuthoritySection causes the NS records to be sent in the authority
+// section.
+func (h *Delegation) ViaAuthoritySection() *Delegation {
+	h.mu.Lock()
+	h.viaAuthority = true
+	h.mu.Unlock()
+	return h
+}
+
+// ServeDNS writes the referral.
+func (h *Delegation) ServeDNS(t testing.TB, w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeSuccess)
+	m.Authoritative = false
+
+	h.mu.Lock()
+	for i, addr := range h.upstreamAddrs {
+		name := fmt.Sprintf("ns%d.test.", i+1)
+		if ip := net.ParseIP(addr); ip != nil {
+			m.Answer = append(m.Answer,
+				NS(t, h.zone, 321, name),
+			)
+			if ip.To4() != nil {
+				m.Extra = append(m.Extra, A(t, name, 321, addr))
+			} else {
+				m.Extra = append(m.Extra, AAAA(t, name, 321, addr))
+			}
+		} else {
+			m.Answer = append(m.Answer,
+				NS(t, h.zone, 321, addr),
+			)
+		}
+	}
+
+	if h.viaAuthority {
+		m.Ns = m.Answer
+		m.Answer = nil
+	}
+	h.mu.Unlock()
+
+	w.WriteMsg(m)
+}
@@ -0,0 +1,138 @@
+package dnsresolvertest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dnsresolver "github.com/classmarkets/go-dns-resolver"
+	"github.com/classmarkets/go-dns-resolver/dnsresolvertest"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	r := dnsresolver.New()
+	r.SetDefaultPort(5354)
+
+	rootSrv := dnsresolvertest.NewRootServer(t, "127.0.1.250:5354")
+	comSrv := dnsresolvertest.NewServer(t, "127.0.1.100:5354")
+	expSrv := dnsresolvertest.NewServer(t, "127.0.1.101:5354")
+
+	assert.NoError(t, r.SetBootstrapServers(rootSrv.IP()))
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP()).ViaAuthoritySection()
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			dnsresolvertest.A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, "127.0.1.101:5354", rs.ServerAddr)
+}
+
+func TestServer_ExpectQuery_Wildcards(t *testing.T) {
+	r := dnsresolver.New()
+
+	srv := dnsresolvertest.NewServer(t, "127.0.1.100:5354")
+	srv.ExpectQuery("A *.example.com.").Times(2).Respond().
+		Answer(dnsresolvertest.A(t, "*.example.com.", 300, "192.0.2.2"))
+	srv.ExpectQuery("A www.example.com.").Respond().
+		Answer(dnsresolvertest.A(t, "www.example.com.", 300, "192.0.2.1"))
+	srv.ExpectQuery("* example.com.").AnyTimes().Respond().Status(dns.RcodeRefused)
+	srv.ExpectQuery("TXT *").Respond().
+		Answer(dnsresolvertest.TXT(t, "*.", 300, "hello"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	query := func(typ, name string) (dnsresolver.RecordSet, error) {
+		return r.QueryServer(ctx, srv.IP()+":5354", "IN", typ, name)
+	}
+
+	// The exact match takes precedence even though the wildcard has been
+	// registered first.
+	rs, err := query("A", "WWW.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	for _, name := range []string{"a.example.com", "a.b.example.com"} {
+		rs, err := query("A", name)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.2"}, rs.Values, name)
+	}
+
+	for _, typ := range []string{"A", "MX", "NS"} {
+		_, err := query(typ, "example.com")
+		assert.EqualError(t, err, typ+" example.com: REFUSED")
+	}
+
+	rs, err = query("TXT", "example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"hello"`}, rs.Values)
+}
+
+func TestServer_OnUnexpectedQuery(t *testing.T) {
+	r := dnsresolver.New()
+
+	srv := dnsresolvertest.NewServer(t, "127.0.1.100:5354").
+		OnUnexpectedQuery(dnsresolvertest.NXDOMAINUnexpected)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.QueryServer(ctx, srv.IP()+":5354", "IN", "A", "www.example.com")
+	assert.ErrorIs(t, err, dnsresolver.ErrNXDomain)
+	assert.True(t, rs.Raw.Authoritative)
+}
+
+func TestServer_ExpectQuery_Concurrent(t *testing.T) {
+	r := dnsresolver.New()
+
+	srv := dnsresolvertest.NewServer(t, "127.0.1.100:5354")
+	srv.ExpectQuery("A *.example.com.").AnyTimes().Respond().
+		Answer(
+			dnsresolvertest.A(t, "*.example.com.", 300, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			r.ClearCache()
+			_, err := r.QueryServer(ctx, srv.IP()+":5354", "IN", "A", "www.example.com")
+			assert.NoError(t, err)
+		}
+	}()
+
+	// Expectations may be configured while the server answers queries.
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		h := srv.ExpectQuery("A other.example.com.")
+		time.Sleep(time.Millisecond)
+		h.AnyTimes().Respond().Status(dns.RcodeNameError)
+
+		h = srv.ExpectQuery("NS example.com.")
+		time.Sleep(time.Millisecond)
+		h.AnyTimes().DelegateTo("example.com.", "127.0.1.101").ViaAuthoritySection()
+
+		h = srv.ExpectQuery("MX example.com.")
+		time.Sleep(time.Millisecond)
+		h.AnyTimes().RespondWith(new(dns.Msg))
+	}
+}
@@ -0,0 +1,368 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnstapContentType is the content type of Frame Streams that carry dnstap
+// messages.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame Streams control frame types and fields; see
+// https://farsightsec.github.io/fstrm/.
+const (
+	fstrmAccept = 0x01
+	fstrmStart  = 0x02
+	fstrmStop   = 0x03
+	fstrmReady  = 0x04
+	fstrmFinish = 0x05
+
+	fstrmContentType = 0x01
+)
+
+// dnstap message types; see dnstap.proto.
+const (
+	dnstapResolverQuery     = 3
+	dnstapResolverResponse  = 4
+	dnstapForwarderQuery    = 7
+	dnstapForwarderResponse = 8
+)
+
+// DnstapLogger writes a dnstap message (https://dnstap.info) for every query
+// that a Resolver sends to a name server and for every response it receives,
+// so that the resolver can be integrated with existing DNS observability
+// pipelines. Install DnstapLogger.Middleware with Resolver.Use.
+//
+// Queries are logged as RESOLVER_QUERY and responses as RESOLVER_RESPONSE
+// messages, or FORWARDER_QUERY and FORWARDER_RESPONSE messages if recursion
+// has been requested, for instance from the servers set with SetForwarders.
+// Queries that have been answered from the cache are not logged.
+//
+// DnstapLoggers are safe for concurrent use.
+type DnstapLogger struct {
+	// Identity and Version are included in every dnstap message, if set.
+	// They must not be changed after the first message has been written.
+	Identity string
+	Version  string
+
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer // may be nil
+	err    error     // the first write error; once set, nothing is written
+	closed bool
+
+	// bidirectional is true if w is a connection to a receiver that expects
+	// the handshake with READY and ACCEPT frames, and confirms the end of
+	// the stream with a FINISH frame.
+	bidirectional bool
+	r             io.Reader
+}
+
+// NewDnstapLogger returns a DnstapLogger that writes a unidirectional Frame
+// Stream to w, such as a file. If w is an io.Closer, Close closes w.
+func NewDnstapLogger(w io.Writer) (*DnstapLogger, error) {
+	l := &DnstapLogger{w: w}
+	if c, ok := w.(io.Closer); ok {
+		l.closer = c
+	}
+
+	if err := writeControlFrame(w, fstrmStart, dnstapContentType); err != nil {
+		return nil, fmt.Errorf("dnstap: %w", err)
+	}
+
+	return l, nil
+}
+
+// DialDnstap connects to the dnstap receiver listening at address on the
+// named network, typically "unix" or "tcp", and returns a DnstapLogger that
+// writes to it. The connection uses bidirectional Frame Streams, as expected
+// by receivers such as the dnstap command and most collectors.
+func DialDnstap(ctx context.Context, network, address string) (*DnstapLogger, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("dnstap: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := handshake(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dnstap: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &DnstapLogger{
+		w:             conn,
+		r:             conn,
+		closer:        conn,
+		bidirectional: true,
+	}, nil
+}
+
+// handshake sends a READY frame, waits for the ACCEPT frame, and sends the
+// START frame.
+func handshake(rw io.ReadWriter) error {
+	if err := writeControlFrame(rw, fstrmReady, dnstapContentType); err != nil {
+		return err
+	}
+
+	typ, err := readControlFrame(rw)
+	if err != nil {
+		return err
+	}
+	if typ != fstrmAccept {
+		return fmt.Errorf("unexpected control frame: %d", typ)
+	}
+
+	return writeControlFrame(rw, fstrmStart, dnstapContentType)
+}
+
+// Middleware logs the queries that pass through it and their responses.
+// Its signature is that of a Middleware:
+//
+//	tap, err := dnsresolver.NewDnstapLogger(f)
+//	...
+//	r.Use(tap.Middleware)
+func (l *DnstapLogger) Middleware(next Exchanger) Exchanger {
+	return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		qtype, rtype := dnstapResolverQuery, dnstapResolverResponse
+		if m.RecursionDesired {
+			qtype, rtype = dnstapForwarderQuery, dnstapForwarderResponse
+		}
+
+		queryTime := time.Now()
+		query, _ := m.Pack()
+		l.log(dnstapMessage{
+			typ:       qtype,
+			addr:      addr,
+			queryTime: queryTime,
+			query:     query,
+		})
+
+		resp, rtt, err := next.Exchange(ctx, m, addr)
+		if resp != nil {
+			wire, _ := resp.Pack()
+			l.log(dnstapMessage{
+				typ:          rtype,
+				addr:         addr,
+				queryTime:    queryTime,
+				query:        query,
+				responseTime: time.Now(),
+				response:     wire,
+			})
+		}
+
+		return resp, rtt, err
+	})
+}
+
+// Err returns the first error that has occurred while writing to the
+// underlying writer. Once an error has occurred, no more messages are
+// written.
+func (l *DnstapLogger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+// Close ends the Frame Stream and closes the underlying writer if it is an
+// io.Closer. Messages logged after Close are discarded. Close returns the
+// first error that has occurred while writing, if any.
+func (l *DnstapLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return l.err
+	}
+	l.closed = true
+
+	if l.err == nil {
+		l.err = writeControlFrame(l.w, fstrmStop, "")
+	}
+	if l.err == nil && l.bidirectional {
+		if typ, err := readControlFrame(l.r); err != nil {
+			l.err = err
+		} else if typ != fstrmFinish {
+			l.err = fmt.Errorf("unexpected control frame: %d", typ)
+		}
+	}
+	if l.closer != nil {
+		if err := l.closer.Close(); l.err == nil {
+			l.err = err
+		}
+	}
+
+	if l.err != nil {
+		l.err = fmt.Errorf("dnstap: %w", l.err)
+	}
+
+	return l.err
+}
+
+func (l *DnstapLogger) log(msg dnstapMessage) {
+	frame := msg.marshal(l.Identity, l.Version)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed || l.err != nil {
+		return
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	if _, err := l.w.Write(buf); err != nil {
+		l.err = err
+	}
+}
+
+// writeControlFrame writes a Frame Streams control frame of the given type,
+// with a content type field unless contentType is empty.
+func writeControlFrame(w io.Writer, typ uint32, contentType string) error {
+	frame := appendUint32(nil, typ)
+	if contentType != "" {
+		frame = appendUint32(frame, fstrmContentType)
+		frame = appendUint32(frame, uint32(len(contentType)))
+		frame = append(frame, contentType...)
+	}
+
+	// A control frame is escaped with a zero length.
+	buf := make([]byte, 8, 8+len(frame))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(frame)))
+	buf = append(buf, frame...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readControlFrame reads a Frame Streams control frame and returns its type.
+func readControlFrame(r io.Reader) (uint32, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(hdr[:4]) != 0 {
+		return 0, errors.New("expected control frame")
+	}
+
+	n := binary.BigEndian.Uint32(hdr[4:])
+	if n < 4 || n > 512 {
+		return 0, fmt.Errorf("malformed control frame: length %d", n)
+	}
+
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(frame[:4]), nil
+}
+
+// dnstapMessage is a dnstap Message; see dnstap.proto.
+type dnstapMessage struct {
+	typ          int
+	addr         string // the name server's ip:port pair
+	queryTime    time.Time
+	query        []byte
+	responseTime time.Time // zero for queries
+	response     []byte
+}
+
+// marshal returns the protobuf encoding of a Dnstap message that contains
+// msg.
+func (msg dnstapMessage) marshal(identity, version string) []byte {
+	var m protoBuf
+	m.varint(1, uint64(msg.typ))
+
+	if host, port, err := net.SplitHostPort(endpointHostPort(msg.addr)); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				m.varint(2, 1) // INET
+				ip = ip4
+			} else {
+				m.varint(2, 2) // INET6
+			}
+			m.bytes(5, ip)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err == nil {
+			m.varint(7, n)
+		}
+	}
+
+	m.varint(8, uint64(msg.queryTime.Unix()))
+	m.fixed32(9, uint32(msg.queryTime.Nanosecond()))
+	m.bytes(10, msg.query)
+	if !msg.responseTime.IsZero() {
+		m.varint(12, uint64(msg.responseTime.Unix()))
+		m.fixed32(13, uint32(msg.responseTime.Nanosecond()))
+		m.bytes(14, msg.response)
+	}
+
+	var d protoBuf
+	if identity != "" {
+		d.bytes(1, []byte(identity))
+	}
+	if version != "" {
+		d.bytes(2, []byte(version))
+	}
+	d.bytes(14, m)
+	d.varint(15, 1) // MESSAGE
+
+	return d
+}
+
+// protoBuf is a minimal protocol buffers encoder, which is all that is
+// needed to write dnstap messages.
+type protoBuf []byte
+
+func (b *protoBuf) tag(field, wireType int) {
+	b.uvarint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuf) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	*b = append(*b, buf[:n]...)
+}
+
+func (b *protoBuf) varint(field int, v uint64) {
+	b.tag(field, 0)
+	b.uvarint(v)
+}
+
+func (b *protoBuf) fixed32(field int, v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+
+	b.tag(field, 5)
+	*b = append(*b, buf[:]...)
+}
+
+func (b *protoBuf) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.uvarint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+
+	return append(b, buf[:]...)
+}
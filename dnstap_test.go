@@ -0,0 +1,202 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDnstapLogger(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+
+	var buf bytes.Buffer
+	tap, err := NewDnstapLogger(&buf)
+	require.NoError(t, err)
+	tap.Identity = "test"
+	r.Use(tap.Middleware)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err = r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, tap.Close())
+
+	typ, err := readControlFrame(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(fstrmStart), typ)
+
+	var got []string
+	for {
+		frame, control := readFrame(t, &buf)
+		if frame == nil {
+			assert.Equal(t, uint32(fstrmStop), control)
+			break
+		}
+		got = append(got, describeDnstap(t, frame))
+	}
+	assert.Equal(t, []string{
+		"test FORWARDER_QUERY . NS @127.0.0.250:5354",
+		"test FORWARDER_RESPONSE . NS @127.0.0.250:5354",
+		"test RESOLVER_QUERY www.example.com. A @127.0.0.250:5354",
+		"test RESOLVER_RESPONSE www.example.com. A @127.0.0.250:5354",
+	}, got)
+	assert.Zero(t, buf.Len())
+}
+
+func TestDialDnstap(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "dnstap.sock")
+	l, err := net.Listen("unix", addr)
+	require.NoError(t, err)
+	defer l.Close()
+
+	frames := make(chan int, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// READY, ACCEPT, START, data frames, STOP, FINISH
+		if typ, err := readControlFrame(conn); err != nil || typ != fstrmReady {
+			return
+		}
+		writeControlFrame(conn, fstrmAccept, dnstapContentType)
+		if typ, err := readControlFrame(conn); err != nil || typ != fstrmStart {
+			return
+		}
+		n := 0
+		for {
+			var length uint32
+			if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+				return
+			}
+			if length == 0 {
+				break // STOP
+			}
+			if _, err := io.CopyN(io.Discard, conn, int64(length)); err != nil {
+				return
+			}
+			n++
+		}
+		var stop [8]byte
+		if _, err := io.ReadFull(conn, stop[:]); err != nil {
+			return
+		}
+		writeControlFrame(conn, fstrmFinish, "")
+		frames <- n
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	tap, err := DialDnstap(ctx, "unix", addr)
+	require.NoError(t, err)
+
+	m := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	x := tap.Middleware(ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		return new(dns.Msg).SetReply(m), time.Millisecond, nil
+	}))
+	_, _, err = x.Exchange(ctx, m, "192.0.2.1:53")
+	assert.NoError(t, err)
+
+	assert.NoError(t, tap.Close())
+	assert.Equal(t, 2, <-frames)
+}
+
+// readFrame reads a Frame Streams frame and returns its content if it is a
+// data frame, or its type if it is a control frame.
+func readFrame(t *testing.T, r io.Reader) ([]byte, uint32) {
+	var n uint32
+	require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+	if n == 0 {
+		require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+		control := make([]byte, n)
+		_, err := io.ReadFull(r, control)
+		require.NoError(t, err)
+
+		return nil, binary.BigEndian.Uint32(control)
+	}
+
+	frame := make([]byte, n)
+	_, err := io.ReadFull(r, frame)
+	require.NoError(t, err)
+
+	return frame, 0
+}
+
+// describeDnstap decodes the dnstap message in frame and summarizes it as
+// "identity TYPE question @server".
+func describeDnstap(t *testing.T, frame []byte) string {
+	fields := decodeProto(t, frame)
+	msg := decodeProto(t, fields[14])
+
+	types := map[uint64]string{
+		dnstapResolverQuery:     "RESOLVER_QUERY",
+		dnstapResolverResponse:  "RESOLVER_RESPONSE",
+		dnstapForwarderQuery:    "FORWARDER_QUERY",
+		dnstapForwarderResponse: "FORWARDER_RESPONSE",
+	}
+	typ, _ := binary.Uvarint(msg[1])
+	port, _ := binary.Uvarint(msg[7])
+
+	wire := msg[10]
+	if resp, ok := msg[14]; ok {
+		wire = resp
+	}
+	var m dns.Msg
+	require.NoError(t, m.Unpack(wire))
+	q := m.Question[0]
+
+	return string(fields[1]) + " " + types[typ] + " " + q.Name + " " + dns.TypeToString[q.Qtype] +
+		" @" + net.JoinHostPort(net.IP(msg[5]).String(), strconv.FormatUint(port, 10))
+}
+
+// decodeProto decodes the fields of a protobuf message, which must not have
+// repeated fields. Varints are returned in their encoded form.
+func decodeProto(t *testing.T, b []byte) map[int][]byte {
+	fields := map[int][]byte{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		require.Greater(t, n, 0)
+		b = b[n:]
+
+		field := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			fields[field], b = b[:n], b[n:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			fields[field], b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			fields[field], b = b[:4], b[4:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+
+	return fields
+}
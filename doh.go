@@ -0,0 +1,139 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohContentType is the media type of DNS messages sent via HTTPS.
+const dohContentType = "application/dns-message"
+
+type tlsConfigKey struct{}
+
+// newHTTPTransport returns the HTTP transport that is used for DNS over
+// HTTPS. Connections are established with the TLS configuration of the
+// request context; see exchangeHTTPS.
+func newHTTPTransport() *http.Transport {
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cfg, _ := ctx.Value(tlsConfigKey{}).(*tls.Config)
+			d := &tls.Dialer{Config: cfg}
+			return d.DialContext(ctx, network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     30 * time.Second,
+	}
+}
+
+// tlsConfig returns the TLS configuration for the name server at addr.
+func (x *defaultExchanger) tlsConfig(addr string) *tls.Config {
+	serverName := x.serverNames[addr]
+
+	cfg := x.tls
+	if x.tlsFunc != nil {
+		if c := x.tlsFunc(addr, serverName); c != nil {
+			cfg = c
+		}
+	}
+	if cfg != nil {
+		cfg = cfg.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+
+	return cfg
+}
+
+// exchangeHTTPS sends m to the DNS over HTTPS server at addr, which is the
+// URL of the server, with a POST request (RFC 8484). If udpSize is not zero,
+// an EDNS0 OPT record is added as for UDP; it doesn't limit the size of the
+// response.
+func (x *defaultExchanger) exchangeHTTPS(ctx context.Context, m *dns.Msg, addr string, udpSize uint16) (*dns.Msg, time.Duration, error) {
+	if udpSize > 0 && m.IsEdns0() == nil {
+		m = m.Copy()
+		m.SetEdns0(udpSize, false)
+	}
+	x.stats.sent("https")
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	capture := wireCaptureFrom(ctx)
+	capture.setQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	if name := x.serverNames[addr]; name != "" {
+		req.Host = name
+	}
+
+	start := time.Now()
+	resp, wire, err := x.roundTrip(req, addr, dns.MaxMsgSize+1)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	if len(wire) > dns.MaxMsgSize {
+		return nil, rtt, fmt.Errorf("response too large")
+	}
+	capture.setResponse(wire)
+
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		return nil, rtt, err
+	}
+	if r.Id != m.Id {
+		return nil, rtt, dns.ErrId
+	}
+
+	return r, rtt, nil
+}
+
+// roundTrip sends req with the TLS configuration for the server at addr, and
+// returns the response and up to limit bytes of its body.
+func (x *defaultExchanger) roundTrip(req *http.Request, addr string, limit int64) (*http.Response, []byte, error) {
+	cfg := x.tlsConfig(addr)
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	req = req.WithContext(context.WithValue(req.Context(), tlsConfigKey{}, cfg))
+
+	transport := x.http
+	if transport == nil {
+		transport = newHTTPTransport()
+		defer transport.CloseIdleConnections()
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, body, nil
+}
@@ -0,0 +1,109 @@
+package dnsresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_EncryptedTransports(t *testing.T) {
+	answer := func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg).SetReply(req)
+		m.RecursionAvailable = true
+		m.Answer = []dns.RR{A(t, req.Question[0].Name, 300, "192.0.2.1")}
+		return m
+	}
+
+	// The certificate of httptest servers is valid for 127.0.0.1 and
+	// example.com. It is used for the DNS over TLS server as well.
+	var mu sync.Mutex
+	var paths []string
+	dohSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wire, _ := answer(req).Pack()
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(wire)
+	}))
+	dohSrv.EnableHTTP2 = true
+	dohSrv.StartTLS()
+	defer dohSrv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dotSrv := &dns.Server{
+		Listener: tls.NewListener(ln, dohSrv.TLS.Clone()),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			w.WriteMsg(answer(req))
+		}),
+	}
+	started := make(chan struct{})
+	dotSrv.NotifyStartedFunc = func() { close(started) }
+	go dotSrv.ActivateAndServe()
+	defer dotSrv.Shutdown()
+	<-started
+
+	roots := x509.NewCertPool()
+	roots.AddCert(dohSrv.Certificate())
+
+	testCases := []struct {
+		name      string
+		addr      string
+		tlsConfig *tls.Config
+		wantErr   bool
+	}{
+		{name: "tls", addr: "tls://" + ln.Addr().String(), tlsConfig: &tls.Config{RootCAs: roots}},
+		{name: "https", addr: dohSrv.URL, tlsConfig: &tls.Config{RootCAs: roots}},
+		{name: "https name", addr: dohSrv.URL + "/query", tlsConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"}},
+		{name: "untrusted", addr: "tls://" + ln.Addr().String(), wantErr: true},
+		{name: "wrong name", addr: dohSrv.URL, tlsConfig: &tls.Config{RootCAs: roots, ServerName: "example.net"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := New()
+			r.LogFunc = DebugLog(t)
+			r.TLSConfig = tc.tlsConfig
+			require.NoError(t, r.SetBootstrapServers(tc.addr))
+			require.NoError(t, r.SetForwarders(tc.addr))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			rs, err := r.Query(ctx, "A", "www.example.com")
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/dns-query", "/query"}, paths)
+}
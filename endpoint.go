@@ -0,0 +1,98 @@
+package dnsresolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Schemes of the addresses of name servers that are queried via DNS over TLS
+// (RFC 7858) and DNS over HTTPS (RFC 8484), respectively.
+const (
+	tlsScheme   = "tls://"
+	httpsScheme = "https://"
+)
+
+// Default port for DNS over TLS and default path for DNS over HTTPS.
+const (
+	dotPort = "853"
+	dohPath = "/dns-query"
+)
+
+// normalizeAddr returns the canonical forms of a name server address as
+// accepted by SetBootstrapServers. Host names are resolved with the
+// operating system's resolver, which may result in several addresses. For
+// TLS and HTTPS addresses with a host name, serverName is the name that the
+// server's certificate is verified against.
+func normalizeAddr(addr, defaultPort string) (addrs []string, serverName string, err error) {
+	if unixAddr, ok := normalizeUnixAddr(addr); ok {
+		return []string{unixAddr}, "", nil
+	}
+
+	scheme, hostport, path := "", addr, ""
+	switch {
+	case strings.HasPrefix(addr, tlsScheme):
+		scheme, hostport, defaultPort = tlsScheme, strings.TrimPrefix(addr, tlsScheme), dotPort
+	case strings.HasPrefix(addr, httpsScheme):
+		u, err := url.Parse(addr)
+		if err != nil || u.Host == "" || u.User != nil {
+			return nil, "", errors.New("not a valid URL: " + addr)
+		}
+		scheme, hostport, path, defaultPort = httpsScheme, u.Host, u.EscapedPath(), "443"
+		if path == "" || path == "/" {
+			path = dohPath
+		}
+	case strings.Contains(addr, "://"):
+		return nil, "", errors.New("unsupported scheme: " + addr)
+	}
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	if port == "" {
+		port = defaultPort
+	}
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.Contains(host, ":") {
+			return nil, "", errors.New("not an ip address or host name: " + addr)
+		}
+		ips, err = net.LookupHost(host)
+		if err != nil {
+			return nil, "", fmt.Errorf("resolving %s: %w", addr, err)
+		}
+		serverName = strings.TrimSuffix(host, ".")
+	}
+
+	for _, ip := range ips {
+		addrs = append(addrs, scheme+net.JoinHostPort(ip, port)+path)
+	}
+	if scheme == "" {
+		serverName = ""
+	}
+
+	return addrs, serverName, nil
+}
+
+// endpointHostPort returns the ip:port pair of a name server address with
+// the tls:// or https:// scheme, and addr itself otherwise.
+func endpointHostPort(addr string) string {
+	switch {
+	case strings.HasPrefix(addr, tlsScheme):
+		return strings.TrimPrefix(addr, tlsScheme)
+	case strings.HasPrefix(addr, httpsScheme):
+		hostport := strings.TrimPrefix(addr, httpsScheme)
+		if i := strings.IndexByte(hostport, '/'); i >= 0 {
+			hostport = hostport[:i]
+		}
+		return hostport
+	default:
+		return addr
+	}
+}
@@ -0,0 +1,42 @@
+package dnsresolver
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// probeEmptyNonTerminal reports whether the name in rs, for which the server
+// at addr has sent a NODATA response, is an empty non-terminal. Unless the
+// response proves it either way with NSEC or NSEC3 records, the name is
+// queried at addr again, this time for records of any type. A NODATA response
+// to that query means that the name doesn't own any records, even though it
+// exists, so there must be names below it.
+func (r *resolver) probeEmptyNonTerminal(ctx context.Context, rs RecordSet, addr string) bool {
+	if !rs.NoData || rs.EmptyNonTerminal {
+		return rs.EmptyNonTerminal
+	}
+
+	q := rs.Raw.Question[0]
+	if q.Qtype == dns.TypeANY {
+		return false
+	}
+	if soa := noDataSOA(&rs.Raw); dns.CanonicalName(soa.Hdr.Name) == dns.CanonicalName(q.Name) {
+		return false // zone apexes always own records
+	}
+	for _, rr := range rs.Raw.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+			return false
+		}
+	}
+
+	probe := dns.Question{
+		Name:   q.Name,
+		Qtype:  dns.TypeANY,
+		Qclass: q.Qclass,
+	}
+	resp, _, _, err := r.doQuery(ctx, probe, addr, rs.Trace)
+
+	return err == nil && isEmptyNonTerminal(resp)
+}
@@ -1,7 +1,13 @@
 package dnsresolver
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 // ErrNXDomain is returned by Resolver.Query if the final response of a query
@@ -12,4 +18,264 @@ var ErrNXDomain = errors.New("NXDOMAIN response")
 // ErrCircular is returned by Resolver.Query if CNAME records or name servers
 // refer to one another. ErrCircular may be wrapped and must be tested for with
 // errors.Is.
+//
+// Use ErrCircularDelegation and ErrCircularCNAME to distinguish between the
+// two cases.
 var ErrCircular = errors.New("circular reference")
+
+// ErrCircularDelegation is returned by Resolver.Query if the name servers of
+// a zone can only be resolved by asking those very name servers, directly or
+// indirectly. ErrCircularDelegation wraps ErrCircular, may be wrapped itself
+// and must be tested for with errors.Is.
+var ErrCircularDelegation = fmt.Errorf("%w: delegation loop", ErrCircular)
+
+// ErrCircularCNAME is returned by Resolver.Query if CNAME records refer to one
+// another. ErrCircularCNAME wraps ErrCircular, may be wrapped itself and must
+// be tested for with errors.Is.
+var ErrCircularCNAME = fmt.Errorf("%w: CNAME loop", ErrCircular)
+
+// CycleError is returned by Resolver.Query if a cycle has been detected. Use
+// errors.As to access the names that make up the cycle.
+type CycleError struct {
+	// Kind is either ErrCircularDelegation or ErrCircularCNAME.
+	Kind error
+
+	// Chain contains the fully qualified names that have been resolved, in
+	// order, until a name repeated itself. If the repetition is a name that
+	// appears earlier in the chain, Chain starts and ends with that name.
+	Chain []string
+}
+
+func (e *CycleError) Error() string {
+	return e.Kind.Error() + ": " + strings.Join(e.Chain, " -> ")
+}
+
+func (e *CycleError) Unwrap() error {
+	return e.Kind
+}
+
+// ErrCNAMEChainTooLong is returned by Resolver.Query if more CNAME records
+// than Resolver.MaxCNAMEChain would have to be followed to resolve a name.
+// ErrCNAMEChainTooLong may be wrapped and must be tested for with errors.Is.
+var ErrCNAMEChainTooLong = errors.New("CNAME chain too long")
+
+// CNAMEChainError is returned by Resolver.Query if a chain of CNAME records
+// exceeds Resolver.MaxCNAMEChain. Use errors.As to access the names that make
+// up the chain.
+type CNAMEChainError struct {
+	// Chain contains the fully qualified names of the chain, in order,
+	// starting with the first alias and ending with the target that has not
+	// been followed anymore.
+	Chain []string
+}
+
+func (e *CNAMEChainError) Error() string {
+	return ErrCNAMEChainTooLong.Error() + ": " + strings.Join(e.Chain, " -> ")
+}
+
+func (e *CNAMEChainError) Unwrap() error {
+	return ErrCNAMEChainTooLong
+}
+
+// BudgetError is returned by Resolver.Query if resolving the addresses of name
+// servers that have been delegated to without glue records has used up its
+// share of the time until the deadline of the query's context. The addresses
+// of each name server but the last may take no more than an equal share of
+// the remaining time, so that one slow name server doesn't prevent the others
+// from being tried. BudgetError wraps context.DeadlineExceeded.
+type BudgetError struct {
+	// Names are the fully qualified names of the name servers whose
+	// addresses couldn't be resolved in time, in the order they have been
+	// tried.
+	Names []string
+
+	// Budget is the share of the time that the last name has been given.
+	Budget time.Duration
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("time budget of %v exhausted resolving name servers %s: %v",
+		e.Budget.Round(time.Millisecond), strings.Join(e.Names, ", "), context.DeadlineExceeded)
+}
+
+func (e *BudgetError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// ErrLocalName is returned by Resolver.Query for names in the .local domain if
+// Resolver.LocalPolicy is LocalReject. ErrLocalName may be wrapped and must be
+// tested for with errors.Is.
+var ErrLocalName = errors.New("multicast DNS name")
+
+// LocalNameError is returned by Resolver.Query for names in the .local domain
+// if Resolver.LocalPolicy is LocalReject. Such names are resolved via
+// multicast DNS (RFC 6762), not via the global DNS.
+type LocalNameError struct {
+	// Name is the fully qualified name that has been queried.
+	Name string
+}
+
+func (e *LocalNameError) Error() string {
+	return ErrLocalName.Error() + ": " + e.Name + " is reserved for multicast DNS (RFC 6762)"
+}
+
+func (e *LocalNameError) Unwrap() error {
+	return ErrLocalName
+}
+
+// ErrLameDelegation is reported if a name server that has been delegated to
+// responds non-authoritatively without referring to a more specific zone.
+// Resolver.Query moves on to the next name server in that case and records
+// the condition in the trace and in RecordSet.Warnings. If no other server
+// responds, the error returned by Resolver.Query wraps ErrLameDelegation.
+// ErrLameDelegation may be wrapped and must be tested for with errors.Is.
+var ErrLameDelegation = errors.New("lame delegation")
+
+// ErrUnreachable, ErrMissingGlue, ErrInconsistentGlue, and ErrInconsistentNS
+// are reported by Resolver.CheckDelegation if a name server of a zone doesn't
+// respond, if the referral to a zone doesn't include the addresses of name
+// servers within the zone, if these addresses differ from those in the zone
+// itself, and if the NS records in the parent zone differ from those in the
+// zone itself, respectively. They may be wrapped and must be tested for with
+// errors.Is.
+var (
+	ErrUnreachable      = errors.New("name server unreachable")
+	ErrMissingGlue      = errors.New("missing glue")
+	ErrInconsistentGlue = errors.New("inconsistent glue")
+	ErrInconsistentNS   = errors.New("inconsistent NS records")
+)
+
+// ErrNoNSEC is returned by Resolver.WalkZone if a name server doesn't
+// respond with an NSEC record for a name in the zone, which means that the
+// zone can't be walked. ErrNoNSEC may be wrapped and must be tested for with
+// errors.Is.
+var ErrNoNSEC = errors.New("no NSEC record")
+
+// ErrMalformedResponse is returned by Resolver.Query if
+// Resolver.StrictResponses is true and no name server has responded with a
+// well-formed response. ErrMalformedResponse may be wrapped and must be tested
+// for with errors.Is.
+var ErrMalformedResponse = errors.New("malformed response")
+
+// MalformedResponseError describes why a response has been rejected because
+// Resolver.StrictResponses is true. MalformedResponseError wraps
+// ErrMalformedResponse. Use errors.As to access the offending record.
+type MalformedResponseError struct {
+	// Server is the address of the name server that has sent the response.
+	Server string
+
+	// Section is the section of the response that contains the offending
+	// record: "QUESTION", "ANSWER", "AUTHORITY", or "ADDITIONAL".
+	Section string
+
+	// Record is the offending record. It is nil if the QUESTION section is
+	// malformed.
+	Record dns.RR
+
+	// Reason describes what is wrong with the record.
+	Reason string
+}
+
+func (e *MalformedResponseError) Error() string {
+	s := ErrMalformedResponse.Error() + " from " + e.Server + ": " + e.Section
+	if e.Record != nil {
+		s += ": " + strings.ReplaceAll(e.Record.String(), "\t", " ")
+	}
+
+	return s + ": " + e.Reason
+}
+
+func (e *MalformedResponseError) Unwrap() error {
+	return ErrMalformedResponse
+}
+
+// ServersExhaustedError is returned by Resolver.Query if none of the name
+// servers of a zone, or none of the forwarders, has responded usefully. It
+// reports why each server has failed. errors.Is and errors.As consider all of
+// these errors, so that errors.Is(err, os.ErrDeadlineExceeded), for
+// instance, reports whether any of the servers has timed out. If all servers
+// have responded with REFUSED or NOTIMP, the error matches ErrRefused as
+// well.
+type ServersExhaustedError struct {
+	// Zone is the fully qualified name of the zone whose name servers have
+	// been queried. It is empty for forwarders.
+	Zone string
+
+	// Errors contains the reason why each server has failed, in the order
+	// in which the servers have been queried. Each error mentions the
+	// address of the server.
+	Errors []error
+
+	// refused is true if all servers have refused to answer.
+	refused bool
+}
+
+func (e *ServersExhaustedError) Error() string {
+	if len(e.Errors) == 0 {
+		return "servers exhausted: no servers"
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+
+	msg := "servers exhausted: "
+	if e.refused {
+		msg += ErrRefused.Error() + ": "
+	}
+
+	return msg + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of e.Errors matches target, or whether target is
+// ErrRefused and all servers have refused to answer.
+func (e *ServersExhaustedError) Is(target error) bool {
+	if target == ErrRefused && e.refused {
+		return true
+	}
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first error in e.Errors that matches target.
+func (e *ServersExhaustedError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrRefused is returned by Resolver.Query if all name servers of a zone, or
+// all forwarders, have responded with REFUSED or NOTIMP. This usually means
+// that the resolver is not permitted to query them, for instance because of
+// an access control list, or that they are misconfigured, rather than that
+// the name doesn't exist. ErrRefused may be wrapped and must be tested for
+// with errors.Is.
+var ErrRefused = errors.New("refused by all servers")
+
+// ErrPolicyDrop is returned by Resolver.Query if the ResponsePolicy has
+// dropped the answer; see PolicyDrop. ErrPolicyDrop may be wrapped and must
+// be tested for with errors.Is.
+var ErrPolicyDrop = errors.New("dropped by response policy")
+
+// ErrServerBusy is reported in the Trace for queries that haven't been sent
+// to a name server because the maximum number of queries to that server are
+// already in flight; see Resolver.SetMaxExchangesPerServer. The next server
+// is tried instead. ErrServerBusy may be wrapped and must be tested for with
+// errors.Is.
+var ErrServerBusy = errors.New("too many queries in flight to name server")
+
+// ErrMinimalANY is added to RecordSet.Warnings if a name server responds to an
+// ANY query with a synthesized HINFO record instead of the actual records, as
+// described in RFC 8482. This means that the records of interest must be
+// queried for by type.
+var ErrMinimalANY = errors.New("minimal ANY response (RFC 8482)")
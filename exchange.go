@@ -0,0 +1,620 @@
+package dnsresolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Exchanger sends a single DNS query to the name server at addr, an ip:port
+// pair or an address with a scheme as described for SetBootstrapServers, such
+// as tls://192.0.2.53:853, and returns the response and the round-trip time. See
+// Resolver.Transport.
+//
+// Exchangers must be safe for concurrent use. They must not modify m and
+// should respect the deadline of ctx, which is set according to the
+// TimeoutPolicy of the Resolver.
+type Exchanger interface {
+	Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error)
+}
+
+// ExchangerFunc is an adapter to allow the use of ordinary functions as
+// Exchangers.
+type ExchangerFunc func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error)
+
+// Exchange calls f(ctx, m, addr).
+func (f ExchangerFunc) Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return f(ctx, m, addr)
+}
+
+// Middleware wraps an Exchanger to observe or alter the queries sent to name
+// servers and their responses. A Middleware typically returns an Exchanger
+// that does some work before and/or after calling next, and may also answer
+// queries itself without calling next at all, for instance to block certain
+// names:
+//
+//	blockList := func(next dnsresolver.Exchanger) dnsresolver.Exchanger {
+//		return dnsresolver.ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+//			if blocked(m.Question[0].Name) {
+//				return new(dns.Msg).SetRcode(m, dns.RcodeNameError), 0, nil
+//			}
+//			return next.Exchange(ctx, m, addr)
+//		})
+//	}
+//
+// Middleware must not modify m; use m.Copy() if necessary.
+type Middleware func(next Exchanger) Exchanger
+
+// Use adds middleware to the chain around each exchange with a name server.
+// The middleware added first is the outermost, i.e. it sees queries first and
+// responses last.
+//
+// Middleware only sees queries that are actually sent, not those answered
+// from the cache, and runs inside the TimeoutPolicy.
+//
+// Use may be called concurrently with Query; the middleware applies to
+// queries that start afterwards.
+func (R *Resolver) Use(middleware ...Middleware) {
+	R.updateConfig(func(c *config) {
+		c.middleware = append(append([]Middleware{}, c.middleware...), middleware...)
+	})
+}
+
+// SetMaxConcurrentExchanges limits the number of queries that are sent to
+// name servers simultaneously, across all calls of Query, to n. Further
+// queries wait until one of the others completes, or their context is done.
+// Bulk users should set a limit to avoid opening thousands of sockets at
+// once, which may overwhelm connection tracking in the local network or the
+// name servers. Waiting doesn't count against the TimeoutPolicy. If n is
+// zero or negative, which is the default, the number isn't limited.
+//
+// Queries that have already started, and clones of R that are created
+// afterwards, share the limit until SetMaxConcurrentExchanges is called
+// again.
+func (R *Resolver) SetMaxConcurrentExchanges(n int) {
+	var slots chan struct{}
+	if n > 0 {
+		slots = make(chan struct{}, n)
+	}
+
+	R.updateConfig(func(c *config) {
+		c.exchangeSlots = slots
+	})
+}
+
+// SetMaxExchangesPerServer limits the number of queries that are sent to any
+// single name server simultaneously to n, which protects small
+// authoritative servers and avoids triggering response rate limiting. If
+// failFast is false, further queries to the server wait until one of the
+// others completes, or their context is done. If failFast is true, they
+// fail immediately with ErrServerBusy instead, so that Query tries the
+// next name server of the zone, if any. Waiting doesn't count against the
+// TimeoutPolicy. If n is zero or negative, which is the default, the number
+// isn't limited.
+//
+// The limit applies in addition to that of SetMaxConcurrentExchanges, and
+// is shared in the same way.
+func (R *Resolver) SetMaxExchangesPerServer(n int, failFast bool) {
+	var slots *serverSlots
+	if n > 0 {
+		slots = &serverSlots{
+			max:      n,
+			failFast: failFast,
+			servers:  map[string]*serverSlot{},
+		}
+	}
+
+	R.updateConfig(func(c *config) {
+		c.serverSlots = slots
+	})
+}
+
+// serverSlots limits the number of concurrent exchanges with each name
+// server.
+type serverSlots struct {
+	max      int
+	failFast bool
+
+	mu      sync.Mutex
+	servers map[string]*serverSlot
+}
+
+// serverSlot limits the exchanges with a single server to the capacity of
+// ch. It is removed from serverSlots when there are no more exchanges that
+// are in flight or waiting, which refs counts.
+type serverSlot struct {
+	ch   chan struct{}
+	refs int
+}
+
+// acquire waits until fewer than the maximum number of queries are being
+// sent to addr, and returns a function that must be called when the
+// exchange is complete. acquire is safe to call on a nil *serverSlots.
+func (s *serverSlots) acquire(ctx context.Context, addr string) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	s.mu.Lock()
+	slot := s.servers[addr]
+	if slot == nil {
+		slot = &serverSlot{ch: make(chan struct{}, s.max)}
+		s.servers[addr] = slot
+	}
+	slot.refs++
+	s.mu.Unlock()
+
+	unref := func() {
+		s.mu.Lock()
+		slot.refs--
+		if slot.refs == 0 {
+			delete(s.servers, addr)
+		}
+		s.mu.Unlock()
+	}
+
+	if s.failFast {
+		select {
+		case slot.ch <- struct{}{}:
+		default:
+			unref()
+			return nil, fmt.Errorf("%w: %s", ErrServerBusy, addr)
+		}
+	} else {
+		select {
+		case slot.ch <- struct{}{}:
+		case <-ctx.Done():
+			unref()
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() {
+		<-slot.ch
+		unref()
+	}, nil
+}
+
+// acquireExchangeSlot waits until fewer than the maximum number of queries
+// are being sent to addr and in total, if limited, and returns a function
+// that must be called when the exchange is complete.
+func (r *resolver) acquireExchangeSlot(ctx context.Context, addr string) (release func(), err error) {
+	releaseServer, err := r.serverSlots.acquire(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if r.exchangeSlots == nil {
+		return releaseServer, nil
+	}
+
+	select {
+	case r.exchangeSlots <- struct{}{}:
+		return func() {
+			<-r.exchangeSlots
+			releaseServer()
+		}, nil
+	case <-ctx.Done():
+		releaseServer()
+		return nil, ctx.Err()
+	}
+}
+
+// ednsUDPSize is the UDP payload size advertised with EDNS0 by default; see
+// https://www.dnsflagday.net/2020/. Servers that don't respond to queries
+// with this size are queried with minUDPSize instead.
+const (
+	ednsUDPSize = 1232
+	minUDPSize  = dns.MinMsgSize
+)
+
+// udpFailuresBeforeTCP is the number of consecutive failed UDP exchanges
+// with a server after which TCP is tried.
+const udpFailuresBeforeTCP = 2
+
+// maxServerModes limits the number of servers whose mode is remembered by
+// defaultExchanger.
+const maxServerModes = 10_000
+
+// defaultExchanger is the Exchanger that is used if Resolver.Transport is
+// nil. It sends queries via UDP with EDNS0, and works around servers that
+// mishandle either of them:
+//
+//   - truncated responses and BADCOOKIE responses are retried over TCP,
+//   - FORMERR responses to queries with EDNS0 are retried without EDNS0,
+//   - if queries with a UDP payload size above 1232 bytes fail, which is
+//     typical for paths that drop IP fragments, the size is reduced to 1232
+//     bytes, and after further failures to 512 bytes,
+//   - after repeated failures via UDP, queries are retried over TCP.
+//
+// What works for each server is remembered for subsequent queries.
+type defaultExchanger struct {
+	*serverModes
+
+	// retransmit is the time after which UDP queries are sent again if no
+	// response has arrived, doubling with each retransmission. If zero,
+	// UDP queries are sent only once.
+	retransmit time.Duration
+
+	// udpSize is the UDP payload size that is advertised with EDNS0 unless
+	// a server requires a smaller size. If zero, ednsUDPSize is used.
+	udpSize uint16
+
+	// retryRefused causes queries that have been refused via UDP to be
+	// sent again via TCP; see RefusalPolicy.RetryTCP.
+	retryRefused bool
+
+	// tls, tlsFunc, serverNames, and http are used for name servers that
+	// are queried via TLS or HTTPS. tlsFunc and http may be nil.
+	tls         *tls.Config
+	tlsFunc     func(addr, serverName string) *tls.Config
+	serverNames map[string]string
+	http        *http.Transport
+
+	// odohProxy is the URL of the Oblivious DoH proxy through which name
+	// servers with the https:// scheme are queried, if not empty.
+	// odohConfigs caches the public keys of the targets.
+	odohProxy   string
+	odohConfigs *odohConfigs
+
+	// conns keeps TCP and TLS connections open for reuse. If nil,
+	// connections are closed after each exchange.
+	conns *tcpConns
+
+	stats *stats // may be nil
+}
+
+// serverModes remembers the serverMode of each server. It is shared by all
+// defaultExchangers of a Resolver.
+type serverModes struct {
+	mu      sync.Mutex
+	servers map[string]serverMode
+}
+
+// serverMode is what defaultExchanger knows about a particular server.
+type serverMode struct {
+	noEDNS      bool   // the server doesn't support EDNS0
+	tcp         bool   // the server only works via TCP
+	udpFailures int    // the number of consecutive failed UDP exchanges
+	udpSize     uint16 // the reduced EDNS0 UDP payload size, if not zero
+}
+
+func newServerModes() *serverModes {
+	return &serverModes{
+		servers: map[string]serverMode{},
+	}
+}
+
+func (x *serverModes) mode(addr string) serverMode {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	return x.servers[addr]
+}
+
+func (x *serverModes) update(addr string, f func(*serverMode)) serverMode {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	mode := x.servers[addr]
+	f(&mode)
+	if _, ok := x.servers[addr]; !ok && len(x.servers) >= maxServerModes {
+		x.servers = map[string]serverMode{}
+	}
+	x.servers[addr] = mode
+
+	return mode
+}
+
+func (x *defaultExchanger) Exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	mode := x.mode(addr)
+	size := x.ednsSize(mode)
+
+	switch {
+	case strings.HasPrefix(addr, unixScheme):
+		return x.exchangeVia(ctx, "unix", m, addr, size)
+	case strings.HasPrefix(addr, tlsScheme):
+		return x.exchangeVia(ctx, "tcp-tls", m, addr, size)
+	case strings.HasPrefix(addr, httpsScheme) && x.odohProxy != "":
+		return x.exchangeODoH(ctx, m, addr, size)
+	case strings.HasPrefix(addr, httpsScheme):
+		return x.exchangeHTTPS(ctx, m, addr, size)
+	case isMulticast(addr):
+		return x.exchangeMulticast(ctx, m, addr)
+	}
+
+	if mode.tcp || mode.udpFailures >= udpFailuresBeforeTCP {
+		resp, rtt, err := x.exchangeVia(ctx, "tcp", m, addr, size)
+		x.update(addr, func(mode *serverMode) {
+			mode.tcp = err == nil
+			mode.udpFailures = 0
+		})
+		return resp, rtt, err
+	}
+
+	resp, rtt, err := x.exchangeVia(ctx, "udp", m, addr, size)
+	if err != nil {
+		mode = x.update(addr, func(mode *serverMode) {
+			switch {
+			case size > ednsUDPSize:
+				// Large responses may have been fragmented, and the
+				// fragments dropped. This doesn't count as a failure
+				// of UDP as such.
+				mode.udpSize = ednsUDPSize
+			case size > minUDPSize:
+				mode.udpSize = minUDPSize
+				mode.udpFailures++
+			default:
+				mode.udpFailures++
+			}
+		})
+		if mode.udpFailures < udpFailuresBeforeTCP || ctx.Err() != nil {
+			return resp, rtt, err
+		}
+
+		x.stats.fallback(true)
+		tcpResp, tcpRTT, tcpErr := x.exchangeVia(ctx, "tcp", m, addr, size)
+		if tcpErr != nil {
+			return resp, rtt + tcpRTT, err
+		}
+		x.update(addr, func(mode *serverMode) {
+			mode.tcp = true
+			mode.udpFailures = 0
+		})
+		return tcpResp, rtt + tcpRTT, nil
+	}
+	if mode.udpFailures > 0 {
+		x.update(addr, func(mode *serverMode) { mode.udpFailures = 0 })
+	}
+
+	if size > 0 && resp.Rcode == dns.RcodeFormatError && resp.IsEdns0() == nil {
+		x.stats.fallback(false)
+		plainResp, plainRTT, plainErr := x.exchangeVia(ctx, "udp", m, addr, 0)
+		rtt += plainRTT
+		if plainErr != nil {
+			return resp, rtt, nil
+		}
+		if plainResp.Rcode != dns.RcodeFormatError {
+			x.update(addr, func(mode *serverMode) { mode.noEDNS = true })
+		}
+		resp, size = plainResp, 0
+	}
+
+	if resp.Truncated || resp.Rcode == dns.RcodeBadCookie || x.retryRefused && resp.Rcode == dns.RcodeRefused {
+		x.stats.fallback(true)
+		tcpResp, tcpRTT, tcpErr := x.exchangeVia(ctx, "tcp", m, addr, size)
+		rtt += tcpRTT
+		if tcpErr != nil {
+			return resp, rtt, nil
+		}
+		resp = tcpResp
+	}
+
+	return resp, rtt, nil
+}
+
+// ednsSize returns the UDP payload size to advertise with EDNS0 to a server
+// with the given mode, or zero if EDNS0 is not to be used.
+func (x *defaultExchanger) ednsSize(mode serverMode) uint16 {
+	switch {
+	case mode.noEDNS:
+		return 0
+	case mode.udpSize > 0:
+		return mode.udpSize
+	case x.udpSize > 0:
+		return x.udpSize
+	default:
+		return ednsUDPSize
+	}
+}
+
+// exchangeVia sends m to addr via the given network, "udp", "tcp", "tcp-tls"
+// for addresses with the tls:// scheme, or "unix" for the addresses of Unix
+// domain sockets. If udpSize is not zero, an EDNS0 OPT record that advertises
+// this UDP payload size is added to a copy of m.
+func (x *defaultExchanger) exchangeVia(ctx context.Context, network string, m *dns.Msg, addr string, udpSize uint16) (*dns.Msg, time.Duration, error) {
+	if udpSize > 0 && m.IsEdns0() == nil {
+		m = m.Copy()
+		m.SetEdns0(udpSize, false)
+	}
+
+	c := &dns.Client{
+		Net: network,
+	}
+	if network == "tcp-tls" {
+		c.TLSConfig = x.tlsConfig(addr)
+		addr = endpointHostPort(addr)
+	}
+	x.stats.sent(network)
+
+	if (network == "tcp" || network == "tcp-tls") && x.conns != nil && m.IsEdns0() != nil {
+		return x.exchangeKeepalive(ctx, c, network, m, addr)
+	}
+
+	capture := wireCaptureFrom(ctx)
+	if network == "udp" && x.retransmit > 0 {
+		return exchangeRetransmit(ctx, c, m, addr, x.retransmit, capture)
+	}
+	if capture != nil || network == "unix" {
+		return exchangeRetransmit(ctx, c, m, addr, 0, capture)
+	}
+
+	return c.ExchangeContext(ctx, m, addr)
+}
+
+// exchangeRetransmit is like c.ExchangeContext, but sends m again if no
+// response has arrived after interval, and then after twice the interval,
+// and so on, until a response arrives or ctx expires. If interval is zero, m
+// is sent only once. If ctx has no deadline, the exchange is limited to two
+// seconds, like c.ExchangeContext.
+//
+// Addresses of Unix domain sockets are dialed with dialUnix instead of c.
+//
+// The returned round-trip time is measured from the first transmission. If
+// capture is not nil, the query and the response are stored in it in wire
+// format.
+func exchangeRetransmit(ctx context.Context, c *dns.Client, m *dns.Msg, addr string, interval time.Duration, capture *wireCapture) (*dns.Msg, time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(2 * time.Second)
+	}
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	capture.setQuery(query)
+
+	var conn *dns.Conn
+	if path, ok := unixSocketPath(addr); ok {
+		conn, err = dialUnix(ctx, path)
+	} else {
+		conn, err = c.DialContext(ctx, addr)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	return exchangeConn(ctx, conn, m, query, deadline, interval, capture)
+}
+
+// exchangeConn sends query, which is m in wire format, over conn, and
+// returns the response, retransmitting as described for exchangeRetransmit.
+// The exchange fails if no response has arrived by deadline. conn remains
+// open.
+func exchangeConn(ctx context.Context, conn *dns.Conn, m *dns.Msg, query []byte, deadline time.Time, interval time.Duration, capture *wireCapture) (*dns.Msg, time.Duration, error) {
+	if opt := m.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+
+	// Unblock ReadMsg if ctx is canceled.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	start := time.Now()
+	for {
+		if err := conn.SetWriteDeadline(deadline); err != nil {
+			return nil, 0, err
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, time.Since(start), err
+		}
+
+		next := time.Now().Add(interval)
+		if interval == 0 || next.After(deadline) {
+			next = deadline
+		}
+		if err := conn.SetReadDeadline(next); err != nil {
+			return nil, 0, err
+		}
+
+		for {
+			resp, err := readMsg(conn)
+			if err == nil && resp.Id != m.Id {
+				continue // response to an unrelated query
+			}
+			if resp != nil {
+				capture.setResponse(resp.wire)
+			}
+			if err == nil {
+				return resp.Msg, time.Since(start), nil
+			}
+
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && ctx.Err() == nil && time.Now().Before(deadline) {
+				break // retransmit
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+
+			return nil, time.Since(start), err
+		}
+
+		interval *= 2
+	}
+}
+
+// wireMsg is a DNS message along with its wire format.
+type wireMsg struct {
+	*dns.Msg
+	wire []byte
+}
+
+// readMsg is like conn.ReadMsg, but retains the wire format of the message.
+// If the message is malformed, readMsg returns the wire format and an error.
+func readMsg(conn *dns.Conn) (*wireMsg, error) {
+	p, err := conn.ReadMsgHeader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &wireMsg{Msg: new(dns.Msg), wire: p}
+	if err := m.Unpack(p); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
+
+type wireCaptureKey struct{}
+
+// wireCapture receives the query that the default transport has sent last
+// and the response that it has received last, in wire format. See
+// Resolver.RetainWireFormat.
+type wireCapture struct {
+	mu       sync.Mutex
+	query    []byte
+	response []byte
+}
+
+func withWireCapture(ctx context.Context, capture *wireCapture) context.Context {
+	return context.WithValue(ctx, wireCaptureKey{}, capture)
+}
+
+func wireCaptureFrom(ctx context.Context) *wireCapture {
+	capture, _ := ctx.Value(wireCaptureKey{}).(*wireCapture)
+	return capture
+}
+
+func (c *wireCapture) setQuery(b []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.query, c.response = b, nil
+	c.mu.Unlock()
+}
+
+func (c *wireCapture) setResponse(b []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.response = b
+	c.mu.Unlock()
+}
+
+func (c *wireCapture) get() (query, response []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.query, c.response
+}
@@ -0,0 +1,556 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_Use(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 60, "192.0.2.1"),
+		)
+
+	var (
+		mu  sync.Mutex
+		log []string
+	)
+	logger := func(name string) Middleware {
+		return func(next Exchanger) Exchanger {
+			return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+				mu.Lock()
+				log = append(log, name+" "+dns.TypeToString[m.Question[0].Qtype]+" "+m.Question[0].Name+" @"+addr)
+				mu.Unlock()
+				return next.Exchange(ctx, m, addr)
+			})
+		}
+	}
+
+	blocker := func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if strings.HasSuffix(m.Question[0].Name, ".invalid.") {
+				resp := new(dns.Msg).SetRcode(m, dns.RcodeNameError)
+				resp.Authoritative = true
+				return resp, 0, nil
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	}
+
+	r.Use(logger("outer"), blocker)
+	r.Use(logger("inner"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	assert.Equal(t, []string{
+		"outer NS . @127.0.0.250:5354",
+		"inner NS . @127.0.0.250:5354",
+		"outer A www.example.com. @127.0.0.250:5354",
+		"inner A www.example.com. @127.0.0.250:5354",
+		"outer A www.example.com. @127.0.0.100:5354",
+		"inner A www.example.com. @127.0.0.100:5354",
+		"outer A www.example.com. @127.0.0.101:5354",
+		"inner A www.example.com. @127.0.0.101:5354",
+	}, log)
+
+	log = nil
+	_, err = r.Query(ctx, "A", "www.example.invalid")
+	assert.True(t, errors.Is(err, ErrNXDomain), "error %v should wrap ErrNXDomain", err)
+	assert.Equal(t, []string{
+		"outer A www.example.invalid. @127.0.0.250:5354",
+	}, log)
+}
+
+func TestResolver_Transport(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.SetBootstrapServers("192.0.2.53")
+
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+	r.Transport = ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		q := m.Question[0]
+
+		mu.Lock()
+		queries = append(queries, dns.TypeToString[q.Qtype]+" "+q.Name+" @"+addr)
+		mu.Unlock()
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Authoritative = true
+		switch {
+		case q.Qtype == dns.TypeNS && q.Name == ".":
+			resp.Answer = []dns.RR{NS(t, ".", 300, "root.test.")}
+			resp.Extra = []dns.RR{A(t, "root.test.", 300, "192.0.2.250")}
+		case addr == "192.0.2.250:53":
+			resp.Answer = []dns.RR{A(t, q.Name, 300, "192.0.2.1")}
+		default:
+			resp.Rcode = dns.RcodeRefused
+		}
+
+		return resp, time.Millisecond, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, "192.0.2.250:53", rs.ServerAddr)
+	assert.Equal(t, time.Millisecond, rs.RTT)
+
+	assert.Equal(t, []string{
+		"NS . @192.0.2.53:53",
+		"A www.example.com. @192.0.2.250:53",
+	}, queries)
+}
+
+func TestResolver_SetMaxConcurrentExchanges(t *testing.T) {
+	var inflight, maxInflight int64
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			n := atomic.AddInt64(&inflight, 1)
+			defer atomic.AddInt64(&inflight, -1)
+			for {
+				prev := atomic.LoadInt64(&maxInflight)
+				if n <= prev || atomic.CompareAndSwapInt64(&maxInflight, prev, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// The queries run concurrently, so each of them may discover the root
+	// servers.
+	rootSrv.ExpectQuery("NS .").AnyTimes().Respond().
+		Answer(NS(t, ".", 321, "self.test.")).
+		Additional(A(t, "self.test.", 321, rootSrv.IP()))
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("www%d.example.", i)
+		rootSrv.ExpectQuery("A " + name).Respond().
+			Answer(A(t, name, 300, "192.0.2.1"))
+	}
+
+	r.SetMaxConcurrentExchanges(2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := r.Query(ctx, "A", fmt.Sprintf("www%d.example", i))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(2), atomic.LoadInt64(&maxInflight))
+
+	// Waiting is aborted with the context.
+	r.SetMaxConcurrentExchanges(1)
+	cfg := r.config()
+	cfg.exchangeSlots <- struct{}{}
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := r.Query(ctx, "A", "blocked.example")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_SetMaxExchangesPerServer(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		inflight = map[string]int{}
+		maxByIP  = map[string]int{}
+	)
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			mu.Lock()
+			inflight[addr]++
+			if inflight[addr] > maxByIP[addr] {
+				maxByIP[addr] = inflight[addr]
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				inflight[addr]--
+				mu.Unlock()
+			}()
+			time.Sleep(5 * time.Millisecond)
+
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1Srv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// The queries run concurrently, so each of them may discover the root
+	// servers and the delegation of example.
+	rootSrv.ExpectQuery("NS .").AnyTimes().Respond().
+		Answer(NS(t, ".", 321, "self.test.")).
+		Additional(A(t, "self.test.", 321, rootSrv.IP()))
+	rootSrv.ExpectQuery("A *.example.").AnyTimes().DelegateTo("example.", ns1Srv.IP(), ns2Srv.IP()).ViaAuthoritySection()
+	for _, srv := range []*TestServer{ns1Srv, ns2Srv} {
+		for i := 0; i < 6; i++ {
+			name := fmt.Sprintf("www%d.example.", i)
+			srv.ExpectQuery("A " + name).AnyTimes().Respond().
+				Answer(A(t, name, 300, "192.0.2.100"))
+		}
+		srv.ExpectQuery("A www.example.").AnyTimes().Respond().
+			Answer(A(t, "www.example.", 300, "192.0.2.100"))
+	}
+	r.DisableIP6 = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r.SetMaxExchangesPerServer(1, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := r.Query(ctx, "A", fmt.Sprintf("www%d.example", i))
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	for addr, n := range maxByIP {
+		assert.Equal(t, 1, n, addr)
+	}
+	mu.Unlock()
+
+	// Busy servers are skipped if failing fast.
+	r.SetMaxExchangesPerServer(1, true)
+	r.ClearCache()
+	var busy []func()
+	for _, addr := range []string{"127.0.0.101:5354", "127.0.0.102:5354"} {
+		release, err := r.config().serverSlots.acquire(ctx, addr)
+		require.NoError(t, err)
+		busy = append(busy, release)
+	}
+
+	_, err := r.Query(ctx, "A", "www.example")
+	assert.True(t, errors.Is(err, ErrServerBusy), "%v", err)
+
+	busy[1]()
+	rs, err := r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.102:5354", rs.ServerAddr)
+	assert.Contains(t, rs.Trace.Dump(), ErrServerBusy.Error()+": 127.0.0.101:5354")
+	busy[0]()
+
+	assert.Empty(t, r.config().serverSlots.servers)
+}
+
+func TestDefaultExchanger_TCPFallback(t *testing.T) {
+	var udpEDNS, tcpQueries int32
+
+	addr := "127.0.0.60:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		if req.IsEdns0() != nil {
+			atomic.AddInt32(&udpEDNS, 1)
+		}
+		m := new(dns.Msg).SetReply(req)
+		m.Truncated = true
+		w.WriteMsg(m)
+	})
+	startServer(t, "tcp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&tcpQueries, 1)
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{serverModes: newServerModes()}
+	resp, _, err := x.Exchange(context.Background(), query("www.example.com.", dns.TypeA), addr)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.False(t, resp.Truncated)
+		assert.Len(t, resp.Answer, 1)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&udpEDNS))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpQueries))
+}
+
+func TestDefaultExchanger_RetryRefused(t *testing.T) {
+	var tcpQueries int32
+
+	addr := "127.0.0.65:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(new(dns.Msg).SetRcode(req, dns.RcodeRefused))
+	})
+	startServer(t, "tcp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&tcpQueries, 1)
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{serverModes: newServerModes()}
+	resp, _, err := x.Exchange(context.Background(), query("www.example.com.", dns.TypeA), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tcpQueries))
+
+	x.retryRefused = true
+	resp, _, err = x.Exchange(context.Background(), query("www.example.com.", dns.TypeA), addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Len(t, resp.Answer, 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpQueries))
+}
+
+func TestDefaultExchanger_NoEDNS(t *testing.T) {
+	var withEDNS, withoutEDNS int32
+
+	addr := "127.0.0.61:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		if req.IsEdns0() != nil {
+			atomic.AddInt32(&withEDNS, 1)
+			m.SetRcode(req, dns.RcodeFormatError)
+		} else {
+			atomic.AddInt32(&withoutEDNS, 1)
+			m.SetReply(req)
+			m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{serverModes: newServerModes()}
+	for i := 0; i < 2; i++ {
+		resp, _, err := x.Exchange(context.Background(), query("www.example.com.", dns.TypeA), addr)
+		assert.NoError(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		}
+	}
+
+	// EDNS0 is only tried once.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&withEDNS))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&withoutEDNS))
+}
+
+func TestDefaultExchanger_RepeatedUDPFailures(t *testing.T) {
+	var tcpQueries int32
+
+	// Nothing listens on UDP, so UDP queries fail quickly.
+	addr := "127.0.0.62:5354"
+	startServer(t, "tcp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&tcpQueries, 1)
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		w.WriteMsg(m)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	x := &defaultExchanger{serverModes: newServerModes()}
+
+	_, _, err := x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tcpQueries))
+
+	_, _, err = x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tcpQueries))
+	assert.True(t, x.mode(addr).tcp)
+
+	_, _, err = x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&tcpQueries))
+}
+
+func TestDefaultExchanger_Retransmit(t *testing.T) {
+	var queries, lost int32
+
+	addr := "127.0.0.63:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		if atomic.AddInt32(&lost, -1) >= 0 {
+			return
+		}
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{
+		serverModes: newServerModes(),
+		retransmit:  50 * time.Millisecond,
+	}
+
+	// The first query is lost.
+	atomic.StoreInt32(&lost, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	resp, rtt, err := x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Len(t, resp.Answer, 1)
+	}
+	assert.GreaterOrEqual(t, int64(rtt), int64(50*time.Millisecond))
+	assert.Less(t, int64(rtt), int64(500*time.Millisecond))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+
+	// Without any response, retransmissions continue until the deadline.
+	atomic.StoreInt32(&queries, 0)
+	atomic.StoreInt32(&lost, 100)
+	ctx, cancel = context.WithTimeout(context.Background(), 180*time.Millisecond)
+	defer cancel()
+
+	_, _, err = x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "error %v should wrap context.DeadlineExceeded", err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries)) // after 0, 50, and 150ms
+}
+
+func TestDefaultExchanger_EDNSBufferSize(t *testing.T) {
+	var maxSize int32
+	var sizes []uint16
+	var mu sync.Mutex
+
+	// The server drops queries that advertise more than maxSize bytes, as
+	// if large responses were fragmented and the fragments dropped.
+	addr := "127.0.0.64:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		size := uint16(dns.MinMsgSize)
+		if opt := req.IsEdns0(); opt != nil {
+			size = opt.UDPSize()
+		}
+		mu.Lock()
+		sizes = append(sizes, size)
+		mu.Unlock()
+		if int32(size) > atomic.LoadInt32(&maxSize) {
+			return
+		}
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{
+		serverModes: newServerModes(),
+		udpSize:     4096,
+	}
+
+	exchange := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, _, err := x.Exchange(ctx, query("www.example.com.", dns.TypeA), addr)
+		return err
+	}
+
+	atomic.StoreInt32(&maxSize, 1232)
+	assert.Error(t, exchange())
+	assert.NoError(t, exchange())
+	assert.NoError(t, exchange())
+	assert.Equal(t, uint16(1232), x.mode(addr).udpSize)
+	assert.Equal(t, 0, x.mode(addr).udpFailures)
+
+	atomic.StoreInt32(&maxSize, 512)
+	assert.Error(t, exchange())
+	assert.NoError(t, exchange())
+	assert.Equal(t, uint16(512), x.mode(addr).udpSize)
+	assert.False(t, x.mode(addr).tcp)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []uint16{4096, 1232, 1232, 1232, 512}, sizes)
+}
+
+func query(name string, qtype uint16) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return m
+}
+
+// startServer starts a name server that listens on addr via the given
+// network, "udp" or "tcp", and answers all queries with h.
+func startServer(t *testing.T, network, addr string, h dns.HandlerFunc) {
+	srv := &dns.Server{
+		Handler: h,
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PacketConn = pc
+	default:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener = ln
+	}
+
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+}
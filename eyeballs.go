@@ -0,0 +1,119 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// doQueryHappyEyeballs is like doQuery, but races a server with an IPv6
+// address against a server with an IPv4 address, as described in
+// HappyEyeballsDelay. addr is the next server of frame and ip its address.
+// The address of the other server, if any, is taken from frame.addrs and put
+// back if the query hasn't been sent to it.
+//
+// doQueryHappyEyeballs returns the first response, or the last error if no
+// response has been received, and the address of the server that sent it.
+func (r *resolver) doQueryHappyEyeballs(ctx context.Context, frame *stackFrame, addr string, ip net.IP, trace *Trace) (resp *dns.Msg, rtt, age time.Duration, from string, err error) {
+	isIP6 := ip.To4() == nil
+
+	other := -1
+	for i, a := range frame.addrs {
+		host, _, splitErr := net.SplitHostPort(a)
+		if splitErr != nil {
+			host = a
+		}
+		if otherIP := net.ParseIP(host); otherIP != nil && (otherIP.To4() != nil) == isIP6 {
+			other = i
+			break
+		}
+	}
+	if other < 0 {
+		resp, rtt, age, err = r.doQueryRetry(ctx, frame.q, addr, trace)
+		return resp, rtt, age, addr, err
+	}
+
+	fallback := frame.addrs[other]
+	frame.addrs = append(frame.addrs[:other:other], frame.addrs[other+1:]...)
+	if _, _, splitErr := net.SplitHostPort(fallback); splitErr != nil {
+		fallback = net.JoinHostPort(fallback, r.defaultPort)
+	}
+
+	primary := addr
+	if !isIP6 {
+		primary, fallback = fallback, addr // prefer IPv6
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		i        int
+		resp     *dns.Msg
+		rtt, age time.Duration
+		err      error
+	}
+
+	var (
+		addrs   = []string{primary, fallback}
+		traces  []*Trace
+		results = make(chan result, 2)
+	)
+	start := func() {
+		i := len(traces)
+		t := trace.fork()
+		traces = append(traces, t)
+		go func() {
+			resp, rtt, age, err := r.doQueryRetry(ctx, frame.q, addrs[i], t)
+			results <- result{i, resp, rtt, age, err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(r.happyEyeballs)
+	defer timer.Stop()
+
+	var (
+		winner  result
+		pending = 1
+	)
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			winner = res
+			if res.err == nil {
+				cancel()
+				for ; pending > 0; pending-- {
+					<-results
+				}
+				break
+			}
+			if len(traces) == 1 {
+				// Don't wait for the delay if the first attempt has failed
+				// already.
+				start()
+				pending++
+			}
+		case <-timer.C:
+			if len(traces) == 1 {
+				start()
+				pending++
+			}
+		}
+	}
+
+	if len(traces) == 1 {
+		// The fallback server hasn't been used; keep it for later.
+		frame.addrs = append([]string{fallback}, frame.addrs...)
+	}
+
+	for _, t := range traces {
+		trace.adopt(t)
+	}
+	trace.last = traces[winner.i].last
+
+	return winner.resp, winner.rtt, winner.age, addrs[winner.i], winner.err
+}
@@ -0,0 +1,63 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_Query_HappyEyeballs(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.HappyEyeballsDelay = 50 * time.Millisecond
+	r.TimeoutPolicy = func(string, string, string) time.Duration { return 5 * time.Second }
+
+	// IPv6 is broken: queries are never answered.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			if net.ParseIP(host).To4() == nil {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP(), "2001:db8::1")
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
+
+	dump := rs.Trace.Dump()
+	assert.Contains(t, dump, strings.TrimSpace(`
+? www.example.com. IN A @[2001:db8::1]:5354 (rtt<1ms)
+  X context canceled
+  ~ EMPTY
+? www.example.com. IN A @127.0.0.101:5354`))
+}
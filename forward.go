@@ -0,0 +1,110 @@
+package dnsresolver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// forward sends the question of rs to the recursive resolvers in addrs, in
+// order, until one of them responds with anything other than SERVFAIL,
+// REFUSED, or NOTIMP.
+func (r *resolver) forward(ctx context.Context, addrs []string, rs RecordSet) (RecordSet, error) {
+	q := rs.Raw.Question[0]
+
+	var errs []error
+	refused := 0
+	for _, addr := range addrs {
+		rs.ServersTried = append(rs.ServersTried, addr)
+		resp, rtt, age, err := r.doQueryRetry(ctx, q, addr, rs.Trace)
+		if isTerminal(resp, err) {
+			return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+		}
+		if err != nil {
+			errs = append(errs, serverError(err, addr))
+			continue
+		}
+
+		switch {
+		case isRefusal(resp):
+			refused++
+			fallthrough
+		case resp.Rcode == dns.RcodeServerFailure:
+			errs = append(errs, fmt.Errorf("%s @%s", dns.RcodeToString[resp.Rcode], addr))
+			continue
+		}
+
+		if err := checkRcode(resp); err != nil {
+			err = fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+			rs.fromResponse(resp, addr, rtt, age, false)
+			return rs, err
+		}
+
+		rs.fromResponse(resp, addr, rtt, age, false)
+		if r.wildcards && !rs.Synthesized && len(rs.Values) > 0 {
+			rs.Synthesized = r.probeWildcard(ctx, rs, "", addr)
+		}
+		rs.EmptyNonTerminal = r.probeEmptyNonTerminal(ctx, rs, addr)
+		return rs, nil
+	}
+
+	err := &ServersExhaustedError{
+		Errors:  errs,
+		refused: refused > 0 && refused == len(addrs),
+	}
+
+	return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+}
+
+// isForwarder reports whether addr is the address of a recursive resolver
+// that queries are forwarded to, either all queries or those for a particular
+// zone.
+func (r *resolver) isForwarder(addr string) bool {
+	for _, x := range r.forwarders {
+		if x == addr {
+			return true
+		}
+	}
+	for _, addrs := range r.zoneForwarders {
+		for _, x := range addrs {
+			if x == addr {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// zoneForwarder returns the forwarders for the most specific zone that
+// contains fqdn, and the zone itself. If queries for fqdn are not to be
+// forwarded, zoneForwarder returns nil.
+func (r *resolver) zoneForwarder(fqdn string) ([]string, string) {
+	fqdn = dns.CanonicalName(fqdn)
+
+	var (
+		addrs []string
+		zone  string
+	)
+	for z, x := range r.zoneForwarders {
+		if dns.IsSubDomain(z, fqdn) && len(z) > len(zone) {
+			addrs, zone = x, z
+		}
+	}
+
+	return addrs, zone
+}
+
+// isNegativelyTrusted reports whether fqdn is in a zone that has been
+// configured as a negative trust anchor.
+func (r *resolver) isNegativelyTrusted(fqdn string) bool {
+	fqdn = dns.CanonicalName(fqdn)
+	for _, zone := range r.ntas {
+		if dns.IsSubDomain(zone, fqdn) {
+			return true
+		}
+	}
+
+	return false
+}
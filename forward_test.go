@@ -0,0 +1,182 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_Query_Forwarders(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	fwd1 := NewTestServer(t, "127.0.0.53:"+r.defaultPort)
+	fwd2 := NewTestServer(t, "127.0.0.54:"+r.defaultPort)
+
+	assert.NoError(t, r.SetForwarders(fwd1.IP(), fwd2.IP()))
+
+	fwd1.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeServerFailure)
+	fwd2.ExpectQuery("A www.example.com.").Respond().
+		NonAuthoritative().
+		Answer(
+			CNAME(t, "www.example.com.", 300, "web.example.com."),
+			A(t, "web.example.com.", 60, "192.0.2.1"),
+		)
+	fwd1.ExpectQuery("A nope.example.com.").Respond().Status(dns.RcodeNameError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, 60*time.Second, rs.TTL)
+	assert.Equal(t, "127.0.0.54:5354", rs.ServerAddr)
+	assert.Equal(t, []string{"127.0.0.53:5354", "127.0.0.54:5354"}, rs.ServersTried)
+	if assert.Len(t, rs.Trace.Queries, 2) {
+		assert.True(t, rs.Trace.Queries[0].Message.RecursionDesired)
+	}
+
+	rs, err = r.Query(ctx, "A", "nope.example.com")
+	assert.EqualError(t, err, "A nope.example.com: NXDOMAIN response")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+	assert.Equal(t, "NXDOMAIN", rs.Type)
+}
+
+func TestResolver_Query_Forwarders_Refused(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	fwd1 := NewTestServer(t, "127.0.0.53:"+r.defaultPort)
+	fwd2 := NewTestServer(t, "127.0.0.54:"+r.defaultPort)
+
+	assert.NoError(t, r.SetForwarders(fwd1.IP(), fwd2.IP()))
+
+	fwd1.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeRefused)
+	fwd2.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeRefused)
+	fwd1.ExpectQuery("A mail.example.com.").Respond().Status(dns.RcodeRefused)
+	fwd2.ExpectQuery("A mail.example.com.").Respond().Status(dns.RcodeServerFailure)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.example.com")
+	assert.EqualError(t, err, "A www.example.com: servers exhausted: refused by all servers: "+
+		"REFUSED @127.0.0.53:5354; REFUSED @127.0.0.54:5354")
+	assert.ErrorIs(t, err, ErrRefused)
+
+	var exhausted *ServersExhaustedError
+	if assert.ErrorAs(t, err, &exhausted) {
+		assert.Equal(t, "", exhausted.Zone)
+		assert.Len(t, exhausted.Errors, 2)
+	}
+
+	// A server that fails otherwise means that not all servers have
+	// refused.
+	_, err = r.Query(ctx, "A", "mail.example.com")
+	assert.EqualError(t, err, "A mail.example.com: servers exhausted: "+
+		"REFUSED @127.0.0.53:5354; SERVFAIL @127.0.0.54:5354")
+	assert.False(t, errors.Is(err, ErrRefused))
+	assert.ErrorAs(t, err, &exhausted)
+}
+
+func TestResolver_Query_ZoneForwarders(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	fwd := NewTestServer(t, "127.0.0.53:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+	assert.NoError(t, r.SetZoneForwarders("corp.example.com", fwd.IP()))
+
+	// Names in the forwarded zone go straight to the forwarder.
+	fwd.ExpectQuery("A app.corp.example.com.").Respond().NonAuthoritative().
+		Answer(
+			A(t, "app.corp.example.com.", 60, "10.0.0.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "app.corp.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, rs.Values)
+	assert.Equal(t, "127.0.0.53:5354", rs.ServerAddr)
+
+	// Name servers in the forwarded zone are resolved by the forwarder.
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", "ns.corp.example.com.")
+	fwd.ExpectQuery("AAAA ns.corp.example.com.").Respond().NonAuthoritative()
+	fwd.ExpectQuery("A ns.corp.example.com.").Respond().NonAuthoritative().
+		Answer(
+			A(t, "ns.corp.example.com.", 60, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 60, "192.0.2.1"),
+		)
+
+	rs, err = r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	assert.NoError(t, r.SetZoneForwarders("corp.example.com"))
+	assert.Empty(t, r.config().zoneForwarders)
+}
+
+func TestResolver_SetNegativeTrustAnchors(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	fwd := NewTestServer(t, "127.0.0.53:"+r.defaultPort)
+
+	assert.NoError(t, r.SetForwarders(fwd.IP()))
+	assert.NoError(t, r.SetNegativeTrustAnchors("broken.example"))
+	assert.EqualError(t, r.SetNegativeTrustAnchors("not..valid"), "not a domain name: not..valid.")
+
+	var mu sync.Mutex
+	cd := map[string]bool{}
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			mu.Lock()
+			cd[m.Question[0].Name] = m.CheckingDisabled
+			mu.Unlock()
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	fwd.ExpectQuery("A www.broken.example.").Respond().
+		NonAuthoritative().
+		Answer(A(t, "www.broken.example.", 300, "192.0.2.1"))
+	fwd.ExpectQuery("A www.example.com.").Respond().
+		NonAuthoritative().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.2"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.broken.example")
+	assert.NoError(t, err)
+	_, err = r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[string]bool{
+		"www.broken.example.": true,
+		"www.example.com.":    false,
+	}, cd)
+}
@@ -0,0 +1,156 @@
+package dnsresolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resolveNS resolves the addresses of the name servers in names, which have
+// been delegated to without glue records, on behalf of frame. At most
+// r.parallelNS names are resolved concurrently. resolveNS returns the
+// addresses of the first name server that has been resolved successfully and
+// cancels the remaining lookups.
+//
+// The queries of all lookups are added to trace as children of the most
+// recent query, in the order of names.
+func (r *resolver) resolveNS(ctx context.Context, names []string, frame *stackFrame, rootAddrs []string, trace *Trace) ([]string, []error, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		addrs    []string
+		warnings []error
+		err      error
+	}
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, r.parallelNS)
+		first   = make(chan []string, len(names))
+		results = make([]result, len(names))
+		traces  = make([]*Trace, len(names))
+	)
+
+	for i, name := range names {
+		traces[i] = trace.fork()
+
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].err = ctx.Err()
+				return
+			}
+
+			var res result
+			res.addrs, res.warnings, res.err = r.lookupNS(ctx, name, frame, rootAddrs, traces[i])
+			results[i] = res
+			if res.err == nil {
+				first <- res.addrs
+			}
+		}(i, name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var addrs []string
+	select {
+	case addrs = <-first:
+		cancel()
+		<-done
+	case <-done:
+		select {
+		case addrs = <-first:
+		default:
+		}
+	}
+
+	trace.push()
+	for _, t := range traces {
+		trace.adopt(t)
+	}
+	trace.pop()
+
+	var (
+		warnings []error
+		err      error
+	)
+	for _, res := range results {
+		warnings = append(warnings, res.warnings...)
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+
+	if addrs != nil {
+		return addrs, warnings, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, warnings, ctxErr
+	}
+
+	return nil, warnings, err
+}
+
+// lookupNS resolves the addresses of the name server called name, which
+// frame has been delegated to.
+func (r *resolver) lookupNS(ctx context.Context, name string, frame *stackFrame, rootAddrs []string, trace *Trace) ([]string, []error, error) {
+	atomic.AddInt64(&r.nsLookups, 1)
+
+	q := dns.Question{
+		Name:   name,
+		Qtype:  dns.TypeAAAA,
+		Qclass: dns.ClassINET,
+	}
+	if r.ip6disabled {
+		q.Qtype = dns.TypeA
+	}
+
+	addrs, zone := r.nsAddrs(name, rootAddrs)
+
+	nested := &stackFrame{
+		q:       q,
+		zone:    zone,
+		addrs:   addrs,
+		chain:   append(append([]string{}, frame.chain...), name),
+		nested:  true,
+		nsNames: []string{name},
+	}
+	nested.setBudget(earliestDeadline(ctx, frame))
+
+	var stack stack
+	stack.push(nested)
+
+	rs := RecordSet{
+		Raw:   dns.Msg{Question: []dns.Question{q}},
+		Name:  trimTrailingDot(name),
+		Type:  dns.Type(q.Qtype).String(),
+		Age:   -1 * time.Second,
+		Trace: trace,
+	}
+
+	rs, err := r.iterate(ctx, rs, stack, rootAddrs)
+	if err != nil {
+		return nil, rs.Warnings, err
+	}
+
+	ips, _ := r.referrals(&rs.Raw, "")
+	if len(ips) == 0 {
+		return nil, rs.Warnings, fmt.Errorf("no addresses for name server %s", name)
+	}
+
+	return ips, rs.Warnings, nil
+}
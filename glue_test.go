@@ -0,0 +1,205 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_Query_ParallelNSLookups(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+	r.ParallelNSLookups = 2
+	r.TimeoutPolicy = func(string, string, string) time.Duration { return 5 * time.Second }
+
+	// Queries for ns1.test.net. are never answered. If the name servers
+	// were resolved one at a time, ns2.test.org. would only be tried after
+	// ns1.test.net. has used up its share of the deadline.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if m.Question[0].Name == "ns1.test.net." {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	orgSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A example.com.").DelegateTo("example.com.", "ns1.test.net.", "ns2.test.org.")
+	rootSrv.ExpectQuery("A ns2.test.org.").DelegateTo("org.", orgSrv.IP())
+	orgSrv.ExpectQuery("A ns2.test.org.").Respond().
+		Answer(
+			A(t, "ns2.test.org.", 321, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("A example.com.").Respond().
+		Answer(
+			A(t, "example.com.", 321, "192.0.2.0"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0"}, rs.Values)
+	assert.Equal(t, "127.0.0.102:5354", rs.ServerAddr)
+
+	wantTrace := strings.TrimSpace(`
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
+  ! . 321 IN NS self.test.
+  ! self.test. 321 IN A 127.0.0.250
+? example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
+  ! com. 321 IN NS ns1.test.
+  ! ns1.test. 321 IN A 127.0.0.100
+? example.com. IN A @127.0.0.100:5354 (rtt<1ms)
+  ! example.com. 321 IN NS ns1.test.net.
+  ! example.com. 321 IN NS ns2.test.org.
+    ? ns1.test.net. IN A @127.0.0.250:5354 (rtt<1ms)
+      X context canceled
+      ~ EMPTY
+    ? ns2.test.org. IN A @127.0.0.250:5354 (rtt<1ms, cached)
+      ! org. 321 IN NS ns1.test.
+      ! ns1.test. 321 IN A 127.0.0.101
+    ? ns2.test.org. IN A @127.0.0.101:5354 (rtt<1ms)
+      ! ns2.test.org. 321 IN A 127.0.0.102
+? example.com. IN A @127.0.0.102:5354 (rtt<1ms)
+  ! example.com. 321 IN A 192.0.2.0
+	`) + "\n"
+
+	assert.Equal(t, wantTrace, rs.Trace.Dump())
+}
+
+func TestResolver_Query_NSBudget(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+	r.TimeoutPolicy = func(string, string, string) time.Duration { return 5 * time.Second }
+
+	// The root server doesn't respond to queries for slow*.test. before
+	// the deadline.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if strings.HasPrefix(m.Question[0].Name, "slow") {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.").DelegateTo("example.", "slow1.test.", "fast.test.")
+	rootSrv.ExpectQuery("A fast.test.").Respond().
+		Answer(
+			A(t, "fast.test.", 321, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("A www.example.").Respond().
+		Answer(
+			A(t, "www.example.", 321, "192.0.2.100"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+
+	// slow1.test. gets a third of the time, the rest is left for
+	// fast.test. and the query itself.
+	rs, err := r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+
+	r.ClearCache()
+	rootSrv.ExpectQuery("NS .").Respond().
+		Answer(
+			NS(t, ".", 321, "self.test."),
+		).
+		Additional(
+			A(t, "self.test.", 321, rootSrv.IP()),
+		)
+	rootSrv.ExpectQuery("A all-slow.example.").DelegateTo("example.", "slow1.test.", "slow2.test.")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+
+	// slow2.test. is the last name server and may use up the rest of the
+	// time.
+	_, err = r.Query(ctx, "A", "all-slow.example")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	var berr *BudgetError
+	if assert.True(t, errors.As(err, &berr), "%v", err) {
+		assert.Equal(t, []string{"slow1.test.", "slow2.test."}, berr.Names)
+	}
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_Query_NSBudget_SingleName(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+	r.TimeoutPolicy = func(string, string, string) time.Duration { return 5 * time.Second }
+
+	// The root server responds to queries for slow.test. after two thirds
+	// of the deadline.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if strings.HasPrefix(m.Question[0].Name, "slow") {
+				select {
+				case <-time.After(400 * time.Millisecond):
+				case <-ctx.Done():
+					return nil, 0, ctx.Err()
+				}
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.").DelegateTo("example.", "slow.test.")
+	rootSrv.ExpectQuery("A slow.test.").Respond().
+		Answer(
+			A(t, "slow.test.", 321, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("A www.example.").Respond().
+		Answer(
+			A(t, "www.example.", 321, "192.0.2.100"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+	defer cancel()
+
+	// slow.test. is the only name server, so it gets all of the time.
+	rs, err := r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
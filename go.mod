@@ -2,14 +2,18 @@ module github.com/classmarkets/go-dns-resolver
 
 go 1.17
 
+require (
+	github.com/miekg/dns v1.1.45
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20220114011407-0dd24b26b47d
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
-	github.com/miekg/dns v1.1.45 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.7.0 // indirect
 	golang.org/x/mod v0.4.2 // indirect
-	golang.org/x/net v0.0.0-20220114011407-0dd24b26b47d // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/tools v0.1.6-0.20210726203631-07bc1bf47fb2 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
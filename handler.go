@@ -0,0 +1,223 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Handler is a dns.Handler that answers queries by resolving them with a
+// Resolver. Mounted in a dns.Server, it turns the Resolver into a small
+// caching recursive name server, for instance for a LAN or a test
+// environment:
+//
+//	srv := &dns.Server{
+//		Addr:    "127.0.0.1:53",
+//		Net:     "udp",
+//		Handler: dnsresolver.NewHandler(dnsresolver.New()),
+//	}
+//	err := srv.ListenAndServe()
+//
+// The sections of the final authoritative response are passed on to the
+// client as they are. If the question is an alias for a name in another
+// zone, the CNAME records that lead to the final response are added to its
+// answer section. Queries that cannot be resolved are answered with
+// SERVFAIL. Only queries of the IN class are supported. Make sure to
+// configure a suitable CachePolicy, such as ObeyResponderAdvice, since the
+// DefaultCachePolicy caches very little.
+type Handler struct {
+	// Resolver resolves the incoming queries.
+	Resolver *Resolver
+
+	// Timeout limits the time it may take to resolve a single query. If
+	// zero, a timeout of 10 seconds is used.
+	Timeout time.Duration
+
+	// TraceTXT causes the trace of each resolution to be added to the
+	// additional section of the response, as TXT records of the CH class
+	// with the owner name "trace.dnsresolver.invalid.", one record per
+	// line of Trace.Dump. This is useful for debugging with tools like
+	// dig, but inflates responses considerably.
+	TraceTXT bool
+}
+
+// NewHandler returns a Handler that resolves queries with r.
+func NewHandler(r *Resolver) *Handler {
+	return &Handler{
+		Resolver: r,
+	}
+}
+
+// traceTXTName is the owner name of the TXT records added by Handler.TraceTXT.
+const traceTXTName = "trace.dnsresolver.invalid."
+
+// ServeDNS implements dns.Handler.
+func (h *Handler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = false
+	m.RecursionAvailable = true
+
+	defer func() {
+		h.finish(w, req, m)
+	}()
+
+	switch {
+	case req.Opcode != dns.OpcodeQuery:
+		m.Rcode = dns.RcodeNotImplemented
+		return
+	case len(req.Question) != 1:
+		m.Rcode = dns.RcodeFormatError
+		return
+	}
+
+	q := req.Question[0]
+	switch {
+	case q.Qclass != dns.ClassINET:
+		m.Rcode = dns.RcodeNotImplemented
+		return
+	case q.Qtype == dns.TypeAXFR, q.Qtype == dns.TypeIXFR:
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rs, answer, err := h.resolve(ctx, q)
+
+	switch {
+	case err == nil, errors.Is(err, ErrNXDomain):
+		m.Rcode = rs.Raw.Rcode
+		m.Answer = answer
+		m.Ns = rs.Raw.Ns
+		for _, rr := range rs.Raw.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	default:
+		m.Rcode = dns.RcodeServerFailure
+	}
+
+	if h.TraceTXT && rs.Trace != nil {
+		m.Extra = append(m.Extra, traceTXT(rs.Trace)...)
+	}
+}
+
+// resolve resolves q. Query returns CNAME records that refer to names in
+// other zones as they are, so resolve follows them with further queries and
+// returns the CNAME records of all responses, followed by the answer of the
+// final response. The trace of the returned RecordSet contains all queries.
+func (h *Handler) resolve(ctx context.Context, q dns.Question) (RecordSet, []dns.RR, error) {
+	recordType := dns.Type(q.Qtype).String()
+
+	rs, err := h.Resolver.Query(ctx, recordType, q.Name)
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY {
+		return rs, rs.Raw.Answer, err
+	}
+
+	maxCNAMEs := h.Resolver.MaxCNAMEChain
+	if maxCNAMEs == 0 {
+		maxCNAMEs = 8
+	}
+
+	trace := rs.Trace
+	answer := rs.Raw.Answer
+	aliases := []string{dns.CanonicalName(q.Name)}
+	for err == nil {
+		chain := cnameChain(&rs.Raw)
+		if len(chain) < 2 {
+			break
+		}
+		target := chain[len(chain)-1]
+		if hasRecords(rs.Raw.Answer, target, q.Qtype) {
+			break
+		}
+
+		aliases = append(aliases[:len(aliases)-1], chain...)
+		for i, name := range aliases[:len(aliases)-1] {
+			if name == target {
+				return rs, nil, &CycleError{Kind: ErrCircularCNAME, Chain: aliases[i:]}
+			}
+		}
+		if maxCNAMEs >= 0 && len(aliases)-1 > maxCNAMEs {
+			return rs, nil, &CNAMEChainError{Chain: aliases}
+		}
+
+		rs, err = h.Resolver.Query(ctx, recordType, target)
+		trace.append(rs.Trace)
+		answer = append(answer, rs.Raw.Answer...)
+	}
+	rs.Trace = trace
+
+	return rs, answer, err
+}
+
+// hasRecords reports whether rrs contain records of type qtype owned by name.
+func hasRecords(rrs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range rrs {
+		if hdr := rr.Header(); hdr.Rrtype == qtype && strings.EqualFold(hdr.Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finish adds an OPT record if the client supports EDNS, truncates the
+// response if necessary and sends it.
+func (h *Handler) finish(w dns.ResponseWriter, req, m *dns.Msg) {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+		if size > 1232 {
+			size = 1232 // see https://www.dnsflagday.net/2020/
+		}
+		if size < dns.MinMsgSize {
+			size = dns.MinMsgSize
+		}
+		m.SetEdns0(uint16(size), false)
+	}
+
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		m.Truncate(size)
+	} else {
+		m.Truncate(dns.MaxMsgSize)
+	}
+
+	w.WriteMsg(m)
+}
+
+// traceTXT converts the lines of t.Dump to TXT records.
+func traceTXT(t *Trace) []dns.RR {
+	var rrs []dns.RR
+	for _, line := range strings.Split(strings.TrimRight(t.Dump(), "\n"), "\n") {
+		rr := &dns.TXT{
+			Hdr: dns.RR_Header{
+				Name:   traceTXTName,
+				Rrtype: dns.TypeTXT,
+				Class:  dns.ClassCHAOS,
+			},
+		}
+
+		// Character strings are limited to 255 bytes.
+		for len(line) > 255 {
+			rr.Txt = append(rr.Txt, line[:255])
+			line = line[255:]
+		}
+		rr.Txt = append(rr.Txt, line)
+
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
@@ -0,0 +1,154 @@
+package dnsresolver
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+	// The delegation to example.com. is cached after the first query.
+	expSrv.ExpectQuery("A nope.example.com.").Respond().Status(dns.RcodeNameError)
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	h := NewHandler(r)
+	h.TraceTXT = true
+
+	srv := &dns.Server{PacketConn: ln, Handler: h}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(4096, false)
+
+		resp, _, err := new(dns.Client).Exchange(req, ln.LocalAddr().String())
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	resp := exchange("www.example.com.", dns.TypeA)
+	t.Log(resp)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.True(t, resp.RecursionAvailable)
+	assert.False(t, resp.Authoritative)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, "www.example.com.\t321\tIN\tA\t192.0.2.1", resp.Answer[0].String())
+	}
+	assert.NotNil(t, resp.IsEdns0())
+
+	var trace []string
+	for _, rr := range resp.Extra {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == traceTXTName {
+			trace = append(trace, strings.Join(txt.Txt, ""))
+		}
+	}
+	assert.Len(t, trace, 11)
+	assert.Contains(t, trace, "  ! www.example.com. 321 IN A 192.0.2.1")
+
+	resp = exchange("nope.example.com.", dns.TypeA)
+	assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+	req := new(dns.Msg)
+	req.SetQuestion("version.bind.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	resp, _, err = new(dns.Client).Exchange(req, ln.LocalAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNotImplemented, resp.Rcode)
+}
+
+func TestHandler_CNAME(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	netSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// www.example.com. is an alias for a name in another zone.
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			CNAME(t, "www.example.com.", 300, "web.example.com."),
+			CNAME(t, "web.example.com.", 300, "cdn.example.net."),
+		)
+	rootSrv.ExpectQuery("A cdn.example.net.").DelegateTo("example.net.", netSrv.IP())
+	netSrv.ExpectQuery("A cdn.example.net.").Respond().
+		Answer(
+			CNAME(t, "cdn.example.net.", 60, "edge.example.net."),
+			A(t, "edge.example.net.", 60, "192.0.2.1"),
+		)
+
+	// The chain of mail.example.com. leads back to itself. The delegations
+	// are cached by now.
+	comSrv.ExpectQuery("A mail.example.com.").Respond().
+		Answer(
+			CNAME(t, "mail.example.com.", 300, "mail.example.net."),
+		)
+	netSrv.ExpectQuery("A mail.example.net.").Respond().
+		Answer(
+			CNAME(t, "mail.example.net.", 300, "mail.example.com."),
+		)
+
+	ln, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &dns.Server{PacketConn: ln, Handler: NewHandler(r)}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	exchange := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+
+		resp, _, err := new(dns.Client).Exchange(req, ln.LocalAddr().String())
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	resp := exchange("www.example.com.")
+	t.Log(resp)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+	var answer []string
+	for _, rr := range resp.Answer {
+		answer = append(answer, rr.String())
+	}
+	assert.Equal(t, []string{
+		"www.example.com.\t300\tIN\tCNAME\tweb.example.com.",
+		"web.example.com.\t300\tIN\tCNAME\tcdn.example.net.",
+		"cdn.example.net.\t60\tIN\tCNAME\tedge.example.net.",
+		"edge.example.net.\t60\tIN\tA\t192.0.2.1",
+	}, answer)
+
+	resp = exchange("mail.example.com.")
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+}
@@ -0,0 +1,140 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ServerHealth is what a Resolver has measured about a particular name
+// server; see TimeoutRequest.
+type ServerHealth struct {
+	// Exchanges is the number of queries that have been sent to the
+	// server, and Failures the number of those that have failed, for
+	// instance because they have timed out. ConsecutiveFailures is the
+	// number of failures since the last successful query.
+	Exchanges           int64
+	Failures            int64
+	ConsecutiveFailures int
+
+	// Refusals is the number of responses with the response code REFUSED or
+	// NOTIMP. Such responses count as successful exchanges.
+	Refusals int64
+
+	// LastRTT is the round-trip time of the last successful query. SRTT
+	// and RTTVar are the smoothed round-trip time and its variation,
+	// computed from all successful queries as described in RFC 6298,
+	// section 2. All three are zero if no query has succeeded yet.
+	LastRTT time.Duration
+	SRTT    time.Duration
+	RTTVar  time.Duration
+}
+
+// serverHealth holds the ServerHealth of each name server that a Resolver
+// has queried. All methods are safe for concurrent use and may be called on
+// a nil *serverHealth.
+type serverHealth struct {
+	mu      sync.Mutex
+	servers map[string]ServerHealth
+}
+
+func newServerHealth() *serverHealth {
+	return &serverHealth{
+		servers: map[string]ServerHealth{},
+	}
+}
+
+func (h *serverHealth) get(addr string) ServerHealth {
+	if h == nil {
+		return ServerHealth{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.servers[addr]
+}
+
+// refused counts a response from the server at addr with the response code
+// REFUSED or NOTIMP.
+func (h *serverHealth) refused(addr string) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.servers[addr]
+	if !ok && len(h.servers) >= maxServerModes {
+		h.servers = map[string]ServerHealth{}
+	}
+	s.Refusals++
+	h.servers[addr] = s
+}
+
+// record updates the health of the server at addr after a query that has
+// been sent to it, which took rtt and failed with err, if not nil. Queries
+// that have been canceled are not taken into account, since the server
+// can't be blamed for that.
+func (h *serverHealth) record(addr string, rtt time.Duration, err error) {
+	if h == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.servers[addr]
+	if !ok && len(h.servers) >= maxServerModes {
+		h.servers = map[string]ServerHealth{}
+	}
+
+	s.Exchanges++
+	switch {
+	case err != nil:
+		s.Failures++
+		s.ConsecutiveFailures++
+	case s.SRTT == 0:
+		s.ConsecutiveFailures = 0
+		s.LastRTT = rtt
+		s.SRTT = rtt
+		s.RTTVar = rtt / 2
+	default:
+		s.ConsecutiveFailures = 0
+		s.LastRTT = rtt
+		delta := s.SRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.RTTVar = (3*s.RTTVar + delta) / 4
+		s.SRTT = (7*s.SRTT + rtt) / 8
+	}
+
+	h.servers[addr] = s
+}
+
+// isRefusal reports whether m is a response with the response code REFUSED
+// or NOTIMP.
+func isRefusal(m *dns.Msg) bool {
+	return m != nil && (m.Rcode == dns.RcodeRefused || m.Rcode == dns.RcodeNotImplemented)
+}
+
+// demoteRefusing sorts addrs by the number of queries that the servers have
+// refused, retaining the order of servers with equal counts.
+func (r *resolver) demoteRefusing(addrs []string) {
+	if len(addrs) < 2 {
+		return
+	}
+
+	refusals := func(addr string) int64 {
+		return r.health.get(r.withPort(addr)).Refusals
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return refusals(addrs[i]) < refusals(addrs[j])
+	})
+}
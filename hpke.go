@@ -0,0 +1,223 @@
+package dnsresolver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Identifiers of the HPKE algorithms (RFC 9180, section 7) that are
+// supported for Oblivious DoH.
+const (
+	hpkeKEMP256HKDFSHA256 = 0x0010
+	hpkeKDFHKDFSHA256     = 0x0001
+	hpkeAEADAES128GCM     = 0x0001
+	hpkeAEADAES256GCM     = 0x0002
+)
+
+// hpkeNonceSize is Nn of the supported AEADs.
+const hpkeNonceSize = 12
+
+// hpkeSuite is a combination of an HPKE KEM, KDF, and AEAD. Only the base
+// mode of HPKE (RFC 9180, section 5.1.1) is implemented, with
+// DHKEM(P-256, HKDF-SHA256), HKDF-SHA256, and AES-GCM.
+type hpkeSuite struct {
+	kem, kdf, aead uint16
+}
+
+// supported reports whether s can be used with setupBaseS.
+func (s hpkeSuite) supported() bool {
+	return s.kem == hpkeKEMP256HKDFSHA256 && s.kdf == hpkeKDFHKDFSHA256 &&
+		(s.aead == hpkeAEADAES128GCM || s.aead == hpkeAEADAES256GCM)
+}
+
+// keySize returns Nk, the key size of the AEAD of s.
+func (s hpkeSuite) keySize() int {
+	if s.aead == hpkeAEADAES256GCM {
+		return 32
+	}
+
+	return 16
+}
+
+func (s hpkeSuite) kemSuiteID() []byte {
+	id := []byte("KEM")
+	return appendUint16(id, s.kem)
+}
+
+func (s hpkeSuite) suiteID() []byte {
+	id := []byte("HPKE")
+	id = appendUint16(id, s.kem)
+	id = appendUint16(id, s.kdf)
+	return appendUint16(id, s.aead)
+}
+
+// setupBaseS generates an ephemeral key pair and returns the encapsulated
+// key and the encryption context for the recipient's public key pkR, which
+// is an uncompressed P-256 point.
+func (s hpkeSuite) setupBaseS(rand io.Reader, pkR, info []byte) (enc []byte, ctx *hpkeContext, err error) {
+	if !s.supported() {
+		return nil, nil, errors.New("unsupported HPKE suite")
+	}
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, pkR)
+	if x == nil {
+		return nil, nil, errors.New("invalid HPKE public key")
+	}
+	skE, ex, ey, err := elliptic.GenerateKey(curve, rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = elliptic.Marshal(curve, ex, ey)
+
+	dhx, _ := curve.ScalarMult(x, y, skE)
+	dh := make([]byte, 32)
+	dhx.FillBytes(dh)
+
+	ctx, err = s.keySchedule(s.extractAndExpand(dh, concatBytes(enc, pkR)), info)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, ctx, nil
+}
+
+// extractAndExpand derives the KEM shared secret from the Diffie-Hellman
+// shared secret dh.
+func (s hpkeSuite) extractAndExpand(dh, kemContext []byte) []byte {
+	id := s.kemSuiteID()
+	prk := labeledExtract(id, nil, "eae_prk", dh)
+
+	return labeledExpand(id, prk, "shared_secret", kemContext, sha256.Size)
+}
+
+// keySchedule returns the encryption context for the KEM shared secret in
+// the base mode.
+func (s hpkeSuite) keySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	id := s.suiteID()
+	pskIDHash := labeledExtract(id, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(id, nil, "info_hash", info)
+	keyScheduleContext := concatBytes([]byte{0x00}, pskIDHash, infoHash)
+
+	secret := labeledExtract(id, sharedSecret, "secret", nil)
+	key := labeledExpand(id, secret, "key", keyScheduleContext, s.keySize())
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hpkeContext{
+		suiteID:        id,
+		aead:           aead,
+		baseNonce:      labeledExpand(id, secret, "base_nonce", keyScheduleContext, hpkeNonceSize),
+		exporterSecret: labeledExpand(id, secret, "exp", keyScheduleContext, sha256.Size),
+	}, nil
+}
+
+// hpkeContext is an HPKE encryption context.
+type hpkeContext struct {
+	suiteID        []byte
+	aead           cipher.AEAD
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+}
+
+// seal encrypts plaintext with the next nonce.
+func (c *hpkeContext) seal(aad, plaintext []byte) []byte {
+	ct := c.aead.Seal(nil, c.nonce(), plaintext, aad)
+	c.seq++
+
+	return ct
+}
+
+// open decrypts ciphertext with the next nonce.
+func (c *hpkeContext) open(aad, ciphertext []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nonce(), ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+
+	return pt, nil
+}
+
+func (c *hpkeContext) nonce() []byte {
+	nonce := append([]byte(nil), c.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[len(nonce)-len(seq)+i] ^= seq[i]
+	}
+
+	return nonce
+}
+
+// export derives a secret of the given length from the context.
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterContext, length)
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	return hkdfExtract(salt, concatBytes([]byte("HPKE-v1"), suiteID, []byte(label), ikm))
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := appendUint16(nil, uint16(length))
+	labeledInfo = concatBytes(labeledInfo, []byte("HPKE-v1"), suiteID, []byte(label), info)
+
+	return hkdfExpand(prk, labeledInfo, length)
+}
+
+// hkdfExtract and hkdfExpand implement HKDF-SHA256 (RFC 5869).
+func hkdfExtract(salt, ikm []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+
+	return out[:length]
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+
+	return out
+}
@@ -0,0 +1,70 @@
+package dnsresolver
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHPKEKey returns a P-256 key pair for tests: the private key and the
+// uncompressed public key.
+func newHPKEKey(t *testing.T) (skR, pkR []byte) {
+	curve := elliptic.P256()
+	skR, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+	require.NoError(t, err)
+
+	return skR, elliptic.Marshal(curve, x, y)
+}
+
+// setupBaseR is the recipient's counterpart of hpkeSuite.setupBaseS.
+func setupBaseR(t *testing.T, s hpkeSuite, enc, skR, pkR, info []byte) *hpkeContext {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, enc)
+	require.NotNil(t, x)
+	dhx, _ := curve.ScalarMult(x, y, skR)
+	dh := make([]byte, 32)
+	dhx.FillBytes(dh)
+
+	ctx, err := s.keySchedule(s.extractAndExpand(dh, concatBytes(enc, pkR)), info)
+	require.NoError(t, err)
+
+	return ctx
+}
+
+func TestHPKE(t *testing.T) {
+	for _, aead := range []uint16{hpkeAEADAES128GCM, hpkeAEADAES256GCM} {
+		s := hpkeSuite{kem: hpkeKEMP256HKDFSHA256, kdf: hpkeKDFHKDFSHA256, aead: aead}
+		skR, pkR := newHPKEKey(t)
+
+		enc, sender, err := s.setupBaseS(rand.Reader, pkR, []byte("info"))
+		require.NoError(t, err)
+		assert.Len(t, enc, 65)
+		ct1 := sender.seal([]byte("aad 1"), []byte("first"))
+		ct2 := sender.seal([]byte("aad 2"), []byte("second"))
+
+		recipient := setupBaseR(t, s, enc, skR, pkR, []byte("info"))
+		_, err = recipient.open([]byte("aad 2"), ct1)
+		assert.Error(t, err)
+		pt, err := recipient.open([]byte("aad 1"), ct1)
+		require.NoError(t, err)
+		assert.Equal(t, "first", string(pt))
+		pt, err = recipient.open([]byte("aad 2"), ct2)
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(pt))
+
+		assert.Equal(t, sender.export([]byte("ctx"), 16), recipient.export([]byte("ctx"), 16))
+		assert.NotEqual(t, sender.export([]byte("ctx"), 16), sender.export([]byte("other"), 16))
+
+		other := setupBaseR(t, s, enc, skR, pkR, []byte("other info"))
+		_, err = other.open([]byte("aad 1"), ct1)
+		assert.Error(t, err)
+	}
+
+	_, _, err := hpkeSuite{kem: 0x0020, kdf: hpkeKDFHKDFSHA256, aead: hpkeAEADAES128GCM}.setupBaseS(rand.Reader, make([]byte, 32), nil)
+	assert.Error(t, err)
+	_, _, err = hpkeSuite{kem: hpkeKEMP256HKDFSHA256, kdf: hpkeKDFHKDFSHA256, aead: hpkeAEADAES128GCM}.setupBaseS(rand.Reader, make([]byte, 65), nil)
+	assert.Error(t, err)
+}
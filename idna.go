@@ -0,0 +1,70 @@
+package dnsresolver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+var (
+	lenientIDNA = idna.New(idna.MapForLookup(), idna.Transitional(false))
+	strictIDNA  = idna.New(idna.ValidateForRegistration())
+)
+
+// toASCII converts the internationalized domain name name to its ASCII form
+// and returns it as a canonical, i.e. fully qualified and lower case, name.
+// Names consisting only of ASCII characters are only canonicalized. name must
+// not have been canonicalized already, since that would map upper case
+// letters in U-labels, which the strict profile rejects. Labels consisting
+// only of ASCII characters are case-insensitive either way.
+func toASCII(name string, strict bool) (string, error) {
+	if isASCII(name) {
+		return dns.CanonicalName(name), nil
+	}
+
+	profile := lenientIDNA
+	if strict {
+		profile = strictIDNA
+	}
+
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			labels[i] = strings.ToLower(label)
+		}
+	}
+
+	ascii, err := profile.ToASCII(strings.Join(labels, "."))
+	if err != nil {
+		return "", err
+	}
+
+	return dns.CanonicalName(ascii), nil
+}
+
+// DisplayName converts the labels of name that are in their ASCII form
+// ("xn--" labels) to Unicode, for display purposes. If name is not a valid
+// internationalized domain name, it is returned unchanged.
+func DisplayName(name string) string {
+	if !strings.Contains(name, "xn--") {
+		return name
+	}
+
+	s, err := idna.Display.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+
+	return s
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+
+	return true
+}
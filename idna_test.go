@@ -0,0 +1,103 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToASCII(t *testing.T) {
+	cases := []struct {
+		fqdn    string
+		strict  bool
+		want    string
+		wantErr bool
+	}{
+		{fqdn: "example.com.", want: "example.com."},
+		{fqdn: "Example.COM", want: "example.com."},
+		{fqdn: "_sip._tcp.example.com.", want: "_sip._tcp.example.com."},
+		{fqdn: "bücher.example.", want: "xn--bcher-kva.example."},
+		{fqdn: "Bücher.example.", want: "xn--bcher-kva.example."},
+		{fqdn: "faß.example.", want: "xn--fa-hia.example."},
+		{fqdn: "bücher.example.", strict: true, want: "xn--bcher-kva.example."},
+		{fqdn: "Bücher.example.", strict: true, wantErr: true},
+		{fqdn: "Bücher.Example.", want: "xn--bcher-kva.example."},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.fqdn, func(t *testing.T) {
+			got, err := toASCII(tc.fqdn, tc.strict)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	assert.Equal(t, "bücher.example.", DisplayName("xn--bcher-kva.example."))
+	assert.Equal(t, "example.com.", DisplayName("example.com."))
+}
+
+func TestResolver_Query_IDN(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A xn--bcher-kva.example.").DelegateTo("example.", expSrv.IP())
+	expSrv.ExpectQuery("A xn--bcher-kva.example.").Respond().
+		Answer(
+			A(t, "xn--bcher-kva.example.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "bücher.example")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, "bücher.example", rs.Name)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+}
+
+func TestResolver_Query_StrictIDNA(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.StrictIDNA = true
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A xn--bcher-kva.example.").DelegateTo("example.", expSrv.IP())
+	expSrv.ExpectQuery("A xn--bcher-kva.example.").Respond().
+		Answer(
+			A(t, "xn--bcher-kva.example.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Upper case U-labels are not in their canonical form and rejected
+	// before any query is sent.
+	_, err := r.Query(ctx, "A", "Bücher.example")
+	assert.Error(t, err)
+
+	// The ASCII parts of the name are case-insensitive nonetheless.
+	rs, err := r.Query(ctx, "A", "bücher.EXAMPLE")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+}
@@ -0,0 +1,163 @@
+package dnsresolver
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// jsonRecordSet is the JSON representation of a RecordSet. Durations are
+// expressed in seconds.
+type jsonRecordSet struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	Rcode         string          `json:"rcode,omitempty"`
+	TTL           float64         `json:"ttl"`
+	Values        []string        `json:"values"`
+	Chain         []string        `json:"chain,omitempty"`
+	Authoritative bool            `json:"authoritative,omitempty"`
+	Server        string          `json:"server,omitempty"`
+	ServersTried  []string        `json:"servers_tried,omitempty"`
+	RTT           float64         `json:"rtt"`
+	Age           float64         `json:"age"`
+	ZoneCuts      []jsonZoneCut   `json:"zone_cuts,omitempty"`
+	Warnings      []string        `json:"warnings,omitempty"`
+	Trace         []jsonTraceNode `json:"trace,omitempty"`
+}
+
+// jsonZoneCut is the JSON representation of a ZoneCut.
+type jsonZoneCut struct {
+	Zone        string   `json:"zone"`
+	Parent      string   `json:"parent,omitempty"`
+	Server      string   `json:"server,omitempty"`
+	NameServers []string `json:"name_servers,omitempty"`
+}
+
+// jsonTraceNode is the JSON representation of a TraceNode. Records are in
+// presentation format, with single spaces between fields.
+type jsonTraceNode struct {
+	Question string          `json:"question"`
+	Server   string          `json:"server"`
+	RTT      float64         `json:"rtt"`
+	Age      float64         `json:"age"`
+	Cached   bool            `json:"cached,omitempty"`
+	Rcode    string          `json:"rcode,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Answer   []string        `json:"answer,omitempty"`
+	Ns       []string        `json:"authority,omitempty"`
+	Extra    []string        `json:"additional,omitempty"`
+	Children []jsonTraceNode `json:"children,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. The JSON representation of a
+// RecordSet is an object with the keys "name", "type", "rcode", "ttl",
+// "values", "chain", "authoritative", "server", "servers_tried", "rtt",
+// "age", "zone_cuts", "warnings", and "trace". Durations are expressed in
+// seconds; age is negative if the response hasn't been cached. Zone cuts are
+// objects with the keys "zone", "parent", "server", and "name_servers". The
+// trace is included if rs.Trace is not nil; see Trace.MarshalJSON. Keys are
+// omitted if their value is empty, except for name, type, ttl, values, rtt,
+// and age.
+//
+// The representation is stable across releases of this package, but new
+// keys may be added.
+func (rs RecordSet) MarshalJSON() ([]byte, error) {
+	x := jsonRecordSet{
+		Name:          rs.Name,
+		Type:          rs.Type,
+		Rcode:         rs.Rcode,
+		TTL:           rs.TTL.Seconds(),
+		Values:        rs.Values,
+		Chain:         rs.Chain,
+		Authoritative: rs.Authoritative,
+		Server:        rs.ServerAddr,
+		ServersTried:  rs.ServersTried,
+		RTT:           rs.RTT.Seconds(),
+		Age:           rs.Age.Seconds(),
+		Trace:         rs.Trace.jsonNodes(),
+	}
+	if x.Values == nil {
+		x.Values = []string{}
+	}
+	for _, c := range rs.ZoneCuts {
+		x.ZoneCuts = append(x.ZoneCuts, jsonZoneCut(c))
+	}
+	for _, w := range rs.Warnings {
+		x.Warnings = append(x.Warnings, w.Error())
+	}
+
+	return json.Marshal(x)
+}
+
+// MarshalJSON implements json.Marshaler. The JSON representation of a Trace
+// is an array of the top-level queries. Each query is an object with the
+// keys "question", "server", "rtt", "age", "cached", "rcode", "error",
+// "answer", "authority", "additional", and "children", which is an array of
+// the nested queries. Records are in presentation format; EDNS OPT records
+// are omitted.
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	nodes := t.jsonNodes()
+	if nodes == nil {
+		nodes = []jsonTraceNode{}
+	}
+
+	return json.Marshal(nodes)
+}
+
+func (t *Trace) jsonNodes() []jsonTraceNode {
+	if t == nil {
+		return nil
+	}
+
+	return newJSONTraceNodes(t.Queries)
+}
+
+func newJSONTraceNodes(nodes []*TraceNode) []jsonTraceNode {
+	var out []jsonTraceNode
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+
+		x := jsonTraceNode{
+			Server:   n.Server,
+			RTT:      n.RTT.Seconds(),
+			Age:      n.Age.Seconds(),
+			Cached:   n.CacheHit,
+			Children: newJSONTraceNodes(n.Children),
+		}
+		if n.Error != nil {
+			x.Error = n.Error.Error()
+		}
+		if m := n.Message; m != nil {
+			if len(m.Question) > 0 {
+				q := m.Question[0]
+				x.Question = q.Name + " " + dns.ClassToString[q.Qclass] + " " + dns.TypeToString[q.Qtype]
+			}
+			if m.Response {
+				x.Rcode = dns.RcodeToString[m.Rcode]
+			}
+			x.Answer = jsonRecords(m.Answer)
+			x.Ns = jsonRecords(m.Ns)
+			x.Extra = jsonRecords(m.Extra)
+		}
+		out = append(out, x)
+	}
+
+	return out
+}
+
+// jsonRecords formats rrs in presentation format, skipping OPT
+// pseudo-records.
+func jsonRecords(rrs []dns.RR) []string {
+	var out []string
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, strings.Join(strings.Fields(rr.String()), " "))
+	}
+
+	return out
+}
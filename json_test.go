@@ -0,0 +1,93 @@
+package dnsresolver
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordSet_MarshalJSON(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+	resp.SetEdns0(1232, false)
+
+	rs := RecordSet{
+		Name:         "www.example.com",
+		Type:         "A",
+		Rcode:        "NOERROR",
+		TTL:          300 * time.Second,
+		Values:       []string{"192.0.2.1"},
+		ServerAddr:   "192.0.2.53:53",
+		ServersTried: []string{"192.0.2.1:53", "192.0.2.53:53"},
+		RTT:          20 * time.Millisecond,
+		Age:          -1 * time.Second,
+		ZoneCuts: []ZoneCut{
+			{Zone: "."},
+			{Zone: "com.", Parent: ".", Server: "192.0.2.250:53", NameServers: []string{"a.gtld.test."}},
+		},
+		Warnings: []error{errors.New("something odd")},
+		Trace: &Trace{
+			Queries: []*TraceNode{
+				{Server: "192.0.2.53:53", Message: resp, RTT: 20 * time.Millisecond, Age: -1 * time.Second},
+			},
+		},
+	}
+
+	b, err := json.Marshal(rs)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"name": "www.example.com",
+		"type": "A",
+		"rcode": "NOERROR",
+		"ttl": 300,
+		"values": ["192.0.2.1"],
+		"server": "192.0.2.53:53",
+		"servers_tried": ["192.0.2.1:53", "192.0.2.53:53"],
+		"rtt": 0.02,
+		"age": -1,
+		"zone_cuts": [
+			{"zone": "."},
+			{"zone": "com.", "parent": ".", "server": "192.0.2.250:53", "name_servers": ["a.gtld.test."]}
+		],
+		"warnings": ["something odd"],
+		"trace": [{
+			"question": "www.example.com. IN A",
+			"server": "192.0.2.53:53",
+			"rtt": 0.02,
+			"age": -1,
+			"rcode": "NOERROR",
+			"answer": ["www.example.com. 300 IN A 192.0.2.1"]
+		}]
+	}`, string(b))
+
+	rs.Trace = nil
+	rs.Values = nil
+	rs.Warnings = nil
+	rs.ServersTried = nil
+	rs.ZoneCuts = nil
+	b, err = json.Marshal(rs)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"name": "www.example.com",
+		"type": "A",
+		"rcode": "NOERROR",
+		"ttl": 300,
+		"values": [],
+		"server": "192.0.2.53:53",
+		"rtt": 0.02,
+		"age": -1
+	}`, string(b))
+
+	b, err = json.Marshal(&Trace{})
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(b))
+}
@@ -0,0 +1,333 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errConnLost is returned by pipeConn.exchange if the connection has been
+// closed or has failed before the response arrived.
+var errConnLost = errors.New("connection lost")
+
+// errConnIdle is the reason for closing connections that are no longer
+// needed.
+var errConnIdle = errors.New("connection idle")
+
+// tcpConns keeps a TCP or TLS connection to each name server open, over which
+// queries are pipelined (RFC 7766), for as long as the server allows with the
+// edns-tcp-keepalive option (RFC 7828). It is shared by all defaultExchangers
+// of a Resolver.
+type tcpConns struct {
+	mu    sync.Mutex
+	conns map[string]*pipeConn // by network and address
+}
+
+func newTCPConns() *tcpConns {
+	return &tcpConns{
+		conns: map[string]*pipeConn{},
+	}
+}
+
+// get returns the open connection to addr via network, or nil.
+func (p *tcpConns) get(network, addr string) *pipeConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.conns[network+" "+addr]
+}
+
+// add starts reading responses from conn, and keeps it open for subsequent
+// queries unless there is an open connection to addr already.
+func (p *tcpConns) add(network, addr string, conn *dns.Conn) *pipeConn {
+	c := &pipeConn{
+		conn:    conn,
+		key:     network + " " + addr,
+		pool:    p,
+		pending: map[uint16]*pipeCall{},
+	}
+
+	p.mu.Lock()
+	if p.conns[c.key] == nil {
+		p.conns[c.key] = c
+		c.managed = true
+	}
+	p.mu.Unlock()
+
+	go c.read()
+
+	return c
+}
+
+func (p *tcpConns) remove(c *pipeConn) {
+	p.mu.Lock()
+	if p.conns[c.key] == c {
+		delete(p.conns, c.key)
+	}
+	p.mu.Unlock()
+}
+
+// pipeConn is a TCP or TLS connection to a name server over which queries are
+// pipelined (RFC 7766, section 6.2.1.1): queries are sent without waiting for
+// the responses to earlier queries, and responses are matched to the queries
+// by ID and question in whatever order they arrive.
+type pipeConn struct {
+	conn *dns.Conn
+	key  string
+	pool *tcpConns
+
+	// managed is true if the connection is kept open for reuse, i.e. it is
+	// in pool. Otherwise it is closed as soon as it is idle.
+	managed bool
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	pending   map[uint16]*pipeCall
+	keepalive time.Duration // advertised by the server with the last response
+	idle      *time.Timer   // closes the connection when it has been idle for keepalive
+	err       error         // the reason why the connection has been closed
+}
+
+// pipeCall is a query that is waiting for its response.
+type pipeCall struct {
+	q  dns.Question
+	ch chan pipeResult // buffered
+}
+
+type pipeResult struct {
+	resp *wireMsg
+	err  error
+}
+
+// exchange sends query, which is m in wire format, over c, and waits for the
+// response until ctx is done or deadline has passed. If the ID of m is
+// already in use by another query, a different ID is sent, but the returned
+// response carries the ID of m.
+func (c *pipeConn) exchange(ctx context.Context, m *dns.Msg, query []byte, deadline time.Time) (*wireMsg, error) {
+	call := &pipeCall{q: m.Question[0], ch: make(chan pipeResult, 1)}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %v", errConnLost, c.err)
+	}
+	id := m.Id
+	for c.pending[id] != nil {
+		id = dns.Id()
+	}
+	c.pending[id] = call
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	c.mu.Unlock()
+	defer c.done(id, call)
+
+	if id != m.Id {
+		query = append([]byte(nil), query...)
+		binary.BigEndian.PutUint16(query, id)
+	}
+
+	c.writeMu.Lock()
+	err := c.conn.SetWriteDeadline(deadline)
+	if err == nil {
+		_, err = c.conn.Write(query)
+	}
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(err, false)
+		return nil, fmt.Errorf("%w: %v", errConnLost, err)
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case r := <-call.ch:
+		if r.resp != nil {
+			r.resp.Id = m.Id
+		}
+		return r.resp, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// done removes the query with the given ID unless its response has arrived,
+// and closes c or arranges for it to be closed if no more queries are
+// pending.
+func (c *pipeConn) done(id uint16, call *pipeCall) {
+	c.mu.Lock()
+	if c.pending[id] == call {
+		delete(c.pending, id)
+	}
+	closeNow := false
+	if len(c.pending) == 0 && c.err == nil {
+		if c.managed && c.keepalive > 0 {
+			// The connection may already be idle if done has been
+			// called for a query whose response has been delivered.
+			if c.idle != nil {
+				c.idle.Stop()
+			}
+			c.idle = time.AfterFunc(c.keepalive, func() { c.close(errConnIdle, true) })
+		} else {
+			closeNow = true
+		}
+	}
+	c.mu.Unlock()
+
+	if closeNow {
+		c.close(errConnIdle, true)
+	}
+}
+
+// read delivers the responses that arrive over c to the pending queries
+// until the connection fails or is closed.
+func (c *pipeConn) read() {
+	for {
+		resp, err := readMsg(c.conn)
+		if resp == nil {
+			c.close(err, false)
+			return
+		}
+		if len(resp.wire) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(resp.wire)
+
+		c.mu.Lock()
+		call := c.pending[id]
+		if call != nil && err == nil && !sameQuestion(resp.Msg, call.q) {
+			call = nil // response to an unrelated query
+		}
+		if call != nil {
+			delete(c.pending, id)
+			if err == nil {
+				c.keepalive = keepaliveTimeout(resp.Msg)
+			}
+		}
+		c.mu.Unlock()
+
+		if call != nil {
+			call.ch <- pipeResult{resp: resp, err: err}
+		}
+	}
+}
+
+// sameQuestion reports whether m is a response to a query for q.
+func sameQuestion(m *dns.Msg, q dns.Question) bool {
+	if len(m.Question) == 0 {
+		// Some servers omit the question from error responses.
+		return m.Rcode != dns.RcodeSuccess
+	}
+	got := m.Question[0]
+
+	return got.Qtype == q.Qtype && got.Qclass == q.Qclass && strings.EqualFold(got.Name, q.Name)
+}
+
+// close closes c, if onlyIfIdle is false or no queries are pending, and
+// fails the pending queries with errConnLost.
+func (c *pipeConn) close(reason error, onlyIfIdle bool) {
+	c.mu.Lock()
+	if c.err != nil || onlyIfIdle && len(c.pending) > 0 {
+		c.mu.Unlock()
+		return
+	}
+	if reason == nil {
+		reason = errConnIdle
+	}
+	c.err = reason
+	pending := c.pending
+	c.pending = map[uint16]*pipeCall{}
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+	c.mu.Unlock()
+
+	c.pool.remove(c)
+	c.conn.Close()
+
+	for _, call := range pending {
+		call.ch <- pipeResult{err: fmt.Errorf("%w: %v", errConnLost, reason)}
+	}
+}
+
+// keepaliveTimeout returns the idle timeout that the server has advertised
+// with the edns-tcp-keepalive option in m, or zero.
+func keepaliveTimeout(m *dns.Msg) time.Duration {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+	for _, o := range opt.Option {
+		if k, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			return time.Duration(k.Timeout) * 100 * time.Millisecond
+		}
+	}
+
+	return 0
+}
+
+// exchangeKeepalive sends m, which must contain an EDNS0 OPT record, to addr
+// via network, "tcp" or "tcp-tls", with the edns-tcp-keepalive option. The
+// open connection to the server is used if there is one, even if other
+// queries are waiting for their responses, and the connection is kept open
+// afterwards if the server allows it.
+func (x *defaultExchanger) exchangeKeepalive(ctx context.Context, c *dns.Client, network string, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	m = m.Copy()
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(2 * time.Second)
+	}
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	capture := wireCaptureFrom(ctx)
+	capture.setQuery(query)
+
+	start := time.Now()
+	if pc := x.conns.get(network, addr); pc != nil {
+		resp, err := pc.exchange(ctx, m, query, deadline)
+		if resp != nil {
+			capture.setResponse(resp.wire)
+		}
+		if err == nil {
+			return resp.Msg, time.Since(start), nil
+		}
+		if !errors.Is(err, errConnLost) || ctx.Err() != nil {
+			return nil, time.Since(start), err
+		}
+		// The server has closed the connection in the meantime, so try
+		// again with a new one.
+	}
+
+	conn, err := c.DialContext(ctx, addr)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	resp, err := x.conns.add(network, addr, conn).exchange(ctx, m, query, deadline)
+	if resp != nil {
+		capture.setResponse(resp.wire)
+	}
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+
+	return resp.Msg, time.Since(start), nil
+}
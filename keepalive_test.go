@@ -0,0 +1,175 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultExchanger_TCPKeepalive(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		clients []string
+		timeout uint16 = 10 // 1s
+	)
+
+	addr := "127.0.0.67:5354"
+	startServer(t, "tcp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		mu.Lock()
+		clients = append(clients, w.RemoteAddr().String())
+		timeout := timeout
+		mu.Unlock()
+
+		m := new(dns.Msg).SetReply(req)
+		m.Answer = []dns.RR{A(t, req.Question[0].Name, 10, "192.0.2.1")}
+		if opt := req.IsEdns0(); opt != nil {
+			keepalive := false
+			for _, o := range opt.Option {
+				if _, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+					keepalive = true
+				}
+			}
+			assert.True(t, keepalive)
+
+			m.SetEdns0(1232, false)
+			if timeout > 0 {
+				m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: timeout}}
+			}
+		}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{serverModes: newServerModes(), conns: newTCPConns()}
+	exchange := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		resp, _, err := x.exchangeVia(ctx, "tcp", query("www.example.", dns.TypeA), addr, ednsUDPSize)
+		require.NoError(t, err)
+		assert.Len(t, resp.Answer, 1)
+	}
+
+	exchange()
+	exchange()
+	exchange()
+
+	mu.Lock()
+	require.Len(t, clients, 3)
+	assert.Equal(t, clients[0], clients[1])
+	assert.Equal(t, clients[0], clients[2])
+	timeout = 0
+	mu.Unlock()
+
+	exchange() // reuses the connection, which is closed afterwards
+	exchange()
+
+	mu.Lock()
+	require.Len(t, clients, 5)
+	assert.Equal(t, clients[0], clients[3])
+	assert.NotEqual(t, clients[3], clients[4])
+	mu.Unlock()
+
+	assert.Empty(t, x.conns.conns)
+}
+
+func TestDefaultExchanger_TCPPipelining(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.68:5354")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	// The server reads two queries, answers them in reverse order, and then
+	// closes the connection.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &dns.Conn{Conn: conn}
+
+		var queries []*dns.Msg
+		for len(queries) < 2 {
+			q, err := c.ReadMsg()
+			if err != nil {
+				return
+			}
+			queries = append(queries, q)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			m := new(dns.Msg).SetReply(queries[i])
+			m.Answer = []dns.RR{A(t, queries[i].Question[0].Name, 10, "192.0.2.1")}
+			m.SetEdns0(1232, false)
+			m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Timeout: 100}}
+			c.WriteMsg(m)
+		}
+	}()
+
+	x := &defaultExchanger{serverModes: newServerModes(), conns: newTCPConns()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// The first query opens the connection, so that the second one is
+	// pipelined. Both use the same ID.
+	qa, qb := query("a.example.", dns.TypeA), query("b.example.", dns.TypeA)
+	qa.Id, qb.Id = 1, 1
+
+	first := make(chan error, 1)
+	go func() {
+		resp, _, err := x.exchangeVia(ctx, "tcp", qa, ln.Addr().String(), ednsUDPSize)
+		if err == nil && resp.Question[0].Name != "a.example." {
+			err = errors.New("wrong response: " + resp.Question[0].Name)
+		}
+		first <- err
+	}()
+	for x.conns.get("tcp", ln.Addr().String()) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, _, err := x.exchangeVia(ctx, "tcp", qb, ln.Addr().String(), ednsUDPSize)
+	require.NoError(t, err)
+	assert.Equal(t, "b.example.", resp.Question[0].Name)
+	assert.Equal(t, uint16(1), resp.Id)
+	require.NoError(t, <-first)
+
+	// The server closes the connection, which is detected and replaced
+	// with a new one by the next query.
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &dns.Conn{Conn: conn}
+		q, err := c.ReadMsg()
+		if err != nil {
+			return
+		}
+		m := new(dns.Msg).SetReply(q)
+		c.WriteMsg(m)
+	}()
+	_, _, err = x.exchangeVia(ctx, "tcp", query("c.example.", dns.TypeA), ln.Addr().String(), ednsUDPSize)
+	assert.NoError(t, err)
+}
+
+func TestPipeConn_Done(t *testing.T) {
+	c := &pipeConn{
+		managed:   true,
+		keepalive: time.Hour,
+		pending:   map[uint16]*pipeCall{},
+	}
+
+	// Both queries have had their responses delivered already.
+	c.done(1, &pipeCall{})
+	idle := c.idle
+	c.done(2, &pipeCall{})
+	defer c.idle.Stop()
+
+	assert.NotSame(t, idle, c.idle)
+	assert.False(t, idle.Stop(), "the replaced timer is still running")
+}
@@ -0,0 +1,356 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// LookupTXT queries the TXT records of domainName.
+//
+// Each returned string is the value of one TXT record, with its
+// character-strings unescaped and concatenated without separators, as
+// expected by SPF (RFC 7208) and DKIM (RFC 6376) verifiers, for instance.
+// Values are returned in the order sent by the server.
+//
+// The returned RecordSet and error are the same as for Resolver.Query.
+func (r *Resolver) LookupTXT(ctx context.Context, domainName string) ([]string, RecordSet, error) {
+	rs, err := r.Query(ctx, "TXT", domainName)
+	if err != nil {
+		return nil, rs, err
+	}
+
+	var txts []string
+	for _, rr := range rs.records() {
+		if rr, ok := rr.(*dns.TXT); ok {
+			var buf strings.Builder
+			for _, s := range rr.Txt {
+				buf.WriteString(unescapeCharString(s))
+			}
+			txts = append(txts, buf.String())
+		}
+	}
+
+	return txts, rs, nil
+}
+
+// MXRecord is a parsed MX record.
+type MXRecord struct {
+	// Preference is the preference value of the record. Lower values are
+	// preferred.
+	Preference uint16
+
+	// Host is the fully qualified name of the mail exchange, including the
+	// trailing dot.
+	Host string
+
+	// Addrs contains the IPv6 and IPv4 addresses of Host, if requested.
+	Addrs []string
+}
+
+// LookupMX queries the MX records of domainName and returns them sorted by
+// preference. Records with equal preference remain in the order sent by the
+// server.
+//
+// If resolveHosts is true, the addresses of each mail exchange are resolved
+// as well, using the same resolver (and thus cache). AAAA records are not
+// queried if DisableIP6 is true, A records are not queried if DisableIP4 is
+// true. The queries for the addresses are added to the trace of the returned
+// RecordSet. A null MX record (RFC 7505), i.e. a Host of ".", is never
+// resolved.
+//
+// The returned RecordSet and error are the same as for Resolver.Query, except
+// that errors during address resolution are returned as well.
+func (r *Resolver) LookupMX(ctx context.Context, domainName string, resolveHosts bool) ([]MXRecord, RecordSet, error) {
+	rs, err := r.Query(ctx, "MX", domainName)
+	if err != nil {
+		return nil, rs, err
+	}
+
+	var mxs []MXRecord
+	for _, rr := range rs.records() {
+		if rr, ok := rr.(*dns.MX); ok {
+			mxs = append(mxs, MXRecord{
+				Preference: rr.Preference,
+				Host:       rr.Mx,
+			})
+		}
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Preference < mxs[j].Preference
+	})
+
+	if !resolveHosts {
+		return mxs, rs, nil
+	}
+
+	for i := range mxs {
+		if mxs[i].Host == "." {
+			continue
+		}
+		mxs[i].Addrs, err = r.lookupAddrs(ctx, mxs[i].Host, rs.Trace)
+		if err != nil {
+			return mxs, rs, err
+		}
+	}
+
+	return mxs, rs, nil
+}
+
+// SRVRecord is a parsed SRV record.
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+
+	// Target is the fully qualified name of the host providing the service,
+	// including the trailing dot.
+	Target string
+
+	// Addrs contains the IPv6 and IPv4 addresses of Target, if requested.
+	Addrs []string
+}
+
+// LookupSRV queries the SRV records of _service._proto.name and returns them
+// in the order in which they should be contacted, as described in RFC 2782:
+// sorted by priority, and records of equal priority in a weighted random
+// order. If service and proto are both empty, name is queried directly.
+//
+// If resolveTargets is true, the addresses of each target are resolved as
+// well, like the mail exchanges in Resolver.LookupMX. A target of "." means
+// that the service is not available and is never resolved.
+//
+// The returned RecordSet and error are the same as for Resolver.Query, except
+// that errors during address resolution are returned as well.
+func (r *Resolver) LookupSRV(ctx context.Context, service, proto, name string, resolveTargets bool) ([]SRVRecord, RecordSet, error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+
+	rs, err := r.Query(ctx, "SRV", name)
+	if err != nil {
+		return nil, rs, err
+	}
+
+	var srvs []SRVRecord
+	for _, rr := range rs.records() {
+		if rr, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, SRVRecord{
+				Priority: rr.Priority,
+				Weight:   rr.Weight,
+				Port:     rr.Port,
+				Target:   rr.Target,
+			})
+		}
+	}
+
+	orderSRV(srvs)
+
+	if !resolveTargets {
+		return srvs, rs, nil
+	}
+
+	for i := range srvs {
+		if srvs[i].Target == "." {
+			continue
+		}
+		srvs[i].Addrs, err = r.lookupAddrs(ctx, srvs[i].Target, rs.Trace)
+		if err != nil {
+			return srvs, rs, err
+		}
+	}
+
+	return srvs, rs, nil
+}
+
+// randIntn is rand.Intn, and replaced in tests.
+var randIntn = rand.Intn
+
+// orderSRV sorts srvs by priority and, within each priority, applies the
+// weighted random selection described in RFC 2782.
+func orderSRV(srvs []SRVRecord) {
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		orderByWeight(srvs[i:j])
+		i = j
+	}
+}
+
+func orderByWeight(srvs []SRVRecord) {
+	for len(srvs) > 1 {
+		// Records with weight zero go first, so that they have a very small
+		// chance of being selected.
+		sort.SliceStable(srvs, func(i, j int) bool {
+			return srvs[i].Weight == 0 && srvs[j].Weight != 0
+		})
+
+		sum := 0
+		for _, srv := range srvs {
+			sum += int(srv.Weight)
+		}
+
+		n := randIntn(sum + 1)
+		running := 0
+		for i := range srvs {
+			running += int(srvs[i].Weight)
+			if running >= n {
+				srvs[0], srvs[i] = srvs[i], srvs[0]
+				break
+			}
+		}
+
+		srvs = srvs[1:]
+	}
+}
+
+// NAPTRRecord is a parsed NAPTR record, as described in RFC 3403.
+type NAPTRRecord struct {
+	Order      uint16
+	Preference uint16
+
+	// Flags, Service, and Regexp are the unescaped values of the respective
+	// character-strings.
+	Flags   string
+	Service string
+	Regexp  string
+
+	// Replacement is the fully qualified replacement name, including the
+	// trailing dot, or "." if Regexp is used instead.
+	Replacement string
+}
+
+// LookupNAPTR queries the NAPTR records of domainName and returns them sorted
+// by order and preference, as described in RFC 3403. Records with equal order
+// and preference remain in the order sent by the server.
+//
+// The returned RecordSet and error are the same as for Resolver.Query.
+func (r *Resolver) LookupNAPTR(ctx context.Context, domainName string) ([]NAPTRRecord, RecordSet, error) {
+	rs, err := r.Query(ctx, "NAPTR", domainName)
+	if err != nil {
+		return nil, rs, err
+	}
+
+	var naptrs []NAPTRRecord
+	for _, rr := range rs.records() {
+		if rr, ok := rr.(*dns.NAPTR); ok {
+			naptrs = append(naptrs, NAPTRRecord{
+				Order:       rr.Order,
+				Preference:  rr.Preference,
+				Flags:       unescapeCharString(rr.Flags),
+				Service:     unescapeCharString(rr.Service),
+				Regexp:      unescapeCharString(rr.Regexp),
+				Replacement: rr.Replacement,
+			})
+		}
+	}
+
+	sort.SliceStable(naptrs, func(i, j int) bool {
+		if naptrs[i].Order != naptrs[j].Order {
+			return naptrs[i].Order < naptrs[j].Order
+		}
+		return naptrs[i].Preference < naptrs[j].Preference
+	})
+
+	return naptrs, rs, nil
+}
+
+// TLSARecord is a parsed TLSA record, as described in RFC 6698.
+type TLSARecord struct {
+	// Usage is the certificate usage: 0 (PKIX-TA), 1 (PKIX-EE), 2 (DANE-TA),
+	// or 3 (DANE-EE).
+	Usage uint8
+
+	// Selector specifies which part of the certificate is matched: 0 (full
+	// certificate) or 1 (SubjectPublicKeyInfo).
+	Selector uint8
+
+	// MatchingType specifies how CertData is presented: 0 (exact match), 1
+	// (SHA-256 hash), or 2 (SHA-512 hash).
+	MatchingType uint8
+
+	// CertData is the certificate association data.
+	CertData []byte
+}
+
+// LookupTLSA queries the TLSA records for the service at the given port and
+// protocol (such as "tcp") of host, i.e. the TLSA records of
+// _port._proto.host.
+//
+// DANE (RFC 7671) requires that TLSA records are authenticated with DNSSEC.
+// Resolver does not validate DNSSEC signatures, so the returned records are
+// not fit for DANE authentication and are mostly useful for diagnostics.
+//
+// The returned RecordSet and error are the same as for Resolver.Query.
+func (r *Resolver) LookupTLSA(ctx context.Context, port int, proto, host string) ([]TLSARecord, RecordSet, error) {
+	name := "_" + strconv.Itoa(port) + "._" + proto + "." + host
+
+	rs, err := r.Query(ctx, "TLSA", name)
+	if err != nil {
+		return nil, rs, err
+	}
+
+	var tlsas []TLSARecord
+	for _, rr := range rs.records() {
+		rr, ok := rr.(*dns.TLSA)
+		if !ok {
+			continue
+		}
+
+		data, err := hex.DecodeString(rr.Certificate)
+		if err != nil {
+			continue
+		}
+
+		tlsas = append(tlsas, TLSARecord{
+			Usage:        rr.Usage,
+			Selector:     rr.Selector,
+			MatchingType: rr.MatchingType,
+			CertData:     data,
+		})
+	}
+
+	return tlsas, rs, nil
+}
+
+// lookupAddrs queries the AAAA and A records for host, unless IPv6 or IPv4
+// are disabled, respectively, and adds the queries to trace. Non-existent
+// hosts result in an empty list, not an error.
+func (r *Resolver) lookupAddrs(ctx context.Context, host string, trace *Trace) ([]string, error) {
+	types := make([]string, 0, 2)
+	if !r.DisableIP6 {
+		types = append(types, "AAAA")
+	}
+	if !r.DisableIP4 {
+		types = append(types, "A")
+	}
+
+	var addrs []string
+	for _, typ := range types {
+		rs, err := r.Query(ctx, typ, host)
+		trace.append(rs.Trace)
+		if errors.Is(err, ErrNXDomain) {
+			return nil, nil
+		}
+		if err != nil {
+			return addrs, fmt.Errorf("resolve %s: %w", trimTrailingDot(host), err)
+		}
+		addrs = append(addrs, rs.Values...)
+	}
+
+	return addrs, nil
+}
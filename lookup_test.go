@@ -0,0 +1,265 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_LookupTXT(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("TXT example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("TXT example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("TXT example.com.").Respond().
+		Answer(
+			TXT(t, "example.com.", 321, "v=spf1 include:_spf.example.net ", "-all"),
+			TXT(t, "example.com.", 321, `say \"hello\"\010`),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	txts, rs, err := r.LookupTXT(ctx, "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"v=spf1 include:_spf.example.net -all",
+		"say \"hello\"\n",
+	}, txts)
+	assert.Equal(t, []string{
+		`"v=spf1 include:_spf.example.net " "-all"`,
+		`"say \"hello\"\010"`,
+	}, rs.Values)
+}
+
+func TestResolver_LookupMX(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("MX example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("MX example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("MX example.com.").Respond().
+		Answer(
+			MX(t, "example.com.", 321, 20, "mx2.example.com."),
+			MX(t, "example.com.", 321, 10, "mx1.example.com."),
+		)
+
+	// The delegation to example.com. is cached after the first query.
+	for _, name := range []string{"mx1.example.com.", "mx2.example.com."} {
+		expSrv.ExpectQuery("AAAA " + name).Respond()
+	}
+	expSrv.ExpectQuery("A mx1.example.com.").Respond().
+		Answer(
+			A(t, "mx1.example.com.", 321, "192.0.2.1"),
+		)
+	expSrv.ExpectQuery("A mx2.example.com.").Respond().
+		Answer(
+			A(t, "mx2.example.com.", 321, "192.0.2.2"),
+			A(t, "mx2.example.com.", 321, "192.0.2.3"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	mxs, rs, err := r.LookupMX(ctx, "example.com", true)
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []MXRecord{
+		{Preference: 10, Host: "mx1.example.com.", Addrs: []string{"192.0.2.1"}},
+		{Preference: 20, Host: "mx2.example.com.", Addrs: []string{"192.0.2.2", "192.0.2.3"}},
+	}, mxs)
+	assert.Equal(t, []string{"20 mx2.example.com.", "10 mx1.example.com."}, rs.Values)
+}
+
+func TestResolver_LookupSRV(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("SRV _sip._tcp.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("SRV _sip._tcp.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("SRV _sip._tcp.example.com.").Respond().
+		Answer(
+			SRV(t, "_sip._tcp.example.com.", 321, 20, 0, 5060, "backup.example.com."),
+			SRV(t, "_sip._tcp.example.com.", 321, 10, 0, 5060, "sip1.example.com."),
+		)
+
+	// The delegation to example.com. is cached after the first query.
+	expSrv.ExpectQuery("A sip1.example.com.").Respond().
+		Answer(
+			A(t, "sip1.example.com.", 321, "192.0.2.1"),
+		)
+	expSrv.ExpectQuery("A backup.example.com.").Respond().Status(dns.RcodeNameError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	srvs, rs, err := r.LookupSRV(ctx, "sip", "tcp", "example.com", true)
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SRVRecord{
+		{Priority: 10, Weight: 0, Port: 5060, Target: "sip1.example.com.", Addrs: []string{"192.0.2.1"}},
+		{Priority: 20, Weight: 0, Port: 5060, Target: "backup.example.com."},
+	}, srvs)
+}
+
+func TestResolver_LookupNAPTR(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	arpaSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	name := "4.3.2.1.5.5.5.0.0.8.1.e164.arpa."
+
+	naptr := func(order, pref uint16, flags, service, regexp, replacement string) *dns.NAPTR {
+		rr := RR(t, dns.TypeNAPTR, name, 321).(*dns.NAPTR)
+		rr.Order = order
+		rr.Preference = pref
+		rr.Flags = flags
+		rr.Service = service
+		rr.Regexp = regexp
+		rr.Replacement = replacement
+
+		return rr
+	}
+
+	rootSrv.ExpectQuery("NAPTR "+name).DelegateTo("e164.arpa.", arpaSrv.IP())
+	arpaSrv.ExpectQuery("NAPTR "+name).Respond().
+		Answer(
+			naptr(100, 20, "u", "E2U+mailto", `!^.*$!mailto:info@example.com!`, "."),
+			naptr(100, 10, "u", "E2U+sip", `!^\\+1800555(.*)$!sip:\\1@example.com!`, "."),
+			naptr(90, 50, "s", "SIP+D2T", "", "_sip._tcp.example.com."),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	naptrs, rs, err := r.LookupNAPTR(ctx, name)
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []NAPTRRecord{
+		{Order: 90, Preference: 50, Flags: "s", Service: "SIP+D2T", Replacement: "_sip._tcp.example.com."},
+		{Order: 100, Preference: 10, Flags: "u", Service: "E2U+sip", Regexp: `!^\+1800555(.*)$!sip:\1@example.com!`, Replacement: "."},
+		{Order: 100, Preference: 20, Flags: "u", Service: "E2U+mailto", Regexp: `!^.*$!mailto:info@example.com!`, Replacement: "."},
+	}, naptrs)
+}
+
+func TestResolver_LookupTLSA(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	tlsa := RR(t, dns.TypeTLSA, "_25._tcp.mx.example.com.", 321).(*dns.TLSA)
+	tlsa.Usage = 3
+	tlsa.Selector = 1
+	tlsa.MatchingType = 1
+	tlsa.Certificate = "0123456789abcdef"
+
+	rootSrv.ExpectQuery("TLSA _25._tcp.mx.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("TLSA _25._tcp.mx.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("TLSA _25._tcp.mx.example.com.").Respond().Answer(tlsa)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	tlsas, rs, err := r.LookupTLSA(ctx, 25, "tcp", "mx.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []TLSARecord{
+		{
+			Usage:        3,
+			Selector:     1,
+			MatchingType: 1,
+			CertData:     []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		},
+	}, tlsas)
+}
+
+func TestOrderSRV(t *testing.T) {
+	defer func(f func(int) int) { randIntn = f }(randIntn)
+
+	records := func() []SRVRecord {
+		return []SRVRecord{
+			{Priority: 20, Weight: 5, Target: "d."},
+			{Priority: 10, Weight: 60, Target: "a."},
+			{Priority: 10, Weight: 40, Target: "b."},
+			{Priority: 10, Weight: 0, Target: "c."},
+		}
+	}
+	targets := func(srvs []SRVRecord) []string {
+		var ts []string
+		for _, srv := range srvs {
+			ts = append(ts, srv.Target)
+		}
+		return ts
+	}
+
+	randIntn = func(n int) int { return 0 }
+	srvs := records()
+	orderSRV(srvs)
+	assert.Equal(t, []string{"c.", "a.", "b.", "d."}, targets(srvs))
+
+	randIntn = func(n int) int { return n - 1 }
+	srvs = records()
+	orderSRV(srvs)
+	assert.Equal(t, []string{"b.", "a.", "c.", "d."}, targets(srvs))
+
+	randIntn = func(n int) int { return capInt(61, n-1) }
+	srvs = records()
+	orderSRV(srvs)
+	assert.Equal(t, []string{"b.", "a.", "c.", "d."}, targets(srvs))
+
+	randIntn = func(n int) int { return capInt(60, n-1) }
+	srvs = records()
+	orderSRV(srvs)
+	assert.Equal(t, []string{"a.", "b.", "c.", "d."}, targets(srvs))
+}
+
+func capInt(x, max int) int {
+	if x > max {
+		return max
+	}
+	return x
+}
@@ -0,0 +1,129 @@
+package dnsresolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// mdnsAddr is the address that multicast DNS queries are sent to (RFC 6762).
+const mdnsAddr = "224.0.0.251:5353"
+
+// mdnsMaxSize is the maximum size of multicast DNS messages (RFC 6762,
+// section 17).
+const mdnsMaxSize = 9000
+
+// LocalPolicy determines how a Resolver handles names in the .local domain,
+// which is reserved for multicast DNS (RFC 6762); see Resolver.LocalPolicy.
+type LocalPolicy int
+
+const (
+	// LocalRecurse resolves names in .local like all other names, which
+	// usually results in a NXDOMAIN response from the root name servers.
+	LocalRecurse LocalPolicy = iota
+
+	// LocalReject causes Query to fail with a LocalNameError without
+	// sending any queries.
+	LocalReject
+
+	// LocalMulticast resolves names in .local with a one-shot multicast
+	// DNS query on the local link (RFC 6762, section 5.1), using the first
+	// response. Only IPv4 is supported. Cache and timeout policies apply as
+	// usual.
+	LocalMulticast
+)
+
+// isLocalName reports whether fqdn is in the .local domain.
+func isLocalName(fqdn string) bool {
+	return dns.IsSubDomain("local.", dns.CanonicalName(fqdn))
+}
+
+// queryLocal handles the question of rs, which is in the .local domain,
+// according to policy.
+func (r *resolver) queryLocal(ctx context.Context, rs RecordSet) (RecordSet, error) {
+	if r.localPolicy == LocalReject {
+		err := &LocalNameError{Name: rs.Raw.Question[0].Name}
+		return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	return r.forward(ctx, []string{mdnsAddr}, rs)
+}
+
+// isMulticast reports whether addr is the address of a multicast group.
+func isMulticast(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsMulticast()
+}
+
+// exchangeMulticast sends m to the multicast group at addr from an ephemeral
+// port and returns the first response. Responders send the responses to
+// such queries via unicast (RFC 6762, section 6.7), so they can't be
+// received with a connected socket.
+func (x *defaultExchanger) exchangeMulticast(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	x.stats.sent("udp")
+
+	start := time.Now()
+	if _, err := conn.WriteTo(query, raddr); err != nil {
+		return nil, time.Since(start), err
+	}
+
+	buf := make([]byte, mdnsMaxSize)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return nil, time.Since(start), err
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf[:n]); err != nil || !resp.Response || resp.Id != m.Id {
+			continue
+		}
+
+		// The top bit of the class of multicast DNS records is the
+		// cache-flush bit (RFC 6762, section 10.2).
+		for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+			for _, rr := range rrs {
+				if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+					hdr.Class &^= 1 << 15
+				}
+			}
+		}
+
+		return resp, time.Since(start), nil
+	}
+}
@@ -0,0 +1,82 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_LocalPolicy(t *testing.T) {
+	var exchanges int64
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.SetBootstrapServers("192.0.2.53")
+	r.Transport = ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt64(&exchanges, 1)
+
+		resp := new(dns.Msg)
+		resp.SetReply(m)
+		resp.Authoritative = true
+
+		switch addr {
+		case mdnsAddr:
+			assert.False(t, m.RecursionDesired)
+			resp.Answer = []dns.RR{A(t, m.Question[0].Name, 10, "169.254.1.2")}
+		default:
+			return nil, 0, errors.New("unexpected server: " + addr)
+		}
+
+		return resp, time.Millisecond, nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r.LocalPolicy = LocalReject
+	_, err := r.Query(ctx, "A", "printer.local")
+	assert.True(t, errors.Is(err, ErrLocalName), "%v", err)
+	var lerr *LocalNameError
+	if assert.True(t, errors.As(err, &lerr)) {
+		assert.Equal(t, "printer.local.", lerr.Name)
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&exchanges))
+
+	r.LocalPolicy = LocalMulticast
+	rs, err := r.Query(ctx, "A", "Printer.LOCAL.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"169.254.1.2"}, rs.Values)
+	assert.Equal(t, mdnsAddr, rs.ServerAddr)
+}
+
+func TestDefaultExchanger_Multicast(t *testing.T) {
+	// Responses to one-shot queries are sent from the responder's unicast
+	// address, which is what a server on another address simulates.
+	addr := "127.0.0.66:5354"
+	startServer(t, "udp", addr, func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg).SetReply(req)
+		m.Authoritative = true
+		rr := A(t, "printer.local.", 10, "169.254.1.2")
+		rr.Hdr.Class |= 1 << 15 // cache-flush
+		m.Answer = []dns.RR{rr}
+		w.WriteMsg(m)
+	})
+
+	x := &defaultExchanger{serverModes: newServerModes()}
+	resp, _, err := x.exchangeMulticast(context.Background(), query("printer.local.", dns.TypeA), addr)
+	require.NoError(t, err)
+	if assert.Len(t, resp.Answer, 1) {
+		assert.Equal(t, uint16(dns.ClassINET), resp.Answer[0].Header().Class)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err = x.exchangeMulticast(ctx, query("printer.local.", dns.TypeA), "127.0.0.66:5355")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+}
@@ -0,0 +1,348 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Constants of Oblivious DNS over HTTPS (RFC 9230).
+const (
+	odohContentType     = "application/oblivious-dns-message"
+	odohConfigsPath     = "/.well-known/odohconfigs"
+	odohVersion         = 0x0001
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+)
+
+// odohConfigMaxAge is how long the configuration of an Oblivious DoH target
+// is used before it is fetched again.
+const odohConfigMaxAge = time.Hour
+
+// odohPadding is the block size that the plaintext of queries is padded to,
+// as recommended for queries by RFC 8467.
+const odohPadding = 128
+
+// odohConfig is the public key of an Oblivious DoH target, and the HPKE
+// algorithms to use with it.
+type odohConfig struct {
+	suite     hpkeSuite
+	publicKey []byte
+	keyID     []byte
+}
+
+// parseODoHConfigs returns the first supported configuration in b, which is
+// an ObliviousDoHConfigs structure (RFC 9230, section 6.1).
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	configs, ok := readVector(&b)
+	if !ok || len(b) > 0 {
+		return nil, errors.New("malformed ODoH configuration")
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, errors.New("malformed ODoH configuration")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		configs = configs[2:]
+		contents, ok := readVector(&configs)
+		if !ok {
+			return nil, errors.New("malformed ODoH configuration")
+		}
+		if version != odohVersion || len(contents) < 6 {
+			continue
+		}
+
+		suite := hpkeSuite{
+			kem:  binary.BigEndian.Uint16(contents[0:]),
+			kdf:  binary.BigEndian.Uint16(contents[2:]),
+			aead: binary.BigEndian.Uint16(contents[4:]),
+		}
+		rest := contents[6:]
+		publicKey, ok := readVector(&rest)
+		if !ok || len(rest) > 0 || !suite.supported() {
+			continue
+		}
+
+		return &odohConfig{
+			suite:     suite,
+			publicKey: publicKey,
+			keyID:     hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), sha256.Size),
+		}, nil
+	}
+
+	return nil, errors.New("no supported ODoH configuration")
+}
+
+// readVector removes a vector with a two-byte length prefix from the start
+// of *b and returns its contents.
+func readVector(b *[]byte) ([]byte, bool) {
+	if len(*b) < 2 {
+		return nil, false
+	}
+	n := int(binary.BigEndian.Uint16(*b))
+	if len(*b) < 2+n {
+		return nil, false
+	}
+	v := (*b)[2 : 2+n]
+	*b = (*b)[2+n:]
+
+	return v, true
+}
+
+func appendVector(b, v []byte) []byte {
+	return append(appendUint16(b, uint16(len(v))), v...)
+}
+
+// odohConfigs caches the configurations of Oblivious DoH targets. It is
+// shared by all defaultExchangers of a Resolver. A nil *odohConfigs caches
+// nothing.
+type odohConfigs struct {
+	mu      sync.Mutex
+	configs map[string]odohConfigEntry // by address of the target
+}
+
+type odohConfigEntry struct {
+	config    *odohConfig
+	fetchedAt time.Time
+}
+
+func newODoHConfigs() *odohConfigs {
+	return &odohConfigs{
+		configs: map[string]odohConfigEntry{},
+	}
+}
+
+func (c *odohConfigs) get(addr string) *odohConfig {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.configs[addr]
+	if !ok || time.Since(e.fetchedAt) > odohConfigMaxAge {
+		return nil
+	}
+
+	return e.config
+}
+
+func (c *odohConfigs) set(addr string, config *odohConfig) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if config == nil {
+		delete(c.configs, addr)
+		return
+	}
+	c.configs[addr] = odohConfigEntry{config: config, fetchedAt: time.Now()}
+}
+
+// odohConfig returns the configuration of the Oblivious DoH target at addr,
+// and fetches it from the target unless it is cached.
+func (x *defaultExchanger) odohConfig(ctx context.Context, addr string) (*odohConfig, error) {
+	if config := x.odohConfigs.get(addr); config != nil {
+		return config, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpsScheme+endpointHostPort(addr)+odohConfigsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if name := x.serverNames[addr]; name != "" {
+		req.Host = name
+	}
+
+	resp, body, err := x.roundTrip(req, addr, dns.MaxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+	config, err := parseODoHConfigs(body)
+	if err != nil {
+		return nil, err
+	}
+	x.odohConfigs.set(addr, config)
+
+	return config, nil
+}
+
+// odohTarget returns the targethost and targetpath parameters for the
+// Oblivious DoH target at addr.
+func (x *defaultExchanger) odohTarget(addr string) (host, path string) {
+	hostport := endpointHostPort(addr)
+	path = strings.TrimPrefix(addr, httpsScheme+hostport)
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "443"
+	}
+	if name := x.serverNames[addr]; name != "" {
+		host = name
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	return host, path
+}
+
+// exchangeODoH sends m to the DNS over HTTPS server at addr as an Oblivious
+// DoH target via x.odohProxy (RFC 9230). The query is encrypted with the
+// public key of the target, which is fetched from the target first if
+// necessary. If udpSize is not zero, an EDNS0 OPT record is added as for
+// exchangeHTTPS.
+func (x *defaultExchanger) exchangeODoH(ctx context.Context, m *dns.Msg, addr string, udpSize uint16) (*dns.Msg, time.Duration, error) {
+	if udpSize > 0 && m.IsEdns0() == nil {
+		m = m.Copy()
+		m.SetEdns0(udpSize, false)
+	}
+
+	proxy, err := url.Parse(x.odohProxy)
+	if err != nil || proxy.Scheme != "https" || proxy.Host == "" {
+		return nil, 0, errors.New("not a valid ODoH proxy URL: " + x.odohProxy)
+	}
+	config, err := x.odohConfig(ctx, addr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching ODoH configuration: %w", err)
+	}
+	x.stats.sent("https")
+
+	query, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	capture := wireCaptureFrom(ctx)
+	capture.setQuery(query)
+
+	padding := make([]byte, (odohPadding-(len(query)+4)%odohPadding)%odohPadding)
+	plaintext := appendVector(appendVector(nil, query), padding)
+
+	enc, hctx, err := config.suite.setupBaseS(rand.Reader, config.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, 0, err
+	}
+	ciphertext := hctx.seal(odohAAD(odohMessageQuery, config.keyID), plaintext)
+	body := odohMessage(odohMessageQuery, config.keyID, concatBytes(enc, ciphertext))
+
+	targetHost, targetPath := x.odohTarget(addr)
+	params := proxy.Query()
+	params.Set("targethost", targetHost)
+	params.Set("targetpath", targetPath)
+	proxy.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxy.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", odohContentType)
+	req.Header.Set("Accept", odohContentType)
+
+	start := time.Now()
+	resp, body, err := x.roundTrip(req, x.odohProxy, 2*dns.MaxMsgSize)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The target doesn't know the key anymore.
+		x.odohConfigs.set(addr, nil)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, rtt, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+	}
+
+	wire, err := odohOpenResponse(hctx, config.suite, plaintext, body)
+	if err != nil {
+		return nil, rtt, err
+	}
+	capture.setResponse(wire)
+
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		return nil, rtt, err
+	}
+	if r.Id != m.Id {
+		return nil, rtt, dns.ErrId
+	}
+
+	return r, rtt, nil
+}
+
+// odohOpenResponse decrypts the ObliviousDoHMessage b, which is the
+// response to the query with the given plaintext that has been encrypted
+// with hctx, and returns the DNS message in it (RFC 9230, section 6.4).
+func odohOpenResponse(hctx *hpkeContext, suite hpkeSuite, queryPlaintext, b []byte) ([]byte, error) {
+	msgType, nonce, ciphertext, ok := parseODoHMessage(b)
+	if !ok || msgType != odohMessageResponse {
+		return nil, errors.New("malformed ODoH response")
+	}
+
+	key, aeadNonce := odohResponseKey(hctx, suite, queryPlaintext, nonce)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, aeadNonce, ciphertext, odohAAD(odohMessageResponse, nonce))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting ODoH response: %w", err)
+	}
+	wire, ok := readVector(&plaintext)
+	if !ok {
+		return nil, errors.New("malformed ODoH response")
+	}
+
+	return wire, nil
+}
+
+// odohResponseKey derives the key and nonce of the response to the query
+// with the given plaintext from hctx and the response nonce.
+func odohResponseKey(hctx *hpkeContext, suite hpkeSuite, queryPlaintext, responseNonce []byte) (key, nonce []byte) {
+	secret := hctx.export([]byte("odoh response"), suite.keySize())
+	salt := appendVector(append([]byte(nil), queryPlaintext...), responseNonce)
+	prk := hkdfExtract(salt, secret)
+
+	return hkdfExpand(prk, []byte("odoh key"), suite.keySize()), hkdfExpand(prk, []byte("odoh nonce"), hpkeNonceSize)
+}
+
+func odohAAD(msgType byte, keyID []byte) []byte {
+	return appendVector([]byte{msgType}, keyID)
+}
+
+// odohMessage returns an ObliviousDoHMessage structure.
+func odohMessage(msgType byte, keyID, encrypted []byte) []byte {
+	return appendVector(appendVector([]byte{msgType}, keyID), encrypted)
+}
+
+func parseODoHMessage(b []byte) (msgType byte, keyID, encrypted []byte, ok bool) {
+	if len(b) < 1 {
+		return 0, nil, nil, false
+	}
+	msgType, b = b[0], b[1:]
+	if keyID, ok = readVector(&b); !ok {
+		return 0, nil, nil, false
+	}
+	if encrypted, ok = readVector(&b); !ok || len(b) > 0 {
+		return 0, nil, nil, false
+	}
+
+	return msgType, keyID, encrypted, true
+}
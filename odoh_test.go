@@ -0,0 +1,200 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// odohConfigContents returns an ObliviousDoHConfigContents structure.
+func odohConfigContents(s hpkeSuite, publicKey []byte) []byte {
+	b := appendUint16(nil, s.kem)
+	b = appendUint16(b, s.kdf)
+	b = appendUint16(b, s.aead)
+	return appendVector(b, publicKey)
+}
+
+func TestParseODoHConfigs(t *testing.T) {
+	_, pkR := newHPKEKey(t)
+	x25519 := hpkeSuite{kem: 0x0020, kdf: hpkeKDFHKDFSHA256, aead: hpkeAEADAES128GCM}
+	p256 := hpkeSuite{kem: hpkeKEMP256HKDFSHA256, kdf: hpkeKDFHKDFSHA256, aead: hpkeAEADAES256GCM}
+
+	var configs []byte
+	configs = appendVector(appendUint16(configs, 0x0002), []byte("future version"))
+	configs = appendVector(appendUint16(configs, odohVersion), odohConfigContents(x25519, make([]byte, 32)))
+	configs = appendVector(appendUint16(configs, odohVersion), odohConfigContents(p256, pkR))
+
+	config, err := parseODoHConfigs(appendVector(nil, configs))
+	require.NoError(t, err)
+	assert.Equal(t, p256, config.suite)
+	assert.Equal(t, pkR, config.publicKey)
+	assert.Len(t, config.keyID, 32)
+
+	_, err = parseODoHConfigs(appendVector(nil, configs[:len(configs)-1]))
+	assert.Error(t, err)
+	_, err = parseODoHConfigs(append(appendVector(nil, configs), 0))
+	assert.Error(t, err)
+
+	configs = appendVector(appendUint16(nil, odohVersion), odohConfigContents(x25519, make([]byte, 32)))
+	_, err = parseODoHConfigs(appendVector(nil, configs))
+	assert.EqualError(t, err, "no supported ODoH configuration")
+}
+
+// odohTarget is an Oblivious DoH target for tests.
+type odohTarget struct {
+	t     *testing.T
+	suite hpkeSuite
+
+	mu      sync.Mutex
+	skR     []byte
+	pkR     []byte
+	keyID   []byte
+	fetches int
+}
+
+func (o *odohTarget) rotateKey() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.skR, o.pkR = newHPKEKey(o.t)
+	contents := odohConfigContents(o.suite, o.pkR)
+	o.keyID = hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), 32)
+}
+
+func (o *odohTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if r.URL.Path == odohConfigsPath {
+		o.fetches++
+		config := appendVector(appendUint16(nil, odohVersion), odohConfigContents(o.suite, o.pkR))
+		w.Write(appendVector(nil, config))
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	msgType, keyID, encrypted, ok := parseODoHMessage(body)
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != odohContentType || !ok || msgType != odohMessageQuery || len(encrypted) < 65 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(keyID, o.keyID) {
+		http.Error(w, "unknown key", http.StatusUnauthorized)
+		return
+	}
+
+	hctx := setupBaseR(o.t, o.suite, encrypted[:65], o.skR, o.pkR, []byte("odoh query"))
+	queryPlaintext, err := hctx.open(odohAAD(odohMessageQuery, keyID), encrypted[65:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plaintext := queryPlaintext
+	wire, ok := readVector(&plaintext)
+	req := new(dns.Msg)
+	if !ok || req.Unpack(wire) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	m := new(dns.Msg).SetReply(req)
+	m.RecursionAvailable = true
+	m.Answer = []dns.RR{A(o.t, req.Question[0].Name, 300, "192.0.2.1")}
+	wire, _ = m.Pack()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key, aeadNonce := odohResponseKey(hctx, o.suite, queryPlaintext, nonce)
+	aead, _ := newAESGCM(key)
+	ciphertext := aead.Seal(nil, aeadNonce, appendVector(appendVector(nil, wire), nil), odohAAD(odohMessageResponse, nonce))
+
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(odohMessage(odohMessageResponse, nonce, ciphertext))
+}
+
+func TestResolver_ODoH(t *testing.T) {
+	target := &odohTarget{
+		t:     t,
+		suite: hpkeSuite{kem: hpkeKEMP256HKDFSHA256, kdf: hpkeKDFHKDFSHA256, aead: hpkeAEADAES128GCM},
+	}
+	target.rotateKey()
+	targetSrv := httptest.NewTLSServer(target)
+	defer targetSrv.Close()
+
+	// The certificate of httptest servers is valid for 127.0.0.1.
+	roots := x509.NewCertPool()
+	roots.AddCert(targetSrv.Certificate())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+
+	var mu sync.Mutex
+	var forwarded []string
+	proxySrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := "https://" + r.URL.Query().Get("targethost") + r.URL.Query().Get("targetpath")
+		mu.Lock()
+		forwarded = append(forwarded, u)
+		mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		assert.NotContains(t, string(body), "example")
+
+		req, _ := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer proxySrv.Close()
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.TLSConfig = &tls.Config{RootCAs: roots}
+	r.ODoHProxy = proxySrv.URL + "/proxy"
+	require.NoError(t, r.SetBootstrapServers(targetSrv.URL))
+	require.NoError(t, r.SetForwarders(targetSrv.URL))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	rs, err = r.Query(ctx, "A", "mail.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	// After the target has rotated its key, queries fail until the new
+	// configuration has been fetched.
+	target.rotateKey()
+	_, err = r.Query(ctx, "A", "ftp.example.com")
+	assert.Error(t, err)
+	rs, err = r.Query(ctx, "A", "ftp.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	target.mu.Lock()
+	assert.Equal(t, 2, target.fetches)
+	target.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, forwarded)
+	assert.Equal(t, targetSrv.URL+dohPath, forwarded[0])
+}
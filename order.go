@@ -0,0 +1,142 @@
+package dnsresolver
+
+import (
+	"net"
+	"sync"
+)
+
+// ServerOrder determines the order in which a Resolver tries the name servers
+// of a zone; see Resolver.ServerOrder.
+type ServerOrder int
+
+const (
+	// ServerOrderAsReturned tries the name servers in the order of the
+	// referral, which concentrates the load on the first one.
+	ServerOrderAsReturned ServerOrder = iota
+
+	// ServerOrderRandom tries the name servers in random order.
+	ServerOrderRandom
+
+	// ServerOrderRoundRobin starts with the next name server of a zone for
+	// each query, in the order of the referral.
+	ServerOrderRoundRobin
+
+	// ServerOrderAffinity tries the name server of a zone that has answered
+	// most recently first, as long as it hasn't failed since, and the
+	// others in the order of the referral. This keeps the latency low and
+	// the answers consistent, at the expense of load spreading.
+	ServerOrderAffinity
+)
+
+// maxOrderZones limits the number of zones whose round-robin position or
+// preferred server is remembered by a Resolver. When the limit is reached,
+// everything is forgotten.
+const maxOrderZones = 10_000
+
+// zoneOrder remembers the round-robin position and the preferred server of
+// each zone. It is shared by Resolvers that share their cache.
+type zoneOrder struct {
+	mu        sync.Mutex
+	next      map[string]int
+	preferred map[string]string
+}
+
+func newZoneOrder() *zoneOrder {
+	return &zoneOrder{
+		next:      map[string]int{},
+		preferred: map[string]string{},
+	}
+}
+
+// advance returns the position to start at for zone, and advances it.
+func (o *zoneOrder) advance(zone string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i, ok := o.next[zone]
+	if !ok && len(o.next) >= maxOrderZones {
+		o.next = map[string]int{}
+	}
+	o.next[zone] = i + 1
+
+	return i
+}
+
+// prefer remembers addr as the preferred server of zone.
+func (o *zoneOrder) prefer(zone, addr string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.preferred[zone]; !ok && len(o.preferred) >= maxOrderZones {
+		o.preferred = map[string]string{}
+	}
+	o.preferred[zone] = addr
+}
+
+func (o *zoneOrder) preferredServer(zone string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.preferred[zone]
+}
+
+// orderServers returns addrs, the addresses of the name servers of zone, in
+// the order to try them according to r.serverOrder.
+func (r *resolver) orderServers(zone string, addrs []string) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+
+	switch r.serverOrder {
+	case ServerOrderRandom:
+		out := append([]string(nil), addrs...)
+		for i := len(out) - 1; i > 0; i-- {
+			j := randIntn(i + 1)
+			out[i], out[j] = out[j], out[i]
+		}
+		return out
+	case ServerOrderRoundRobin:
+		if r.zoneOrder == nil {
+			return addrs
+		}
+		n := r.zoneOrder.advance(zone) % len(addrs)
+		return append(append([]string(nil), addrs[n:]...), addrs[:n]...)
+	case ServerOrderAffinity:
+		if r.zoneOrder == nil {
+			return addrs
+		}
+		preferred := r.zoneOrder.preferredServer(zone)
+		if preferred == "" || r.health.get(preferred).ConsecutiveFailures > 0 {
+			return addrs
+		}
+		for i, addr := range addrs {
+			if i > 0 && r.withPort(addr) == preferred {
+				out := append([]string{addr}, addrs[:i]...)
+				return append(out, addrs[i+1:]...)
+			}
+		}
+		return addrs
+	default:
+		return addrs
+	}
+}
+
+// rememberServer records that the server at addr has answered a query into
+// zone, for ServerOrderAffinity.
+func (r *resolver) rememberServer(zone, addr string) {
+	if r.serverOrder != ServerOrderAffinity || r.zoneOrder == nil || zone == "" {
+		return
+	}
+
+	r.zoneOrder.prefer(zone, addr)
+}
+
+// withPort returns addr, an address of a name server, with the default port
+// if it has none.
+func (r *resolver) withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(endpointHostPort(addr)); err != nil {
+		return net.JoinHostPort(addr, r.defaultPort)
+	}
+
+	return addr
+}
@@ -0,0 +1,128 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_orderServers(t *testing.T) {
+	addrs := []string{"a", "b", "c"}
+
+	r := &resolver{}
+	assert.Equal(t, addrs, r.orderServers("example.com.", addrs))
+
+	r = &resolver{serverOrder: ServerOrderRoundRobin, zoneOrder: newZoneOrder()}
+	assert.Equal(t, []string{"a", "b", "c"}, r.orderServers("example.com.", addrs))
+	assert.Equal(t, []string{"b", "c", "a"}, r.orderServers("example.com.", addrs))
+	assert.Equal(t, []string{"a", "b", "c"}, r.orderServers("example.net.", addrs))
+	assert.Equal(t, []string{"c", "a", "b"}, r.orderServers("example.com.", addrs))
+	assert.Equal(t, []string{"a", "b", "c"}, r.orderServers("example.com.", addrs))
+	assert.Equal(t, []string{"a", "b", "c"}, addrs)
+
+	defer func(f func(int) int) { randIntn = f }(randIntn)
+	randIntn = func(n int) int { return 0 }
+
+	r = &resolver{serverOrder: ServerOrderRandom}
+	assert.Equal(t, []string{"b", "c", "a"}, r.orderServers("example.com.", addrs))
+	assert.Equal(t, []string{"a", "b", "c"}, addrs)
+	assert.Equal(t, []string{"a"}, r.orderServers("example.com.", []string{"a"}))
+}
+
+func TestResolver_ServerOrder(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.ServerOrder = ServerOrderRoundRobin
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1Srv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A a.example.com.").DelegateTo("example.com.", ns1Srv.IP(), ns2Srv.IP()).ViaAuthoritySection()
+	for _, srv := range []*TestServer{ns1Srv, ns2Srv} {
+		for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+			srv.ExpectQuery("A " + name).AnyTimes().Respond().
+				Answer(A(t, name, 300, "192.0.2.100"))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var servers []string
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		rs, err := r.Query(ctx, "A", name)
+		require.NoError(t, err)
+		servers = append(servers, rs.ServerAddr)
+	}
+	assert.Contains(t, servers, "127.0.0.101:5354")
+	assert.Contains(t, servers, "127.0.0.102:5354")
+	assert.NotEqual(t, servers[0], servers[1])
+	assert.NotEqual(t, servers[1], servers[2])
+}
+
+func TestResolver_ServerOrderAffinity(t *testing.T) {
+	var mu sync.Mutex
+	down := map[string]bool{"127.0.0.101:5354": true}
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.ServerOrder = ServerOrderAffinity
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			mu.Lock()
+			isDown := down[addr]
+			mu.Unlock()
+			if isDown {
+				return nil, 0, errors.New("i/o timeout")
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1Srv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A a.example.com.").DelegateTo("example.com.", ns1Srv.IP(), ns2Srv.IP()).ViaAuthoritySection()
+	for _, srv := range []*TestServer{ns1Srv, ns2Srv} {
+		for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com.", "d.example.com.", "e.example.com."} {
+			srv.ExpectQuery("A " + name).AnyTimes().Respond().
+				Answer(A(t, name, 300, "192.0.2.100"))
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := func(name string) []string {
+		rs, err := r.Query(ctx, "A", name)
+		require.NoError(t, err)
+		return rs.ServersTried
+	}
+
+	assert.Equal(t, []string{"127.0.0.101:5354", "127.0.0.102:5354"}, query("a.example.com"))
+
+	// The server that has answered is tried first from now on.
+	mu.Lock()
+	down = map[string]bool{}
+	mu.Unlock()
+	assert.Equal(t, []string{"127.0.0.102:5354"}, query("b.example.com"))
+	assert.Equal(t, []string{"127.0.0.102:5354"}, query("c.example.com"))
+
+	// Until it fails.
+	mu.Lock()
+	down = map[string]bool{"127.0.0.102:5354": true}
+	mu.Unlock()
+	assert.Equal(t, []string{"127.0.0.102:5354", "127.0.0.101:5354"}, query("d.example.com"))
+	assert.Equal(t, []string{"127.0.0.101:5354"}, query("e.example.com"))
+}
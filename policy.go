@@ -1,8 +1,12 @@
 package dnsresolver
 
 import (
+	"math/rand"
 	"net"
+	"strings"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
 // TimeoutPolicy determines the round-trip timeout for a single DNS query.
@@ -13,40 +17,311 @@ import (
 // domainName is the fully qualified name to be queried, with the trailing dot
 // is omitted.
 //
-// nameServerAddress is the IP address and port of the server to query.
+// nameServerAddress is the IP address and port of the server to query, or an
+// address with a scheme as described for Resolver.SetBootstrapServers, such
+// as tls://192.0.2.53:853 or unix:///run/dnsproxy.sock.
 //
 // Any non-positive duration is understood as an infinite timeout.
 type TimeoutPolicy func(recordType, domainName, nameServerAddress string) (timeout time.Duration)
 
+// AttemptTimeoutPolicy is an optional alternative to TimeoutPolicy that is
+// told more about each query, such as how many servers have been queried for
+// the same question already and what is known about the server's
+// responsiveness. This enables progressive timeouts, for instance a short
+// timeout for the first attempt and longer ones for subsequent attempts. See
+// Resolver.AttemptTimeoutPolicy.
+type AttemptTimeoutPolicy interface {
+	// Timeout returns the round-trip timeout for the query described by
+	// req. Any non-positive duration is understood as an infinite timeout.
+	Timeout(req TimeoutRequest) time.Duration
+}
+
+// AttemptTimeoutPolicyFunc is an adapter to allow the use of ordinary
+// functions as AttemptTimeoutPolicy.
+type AttemptTimeoutPolicyFunc func(req TimeoutRequest) time.Duration
+
+// Timeout implements AttemptTimeoutPolicy.
+func (f AttemptTimeoutPolicyFunc) Timeout(req TimeoutRequest) time.Duration {
+	return f(req)
+}
+
+// TimeoutRequest describes a query whose timeout is to be determined by an
+// AttemptTimeoutPolicy.
+type TimeoutRequest struct {
+	// RecordType, DomainName, and NameServerAddress are the arguments of
+	// TimeoutPolicy.
+	RecordType        string
+	DomainName        string
+	NameServerAddress string
+
+	// Attempt is 1 for the first query for the record type and domain
+	// name during a call to Resolver.Query, 2 if one other server has been
+	// queried for them already, and so on.
+	Attempt int
+
+	// Health is what the Resolver has measured about the server at
+	// NameServerAddress so far. Resolvers that share their cache share
+	// these measurements as well; see Resolver.Clone.
+	Health ServerHealth
+}
+
+// RefusalPolicy determines how a Resolver handles name servers that respond
+// with REFUSED or NOTIMP; see Resolver.RefusalPolicy. The zero value queries
+// the next name server right away.
+type RefusalPolicy struct {
+	// RetryTCP causes queries that have been refused via UDP to be sent
+	// again via TCP, since some servers refuse UDP queries from sources
+	// that they suspect to be spoofed, for instance as part of response
+	// rate limiting. RetryTCP doesn't apply to custom Transports.
+	RetryTCP bool
+
+	// Demote causes the name servers of a zone to be tried in order of the
+	// number of queries that they have refused, fewest first. This is remembered
+	// for the lifetime of the Resolver and shared with clones that share
+	// its cache; see ServerHealth.Refusals.
+	Demote bool
+}
+
+// ServFailPolicy determines how often a Resolver queries a name server again
+// after it has responded with SERVFAIL; see Resolver.ServFailPolicy. SERVFAIL
+// responses are often caused by transient overload, in which case the other
+// name servers of a zone are likely to be overloaded as well. The zero value
+// queries the next name server right away.
+type ServFailPolicy struct {
+	// Retries is the maximum number of times that a query is sent to the
+	// same name server again after SERVFAIL responses.
+	Retries int
+
+	// Delay is the time to wait before the first retry. It is doubled for
+	// each further retry of the same query.
+	Delay time.Duration
+}
+
+// ZonePolicy overrides the policies of a Resolver for the names in a
+// particular zone; see Resolver.SetZonePolicy. Nil fields leave the
+// respective policy of the Resolver in effect.
+type ZonePolicy struct {
+	// TimeoutPolicy, if not nil, is used instead of both TimeoutPolicy and
+	// AttemptTimeoutPolicy of the Resolver.
+	TimeoutPolicy TimeoutPolicy
+
+	// CachePolicy, if not nil, is used instead of the CachePolicy of the
+	// Resolver.
+	CachePolicy CachePolicy
+
+	// ServFailPolicy, if not nil, is used instead of the ServFailPolicy of
+	// the Resolver.
+	ServFailPolicy *ServFailPolicy
+}
+
+// isZero reports whether p doesn't override any policy.
+func (p ZonePolicy) isZero() bool {
+	return p.TimeoutPolicy == nil && p.CachePolicy == nil && p.ServFailPolicy == nil
+}
+
+// zonePolicy returns the policy of the most specific zone that contains
+// fqdn, or the zero ZonePolicy if there is none.
+func (r *resolver) zonePolicy(fqdn string) ZonePolicy {
+	if len(r.zonePolicies) == 0 {
+		return ZonePolicy{}
+	}
+	fqdn = dns.CanonicalName(fqdn)
+
+	var (
+		policy ZonePolicy
+		zone   string
+	)
+	for z, p := range r.zonePolicies {
+		if dns.IsSubDomain(z, fqdn) && len(z) > len(zone) {
+			policy, zone = p, z
+		}
+	}
+
+	return policy
+}
+
 // DefaultTimeoutPolicy returns the default TimeoutPolicy. It is used by
 // Resolver.Query if Resolver.TimeoutPolicy is nil.
 //
 // DefaultTimeoutPolicy assumes low latency to addresses in PrivateNets
 // (10.0.0.0/8, 192.168.0.0/16, fd00::/8, etc.) and causes requests to such
-// addresses to timeout after 100 milliseconds and all other requests after 1
-// second.
+// addresses and to Unix domain sockets to timeout after 100 milliseconds and
+// all other requests after 1 second.
 func DefaultTimeoutPolicy() TimeoutPolicy {
 	return defaultTimeoutPolicy
 }
 
 func defaultTimeoutPolicy(recordType, domainName, nameServerAddress string) time.Duration {
-	ipStr, _, err := net.SplitHostPort(nameServerAddress)
-	if err != nil {
-		panic(err)
+	if IsPrivateAddr(nameServerAddress) {
+		return 100 * time.Millisecond
+	}
+
+	return 1 * time.Second
+}
+
+// IsPrivateAddr reports whether addr, the address of a name server, is in one
+// of the PrivateNets or is a Unix domain socket, i.e. whether the server is
+// likely to be nearby. addr is an IP address with or without a port, or an
+// address with a scheme as described for Resolver.SetBootstrapServers.
+func IsPrivateAddr(addr string) bool {
+	if _, ok := unixSocketPath(addr); ok {
+		return true
+	}
+
+	host := endpointHostPort(addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
 	}
-	ip := net.ParseIP(ipStr)
 
 	for _, n := range PrivateNets {
 		if n.Contains(ip) {
-			return 100 * time.Millisecond
+			return true
 		}
 	}
 
-	return 1 * time.Second
+	return false
+}
+
+// FixedTimeout returns a TimeoutPolicy that uses the timeout d for all
+// queries.
+func FixedTimeout(d time.Duration) TimeoutPolicy {
+	return func(recordType, domainName, nameServerAddress string) time.Duration {
+		return d
+	}
+}
+
+// PerZoneTimeout returns a TimeoutPolicy that applies the policy in policies
+// for the most specific zone that contains the name in question, such as
+// "corp.example", and fallback to names outside of these zones. Zone names
+// are case-insensitive. If fallback is nil, DefaultTimeoutPolicy() is used.
+//
+// Unlike ZonePolicy.TimeoutPolicy, which is set with
+// Resolver.SetZonePolicy, the returned policy can be combined with others,
+// such as with MaxTimeout.
+func PerZoneTimeout(policies map[string]TimeoutPolicy, fallback TimeoutPolicy) TimeoutPolicy {
+	if fallback == nil {
+		fallback = DefaultTimeoutPolicy()
+	}
+
+	byZone := make(map[string]TimeoutPolicy, len(policies))
+	for zone, policy := range policies {
+		if policy != nil {
+			byZone[dns.CanonicalName(zone)] = policy
+		}
+	}
+
+	return func(recordType, domainName, nameServerAddress string) time.Duration {
+		for name := dns.CanonicalName(domainName); ; name = parentName(name) {
+			if policy, ok := byZone[name]; ok {
+				return policy(recordType, domainName, nameServerAddress)
+			}
+			if name == "." {
+				break
+			}
+		}
+
+		return fallback(recordType, domainName, nameServerAddress)
+	}
+}
+
+// MaxTimeout returns a TimeoutPolicy that uses the longest of the timeouts
+// determined by policies. Since non-positive timeouts are infinite, the
+// returned timeout is infinite if any of them is. If policies is empty,
+// DefaultTimeoutPolicy() is used.
+func MaxTimeout(policies ...TimeoutPolicy) TimeoutPolicy {
+	if len(policies) == 0 {
+		return DefaultTimeoutPolicy()
+	}
+
+	return func(recordType, domainName, nameServerAddress string) time.Duration {
+		var timeout time.Duration
+		for i, policy := range policies {
+			d := policy(recordType, domainName, nameServerAddress)
+			if d <= 0 {
+				return 0
+			}
+			if i == 0 || d > timeout {
+				timeout = d
+			}
+		}
+
+		return timeout
+	}
+}
+
+// MinTimeout returns a TimeoutPolicy that uses the shortest of the timeouts
+// determined by policies. Non-positive, i.e. infinite, timeouts are only
+// used if all of them are. If policies is empty, DefaultTimeoutPolicy() is
+// used.
+func MinTimeout(policies ...TimeoutPolicy) TimeoutPolicy {
+	if len(policies) == 0 {
+		return DefaultTimeoutPolicy()
+	}
+
+	return func(recordType, domainName, nameServerAddress string) time.Duration {
+		var timeout time.Duration
+		for _, policy := range policies {
+			d := policy(recordType, domainName, nameServerAddress)
+			if d > 0 && (timeout <= 0 || d < timeout) {
+				timeout = d
+			}
+		}
+
+		return timeout
+	}
+}
+
+// AdaptiveTimeoutPolicy returns an AttemptTimeoutPolicy that derives the
+// timeout for each server from the round-trip times that have been measured
+// for it, like TCP's retransmission timeout (RFC 6298): the smoothed
+// round-trip time plus four times its variation, but at least min and at
+// most max. This results in short timeouts for servers that are nearby and
+// responsive, and avoids spurious timeouts for servers that are far away or
+// erratic. For each consecutive failure of a server, the timeout is
+// doubled, up to max.
+//
+// Servers that haven't responded yet get the timeout of the
+// DefaultTimeoutPolicy, within the same bounds. If min is zero or negative,
+// it defaults to 50 milliseconds; if max is zero or negative, it defaults to
+// 3 seconds.
+func AdaptiveTimeoutPolicy(min, max time.Duration) AttemptTimeoutPolicy {
+	if min <= 0 {
+		min = 50 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 3 * time.Second
+	}
+
+	return AttemptTimeoutPolicyFunc(func(req TimeoutRequest) time.Duration {
+		h := req.Health
+
+		var timeout time.Duration
+		if h.SRTT > 0 {
+			timeout = h.SRTT + 4*h.RTTVar
+		} else {
+			timeout = defaultTimeoutPolicy(req.RecordType, req.DomainName, req.NameServerAddress)
+		}
+		for i := 0; i < h.ConsecutiveFailures && timeout < max; i++ {
+			timeout *= 2
+		}
+
+		if timeout < min {
+			timeout = min
+		}
+		if timeout > max {
+			timeout = max
+		}
+
+		return timeout
+	})
 }
 
 // PrivateNets is used by DefaultTimeoutPolicy to return a low timeout for
-// server addresses in one of these subnets.
+// server addresses in one of these subnets; see IsPrivateAddr.
 var PrivateNets = []*net.IPNet{
 	mustParseCIDR("10.0.0.0/8"),
 	mustParseCIDR("127.0.0.0/8"),
@@ -107,3 +382,167 @@ func ObeyResponderAdvice(negativeTTL time.Duration) CachePolicy {
 		return rs.TTL
 	}
 }
+
+// WithJitter returns a CachePolicy that shortens the TTLs determined by
+// policy by a random amount of up to fraction of each TTL. For instance,
+// with a fraction of 0.1 a response with a TTL of 300 seconds is cached for
+// 270 to 300 seconds. This prevents responses that have been cached at the
+// same time, such as when an application starts, from expiring at the same
+// time, which would cause a burst of queries to refresh them. TTLs are never
+// extended.
+//
+// fraction is clamped to the range [0, 1]. If policy is nil,
+// DefaultCachePolicy() is used.
+func WithJitter(policy CachePolicy, fraction float64) CachePolicy {
+	if policy == nil {
+		policy = DefaultCachePolicy()
+	}
+	if fraction < 0 {
+		fraction = 0
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	return func(rs RecordSet) time.Duration {
+		ttl := policy(rs)
+		if ttl <= 0 || fraction == 0 {
+			return ttl
+		}
+
+		return ttl - time.Duration(rand.Float64()*fraction*float64(ttl))
+	}
+}
+
+// PerTypeCachePolicy returns a CachePolicy that applies the policy in
+// policies for the record type of the question, such as "A", "TXT", or
+// "TYPE65534", and fallback to responses to questions for all other types. A
+// nil policy in policies means that responses to questions for that type
+// are not cached. For instance,
+//
+//	PerTypeCachePolicy(map[string]CachePolicy{
+//		"TXT": nil,
+//		"SRV": func(rs RecordSet) time.Duration { return 30 * time.Second },
+//	}, ObeyResponderAdvice(time.Minute))
+//
+// obeys the TTLs of all responses except those to questions for TXT
+// records, which are never cached, and SRV records, which are cached for 30
+// seconds. Record types are case-insensitive. If fallback is nil,
+// DefaultCachePolicy() is used.
+//
+// PerTypeCachePolicy panics if a key of policies is not a record type.
+func PerTypeCachePolicy(policies map[string]CachePolicy, fallback CachePolicy) CachePolicy {
+	if fallback == nil {
+		fallback = DefaultCachePolicy()
+	}
+
+	byType := make(map[uint16]CachePolicy, len(policies))
+	for typ, policy := range policies {
+		qtype, ok := parseType(strings.ToUpper(typ))
+		if !ok {
+			panic("PerTypeCachePolicy: unsupported record type: " + typ)
+		}
+		if policy == nil {
+			policy = func(RecordSet) time.Duration { return 0 }
+		}
+		byType[qtype] = policy
+	}
+
+	return func(rs RecordSet) time.Duration {
+		if len(rs.Raw.Question) > 0 {
+			if policy, ok := byType[rs.Raw.Question[0].Qtype]; ok {
+				return policy(rs)
+			}
+		}
+
+		return fallback(rs)
+	}
+}
+
+// ChainPolicies returns a CachePolicy that consults policies in order and
+// returns the first positive TTL, or zero if none of them wants to cache a
+// response. For instance,
+//
+//	ChainPolicies(DefaultCachePolicy(), OnlyZones(ObeyResponderAdvice(0), "corp.example"))
+//
+// caches delegations to public suffixes, and all responses for names in
+// corp.example. Nil policies are skipped.
+func ChainPolicies(policies ...CachePolicy) CachePolicy {
+	return func(rs RecordSet) time.Duration {
+		for _, policy := range policies {
+			if policy == nil {
+				continue
+			}
+			if ttl := policy(rs); ttl > 0 {
+				return ttl
+			}
+		}
+
+		return 0
+	}
+}
+
+// CapTTL returns a CachePolicy that caches responses for the TTL determined
+// by policy, but for no longer than maxTTL. If policy is nil,
+// DefaultCachePolicy() is used.
+func CapTTL(policy CachePolicy, maxTTL time.Duration) CachePolicy {
+	if policy == nil {
+		policy = DefaultCachePolicy()
+	}
+
+	return func(rs RecordSet) time.Duration {
+		if ttl := policy(rs); ttl < maxTTL {
+			return ttl
+		}
+
+		return maxTTL
+	}
+}
+
+// FloorTTL returns a CachePolicy that caches responses for the TTL determined
+// by policy, but for at least minTTL, which prevents responses with very short
+// TTLs from causing a query each time. Responses that policy doesn't cache
+// are still not cached. If policy is nil, DefaultCachePolicy() is used.
+func FloorTTL(policy CachePolicy, minTTL time.Duration) CachePolicy {
+	if policy == nil {
+		policy = DefaultCachePolicy()
+	}
+
+	return func(rs RecordSet) time.Duration {
+		if ttl := policy(rs); ttl <= 0 || ttl > minTTL {
+			return ttl
+		}
+
+		return minTTL
+	}
+}
+
+// OnlyZones returns a CachePolicy that applies policy to responses to
+// questions for names at or below one of zones, such as "corp.example", and
+// doesn't cache any other responses. Names are compared case-insensitively.
+// If policy is nil, DefaultCachePolicy() is used.
+func OnlyZones(policy CachePolicy, zones ...string) CachePolicy {
+	if policy == nil {
+		policy = DefaultCachePolicy()
+	}
+
+	fqdns := make([]string, len(zones))
+	for i, zone := range zones {
+		fqdns[i] = dns.CanonicalName(zone)
+	}
+
+	return func(rs RecordSet) time.Duration {
+		if len(rs.Raw.Question) == 0 {
+			return 0
+		}
+
+		name := dns.CanonicalName(rs.Raw.Question[0].Name)
+		for _, zone := range fqdns {
+			if dns.IsSubDomain(zone, name) {
+				return policy(rs)
+			}
+		}
+
+		return 0
+	}
+}
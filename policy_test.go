@@ -1,11 +1,15 @@
 package dnsresolver
 
 import (
+	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDefaultCachePolicy(t *testing.T) {
@@ -69,3 +73,547 @@ func TestDefaultCachePolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestResolver_CacheLogFunc(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = func(rs RecordSet) time.Duration {
+		if rs.Rcode != "NOERROR" {
+			return 0
+		}
+		return rs.TTL
+	}
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 60, "192.0.2.1"))
+	rootSrv.ExpectQuery("A nx.example.com.").Respond().
+		Status(dns.RcodeNameError)
+
+	type decision struct {
+		question string
+		ttl      time.Duration
+	}
+	var (
+		mu        sync.Mutex
+		decisions []decision
+	)
+	r.CacheLogFunc = func(rs RecordSet, ttl time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := rs.Raw.Question[0]
+		decisions = append(decisions, decision{q.Name + " " + dns.Type(q.Qtype).String() + " " + rs.Rcode, ttl})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+	_, err = r.Query(ctx, "A", "nx.example.com")
+	require.ErrorIs(t, err, ErrNXDomain)
+
+	// Responses from the cache are not reported again.
+	_, err = r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+
+	assert.Equal(t, []decision{
+		{". NS NOERROR", 321 * time.Second},
+		{"www.example.com. A NOERROR", 60 * time.Second},
+		{"nx.example.com. A NXDOMAIN", 0},
+	}, decisions)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_AttemptTimeoutPolicy(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			switch addr {
+			case "127.0.0.101:5354": // broken
+				return nil, 0, errors.New("i/o timeout")
+			case "127.0.0.102:5354":
+				resp, _, err := next.Exchange(ctx, m, addr)
+				return resp, 20 * time.Millisecond, err
+			default:
+				resp, _, err := next.Exchange(ctx, m, addr)
+				return resp, 10 * time.Millisecond, err
+			}
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	nsSrv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A a.example.").DelegateTo("example.", "127.0.0.101", nsSrv.IP()).ViaAuthoritySection()
+	nsSrv.ExpectQuery("A a.example.").Respond().
+		Answer(A(t, "a.example.", 300, "192.0.2.100"))
+	nsSrv.ExpectQuery("A b.example.").Respond().
+		Answer(A(t, "b.example.", 300, "192.0.2.100"))
+
+	var mu sync.Mutex
+	var reqs []TimeoutRequest
+	r.AttemptTimeoutPolicy = AttemptTimeoutPolicyFunc(func(req TimeoutRequest) time.Duration {
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		return time.Duration(req.Attempt) * 100 * time.Millisecond
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"a.example", "b.example"} {
+		rs, err := r.Query(ctx, "A", name)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	}
+
+	type attempt struct {
+		Name, Addr string
+		Attempt    int
+		Health     ServerHealth
+	}
+	var got []attempt
+	for _, req := range reqs {
+		if req.RecordType == "A" {
+			got = append(got, attempt{req.DomainName, req.NameServerAddress, req.Attempt, req.Health})
+		}
+	}
+
+	assert.Equal(t, []attempt{
+		// The root has answered the bootstrap query.
+		{"a.example", "127.0.0.250:5354", 1, ServerHealth{Exchanges: 1, LastRTT: 10 * time.Millisecond, SRTT: 10 * time.Millisecond, RTTVar: 5 * time.Millisecond}},
+		{"a.example", "127.0.0.101:5354", 2, ServerHealth{}},
+		{"a.example", "127.0.0.102:5354", 3, ServerHealth{}},
+		// The delegation of example. has been cached.
+		{"b.example", "127.0.0.101:5354", 1, ServerHealth{Exchanges: 1, Failures: 1, ConsecutiveFailures: 1}},
+		{"b.example", "127.0.0.102:5354", 2, ServerHealth{Exchanges: 1, LastRTT: 20 * time.Millisecond, SRTT: 20 * time.Millisecond, RTTVar: 10 * time.Millisecond}},
+	}, got)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	nsSrv.AssertNoOutstandingExpectations(t)
+}
+
+func TestServerHealth(t *testing.T) {
+	h := newServerHealth()
+	h.record("192.0.2.1:53", 100*time.Millisecond, nil)
+	h.record("192.0.2.1:53", 200*time.Millisecond, nil)
+	h.record("192.0.2.1:53", 0, context.DeadlineExceeded)
+	h.record("192.0.2.1:53", 0, context.Canceled)
+
+	assert.Equal(t, ServerHealth{
+		Exchanges:           3,
+		Failures:            1,
+		ConsecutiveFailures: 1,
+		LastRTT:             200 * time.Millisecond,
+		SRTT:                112500 * time.Microsecond, // 7/8 * 100ms + 1/8 * 200ms
+		RTTVar:              62500 * time.Microsecond,  // 3/4 * 50ms + 1/4 * 100ms
+	}, h.get("192.0.2.1:53"))
+	assert.Equal(t, ServerHealth{}, h.get("192.0.2.2:53"))
+
+	var nilHealth *serverHealth
+	nilHealth.record("192.0.2.1:53", time.Second, nil)
+	assert.Equal(t, ServerHealth{}, nilHealth.get("192.0.2.1:53"))
+}
+
+func TestAdaptiveTimeoutPolicy(t *testing.T) {
+	policy := AdaptiveTimeoutPolicy(0, 0)
+
+	cases := []struct {
+		name   string
+		addr   string
+		health ServerHealth
+		want   time.Duration
+	}{
+		{name: "unknown public", addr: "8.8.8.8:53", want: 1 * time.Second},
+		{name: "unknown private", addr: "10.0.0.1:53", want: 100 * time.Millisecond},
+		{
+			name:   "measured",
+			addr:   "8.8.8.8:53",
+			health: ServerHealth{Exchanges: 10, SRTT: 30 * time.Millisecond, RTTVar: 10 * time.Millisecond},
+			want:   70 * time.Millisecond,
+		},
+		{
+			name:   "min",
+			addr:   "8.8.8.8:53",
+			health: ServerHealth{Exchanges: 10, SRTT: 2 * time.Millisecond, RTTVar: time.Millisecond},
+			want:   50 * time.Millisecond,
+		},
+		{
+			name:   "failures",
+			addr:   "8.8.8.8:53",
+			health: ServerHealth{Exchanges: 10, Failures: 2, ConsecutiveFailures: 2, SRTT: 30 * time.Millisecond, RTTVar: 10 * time.Millisecond},
+			want:   280 * time.Millisecond,
+		},
+		{
+			name:   "max",
+			addr:   "8.8.8.8:53",
+			health: ServerHealth{Exchanges: 100, Failures: 50, ConsecutiveFailures: 50, SRTT: 300 * time.Millisecond},
+			want:   3 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		got := policy.Timeout(TimeoutRequest{
+			RecordType:        "A",
+			DomainName:        "example.com",
+			NameServerAddress: tc.addr,
+			Attempt:           1,
+			Health:            tc.health,
+		})
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+func TestIsPrivateAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"192.168.1.1":               true,
+		"192.168.1.1:53":            true,
+		"[fd00::1]:53":              true,
+		"tls://10.0.0.1:853":        true,
+		"unix:///run/dnsproxy.sock": true,
+		"9.9.9.9":                   false,
+		"9.9.9.9:53":                false,
+		"[2620:fe::fe]:53":          false,
+		"https://9.9.9.9/dns-query": false,
+		"not an address":            false,
+	} {
+		assert.Equal(t, want, IsPrivateAddr(addr), addr)
+	}
+}
+
+func TestTimeoutPolicyCombinators(t *testing.T) {
+	policy := PerZoneTimeout(map[string]TimeoutPolicy{
+		"Corp.Example":      FixedTimeout(50 * time.Millisecond),
+		"slow.corp.example": FixedTimeout(5 * time.Second),
+		"other.example.":    nil,
+	}, FixedTimeout(time.Second))
+
+	assert.Equal(t, 50*time.Millisecond, policy("A", "corp.example", "192.0.2.1:53"))
+	assert.Equal(t, 50*time.Millisecond, policy("A", "www.corp.example", "192.0.2.1:53"))
+	assert.Equal(t, 5*time.Second, policy("A", "www.slow.corp.example", "192.0.2.1:53"))
+	assert.Equal(t, time.Second, policy("A", "www.other.example", "192.0.2.1:53"))
+	assert.Equal(t, time.Second, policy("A", "example.com", "192.0.2.1:53"))
+	assert.Equal(t, 100*time.Millisecond, PerZoneTimeout(nil, nil)("A", "example.com", "192.0.2.1:53"))
+
+	short, long, infinite := FixedTimeout(time.Millisecond), FixedTimeout(time.Second), FixedTimeout(0)
+
+	assert.Equal(t, time.Second, MaxTimeout(short, long)("A", "example.com", "192.0.2.1:53"))
+	assert.Equal(t, time.Duration(0), MaxTimeout(short, infinite, long)("A", "example.com", "192.0.2.1:53"))
+	assert.Equal(t, time.Millisecond, MinTimeout(long, infinite, short)("A", "example.com", "192.0.2.1:53"))
+	assert.Equal(t, time.Duration(0), MinTimeout(infinite, infinite)("A", "example.com", "192.0.2.1:53"))
+	assert.Equal(t, time.Second, MinTimeout()("A", "example.com", "9.9.9.9:53"))
+	assert.Equal(t, 100*time.Millisecond, MaxTimeout(DefaultTimeoutPolicy(), short)("A", "example.com", "192.0.2.1:53"))
+}
+
+func TestWithJitter(t *testing.T) {
+	policy := WithJitter(ObeyResponderAdvice(time.Minute), 0.1)
+
+	rs := RecordSet{Type: "A", TTL: 300 * time.Second}
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		ttl := policy(rs)
+		assert.True(t, ttl > 270*time.Second && ttl <= 300*time.Second, "ttl = %v", ttl)
+		seen[ttl] = true
+	}
+	assert.Greater(t, len(seen), 1)
+
+	assert.Equal(t, time.Duration(0), policy(RecordSet{Type: "A"}))
+	assert.Equal(t, 300*time.Second, WithJitter(ObeyResponderAdvice(time.Minute), -1)(rs))
+}
+
+func TestPerTypeCachePolicy(t *testing.T) {
+	policy := PerTypeCachePolicy(map[string]CachePolicy{
+		"txt":       nil,
+		"SRV":       func(rs RecordSet) time.Duration { return 30 * time.Second },
+		"TYPE65534": func(rs RecordSet) time.Duration { return time.Second },
+	}, ObeyResponderAdvice(time.Minute))
+
+	rs := func(qtype uint16, rcode int) RecordSet {
+		rs := RecordSet{Type: dns.Type(qtype).String(), TTL: 300 * time.Second}
+		if rcode == dns.RcodeNameError {
+			rs.Type = "NXDOMAIN"
+		}
+		rs.Raw.SetQuestion("example.com.", qtype)
+		rs.Raw.Rcode = rcode
+		return rs
+	}
+
+	assert.Equal(t, 300*time.Second, policy(rs(dns.TypeA, dns.RcodeSuccess)))
+	assert.Equal(t, time.Minute, policy(rs(dns.TypeA, dns.RcodeNameError)))
+	assert.Equal(t, time.Duration(0), policy(rs(dns.TypeTXT, dns.RcodeSuccess)))
+	assert.Equal(t, time.Duration(0), policy(rs(dns.TypeTXT, dns.RcodeNameError)))
+	assert.Equal(t, 30*time.Second, policy(rs(dns.TypeSRV, dns.RcodeSuccess)))
+	assert.Equal(t, time.Second, policy(rs(65534, dns.RcodeSuccess)))
+	assert.Equal(t, 300*time.Second, policy(RecordSet{Type: "A", TTL: 300 * time.Second}))
+
+	assert.Panics(t, func() { PerTypeCachePolicy(map[string]CachePolicy{"BOGUS": nil}, nil) })
+}
+
+func TestCachePolicyCombinators(t *testing.T) {
+	rs := func(name string, ttl time.Duration) RecordSet {
+		rs := RecordSet{Type: "A", TTL: ttl}
+		rs.Raw.SetQuestion(name, dns.TypeA)
+		return rs
+	}
+	fixed := func(ttl time.Duration) CachePolicy {
+		return func(RecordSet) time.Duration { return ttl }
+	}
+	obey := ObeyResponderAdvice(0)
+
+	policy := ChainPolicies(fixed(0), nil, fixed(-time.Second), obey, fixed(time.Hour))
+	assert.Equal(t, 5*time.Second, policy(rs("example.com.", 5*time.Second)))
+	assert.Equal(t, time.Hour, policy(rs("example.com.", 0)))
+	assert.Equal(t, time.Duration(0), ChainPolicies()(rs("example.com.", 5*time.Second)))
+
+	policy = CapTTL(obey, time.Minute)
+	assert.Equal(t, time.Minute, policy(rs("example.com.", time.Hour)))
+	assert.Equal(t, 5*time.Second, policy(rs("example.com.", 5*time.Second)))
+	assert.Equal(t, time.Duration(0), policy(rs("example.com.", 0)))
+
+	policy = FloorTTL(obey, time.Minute)
+	assert.Equal(t, time.Hour, policy(rs("example.com.", time.Hour)))
+	assert.Equal(t, time.Minute, policy(rs("example.com.", 5*time.Second)))
+	assert.Equal(t, time.Duration(0), policy(rs("example.com.", 0)))
+
+	policy = OnlyZones(obey, "Corp.Example", "example.org.")
+	assert.Equal(t, time.Hour, policy(rs("corp.example.", time.Hour)))
+	assert.Equal(t, time.Hour, policy(rs("www.CORP.example.", time.Hour)))
+	assert.Equal(t, time.Hour, policy(rs("www.example.org.", time.Hour)))
+	assert.Equal(t, time.Duration(0), policy(rs("example.", time.Hour)))
+	assert.Equal(t, time.Duration(0), policy(rs("notcorp.example.", time.Hour)))
+	assert.Equal(t, time.Duration(0), policy(RecordSet{Type: "A", TTL: time.Hour}))
+}
+
+func TestResolver_RefusalPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var queried []string
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if m.Question[0].Qtype == dns.TypeA {
+				mu.Lock()
+				queried = append(queried, addr)
+				mu.Unlock()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1Srv := NewTestServer(t, "127.0.0.101:"+r.defaultPort) // refuses everything
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort) // refuses refused.example
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A a.example.").DelegateTo("example.", ns1Srv.IP(), ns2Srv.IP()).ViaAuthoritySection()
+	ns1Srv.ExpectQuery("A *.example.").Times(3).Respond().NonAuthoritative().Status(dns.RcodeRefused)
+	for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+		ns2Srv.ExpectQuery("A " + name).Respond().
+			Answer(A(t, name, 300, "192.0.2.100"))
+	}
+	ns2Srv.ExpectQuery("A refused.example.").Respond().Status(dns.RcodeNotImplemented)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		q := queried
+		queried = nil
+		return q
+	}
+
+	rs, err := r.Query(ctx, "A", "a.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	assert.Equal(t, []string{"127.0.0.250:5354", "127.0.0.101:5354", "127.0.0.102:5354"}, reset())
+
+	_, err = r.Query(ctx, "A", "refused.example")
+	assert.True(t, errors.Is(err, ErrRefused), "%v", err)
+	reset()
+
+	// Without Demote, the refusing server is still queried first.
+	_, err = r.Query(ctx, "A", "b.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.101:5354", "127.0.0.102:5354"}, reset())
+
+	r.RefusalPolicy.Demote = true
+	_, err = r.Query(ctx, "A", "c.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.102:5354"}, reset())
+	assert.Equal(t, int64(3), r.health.get("127.0.0.101:5354").Refusals)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	ns1Srv.AssertNoOutstandingExpectations(t)
+	ns2Srv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_ServFailPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var queried []string
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if addr != "127.0.0.250:5354" { // root
+				mu.Lock()
+				queried = append(queried, addr)
+				mu.Unlock()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1Srv := NewTestServer(t, "127.0.0.101:"+r.defaultPort) // fails twice per name
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort) // always fails
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A a.example.").DelegateTo("example.", ns1Srv.IP(), ns2Srv.IP()).ViaAuthoritySection()
+
+	ns1Srv.ExpectQuery("A a.example.").Respond().Status(dns.RcodeServerFailure)
+	ns2Srv.ExpectQuery("A a.example.").Respond().Status(dns.RcodeServerFailure)
+
+	ns1Srv.ExpectQuery("A b.example.").Times(2).Respond().Status(dns.RcodeServerFailure)
+	ns1Srv.ExpectQuery("A b.example.").Respond().
+		Answer(A(t, "b.example.", 300, "192.0.2.100"))
+
+	ns1Srv.ExpectQuery("A c.example.").Times(2).Respond().Status(dns.RcodeServerFailure)
+	ns2Srv.ExpectQuery("A c.example.").Times(2).Respond().Status(dns.RcodeServerFailure)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reset := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		q := queried
+		queried = nil
+		return q
+	}
+
+	_, err := r.Query(ctx, "A", "a.example")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"127.0.0.101:5354", "127.0.0.102:5354"}, reset())
+
+	r.ServFailPolicy = ServFailPolicy{Retries: 2, Delay: 5 * time.Millisecond}
+	start := time.Now()
+	rs, err := r.Query(ctx, "A", "b.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	assert.Equal(t, []string{"127.0.0.101:5354", "127.0.0.101:5354", "127.0.0.101:5354"}, reset())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(15*time.Millisecond))
+
+	r.ServFailPolicy.Retries = 1
+	_, err = r.Query(ctx, "A", "c.example")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"127.0.0.101:5354", "127.0.0.101:5354", "127.0.0.102:5354", "127.0.0.102:5354"}, reset())
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	ns1Srv.AssertNoOutstandingExpectations(t)
+	ns2Srv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_SetZonePolicy(t *testing.T) {
+	var mu sync.Mutex
+	exchanges := map[string]int{}
+	timeouts := map[string]string{}
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if q := m.Question[0]; q.Qtype == dns.TypeA {
+				mu.Lock()
+				exchanges[q.Name]++
+				mu.Unlock()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	for name, n := range map[string]int{
+		"a.example.":     1,
+		"b.sub.example.": 2,
+		"example.net.":   2,
+		"c.example.":     2,
+	} {
+		rootSrv.ExpectQuery("A " + name).Times(n).Respond().
+			Answer(A(t, name, 300, "192.0.2.100"))
+	}
+
+	timeoutPolicy := func(name string) TimeoutPolicy {
+		return func(recordType, domainName, nameServerAddress string) time.Duration {
+			mu.Lock()
+			defer mu.Unlock()
+			timeouts[domainName] = name
+			return time.Second
+		}
+	}
+	r.TimeoutPolicy = timeoutPolicy("default")
+
+	require.NoError(t, r.SetZonePolicy("Example.", ZonePolicy{
+		TimeoutPolicy: timeoutPolicy("example"),
+		CachePolicy:   ObeyResponderAdvice(0),
+	}))
+	require.NoError(t, r.SetZonePolicy("sub.example", ZonePolicy{
+		CachePolicy: DefaultCachePolicy(),
+	}))
+	assert.Error(t, r.SetZonePolicy("example..", ZonePolicy{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"a.example", "b.sub.example", "example.net"} {
+			_, err := r.Query(ctx, "A", name)
+			require.NoError(t, err)
+		}
+	}
+
+	mu.Lock()
+	assert.Equal(t, map[string]int{
+		"a.example.":     1, // cached
+		"b.sub.example.": 2,
+		"example.net.":   2,
+	}, exchanges)
+	assert.Equal(t, map[string]string{
+		".":             "default",
+		"a.example":     "example",
+		"b.sub.example": "default",
+		"example.net":   "default",
+	}, timeouts)
+	exchanges = map[string]int{}
+	mu.Unlock()
+
+	require.NoError(t, r.SetZonePolicy("example", ZonePolicy{}))
+	_, err := r.Query(ctx, "A", "c.example")
+	require.NoError(t, err)
+	_, err = r.Query(ctx, "A", "c.example")
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, map[string]int{"c.example.": 2}, exchanges)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
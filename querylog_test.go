@@ -0,0 +1,85 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewQueryLog(t *testing.T) {
+	testCases := []struct {
+		format QueryLogFormat
+		want   []string
+	}{
+		{
+			format: QueryLogBIND,
+			want: []string{
+				`^\d\d-[A-Z][a-z]{2}-\d{4} \d\d:\d\d:\d\d\.\d{3} queries: info: client @0x0 0\.0\.0\.0#0 \(\.\): query: \. IN NS \+ \(127\.0\.0\.250\) NOERROR \S+$`,
+				`^\d\d-[A-Z][a-z]{2}-\d{4} \d\d:\d\d:\d\d\.\d{3} queries: info: client @0x0 0\.0\.0\.0#0 \(www\.example\.com\): query: www\.example\.com IN A - \(127\.0\.0\.250\) NOERROR \S+$`,
+				`^\d\d-[A-Z][a-z]{2}-\d{4} \d\d:\d\d:\d\d\.\d{3} queries: info: client @0x0 0\.0\.0\.0#0 \(\.\): query: \. IN NS \+ \(127\.0\.0\.250\) NOERROR \S+$`,
+				`^\d\d-[A-Z][a-z]{2}-\d{4} \d\d:\d\d:\d\d\.\d{3} queries: info: client @0x0 0\.0\.0\.0#0 \(nope\.example\.com\): query: nope\.example\.com IN A - \(127\.0\.0\.250\) SERVFAIL 0s$`,
+			},
+		},
+		{
+			format: QueryLogUnbound,
+			want: []string{
+				`^\[\d+\] dnsresolver\[\d+:0\] info: 127\.0\.0\.250 \. NS IN NOERROR \d\.\d{6} 0 \d+$`,
+				`^\[\d+\] dnsresolver\[\d+:0\] info: 127\.0\.0\.250 www\.example\.com\. A IN NOERROR \d\.\d{6} 0 \d+$`,
+				`^\[\d+\] dnsresolver\[\d+:0\] info: 127\.0\.0\.250 \. NS IN NOERROR \d\.\d{6} 1 \d+$`,
+				`^\[\d+\] dnsresolver\[\d+:0\] info: 127\.0\.0\.250 nope\.example\.com\. A IN SERVFAIL 0\.000000 0 0$`,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run("", func(t *testing.T) {
+			var buf bytes.Buffer
+
+			r := New()
+			r.defaultPort = "5354"
+			r.LogFunc = NewQueryLog(&buf, tc.format)
+
+			// Queries for nope.example.com. time out.
+			r.Use(func(next Exchanger) Exchanger {
+				return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+					if m.Question[0].Name == "nope.example.com." {
+						return nil, 0, context.DeadlineExceeded
+					}
+					return next.Exchange(ctx, m, addr)
+				})
+			})
+
+			rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+
+			r.SetBootstrapServers(rootSrv.IP())
+
+			rootSrv.ExpectQuery("A www.example.com.").Respond().
+				Answer(
+					A(t, "www.example.com.", 300, "192.0.2.1"),
+				)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			_, err := r.Query(ctx, "A", "www.example.com")
+			assert.NoError(t, err)
+			_, err = r.Query(ctx, "A", "nope.example.com")
+			assert.Error(t, err)
+
+			// The NS . query is answered from the cache the second time.
+			lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+			if assert.Len(t, lines, len(tc.want)) {
+				for i, want := range tc.want {
+					assert.Regexp(t, regexp.MustCompile(want), lines[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNotRecorded is returned by a Resolver in replay mode if a query has not
+// been recorded. ErrNotRecorded may be wrapped and must be tested for with
+// errors.Is.
+var ErrNotRecorded = errors.New("query not recorded")
+
+// RecordedExchange is a single query to a name server and its outcome, as
+// recorded by a Recorder.
+type RecordedExchange struct {
+	// Question is the question of the query in the form
+	// "www.example.com. IN A".
+	Question string `json:"question"`
+
+	// Server is the IP address and port of the name server.
+	Server string `json:"server"`
+
+	// Response is the response in wire format, or nil if the query failed.
+	Response []byte `json:"response,omitempty"`
+
+	// Error is the text of the error that occurred instead of a response,
+	// such as a timeout.
+	Error string `json:"error,omitempty"`
+
+	// RTT is the measured round-trip time.
+	RTT time.Duration `json:"rtt"`
+}
+
+// Recorder records every query that a Resolver sends to name servers. Use
+// Resolver.Record to create a Recorder.
+//
+// Recorders are safe for concurrent use.
+type Recorder struct {
+	mu        sync.Mutex
+	exchanges []RecordedExchange
+}
+
+// Record starts recording every query that R sends to name servers, and
+// returns the Recorder that holds the recorded exchanges. Responses served
+// from the cache are not recorded; use ClearCache before Record if the
+// recording is supposed to be complete.
+//
+// Record installs a Middleware with Use, so the exchanges are recorded as
+// they are seen by the Transport, after any middleware that has been
+// installed earlier.
+//
+// Recorded exchanges can be replayed with Replay, which is useful for
+// hermetic tests of applications that use this package: record a resolution
+// once, save it with Recorder.WriteFile, and replay it in every test run.
+//
+// Record must not be called concurrently with Query.
+func (R *Resolver) Record() *Recorder {
+	rec := &Recorder{}
+
+	R.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			return rec.exchange(ctx, next, m, addr)
+		})
+	})
+
+	return rec
+}
+
+func (rec *Recorder) exchange(ctx context.Context, next Exchanger, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	resp, rtt, err := next.Exchange(ctx, m, addr)
+
+	x := RecordedExchange{
+		Question: questionString(m.Question[0]),
+		Server:   addr,
+		RTT:      rtt,
+	}
+	if err != nil {
+		x.Error = err.Error()
+	} else if resp != nil {
+		if b, packErr := resp.Pack(); packErr != nil {
+			x.Error = "packing response: " + packErr.Error()
+		} else {
+			x.Response = b
+		}
+	}
+
+	rec.mu.Lock()
+	rec.exchanges = append(rec.exchanges, x)
+	rec.mu.Unlock()
+
+	return resp, rtt, err
+}
+
+// Exchanges returns the exchanges that have been recorded so far, in the
+// order in which the queries have been completed.
+func (rec *Recorder) Exchanges() []RecordedExchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]RecordedExchange{}, rec.exchanges...)
+}
+
+// WriteTo writes the exchanges that have been recorded so far to w, in a
+// JSON format that can be read with ReadRecording.
+func (rec *Recorder) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(rec.Exchanges(), "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// WriteFile writes the exchanges that have been recorded so far to the named
+// file, which is created or truncated. See WriteTo.
+func (rec *Recorder) WriteFile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = rec.WriteTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// ReadRecording reads exchanges that have been written by Recorder.WriteTo.
+func ReadRecording(r io.Reader) ([]RecordedExchange, error) {
+	var exchanges []RecordedExchange
+	if err := json.NewDecoder(r).Decode(&exchanges); err != nil {
+		return nil, fmt.Errorf("reading recording: %w", err)
+	}
+
+	for i, x := range exchanges {
+		if _, err := parseQuestion(x.Question); err != nil {
+			return nil, fmt.Errorf("reading recording: exchange %d: %w", i, err)
+		}
+	}
+
+	return exchanges, nil
+}
+
+// ReadRecordingFile reads exchanges from the named file. See ReadRecording.
+func ReadRecordingFile(name string) ([]RecordedExchange, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadRecording(f)
+}
+
+// Replay causes R to answer queries with the given recorded exchanges instead
+// of sending them to name servers. No network traffic is generated in replay
+// mode; queries that have not been recorded fail with an error wrapping
+// ErrNotRecorded. Replay replaces the Transport of R; middleware installed
+// with Use still applies.
+//
+// If a query to a particular server has been recorded more than once, the
+// recorded responses are used in order, and the last one is repeated as
+// necessary.
+//
+// If no bootstrap servers have been set with SetBootstrapServers, the servers
+// of the recorded queries for "NS ." are used, so the operating system's
+// configuration doesn't affect replays.
+//
+// Replay must not be called concurrently with Query.
+func (R *Resolver) Replay(exchanges []RecordedExchange) {
+	type key struct {
+		q    string
+		addr string
+	}
+
+	var mu sync.Mutex
+	recorded := map[key][]RecordedExchange{}
+	var bootstrap []string
+
+	for _, x := range exchanges {
+		q, err := parseQuestion(x.Question)
+		if err != nil {
+			continue
+		}
+		k := key{questionString(q), x.Server}
+		recorded[k] = append(recorded[k], x)
+
+		if q.Name == "." && q.Qtype == dns.TypeNS && len(recorded[k]) == 1 {
+			bootstrap = append(bootstrap, x.Server)
+		}
+	}
+
+	R.updateConfig(func(c *config) {
+		if len(c.systemServerAddrs) == 0 {
+			c.systemServerAddrs = bootstrap
+		}
+	})
+
+	R.Transport = ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+		q := questionString(m.Question[0])
+		k := key{q, addr}
+
+		mu.Lock()
+		xs := recorded[k]
+		if len(xs) == 0 {
+			mu.Unlock()
+			return nil, 0, fmt.Errorf("%w: %s @%s", ErrNotRecorded, q, addr)
+		}
+		x := xs[0]
+		if len(xs) > 1 {
+			recorded[k] = xs[1:]
+		}
+		mu.Unlock()
+
+		if x.Error != "" {
+			return nil, x.RTT, errors.New(x.Error)
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(x.Response); err != nil {
+			return nil, x.RTT, fmt.Errorf("replaying %s @%s: %w", q, addr, err)
+		}
+		resp.Id = m.Id
+
+		return resp, x.RTT, nil
+	})
+}
+
+// questionString formats q as "www.example.com. IN A".
+func questionString(q dns.Question) string {
+	return dns.CanonicalName(q.Name) + " " + dns.Class(q.Qclass).String() + " " + dns.Type(q.Qtype).String()
+}
+
+// parseQuestion is the inverse of questionString.
+func parseQuestion(s string) (dns.Question, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return dns.Question{}, fmt.Errorf("malformed question: %q", s)
+	}
+
+	class, ok := parseClass(fields[1])
+	if !ok {
+		return dns.Question{}, fmt.Errorf("unsupported class: %s", fields[1])
+	}
+	qtype, ok := parseType(fields[2])
+	if !ok {
+		return dns.Question{}, fmt.Errorf("unsupported record type: %s", fields[2])
+	}
+
+	return dns.Question{
+		Name:   dns.CanonicalName(fields[0]),
+		Qtype:  qtype,
+		Qclass: class,
+	}, nil
+}
@@ -31,21 +31,95 @@ type RecordSet struct {
 	// representation of that error, such as "NXDOMAIN", "SERVFAIL", etc.
 	Type string
 
+	// Rcode is the response code of the DNS response, such as "NOERROR",
+	// "NXDOMAIN", or "SERVFAIL". Rcode is empty if no response has been
+	// received.
+	Rcode string
+
+	// Authoritative, Truncated, RecursionAvailable, and AuthenticatedData
+	// report the AA, TC, RA, and AD bits of the DNS response, respectively.
+	// All of them are false if no response has been received.
+	Authoritative      bool
+	Truncated          bool
+	RecursionAvailable bool
+	AuthenticatedData  bool
+
 	// TTL is the smallest time-to-live of the records in this set, as returned
 	// by the name server.
 	TTL time.Duration
 
 	// Values contains the values of each record in the DNS response, in the
-	// order sent by the server. The values may be quoted, for instance in SPF
-	// record sets.
+	// order sent by the server. The values are in presentation format, as in
+	// a zone file, without the owner name, TTL, class, and type; for
+	// instance "10 mx.example.com." for an MX record. The values may be
+	// quoted, for instance in SPF record sets.
+	//
+	// Records of types that have no presentation format of their own, such
+	// as types unknown to this package, are formatted generically as
+	// described in RFC 3597: "\#", the length of the data in bytes, and the
+	// data in hex, for instance "\# 3 abcdef".
 	Values []string
 
+	// ValuesByType contains the same values as Values, grouped by record type,
+	// such as "A", "MX", etc. This is mostly useful for ANY queries, which may
+	// return records of various types.
+	//
+	// Servers may answer ANY queries with a single synthesized HINFO record
+	// as described in RFC 8482. Such a record is not included in Values and
+	// ValuesByType; instead, ErrMinimalANY is added to Warnings.
+	ValuesByType map[string][]string
+
+	// Synthesized reports whether the name server has synthesized the
+	// records in Values from a wildcard record (RFC 4592), such as
+	// *.example.com, instead of serving records that exist for Name
+	// explicitly. Synthesized is set if the response contains RRSIG records
+	// that indicate a wildcard, which requires a response to a query with
+	// the DNSSEC OK bit. Otherwise, Resolver.DetectWildcards enables
+	// probing for the wildcard.
+	Synthesized bool
+
+	// DNS64 reports whether the AAAA records in Values have been
+	// synthesized from A records because the name has no AAAA records;
+	// see Resolver.SetDNS64Prefix.
+	DNS64 bool
+
+	// NoData reports whether the response is a NODATA response: the name
+	// exists, but has no records of the requested type, which is indicated by
+	// the response code NOERROR and the SOA record of the zone in the
+	// AUTHORITY section. The SOA record is not included in Values unless
+	// the requested type is SOA.
+	//
+	// EmptyNonTerminal reports whether the name is an empty non-terminal, a
+	// name that doesn't own any records but has names below it, such as
+	// _tcp.example.com if only _sip._tcp.example.com exists. Such names
+	// produce NODATA responses for all types. Unless the response proves it
+	// either way with NSEC or NSEC3 records, Query finds out by asking the
+	// same server for records of any type.
+	NoData           bool
+	EmptyNonTerminal bool
+
+	// Chain lists the fully qualified names that have been passed through
+	// to arrive at Values if Name is an alias, i.e. the owner name of the
+	// first CNAME record followed by the target of each CNAME record, in
+	// order. Chain is nil if no CNAME records have been followed.
+	Chain []string
+
 	// ServerAddr contains the IP address and port of the name server that has
 	// returned this record set.
 	//
 	// ServerAddr is set even in case of network errors.
 	ServerAddr string
 
+	// ServersTried lists the addresses of the name servers that have been
+	// asked for the final answer, in order, including those that have failed
+	// to respond or whose responses have been rejected, such as SERVFAIL
+	// responses or lame delegations. The last one is ServerAddr if a response
+	// has been received. Servers that have only been asked on the way to the
+	// final answer, such as those of parent zones, are not included.
+	// ServersTried is empty if no name server has been asked, such as for
+	// static answers.
+	ServersTried []string
+
 	// Age is the amount of time that has passed since the response was cached
 	// by a Resolver.
 	//
@@ -67,9 +141,111 @@ type RecordSet struct {
 	// response, obviously).
 	RTT time.Duration
 
+	// Authority and Additional contain the records of the AUTHORITY and
+	// ADDITIONAL sections of the DNS response, as sent by the server, such
+	// as the SOA record of the zone if the name exists but has no records of
+	// the requested type, or glue records. The OPT pseudo-record is omitted.
+	Authority  []Record
+	Additional []Record
+
+	// Path describes how Query arrived at this RecordSet.
+	Path PathMetrics
+
+	// ZoneCuts lists the zones that have been traversed to resolve Name
+	// iteratively, in order, such as ".", "com.", and "example.com.",
+	// together with the servers that have referred to them. The first zone
+	// is the one that resolution has started at: the root zone, or the
+	// closest zone whose name servers have been cached, so if the answer
+	// has been served from the cache, ZoneCuts contains only that zone.
+	// ZoneCuts is empty if Name hasn't been resolved iteratively, such as
+	// by a forwarder.
+	ZoneCuts []ZoneCut
+
 	// Trace reports all DNS queries that where necessary to retrieve this
 	// RecordSet.
 	Trace *Trace
+
+	// Warnings contains non-fatal problems that have been encountered while
+	// resolving this RecordSet, such as lame delegations. Test for specific
+	// problems with errors.Is, for instance errors.Is(w, ErrLameDelegation).
+	Warnings []error
+
+	// literal is true if CNAME records are not to be followed; see
+	// WithoutFollowingCNAMEs.
+	literal bool
+}
+
+// Record is a single resource record of a DNS response.
+type Record struct {
+	// Name is the fully qualified owner name of the record. The trailing dot
+	// is omitted.
+	Name string
+
+	// Type is the type of the record, such as "A", "NS", or "SOA".
+	Type string
+
+	TTL time.Duration
+
+	// Value is the value of the record in presentation format, as in
+	// RecordSet.Values.
+	Value string
+}
+
+// newRecords converts rrs to Records, skipping OPT pseudo-records.
+func newRecords(rrs []dns.RR) []Record {
+	var records []Record
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		records = append(records, Record{
+			Name:  trimTrailingDot(hdr.Name),
+			Type:  dns.Type(hdr.Rrtype).String(),
+			TTL:   time.Duration(hdr.Ttl) * time.Second,
+			Value: rrValue(rr),
+		})
+	}
+
+	return records
+}
+
+// PathMetrics describes the path that Resolver.Query has taken to resolve a
+// RecordSet. Unusually large numbers indicate pathological delegations.
+type PathMetrics struct {
+	// Delegations is the number of referrals that have been followed to
+	// arrive at the zone of the answer. Referrals that have been followed
+	// to resolve the addresses of name servers are not counted.
+	Delegations int
+
+	// NSLookups is the number of name servers whose addresses had to be
+	// resolved separately because a referral didn't include glue records.
+	NSLookups int
+
+	// UpstreamRTT is the sum of the round-trip times of all queries that have
+	// been sent to name servers (see Trace.TotalRTT), and Duration is the
+	// time that Query took in total. The difference is mostly due to
+	// queries that have been sent concurrently, and to time spent in this
+	// package.
+	UpstreamRTT time.Duration
+	Duration    time.Duration
+
+	// SubqueryRTT is the part of UpstreamRTT that has been spent on nested
+	// queries, such as those that resolve the addresses of name servers.
+	SubqueryRTT time.Duration
+
+	// SlowestServer is the address of the name server that has taken the
+	// longest to respond to a single query, and SlowestRTT is the
+	// round-trip time of that query. If SlowestRTT accounts for most of
+	// UpstreamRTT, a single server is to blame for a slow lookup rather
+	// than the number of queries.
+	SlowestServer string
+	SlowestRTT    time.Duration
+
+	// CacheTime is the time spent looking up and storing responses in the
+	// cache, including waiting for locks; see Trace.CacheTime.
+	CacheTime time.Duration
 }
 
 func (rs *RecordSet) fromResponse(resp *dns.Msg, addr string, rtt, age time.Duration, ignoreName bool) {
@@ -81,8 +257,28 @@ func (rs *RecordSet) fromResponse(resp *dns.Msg, addr string, rtt, age time.Dura
 	rs.RTT = rtt
 	rs.Age = age
 
+	rs.Rcode = dns.RcodeToString[resp.Rcode]
+	rs.Authoritative = resp.Authoritative
+	rs.Truncated = resp.Truncated
+	rs.RecursionAvailable = resp.RecursionAvailable
+	rs.AuthenticatedData = resp.AuthenticatedData
+
+	if resp.Rcode != dns.RcodeSuccess {
+		rs.Type = dns.RcodeToString[resp.Rcode]
+	}
+
+	rs.Synthesized = isSynthesized(resp)
+	rs.NoData = isNoData(resp)
+	rs.EmptyNonTerminal = isEmptyNonTerminal(resp)
+	rs.Authority = newRecords(resp.Ns)
+	rs.Additional = newRecords(resp.Extra)
+
+	if chain := cnameChain(resp); len(chain) > 1 && !rs.literal {
+		rs.Chain = chain
+	}
+
 	first := true
-	for _, rr := range normalize(resp) {
+	for _, rr := range rs.answer(resp) {
 		hdr := rr.Header()
 		if !ignoreName && hdr.Name != rs.Raw.Question[0].Name {
 			continue
@@ -94,6 +290,65 @@ func (rs *RecordSet) fromResponse(resp *dns.Msg, addr string, rtt, age time.Dura
 		}
 		first = false
 
-		rs.Values = append(rs.Values, rrValue(rr))
+		if rs.NoData && hdr.Rrtype == dns.TypeSOA && rs.Raw.Question[0].Qtype != dns.TypeSOA {
+			// Keep the TTL of the SOA record, which is the negative
+			// caching TTL, so that CachePolicies can obey it.
+			continue
+		}
+
+		if isMinimalANY(rs.Raw.Question[0], rr) {
+			rs.Warnings = append(rs.Warnings, ErrMinimalANY)
+			continue
+		}
+
+		value := rrValue(rr)
+		typ := dns.Type(hdr.Rrtype).String()
+
+		if rs.ValuesByType == nil {
+			rs.ValuesByType = map[string][]string{}
+		}
+		rs.Values = append(rs.Values, value)
+		rs.ValuesByType[typ] = append(rs.ValuesByType[typ], value)
 	}
 }
+
+// records returns the records in rs.Raw that make up this record set, i.e.
+// the records that Values has been derived from.
+func (rs RecordSet) records() []dns.RR {
+	if len(rs.Raw.Question) == 0 {
+		return nil
+	}
+
+	var rrs []dns.RR
+	for _, rr := range rs.answer(&rs.Raw) {
+		if rr.Header().Name == rs.Raw.Question[0].Name {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return rrs
+}
+
+// answer returns the records in m that record sets are made of: the records
+// with CNAME and NS records replaced as described for normalize, or the
+// records of the ANSWER and AUTHORITY sections as they are if rs.literal is
+// true.
+func (rs RecordSet) answer(m *dns.Msg) []dns.RR {
+	if rs.literal {
+		return append(append([]dns.RR{}, m.Answer...), m.Ns...)
+	}
+
+	return normalize(m)
+}
+
+// isMinimalANY reports whether rr is the synthesized HINFO record that RFC
+// 8482 recommends servers to send in response to ANY queries.
+func isMinimalANY(q dns.Question, rr dns.RR) bool {
+	if q.Qtype != dns.TypeANY {
+		return false
+	}
+
+	hinfo, ok := rr.(*dns.HINFO)
+
+	return ok && hinfo.Cpu == "RFC8482"
+}
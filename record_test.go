@@ -0,0 +1,71 @@
+package dnsresolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_RecordReplay(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	rec := r.Record()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	want, err := r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+
+	exchanges := rec.Exchanges()
+	require.Len(t, exchanges, 4)
+	assert.Equal(t, ". IN NS", exchanges[0].Question)
+	assert.Equal(t, "127.0.0.250:5354", exchanges[0].Server)
+	assert.Equal(t, "www.example.com. IN A", exchanges[3].Question)
+	assert.Equal(t, "127.0.0.101:5354", exchanges[3].Server)
+
+	var buf bytes.Buffer
+	_, err = rec.WriteTo(&buf)
+	require.NoError(t, err)
+	t.Log(buf.String())
+
+	exchanges, err = ReadRecording(&buf)
+	require.NoError(t, err)
+
+	// The test servers fail the test if they receive any more queries, so
+	// this verifies that the replay happens offline.
+	r = New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.Replay(exchanges)
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+	assert.Equal(t, want.Values, rs.Values)
+	assert.Equal(t, want.ServerAddr, rs.ServerAddr)
+	assert.Equal(t, want.Trace.Dump(), rs.Trace.Dump())
+
+	_, err = r.Query(ctx, "A", "www.example.org")
+	assert.True(t, errors.Is(err, ErrNotRecorded), "got %v", err)
+}
@@ -2,11 +2,15 @@ package dnsresolver
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/classmarkets/go-dns-resolver/cache"
@@ -18,16 +22,55 @@ import (
 //
 // Concurrent calls to all methods are safe, but exported fields of the
 // Resolver must not be changed until all method calls have returned, of
-// course.
+// course. Methods that change the configuration, such as SetForwarders, may
+// be called at any time; they affect queries that start afterwards.
 type Resolver struct {
-	// mu protects against races in Query, which initializes fields with their
-	// default values if necessary.
-	mu sync.RWMutex
+	// mu serializes changes to cfg.
+	mu sync.Mutex
+
+	// cfg holds the current *config. Query loads it without locking.
+	cfg atomic.Value
 
 	// TimeoutPolicy determines the round-trip timout for a single DNS query.
 	// If nil, DefaultTimeoutPolicy() is used.
 	TimeoutPolicy TimeoutPolicy
 
+	// RefusalPolicy determines how REFUSED and NOTIMP responses are
+	// handled. Either way, the next name server is queried, and if all
+	// name servers of a zone refuse, Query returns an error that wraps
+	// ErrRefused.
+	RefusalPolicy RefusalPolicy
+
+	// ServFailPolicy determines whether a name server that responds with
+	// SERVFAIL is queried again before the next one. By default it isn't.
+	ServFailPolicy ServFailPolicy
+
+	// ServerOrder determines the order in which the name servers of a zone
+	// are tried, sequentially or with HappyEyeballsDelay. By default, they
+	// are tried in the order of the referral. Round-robin positions and
+	// preferred servers are remembered for the lifetime of the Resolver and
+	// shared with clones that share its cache. ServerOrder doesn't apply to
+	// forwarders.
+	ServerOrder ServerOrder
+
+	// AttemptTimeoutPolicy, if not nil, is used instead of TimeoutPolicy.
+	// It receives the number of the attempt and the measured health of the
+	// server in addition to the arguments of TimeoutPolicy.
+	AttemptTimeoutPolicy AttemptTimeoutPolicy
+
+	// QueryTimeout limits the total time that a single call to Query may
+	// take, including all queries that are necessary to follow referrals,
+	// resolve the addresses of name servers, and so on. This way, a lookup
+	// that involves many delegations can't take arbitrarily long even if
+	// each single query completes within the limit set by the
+	// TimeoutPolicy. If the limit is exceeded, Query returns an error
+	// wrapping context.DeadlineExceeded. If zero, Query is limited only by
+	// its context.
+	//
+	// Functions that call Query more than once, such as LookupCAA, apply
+	// the limit to each call separately.
+	QueryTimeout time.Duration
+
 	// CachePolicy determines how long DNS responses remain in this resolver's
 	// cache. If nil, DefaultCachePolicy() is used.
 	//
@@ -38,10 +81,169 @@ type Resolver struct {
 	// clear the cache if desired.
 	//
 	// The cache size is limited to 10k entries, and the least recently used
-	// records are evicted if necessary.
+	// records are evicted if necessary. See SetCacheMaxBytes to limit the
+	// memory used by the cache as well.
 	CachePolicy CachePolicy
 
-	logFunc func(RecordSet, error)
+	// CacheLogFunc, if not nil, is called whenever the CachePolicy, or the
+	// CachePolicy of a ZonePolicy, is consulted for a response that has
+	// just been received, with the RecordSet that has been passed to the
+	// policy and the TTL that the policy has returned. The response is
+	// cached only if the TTL is positive. This helps to understand why
+	// responses are or aren't cached as expected.
+	//
+	// CacheLogFunc may be called concurrently.
+	CacheLogFunc func(RecordSet, time.Duration)
+
+	// LocalPolicy determines how names in the .local domain, which is
+	// reserved for multicast DNS, are handled. By default, they are
+	// resolved like all other names.
+	LocalPolicy LocalPolicy
+
+	// ResponsePolicy, if not nil, filters the answers of Query after
+	// resolution, including NXDOMAIN responses. It may replace them with
+	// NXDOMAIN or empty responses, or other records, or cause Query to fail
+	// with ErrPolicyDrop. Replaced answers are marked in the Trace; see
+	// TraceNode.Policy. See Blocklist for a ResponsePolicy that implements
+	// domain lists and response policy zones (RPZ).
+	ResponsePolicy ResponsePolicy
+
+	// QueryRewriter, if not nil, rewrites the names that Query is called
+	// with before they are resolved, such as to map a staging domain onto
+	// the production domain, and maps the names in the question, the
+	// records, and the Chain of the result back. Since the rewritten names
+	// are resolved, they are the ones that are cached, subject to the
+	// ResponsePolicy, and reported in the Trace. See SuffixRewriter.
+	QueryRewriter QueryRewriter
+
+	// DelegationTTL limits how long the delegations to zones that have been
+	// learned from referrals are cached, that is, the addresses of the name
+	// servers of each zone. Delegations are cached for the TTL of their NS
+	// and glue records, but no longer than DelegationTTL, independently of
+	// the CachePolicy, so that queries for names in known zones are sent to
+	// the zone's name servers right away instead of starting at the root
+	// name servers. If zero, delegations are cached for at most one hour. If
+	// negative, delegations are not cached. ClearCache clears the
+	// delegation cache as well.
+	DelegationTTL time.Duration
+
+	// OnDelegation, if not nil, is called whenever Query is about to follow
+	// a referral to the name servers of a zone, including referrals that
+	// are followed to resolve the addresses of name servers. This allows
+	// for collecting the topology of delegations, or for policies such as
+	// refusing to descend into certain zones: if OnDelegation returns an
+	// error, the referral isn't followed, and Query fails with an error
+	// that wraps it. Referrals that are taken from the delegation cache
+	// are not reported again.
+	//
+	// OnDelegation may be called concurrently.
+	OnDelegation func(ZoneCut) error
+
+	// MaxTraceDepth and MaxTraceQueries limit the size of the Trace of
+	// each RecordSet returned by Query: queries nested more than
+	// MaxTraceDepth levels deep, and all queries after the first
+	// MaxTraceQueries, are omitted and counted in Trace.Truncated. If zero,
+	// 20 levels and 1000 queries are retained, respectively. Negative values
+	// disable the limits.
+	MaxTraceDepth   int
+	MaxTraceQueries int
+
+	// RetainWireFormat causes each TraceNode to retain the query and the
+	// response in wire format, so that traces can be processed by other DNS
+	// tools, or attached to bug reports with full fidelity. See
+	// TraceNode.RawQuery and TraceNode.RawResponse.
+	RetainWireFormat bool
+
+	// MaxCNAMEChain is the maximum number of CNAME records that are
+	// followed to resolve a single name, whether they are contained in a
+	// single response or require further queries. Longer chains cause Query
+	// to fail with a CNAMEChainError. If zero, 8 records are followed. If
+	// negative, chains of any length are followed; cycles are always
+	// detected.
+	MaxCNAMEChain int
+
+	// DetectWildcards causes Query to find out whether answers have been
+	// synthesized from a wildcard record if the response doesn't say so,
+	// by querying the server that sent the answer for the wildcard owners
+	// above the name in question, such as *.example.com for
+	// www.example.com. The answer is considered synthesized if the closest
+	// wildcard with records of the same type has the same values. This is
+	// a heuristic, and it costs additional queries for every answer. See
+	// RecordSet.Synthesized.
+	DetectWildcards bool
+
+	// UDPRetransmitInterval causes queries that are sent via UDP to be sent
+	// again if no response has arrived after UDPRetransmitInterval, and
+	// then after twice that time, and so on, until the timeout determined
+	// by the TimeoutPolicy expires. This way, a single lost packet doesn't
+	// cost the whole timeout. For instance, with a timeout of one second an
+	// interval of 400 milliseconds is reasonable. If zero, queries are sent
+	// only once. UDPRetransmitInterval doesn't apply to custom Transports.
+	UDPRetransmitInterval time.Duration
+
+	// EDNSBufferSize is the UDP payload size that the default Transport
+	// advertises with EDNS0. If zero, 1232 bytes are advertised, as
+	// recommended by DNS Flag Day 2020, which avoids IP fragmentation on
+	// virtually all paths. Larger sizes save falling back to TCP for large
+	// responses, but fragmented responses are dropped by many networks: if
+	// queries to a server with a larger size fail, the server is queried
+	// with 1232 bytes, and then with 512 bytes, and finally via TCP. What
+	// works is remembered for each server. EDNSBufferSize doesn't apply to
+	// custom Transports.
+	EDNSBufferSize uint16
+
+	// TLSConfig is used for name servers that are queried via TLS or HTTPS;
+	// see SetBootstrapServers. If the ServerName is empty, it is set to the
+	// host name that the server has been specified with, if any, and to its
+	// IP address otherwise. If nil, the zero configuration is used, which
+	// verifies certificates against the system's root CAs.
+	TLSConfig *tls.Config
+
+	// TLSConfigFunc, if not nil, returns the TLS configuration for the name
+	// server at addr, such as "tls://192.0.2.53:853" or
+	// "https://dns.example/dns-query", that has been specified with the host
+	// name serverName, or with its IP address if serverName is empty. Use it
+	// to apply custom root CAs, client certificates, or SPKI pins (see
+	// PinSPKI) to particular servers. If it returns nil, TLSConfig is used.
+	// The ServerName is set as for TLSConfig.
+	TLSConfigFunc func(addr, serverName string) *tls.Config
+
+	// ODoHProxy is the URL of an Oblivious DoH proxy (RFC 9230), such as
+	// "https://proxy.example/proxy". If not empty, name servers with the
+	// https:// scheme are queried as Oblivious DoH targets through the
+	// proxy: queries are encrypted for the target, so the proxy can't read
+	// them, and the target doesn't learn where they come from. The public
+	// key of each target is fetched from the target's
+	// /.well-known/odohconfigs and used for an hour. Only targets that
+	// offer DHKEM(P-256, HKDF-SHA256) with AES-GCM are supported.
+	// TLSConfig and TLSConfigFunc apply to the proxy as well. ODoHProxy
+	// doesn't apply to custom Transports.
+	ODoHProxy string
+
+	// Transport sends single queries to name servers. If nil, queries are
+	// sent via UDP with EDNS0. Truncated responses are retried over TCP, and
+	// so are queries to servers that repeatedly fail to respond via UDP.
+	// Queries are sent without EDNS0 to servers that don't support it. What
+	// works for each server is remembered. TCP and TLS connections are
+	// reused for subsequent queries to the same server for as long as the
+	// server allows with the edns-tcp-keepalive option (RFC 7828), and
+	// concurrent queries are pipelined over them (RFC 7766). A custom
+	// Transport can implement other protocols, or answer queries in-process
+	// in tests. Replay sets Transport.
+	//
+	// Middleware installed with Use wraps the Transport.
+	Transport Exchanger
+
+	// LogFunc, if not nil, is called for every query to a name server,
+	// including queries that have been answered from the cache, and
+	// queries that have failed. The RecordSet describes the single
+	// exchange: Raw is the response, or the query if no response has been
+	// received, and Age is positive for responses from the cache. See
+	// NewQueryLog for a LogFunc that writes log lines in the formats of
+	// common name servers.
+	//
+	// LogFunc may be called concurrently.
+	LogFunc func(RecordSet, error)
 
 	// defaultPort is added to things like NS results. This should be "53" for
 	// the real world and "5354" in tests.
@@ -52,28 +254,121 @@ type Resolver struct {
 	DisableIP4 bool
 	DisableIP6 bool
 
-	systemServerAddrs []string
-
-	cache *cache.Cache
+	// HappyEyeballsDelay enables racing name servers with IPv6 and IPv4
+	// addresses against each other, similar to RFC 8305. If a zone has name
+	// servers with both kinds of addresses, a query is sent to an IPv6
+	// address first, and if no response has arrived after
+	// HappyEyeballsDelay, to an IPv4 address as well. The first response is
+	// used. This way, broken IPv6 connectivity doesn't cost a full timeout
+	// for every zone. RFC 8305 recommends a delay of 250 milliseconds. If
+	// zero, name servers are tried one at a time in the order of the
+	// referral.
+	HappyEyeballsDelay time.Duration
+
+	// ParallelNSLookups is the number of name server names whose addresses
+	// are resolved concurrently if a delegation doesn't include glue
+	// records. The addresses of the first name server that can be resolved
+	// are used. If ParallelNSLookups is less than two, name servers are
+	// resolved one at a time.
+	ParallelNSLookups int
+
+	// StrictIDNA controls how internationalized domain names passed to Query
+	// are converted to their ASCII form (IDNA2008). By default, names are
+	// mapped leniently, as browsers do: for instance, upper case letters are
+	// mapped to lower case. If StrictIDNA is true, names must already be in
+	// their canonical form and are validated as for registration; other names
+	// are rejected. Labels consisting only of ASCII characters are never
+	// converted, and remain case-insensitive.
+	//
+	// Use DisplayName to convert names in results back to Unicode.
+	StrictIDNA bool
+
+	// StrictResponses causes responses with records that don't belong
+	// there to be rejected, instead of salvaging what can be used: records
+	// in the ANSWER section whose owner name or type don't match the
+	// question or its CNAME chain, such as the NS records of referrals that
+	// some servers send there, records in the AUTHORITY section that
+	// refer to unrelated zones, records of another class, TTLs larger than
+	// 2^31-1 seconds, and questions that don't match the query. Rejected
+	// responses are treated like network errors: the next name server is
+	// queried, and if none is left, Query returns an error that wraps a
+	// *MalformedResponseError that identifies the offending record.
+	//
+	// By default, such records are ignored as far as possible.
+	StrictResponses bool
+
+	cache         *cache.Cache
+	cacheMaxBytes int
+	cacheHooks    cache.Hooks
+	delegations   *delegationCache
+	health        *serverHealth
+	zoneOrder     *zoneOrder
+	stats         *stats
+
+	// serverModes, httpTransport, tcpConns, and odohConfigs are used by the
+	// default transport; see Transport.
+	serverModes   *serverModes
+	httpTransport *http.Transport
+	tcpConns      *tcpConns
+	odohConfigs   *odohConfigs
 }
 
 // resolver is the same as Resolver, but doesn't need a mutex because it is
-// created for each call to Resolver.Query and therefore not used
-// concurrently.
+// created for each call to Resolver.Query and therefore not reconfigured.
 type resolver struct {
-	TimeoutPolicy TimeoutPolicy
-	CachePolicy   CachePolicy
-	logFunc       func(RecordSet, error)
+	TimeoutPolicy        TimeoutPolicy
+	AttemptTimeoutPolicy AttemptTimeoutPolicy
+	CachePolicy          CachePolicy
+	logFunc              func(RecordSet, error)
+	cacheLogFunc         func(RecordSet, time.Duration)
+	onDelegation         func(ZoneCut) error
 
 	defaultPort string
 
 	ip4disabled bool
 	ip6disabled bool
 
-	cache *cache.Cache
+	parallelNS    int
+	happyEyeballs time.Duration
+	maxCNAMEs     int
+	followCNAMEs  bool
+	wildcards     bool
+	wireFormat    bool
+	strict        bool
+	refusal       RefusalPolicy
+	servfail      ServFailPolicy
+	serverOrder   ServerOrder
+	zonePolicies  map[string]ZonePolicy
+	static        map[string][]dns.RR
+	dns64Prefix   *net.IPNet
+	localPolicy   LocalPolicy
+
+	responsePolicy ResponsePolicy
+	queryRewriter  QueryRewriter
+
+	cache         *cache.Cache
+	exchange      Exchanger
+	exchangeSlots chan struct{}
+	serverSlots   *serverSlots
+	health        *serverHealth
+	zoneOrder     *zoneOrder
+	stats         *stats
+
+	delegations   *delegationCache // nil if disabled
+	delegationTTL time.Duration
 
 	systemServerAddrs []string
+	forwarders        []string
+	zoneForwarders    map[string][]string
+	ntas              []string
 	seen              map[string]map[dns.Question]struct{} // used to detect cycles
+
+	// delegationHops and nsLookups count the referrals that have been
+	// followed and the name servers that have been resolved, respectively.
+	// They are accessed atomically, since name servers may be resolved
+	// concurrently.
+	delegationHops int64
+	nsLookups      int64
 }
 
 // New returns a new Resolver that resolves all queries recursively starting
@@ -85,13 +380,117 @@ func New() *Resolver {
 		CachePolicy:   DefaultCachePolicy(),
 		defaultPort:   "53",
 		cache:         cache.New(10_000),
+		delegations:   newDelegationCache(),
+		health:        newServerHealth(),
+		zoneOrder:     newZoneOrder(),
+		stats:         &stats{},
+
+		serverModes:   newServerModes(),
+		httpTransport: newHTTPTransport(),
+		tcpConns:      newTCPConns(),
+		odohConfigs:   newODoHConfigs(),
 	}
 }
 
+// Clone returns a new Resolver with the same configuration as R, including
+// its exported fields, bootstrap servers, forwarders, and middleware. The
+// configuration of the clone can be changed independently of R; for instance,
+// an application may use R for interactive queries and a clone with a more
+// patient TimeoutPolicy for batch jobs.
+//
+// If shareCache is true, the clone shares the response and delegation caches
+// of R, and what has been learned about the capabilities of name servers, so
+// that either resolver benefits from the queries of the other. ClearCache
+// then clears the caches of both. Otherwise the clone starts with empty
+// caches. Statistics are never shared; see Stats.
+func (R *Resolver) Clone(shareCache bool) *Resolver {
+	R.mu.Lock()
+	defer R.mu.Unlock()
+
+	clone := &Resolver{
+		TimeoutPolicy:         R.TimeoutPolicy,
+		AttemptTimeoutPolicy:  R.AttemptTimeoutPolicy,
+		RefusalPolicy:         R.RefusalPolicy,
+		ServerOrder:           R.ServerOrder,
+		ServFailPolicy:        R.ServFailPolicy,
+		QueryTimeout:          R.QueryTimeout,
+		CachePolicy:           R.CachePolicy,
+		CacheLogFunc:          R.CacheLogFunc,
+		ResponsePolicy:        R.ResponsePolicy,
+		QueryRewriter:         R.QueryRewriter,
+		LocalPolicy:           R.LocalPolicy,
+		DelegationTTL:         R.DelegationTTL,
+		MaxTraceDepth:         R.MaxTraceDepth,
+		MaxTraceQueries:       R.MaxTraceQueries,
+		RetainWireFormat:      R.RetainWireFormat,
+		MaxCNAMEChain:         R.MaxCNAMEChain,
+		DetectWildcards:       R.DetectWildcards,
+		UDPRetransmitInterval: R.UDPRetransmitInterval,
+		EDNSBufferSize:        R.EDNSBufferSize,
+		TLSConfig:             R.TLSConfig,
+		TLSConfigFunc:         R.TLSConfigFunc,
+		OnDelegation:          R.OnDelegation,
+		ODoHProxy:             R.ODoHProxy,
+		Transport:             R.Transport,
+		LogFunc:               R.LogFunc,
+		defaultPort:           R.defaultPort,
+		DisableIP4:            R.DisableIP4,
+		DisableIP6:            R.DisableIP6,
+		HappyEyeballsDelay:    R.HappyEyeballsDelay,
+		ParallelNSLookups:     R.ParallelNSLookups,
+		StrictIDNA:            R.StrictIDNA,
+		StrictResponses:       R.StrictResponses,
+		cache:                 R.cache,
+		cacheMaxBytes:         R.cacheMaxBytes,
+		cacheHooks:            R.cacheHooks,
+		delegations:           R.delegations,
+		health:                R.health,
+		zoneOrder:             R.zoneOrder,
+		stats:                 &stats{},
+		serverModes:           R.serverModes,
+		httpTransport:         R.httpTransport,
+		tcpConns:              R.tcpConns,
+		odohConfigs:           R.odohConfigs,
+	}
+	if !shareCache {
+		clone.cache = cache.New(R.cache.MaxSize())
+		clone.cache.SetMaxBytes(R.cacheMaxBytes)
+		clone.cache.SetHooks(R.cacheHooks)
+		clone.delegations = newDelegationCache()
+		clone.health = newServerHealth()
+		clone.zoneOrder = newZoneOrder()
+		clone.serverModes = newServerModes()
+		clone.httpTransport = newHTTPTransport()
+		clone.tcpConns = newTCPConns()
+		clone.odohConfigs = newODoHConfigs()
+	}
+
+	// The config is never modified, so it can be shared.
+	clone.cfg.Store(R.config())
+
+	return clone
+}
+
 // SetBootstrapServers specifies the IP addresses and, optionally, ports for
 // the name servers that are used to discover the root name servers. By
 // default the name servers configured in the operating system are used.
 //
+// Instead of IP addresses, host names may be specified; they are resolved
+// once, by the operating system's resolver, when SetBootstrapServers is
+// called, and each of their addresses is used. Name servers can also be
+// specified by URL:
+//
+//	tls://dns.example:853           DNS over TLS (RFC 7858); the default port is 853
+//	https://dns.example/dns-query   DNS over HTTPS (RFC 8484); the default path is /dns-query
+//	unix:///run/dnsproxy.sock       a Unix domain socket
+//
+// The certificates of TLS and HTTPS servers are verified against the host
+// name in the URL; see Resolver.TLSConfig.
+//
+// Unix domain sockets are used by some local DNS proxies; their path must be
+// absolute. Messages are exchanged via Unix domain sockets as for DNS over
+// TCP, prefixed with their length.
+//
 // This method is intended mostly for testing this package, but is also useful
 // if the operating system's resolver can't be trusted to query the root zone
 // correctly, or if automatic detection fails.
@@ -101,50 +500,238 @@ func New() *Resolver {
 // platform specific. For instance, on *nix systems, /etc/resolv.conf is
 // parsed.
 func (r *Resolver) SetBootstrapServers(serverAddresses ...string) error {
-	serverAddresses, err := r.normalizeAddrs(serverAddresses)
+	serverAddresses, serverNames, err := r.normalizeAddrs(serverAddresses)
 	if err != nil {
 		return err
 	}
 
+	r.updateConfig(func(c *config) {
+		*c = *c.withServerNames(serverNames)
+		c.systemServerAddrs = serverAddresses
+	})
+
+	return nil
+}
+
+// SetDefaultPort sets the port that is used to contact name servers whose
+// address doesn't include one, such as all name servers discovered during
+// resolution. The default is 53.
+//
+// This is mostly useful in tests that run name servers on unprivileged ports,
+// for instance with the dnsresolvertest package. Addresses previously passed
+// to SetBootstrapServers are not affected. Unlike the other Set methods,
+// SetDefaultPort must not be called concurrently with Query.
+func (r *Resolver) SetDefaultPort(port int) {
 	r.mu.Lock()
-	r.systemServerAddrs = serverAddresses
+	r.defaultPort = strconv.Itoa(port)
 	r.mu.Unlock()
+}
+
+// SetForwarders switches the resolver to forward-only mode: instead of
+// resolving queries iteratively, starting at the root name servers, all
+// queries are forwarded to the given recursive resolvers, with the RD
+// (recursion desired) flag set. This is useful in environments that don't
+// allow direct access to authoritative name servers.
+//
+// The servers are tried in order; the next server is only tried if a server
+// can't be reached or responds with SERVFAIL or REFUSED. Cache and timeout
+// policies apply as usual, and the queries are recorded in the trace.
+//
+// serverAddresses are interpreted as in SetBootstrapServers. Calling
+// SetForwarders without arguments switches back to iterative resolution.
+func (r *Resolver) SetForwarders(serverAddresses ...string) error {
+	serverAddresses, serverNames, err := r.normalizeAddrs(serverAddresses)
+	if err != nil {
+		return err
+	}
+
+	r.updateConfig(func(c *config) {
+		*c = *c.withServerNames(serverNames)
+		c.forwarders = serverAddresses
+	})
+
+	return nil
+}
+
+// SetZoneForwarders causes queries for names in zone, including the zone's
+// apex, to be forwarded to the given recursive resolvers, while all other
+// names are resolved as usual. This is commonly used for internal zones that
+// are only visible to the resolvers of a corporate network, for instance:
+//
+//	r.SetZoneForwarders("corp.example.", "10.0.0.53", "10.0.1.53")
+//
+// If zones are nested, the most specific zone applies. Forwarding also
+// applies to the names of name servers in zone. The servers are tried in
+// order, as described for SetForwarders.
+//
+// serverAddresses are interpreted as in SetBootstrapServers. Calling
+// SetZoneForwarders without any server addresses removes the configuration
+// for zone.
+func (r *Resolver) SetZoneForwarders(zone string, serverAddresses ...string) error {
+	serverAddresses, serverNames, err := r.normalizeAddrs(serverAddresses)
+	if err != nil {
+		return err
+	}
+
+	zone = dns.CanonicalName(zone)
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return errors.New("not a domain name: " + zone)
+	}
+
+	r.updateConfig(func(c *config) {
+		*c = *c.withServerNames(serverNames)
+		zoneForwarders := make(map[string][]string, len(c.zoneForwarders)+1)
+		for z, addrs := range c.zoneForwarders {
+			zoneForwarders[z] = addrs
+		}
+		if len(serverAddresses) > 0 {
+			zoneForwarders[zone] = serverAddresses
+		} else {
+			delete(zoneForwarders, zone)
+		}
+		c.zoneForwarders = zoneForwarders
+	})
+
+	return nil
+}
+
+// SetZonePolicy overrides the timeout, cache, and SERVFAIL policies of the
+// resolver for queries for names in zone, including the zone's apex. For
+// instance, responses from internal name servers may be cached aggressively,
+// while a top-level domain whose name servers are known to be slow may
+// require longer timeouts:
+//
+//	r.SetZonePolicy("internal.", dnsresolver.ZonePolicy{
+//		CachePolicy: dnsresolver.ObeyResponderAdvice(time.Minute),
+//	})
+//	r.SetZonePolicy("example.", dnsresolver.ZonePolicy{
+//		TimeoutPolicy: func(string, string, string) time.Duration { return 5 * time.Second },
+//	})
+//
+// The policies apply to all queries for names in zone, including those for
+// the names of name servers. If zones are nested, only the policy of the
+// most specific zone applies; it isn't merged with the policies of enclosing
+// zones. Calling SetZonePolicy with the zero ZonePolicy
+// removes the configuration for zone.
+func (r *Resolver) SetZonePolicy(zone string, policy ZonePolicy) error {
+	zone = dns.CanonicalName(zone)
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return errors.New("not a domain name: " + zone)
+	}
+
+	r.updateConfig(func(c *config) {
+		zonePolicies := make(map[string]ZonePolicy, len(c.zonePolicies)+1)
+		for z, p := range c.zonePolicies {
+			zonePolicies[z] = p
+		}
+		if !policy.isZero() {
+			zonePolicies[zone] = policy
+		} else {
+			delete(zonePolicies, zone)
+		}
+		c.zonePolicies = zonePolicies
+	})
+
+	return nil
+}
+
+// SetNegativeTrustAnchors configures negative trust anchors (RFC 7646): zones
+// whose DNSSEC deployment is known to be broken, and which should therefore
+// be resolved without DNSSEC validation. Resolver doesn't validate DNSSEC
+// signatures itself, but validating resolvers that queries are forwarded to
+// (see SetForwarders and SetZoneForwarders) fail queries for such zones with
+// SERVFAIL. Queries for names in the given zones, including their apexes,
+// are therefore sent to forwarders with the CD (checking disabled) bit set.
+//
+// Each call replaces the previous configuration. Calling
+// SetNegativeTrustAnchors without arguments removes all negative trust
+// anchors.
+func (r *Resolver) SetNegativeTrustAnchors(zones ...string) error {
+	anchors := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		zone = dns.CanonicalName(zone)
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return errors.New("not a domain name: " + zone)
+		}
+		anchors = append(anchors, zone)
+	}
+
+	r.updateConfig(func(c *config) {
+		c.negativeTrustAnchors = anchors
+	})
 
 	return nil
 }
 
-func (r *Resolver) normalizeAddrs(addrs []string) ([]string, error) {
+// normalizeAddrs returns the canonical forms of addrs, without duplicates,
+// and the names that the certificates of TLS and HTTPS servers are verified
+// against, if they have been specified by host name.
+func (r *Resolver) normalizeAddrs(addrs []string) ([]string, map[string]string, error) {
+	r.mu.Lock()
+	defaultPort := r.defaultPort
+	r.mu.Unlock()
+
 	seen := map[string]bool{}
 	validDistinctAddrs := make([]string, 0, len(addrs))
+	serverNames := map[string]string{}
 
 	for _, addr := range addrs {
-		ip, port, err := net.SplitHostPort(addr)
+		normalized, serverName, err := normalizeAddr(addr, defaultPort)
 		if err != nil {
-			ip = addr
+			return nil, nil, err
 		}
 
-		if net.ParseIP(ip) == nil {
-			return nil, errors.New("not an ip address: " + addr)
+		for _, addr := range normalized {
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			validDistinctAddrs = append(validDistinctAddrs, addr)
+			if serverName != "" {
+				serverNames[addr] = serverName
+			}
 		}
+	}
 
-		if port == "" {
-			port = r.defaultPort
-		}
-		addr = net.JoinHostPort(ip, port)
+	return validDistinctAddrs, serverNames, nil
+}
 
-		if seen[addr] {
-			continue
-		}
-		seen[addr] = true
-		validDistinctAddrs = append(validDistinctAddrs, addr)
-	}
+// SetCacheMaxBytes limits the memory used by the response cache: the sum of
+// the sizes of the cached responses in wire format is kept below
+// approximately n bytes, in addition to the limit of 10k entries, and the
+// least recently used responses are evicted if necessary. Responses that are
+// too large to fit are not cached. A few large responses, such as those to
+// ANY or DNSKEY queries, would otherwise take up much more memory than the
+// number of entries suggests. If n is zero or negative, which is the
+// default, only the number of entries is limited.
+//
+// If R shares its cache with clones, the limit applies to the shared cache.
+func (r *Resolver) SetCacheMaxBytes(n int) {
+	r.mu.Lock()
+	r.cacheMaxBytes = n
+	r.mu.Unlock()
+
+	r.cache.SetMaxBytes(n)
+}
+
+// SetCacheHooks installs callbacks that are called when responses are added
+// to or removed from the response cache, for instance to monitor its churn,
+// to refresh entries before they expire, or to mirror them into a secondary
+// store. See cache.Hooks. The delegation cache doesn't call any hooks.
+//
+// If R shares its cache with clones, the hooks apply to the shared cache.
+func (r *Resolver) SetCacheHooks(h cache.Hooks) {
+	r.mu.Lock()
+	r.cacheHooks = h
+	r.mu.Unlock()
 
-	return validDistinctAddrs, nil
+	r.cache.SetHooks(h)
 }
 
 // ClearCache removes any cached DNS responses.
 func (r *Resolver) ClearCache() {
 	r.cache.Clear()
+	r.delegations.clear()
 }
 
 // Query starts a recursive query for the given record type and DNS name.
@@ -153,18 +740,29 @@ func (r *Resolver) ClearCache() {
 // error is returned but it may be wrapped.
 //
 // recordType is the type of the record set to query, such as "A", "AAAA",
-// "SRV", etc.
+// "SRV", etc. For "ANY" queries, RecordSet.ValuesByType is usually more
+// useful than RecordSet.Values. Any type, including types unknown to this
+// package, can be specified in the generic form "TYPE65534" (RFC 3597). The
+// values of records of unknown types are formatted generically as well, as
+// in "\# 3 abcdef": the length of the RDATA in bytes, followed by the RDATA
+// in hex.
 //
 // domainName is always understood as a fully qualified domain, making the
-// trailing dot optional. If recordType is "PTR", and domainName is a valid
-// IPv4 or IPv6 address, the IP address is converted into the correct .arpa
-// domain automatically, however, the Name field of the resulting RecordSet
-// still contains the IP address.
+// trailing dot optional. Internationalized domain names are converted to
+// their ASCII form as described for Resolver.StrictIDNA. If recordType is
+// "PTR", and domainName is a valid IPv4 or IPv6 address, the IP address is
+// converted into the correct .arpa domain automatically, however, the Name
+// field of the resulting RecordSet still contains the IP address.
 //
 // Timeouts are applied according to the TimeoutPolicy. If a timeout occurs,
 // context.DeadlineExceeded is returned but it may be wrapped and must be
 // tested for with errors.Is.
 //
+// If domainName is an alias, RecordSet.Values contains the values of the
+// records that the CNAME records in the final response lead to. Pass a
+// context returned by WithoutFollowingCNAMEs to get the CNAME record itself
+// instead.
+//
 // Query populates the resolver's cache according to the configured
 // CachePolicy, however matching existing items in the cache are used
 // independently of the CachePolicy.
@@ -173,7 +771,9 @@ func (r *Resolver) ClearCache() {
 // with an error.
 //
 // Concurrent calls to Query are safe, but public fields of the Resolver must
-// not be changed until all Query calls have returned.
+// not be changed until all Query calls have returned. Query doesn't block
+// other calls to Query, and methods such as SetForwarders don't affect
+// queries that are already in progress.
 //
 // Most name servers are setup redundantly, i.e. NS responses include multiple
 // records. Such name servers are tried in the order they appear in in the
@@ -196,12 +796,18 @@ func (r *Resolver) ClearCache() {
 // d.gtld-servers.net is not queried because b.gtld-servers.net. responded
 // (albeit with an NXDOMAIN error).
 func (R *Resolver) Query(ctx context.Context, recordType string, domainName string) (RecordSet, error) {
+	rs, err := R.query(ctx, recordType, domainName)
+	R.stats.query(err)
+
+	return rs, err
+}
+
+func (R *Resolver) query(ctx context.Context, recordType string, domainName string) (RecordSet, error) {
 	rs := RecordSet{
 		Raw: dns.Msg{
 			Question: []dns.Question{
 				{
 					Name:   dns.CanonicalName(domainName),
-					Qtype:  dns.StringToType[recordType],
 					Qclass: dns.ClassINET,
 				},
 			},
@@ -209,56 +815,329 @@ func (R *Resolver) Query(ctx context.Context, recordType string, domainName stri
 		Name:  domainName,
 		Type:  recordType,
 		Age:   -1 * time.Second,
-		Trace: &Trace{},
+		Trace: R.newTrace(),
 	}
 
-	if _, ok := dns.StringToType[recordType]; !ok {
+	qtype, ok := parseType(recordType)
+	if !ok {
 		return rs, fmt.Errorf("unsupported record type: %s", recordType)
 	}
+	rs.Raw.Question[0].Qtype = qtype
 
-	if recordType == "PTR" {
+	if qtype == dns.TypePTR {
 		if ip := net.ParseIP(domainName); ip != nil {
 			domainName = arpaName(ip)
 			rs.Raw.Question[0].Name = domainName
 		}
 	}
 
-	R.mu.Lock()
+	cfg := R.config()
 
 	var err error
-	if len(R.systemServerAddrs) == 0 {
-		R.systemServerAddrs, err = R.discoverSystemServers()
+	if len(cfg.systemServerAddrs) == 0 && len(cfg.forwarders) == 0 {
+		cfg, err = R.discover()
 	}
 	if err != nil {
-		R.mu.Unlock()
 		return rs, fmt.Errorf("cannot determine system resolvers: %w", err)
 	}
 
-	if R.TimeoutPolicy == nil {
-		R.TimeoutPolicy = DefaultTimeoutPolicy()
+	r := R.newResolver(cfg)
+	strictIDNA := R.StrictIDNA
+	queryTimeout := R.QueryTimeout
+
+	rs.literal = !followCNAMEs(ctx)
+	r.followCNAMEs = !rs.literal
+
+	rs.Raw.Question[0].Name, err = toASCII(domainName, strictIDNA)
+	if err != nil {
+		return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	if queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	rs.Raw.Question[0].Name = r.rewrite(rs.Raw.Question[0].Name)
+	query := rs
+	rs, err = r.Query(ctx, recordType, domainName, rs)
+	rs, err = r.synthesizeAAAA(ctx, query, rs, err)
+	rs, err = r.applyResponsePolicy(rs, recordType, err)
+	r.restoreNames(&rs)
+	rs.Path = PathMetrics{
+		Delegations: int(atomic.LoadInt64(&r.delegationHops)),
+		NSLookups:   int(atomic.LoadInt64(&r.nsLookups)),
+		UpstreamRTT: rs.Trace.TotalRTT(),
+		SubqueryRTT: rs.Trace.nestedRTT(),
+		CacheTime:   rs.Trace.CacheTime(),
+		Duration:    time.Since(start),
+	}
+	if n := rs.Trace.slowest(); n != nil {
+		rs.Path.SlowestServer = n.Server
+		rs.Path.SlowestRTT = n.RTT
+	}
+	R.stats.path(rs.Path)
+
+	return rs, err
+}
+
+type noFollowKey struct{}
+
+// WithoutFollowingCNAMEs returns a copy of ctx that causes Query and
+// QueryServer to return CNAME records as published instead of the records
+// they refer to. If the question is an alias, RecordSet.Values contains the
+// target of the CNAME record, and RecordSet.TTL is the TTL of the CNAME
+// record, even if the response contains the records of the target as well.
+// This is useful for tools that audit the content of zones.
+//
+// CNAME records are still followed as necessary to resolve the addresses of
+// name servers.
+func WithoutFollowingCNAMEs(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noFollowKey{}, true)
+}
+
+func followCNAMEs(ctx context.Context) bool {
+	return ctx.Value(noFollowKey{}) == nil
+}
+
+// discover determines the system resolvers, unless the configuration has
+// been completed in the meantime, and returns the resulting configuration.
+func (R *Resolver) discover() (*config, error) {
+	R.mu.Lock()
+	defer R.mu.Unlock()
+
+	cfg := R.config()
+	if len(cfg.systemServerAddrs) > 0 || len(cfg.forwarders) > 0 {
+		return cfg, nil
+	}
+
+	addrs, err := R.discoverSystemServers()
+	if err != nil {
+		return nil, err
+	}
+
+	c := *cfg
+	c.systemServerAddrs = addrs
+	R.cfg.Store(&c)
+
+	return &c, nil
+}
+
+// newResolver returns a resolver with the configuration cfg and the current
+// values of R's exported fields. Unset policies are replaced with their
+// defaults.
+func (R *Resolver) newResolver(cfg *config) *resolver {
+	timeoutPolicy := R.TimeoutPolicy
+	if timeoutPolicy == nil {
+		timeoutPolicy = DefaultTimeoutPolicy()
+	}
+	cachePolicy := R.CachePolicy
+	if cachePolicy == nil {
+		cachePolicy = DefaultCachePolicy()
+	}
+
+	var exchange Exchanger = &defaultExchanger{
+		serverModes:  R.serverModes,
+		retransmit:   R.UDPRetransmitInterval,
+		udpSize:      R.EDNSBufferSize,
+		retryRefused: R.RefusalPolicy.RetryTCP,
+		tls:          R.TLSConfig,
+		tlsFunc:      R.TLSConfigFunc,
+		serverNames:  cfg.serverNames,
+		http:         R.httpTransport,
+		conns:        R.tcpConns,
+		odohProxy:    R.ODoHProxy,
+		odohConfigs:  R.odohConfigs,
+		stats:        R.stats,
 	}
-	if R.CachePolicy == nil {
-		R.CachePolicy = DefaultCachePolicy()
+	if R.Transport != nil {
+		exchange = R.Transport
+	}
+	for i := len(cfg.middleware) - 1; i >= 0; i-- {
+		exchange = cfg.middleware[i](exchange)
+	}
+
+	maxCNAMEs := R.MaxCNAMEChain
+	if maxCNAMEs == 0 {
+		maxCNAMEs = 8
 	}
 
-	r := &resolver{
-		TimeoutPolicy:     R.TimeoutPolicy,
-		CachePolicy:       R.CachePolicy,
-		logFunc:           R.logFunc,
-		defaultPort:       R.defaultPort,
-		ip4disabled:       R.DisableIP4,
-		ip6disabled:       R.DisableIP6,
-		cache:             R.cache,
-		systemServerAddrs: R.systemServerAddrs,
-		seen:              map[string]map[dns.Question]struct{}{},
+	delegations, delegationTTL := R.delegations, R.maxDelegationTTL()
+	if delegationTTL < 0 {
+		delegations = nil
 	}
 
-	R.mu.Unlock()
+	return &resolver{
+		TimeoutPolicy:        timeoutPolicy,
+		AttemptTimeoutPolicy: R.AttemptTimeoutPolicy,
+		CachePolicy:          cachePolicy,
+		logFunc:              R.LogFunc,
+		cacheLogFunc:         R.CacheLogFunc,
+		onDelegation:         R.OnDelegation,
+		defaultPort:          R.defaultPort,
+		ip4disabled:          R.DisableIP4,
+		ip6disabled:          R.DisableIP6,
+		parallelNS:           R.ParallelNSLookups,
+		happyEyeballs:        R.HappyEyeballsDelay,
+		maxCNAMEs:            maxCNAMEs,
+		followCNAMEs:         true,
+		wildcards:            R.DetectWildcards,
+		wireFormat:           R.RetainWireFormat,
+		strict:               R.StrictResponses,
+		refusal:              R.RefusalPolicy,
+		servfail:             R.ServFailPolicy,
+		serverOrder:          R.ServerOrder,
+		cache:                R.cache,
+		exchange:             exchange,
+		health:               R.health,
+		zoneOrder:            R.zoneOrder,
+		stats:                R.stats,
+		delegations:          delegations,
+		delegationTTL:        delegationTTL,
+		systemServerAddrs:    cfg.systemServerAddrs,
+		forwarders:           cfg.forwarders,
+		zoneForwarders:       cfg.zoneForwarders,
+		zonePolicies:         cfg.zonePolicies,
+		static:               cfg.static,
+		dns64Prefix:          cfg.dns64Prefix,
+		localPolicy:          R.LocalPolicy,
+		responsePolicy:       R.ResponsePolicy,
+		queryRewriter:        R.QueryRewriter,
+		exchangeSlots:        cfg.exchangeSlots,
+		serverSlots:          cfg.serverSlots,
+		ntas:                 cfg.negativeTrustAnchors,
+		seen:                 map[string]map[dns.Question]struct{}{},
+	}
+}
+
+// newTrace returns an empty Trace that obeys MaxTraceDepth and
+// MaxTraceQueries.
+func (R *Resolver) newTrace() *Trace {
+	maxDepth := R.MaxTraceDepth
+	if maxDepth == 0 {
+		maxDepth = 20
+	}
+	maxSize := R.MaxTraceQueries
+	if maxSize == 0 {
+		maxSize = 1000
+	}
 
-	return r.Query(ctx, recordType, domainName, rs)
+	return newTrace(maxDepth, maxSize)
+}
+
+// QueryServer sends a single query for the given class, record type, and DNS
+// name to the name server at serverAddress, without any recursion. This is
+// useful for diagnostic queries, such as CH TXT version.bind or CH TXT
+// hostname.bind, which identify a particular instance of an anycast name
+// server.
+//
+// class is the class of the record set to query, such as "IN", "CH", or
+// "HS", or in the generic form "CLASS32" (RFC 3597). recordType and
+// domainName are interpreted as in Query.
+//
+// serverAddress is the IP address and, optionally, port of the name server to
+// query. The port defaults to 53.
+//
+// Cache and timeout policies are applied as for Query. If the response
+// indicates an error, the RecordSet is populated nevertheless, and an error is
+// returned. NXDOMAIN responses result in an error that wraps ErrNXDomain.
+func (R *Resolver) QueryServer(ctx context.Context, serverAddress, class, recordType, domainName string) (RecordSet, error) {
+	rs := RecordSet{
+		Raw: dns.Msg{
+			Question: []dns.Question{
+				{
+					Name: dns.CanonicalName(domainName),
+				},
+			},
+		},
+		Name:  domainName,
+		Type:  recordType,
+		Age:   -1 * time.Second,
+		Trace: R.newTrace(),
+	}
+
+	qtype, ok := parseType(recordType)
+	if !ok {
+		return rs, fmt.Errorf("unsupported record type: %s", recordType)
+	}
+	qclass, ok := parseClass(class)
+	if !ok {
+		return rs, fmt.Errorf("unsupported class: %s", class)
+	}
+	rs.Raw.Question[0].Qtype = qtype
+	rs.Raw.Question[0].Qclass = qclass
+
+	addrs, serverNames, err := R.normalizeAddrs([]string{serverAddress})
+	if err != nil {
+		return rs, err
+	}
+	rs.ServerAddr = addrs[0]
+
+	r := R.newResolver(R.config().withServerNames(serverNames))
+	strictIDNA := R.StrictIDNA
+
+	rs.literal = !followCNAMEs(ctx)
+
+	rs.Raw.Question[0].Name, err = toASCII(domainName, strictIDNA)
+	if err != nil {
+		return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	rs.ServersTried = []string{rs.ServerAddr}
+	resp, rtt, age, err := r.doQuery(ctx, rs.Raw.Question[0], rs.ServerAddr, rs.Trace)
+	rs.RTT = rtt
+	if err != nil {
+		return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	rcodeErr := checkRcode(resp)
+	rs.fromResponse(resp, rs.ServerAddr, rtt, age, false)
+	if rcodeErr != nil {
+		return rs, fmt.Errorf("%s %s: %w", recordType, rs.Name, rcodeErr)
+	}
+
+	return rs, nil
+}
+
+// serverError returns err, which has occurred while querying the name server
+// at addr, with the address appended unless it mentions the address already.
+func serverError(err error, addr string) error {
+	if strings.Contains(err.Error(), addr) {
+		return err
+	}
+
+	return fmt.Errorf("%w @%s", err, addr)
+}
+
+// checkRcode returns an error if the response code of m indicates an error.
+// The error wraps ErrNXDomain for NXDOMAIN responses.
+func checkRcode(m *dns.Msg) error {
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		return nil
+	case dns.RcodeNameError:
+		return ErrNXDomain
+	default:
+		return errors.New(dns.RcodeToString[m.Rcode])
+	}
 }
 
 func (r *resolver) Query(ctx context.Context, recordType, domainName string, rs RecordSet) (RecordSet, error) {
+	if r.answerStatic(&rs) {
+		return rs, nil
+	}
+	if r.localPolicy != LocalRecurse && isLocalName(rs.Raw.Question[0].Name) {
+		return r.queryLocal(ctx, rs)
+	}
+	if len(r.forwarders) > 0 {
+		return r.forward(ctx, r.forwarders, rs)
+	}
+	if addrs, _ := r.zoneForwarder(rs.Raw.Question[0].Name); len(addrs) > 0 {
+		return r.forward(ctx, addrs, rs)
+	}
+
 	var stack stack
 
 	rootAddrs, err := r.discoverRootServers(ctx, rs.Trace)
@@ -268,42 +1147,111 @@ func (r *resolver) Query(ctx context.Context, recordType, domainName string, rs
 	if len(rootAddrs) == 0 {
 		return rs, errors.New("no IP addresses in root name server query")
 	}
+	start := rs.Raw.Question[0].Name
+	if rs.Raw.Question[0].Qtype == dns.TypeDS {
+		// DS records are served by the parent zone, so don't start at the
+		// servers of the zone itself if its delegation is cached.
+		start = parentName(start)
+	}
+	addrs, zone := r.nsAddrs(start, rootAddrs)
+	rs.ZoneCuts = []ZoneCut{{Zone: zone}}
 	stack.push(&stackFrame{
 		q:     rs.Raw.Question[0],
-		addrs: r.nsAddrs(rs.Raw.Question[0].Name, rootAddrs),
+		zone:  zone,
+		addrs: addrs,
+		chain: []string{rs.Raw.Question[0].Name},
 	})
 
+	return r.iterate(ctx, rs, stack, rootAddrs)
+}
+
+// iterate resolves the question of the topmost frame in stack iteratively,
+// starting with the servers in that frame.
+func (r *resolver) iterate(ctx context.Context, rs RecordSet, stack stack, rootAddrs []string) (result RecordSet, err error) {
 	var resp *dns.Msg
 
+	// last is the frame whose servers have been queried most recently,
+	// i.e. for the final answer.
+	var last *stackFrame
+	defer func() {
+		if last != nil {
+			result.ServersTried = append([]string(nil), last.servers...)
+		}
+	}()
+
 	for stack.size() > 0 {
 		frame := stack.top()
 
 		if len(frame.addrs) == 0 {
-			return rs, errors.New("servers exhausted")
+			err := &ServersExhaustedError{
+				Zone:    frame.zone,
+				Errors:  frame.errs,
+				refused: frame.refused > 0 && frame.refused >= frame.tried,
+			}
+			return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+		}
+		if frame.tried == 0 {
+			frame.addrs = r.orderServers(frame.zone, frame.addrs)
+		}
+		if r.refusal.Demote {
+			r.demoteRefusing(frame.addrs)
 		}
 		addr := frame.addrs[0]
 		frame.addrs = frame.addrs[1:]
+		frame.tried++
 
 	retry:
-		host, _, err := net.SplitHostPort(addr)
-		if err != nil {
-			host = addr
-			addr = net.JoinHostPort(addr, r.defaultPort)
+		var ip net.IP
+		var err error
+		if _, ok := unixSocketPath(addr); !ok {
+			var host string
+			host, _, err = net.SplitHostPort(endpointHostPort(addr))
+			if err != nil {
+				host = addr
+				addr = net.JoinHostPort(addr, r.defaultPort)
+			}
+
+			ip = net.ParseIP(host)
+			if ip == nil {
+				frame.fail(fmt.Errorf("not an ip address: %s", host))
+				continue
+			}
 		}
 
-		ip := net.ParseIP(host)
-		if ip == nil {
-			err = fmt.Errorf("not an ip address: %s", host)
-			continue
+		qctx, cancel := ctx, context.CancelFunc(func() {})
+		if !frame.deadline.IsZero() {
+			qctx, cancel = context.WithDeadline(ctx, frame.deadline)
 		}
 
 		var rtt, age time.Duration
-		resp, rtt, age, err = r.doQuery(ctx, frame.q, addr, rs.Trace)
+		if r.happyEyeballs > 0 && ip != nil && len(frame.addrs) > 0 {
+			resp, rtt, age, addr, err = r.doQueryHappyEyeballs(qctx, frame, addr, ip, rs.Trace)
+		} else {
+			resp, rtt, age, err = r.doQueryRetry(qctx, frame.q, addr, rs.Trace)
+		}
+		cancel()
+		frame.servers = append(frame.servers, addr)
+		last = frame
+		if err != nil && qctx.Err() == context.DeadlineExceeded && (ctx.Err() == nil || frame.nsNames != nil) {
+			// The frame has used up its share of the deadline. Leave the
+			// rest to the other name servers, if any. The last one may
+			// use up the query's deadline as well.
+			if len(frame.altNames) > 0 {
+				addr = r.nextAltName(frame, rootAddrs)
+				goto retry
+			}
+			err = &BudgetError{Names: frame.nsNames, Budget: frame.budget}
+			return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+		}
+		if errors.Is(err, ErrCircular) {
+			err = frame.cycleError()
+			rs.Trace.last.Error = err
+		}
 		if isTerminal(resp, err) {
 			return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
 		}
 
-		if stack.size() > 1 && empty(resp) {
+		if (stack.size() > 1 || frame.nested) && empty(resp) {
 			// We're trying to figure out the address(es) for a name server
 			// but we didn't get any records back. If we tried to find IPv6
 			// addresses and IPv4 is also supported, don't give up yet. Try
@@ -314,68 +1262,193 @@ func (r *resolver) Query(ctx context.Context, recordType, domainName string, rs
 			}
 
 			if len(frame.altNames) > 0 {
-				frame.q.Name = frame.altNames[0]
-				if !r.ip6disabled {
-					frame.q.Qtype = dns.TypeAAAA
-				}
-				frame.altNames = frame.altNames[1:]
-				rootAddrs := r.nsAddrs(frame.q.Name, rootAddrs)
-				addr = rootAddrs[0]
-				frame.addrs = rootAddrs[1:]
-
+				addr = r.nextAltName(frame, rootAddrs)
 				goto retry
 			}
 		}
 
 		if err != nil {
+			frame.fail(serverError(err, addr))
 			continue
 		}
 
-		if stack.size() == 0 {
+		if isRefusal(resp) {
+			// The server doesn't want to answer, which is no indication
+			// that the other servers won't.
+			frame.refused++
+			frame.fail(fmt.Errorf("%s @%s", dns.RcodeToString[resp.Rcode], addr))
+			continue
+		}
+
+		if stack.size() == 1 {
 			switch resp.Rcode {
 			case dns.RcodeSuccess:
 			case dns.RcodeNameError:
-				return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, ErrNXDomain)
+				err := fmt.Errorf("%s %s: %w", rs.Type, rs.Name, ErrNXDomain)
+				rs.fromResponse(resp, addr, rtt, age, false)
+				r.rememberServer(frame.zone, addr)
+				return rs, err
 			case dns.RcodeServerFailure:
+				frame.fail(fmt.Errorf("%s @%s", dns.RcodeToString[resp.Rcode], addr))
 				continue
 			default:
-				return rs, fmt.Errorf("%s %s: %s", rs.Type, rs.Name, dns.RcodeToString[resp.Rcode])
+				err := fmt.Errorf("%s %s: %s", rs.Type, rs.Name, dns.RcodeToString[resp.Rcode])
+				rs.fromResponse(resp, addr, rtt, age, false)
+				return rs, err
 			}
 		} else if resp.Rcode != dns.RcodeSuccess {
+			frame.fail(fmt.Errorf("%s @%s", dns.RcodeToString[resp.Rcode], addr))
 			continue
 		}
 
-		if isAuthoritative(resp) {
+		// aliases is the chain of CNAME records that leads from the name
+		// that has been asked for originally to the final target in resp.
+		aliases := frame.aliases
+		chain := cnameChain(resp)
+		if !r.followCNAMEs && stack.size() == 1 && !frame.nested {
+			chain = nil // the CNAME records are returned as they are
+		}
+		if len(chain) > 1 {
+			if len(aliases) > 0 {
+				aliases = aliases[:len(aliases)-1]
+			}
+			aliases = append(append([]string{}, aliases...), chain...)
+
+			if r.maxCNAMEs >= 0 && len(aliases)-1 > r.maxCNAMEs {
+				err := &CNAMEChainError{Chain: aliases}
+				rs.Trace.last.Error = err
+				return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+			}
+		}
+
+		// answered is the frame whose question has been answered by resp,
+		// if any. It may be a CNAME that requires further resolution.
+		var answered *stackFrame
+
+		// Responses of forwarders are as good as authoritative ones.
+		if isAuthoritative(resp) || r.isForwarder(addr) {
+			answered = frame
 			stack.pop()
 			rs.Trace.pop()
 
 			if stack.size() == 0 {
 				rs.fromResponse(resp, addr, rtt, age, false)
+				r.rememberServer(answered.zone, addr)
+				if r.wildcards && !rs.Synthesized && len(rs.Values) > 0 {
+					rs.Synthesized = r.probeWildcard(ctx, rs, answered.zone, addr)
+				}
+				if !answered.nested {
+					rs.EmptyNonTerminal = r.probeEmptyNonTerminal(ctx, rs, addr)
+				}
 
 				return rs, nil
 			}
 			frame = stack.top()
 		}
 
-		addrs, names := r.referrals(resp)
+		// Glue is only accepted from servers that are authoritative for
+		// it. Forwarders are trusted with everything.
+		bailiwick := frame.zone
+		if answered != nil {
+			bailiwick = answered.zone
+		}
+		if r.isForwarder(addr) {
+			bailiwick = ""
+		}
+		addrs, names := r.referrals(resp, bailiwick)
+		zone := referralZone(resp)
+
+		if !isAuthoritative(resp) && !r.isForwarder(addr) && isLame(frame.zone, zone, addrs, names) {
+			// The server has been delegated to, but doesn't consider itself
+			// authoritative and doesn't know any better either. Try the
+			// next one.
+			err := fmt.Errorf("%w: %s @%s", ErrLameDelegation, frame.zone, addr)
+			rs.Trace.last.Error = err
+			rs.Warnings = append(rs.Warnings, err)
+			frame.fail(err)
+			continue
+		}
+		r.rememberServer(bailiwick, addr)
+
+		if answered == nil && zone != "" {
+			cut := ZoneCut{
+				Zone:        zone,
+				Parent:      frame.zone,
+				Server:      addr,
+				NameServers: referralNameServers(resp, zone),
+			}
+			if r.onDelegation != nil {
+				if err := r.onDelegation(cut); err != nil {
+					return rs, fmt.Errorf("%s %s: delegation to %s: %w", rs.Type, rs.Name, zone, err)
+				}
+			}
+			if stack.size() == 1 && !frame.nested {
+				atomic.AddInt64(&r.delegationHops, 1)
+				rs.ZoneCuts = append(rs.ZoneCuts, cut)
+				eventStreamFrom(ctx).emit(Event{Kind: EventDelegation, ZoneCut: cut})
+			}
+		}
 
 		if len(addrs) > 0 {
 			frame.addrs = addrs
+			frame.servers = nil
+			frame.errs = nil
+			frame.tried, frame.refused = 0, 0
+			if zone != "" {
+				frame.zone = zone
+			}
+			if r.delegations != nil && zone != "" && !isAuthoritative(resp) && !r.isForwarder(addr) {
+				r.delegations.update(zone, addrs, delegationTTL(resp, zone, r.delegationTTL))
+			}
+		} else if len(names) > 1 && r.parallelNS > 1 && cnameTarget(resp) == "" {
+			addrs, warnings, err := r.resolveNS(ctx, names, frame, rootAddrs, rs.Trace)
+			rs.Warnings = append(rs.Warnings, warnings...)
+			if isTerminal(nil, err) {
+				return rs, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+			}
+			if err != nil {
+				return rs, fmt.Errorf("%s %s: servers exhausted: %w", rs.Type, rs.Name, err)
+			}
+			frame.addrs = addrs
+			frame.servers = nil
+			frame.errs = nil
+			frame.tried, frame.refused = 0, 0
+			if zone != "" {
+				frame.zone = zone
+			}
 		} else if len(names) > 0 {
 			rs.Trace.push()
 			qtype := dns.TypeAAAA
 			if r.ip6disabled {
 				qtype = dns.TypeA
 			}
-			stack.push(&stackFrame{
+			addrs, zone := r.nsAddrs(names[0], rootAddrs)
+			next := &stackFrame{
 				q: dns.Question{
 					Name:   names[0],
 					Qtype:  qtype,
 					Qclass: dns.ClassINET,
 				},
+				zone:     zone,
 				altNames: names[1:],
-				addrs:    r.nsAddrs(names[0], rootAddrs),
-			})
+				addrs:    addrs,
+			}
+			if cnameTarget(resp) != "" {
+				// The names are aliases of the question, not name servers.
+				prev := frame
+				if answered != nil {
+					prev = answered
+				}
+				next.viaCNAME = true
+				next.aliases = aliases
+				next.chain = append(append([]string{}, prev.chain...), names[0])
+			} else {
+				next.chain = append(append([]string{}, frame.chain...), names[0])
+				next.nsNames = names
+				next.setBudget(earliestDeadline(ctx, frame))
+				atomic.AddInt64(&r.nsLookups, 1)
+			}
+			stack.push(next)
 		} else {
 			return rs, errors.New("empty response")
 		}
@@ -388,6 +1461,127 @@ type stackFrame struct {
 	q        dns.Question
 	altNames []string
 	addrs    []string
+
+	// zone is the zone that the servers in addrs are supposedly
+	// authoritative for.
+	zone string
+
+	// errs contains the reasons to skip the servers in addrs, in order.
+	errs []error
+
+	// tried is the number of servers that have been queried since addrs
+	// has been set, and refused the number of those that have responded
+	// with REFUSED or NOTIMP.
+	tried   int
+	refused int
+
+	// servers lists the servers that have been queried since addrs has
+	// been set, in order.
+	servers []string
+
+	// chain lists the names that had to be resolved to arrive at q, ending
+	// with q.Name. viaCNAME reports whether q.Name is the target of a CNAME
+	// record (as opposed to the name of a name server).
+	chain    []string
+	viaCNAME bool
+
+	// aliases lists the names of the CNAME records that have been followed
+	// to arrive at q, starting with the first alias and ending with q.Name.
+	// aliases is nil if q.Name is not the target of a CNAME record.
+	aliases []string
+
+	// nested is true if q is the name of a name server whose addresses are
+	// resolved on behalf of another query, even though the frame is at the
+	// bottom of the stack. See resolveNS.
+	nested bool
+
+	// nsNames are the names of the name servers whose addresses the frame
+	// resolves, one after another, starting with q.Name; altNames are the
+	// ones that haven't been tried yet. Each name but the last gets a share
+	// of the time that is left until limit, which is the deadline of the
+	// query or of the parent frame, so that a slow name server doesn't use
+	// up all of it: the current name has to be resolved by deadline, budget
+	// after it has been tried. limit and deadline are zero if there is no
+	// deadline.
+	nsNames  []string
+	limit    time.Time
+	deadline time.Time
+	budget   time.Duration
+}
+
+// setBudget sets the deadline for resolving the current name of f, which
+// resolves the addresses of a name server. The time that is left until
+// limit is divided equally among the names that are left to be tried and
+// the rest of the query. The last name gets all of it, since there is no
+// other name server to leave time for.
+func (f *stackFrame) setBudget(limit time.Time) {
+	if limit.IsZero() {
+		return
+	}
+
+	f.limit = limit
+	f.budget = time.Until(limit)
+	if len(f.altNames) > 0 {
+		f.budget /= time.Duration(len(f.altNames) + 2)
+	}
+	f.deadline = time.Now().Add(f.budget)
+}
+
+// earliestDeadline returns the earlier of the deadlines of ctx and f, or the
+// zero time if neither has a deadline.
+func earliestDeadline(ctx context.Context, f *stackFrame) time.Time {
+	d, _ := ctx.Deadline()
+	if !f.deadline.IsZero() && (d.IsZero() || f.deadline.Before(d)) {
+		d = f.deadline
+	}
+
+	return d
+}
+
+// nextAltName switches frame to the first of its altNames and returns the
+// address of the first server to query for it.
+func (r *resolver) nextAltName(frame *stackFrame, rootAddrs []string) string {
+	frame.q.Name = frame.altNames[0]
+	if !r.ip6disabled {
+		frame.q.Qtype = dns.TypeAAAA
+	}
+	frame.altNames = frame.altNames[1:]
+	frame.chain[len(frame.chain)-1] = frame.q.Name
+	frame.setBudget(frame.limit)
+
+	addrs, zone := r.nsAddrs(frame.q.Name, rootAddrs)
+	frame.addrs = addrs[1:]
+	frame.servers = nil
+	frame.zone = zone
+
+	return addrs[0]
+}
+
+// fail records err as the reason to skip one of the servers in f.addrs.
+func (f *stackFrame) fail(err error) {
+	f.errs = append(f.errs, err)
+}
+
+// cycleError returns the error to report if a query for f.q turns out to be
+// a repetition.
+func (f *stackFrame) cycleError() error {
+	chain := f.chain
+	for i, name := range chain[:len(chain)-1] {
+		if name == f.q.Name {
+			chain = chain[i:]
+			break
+		}
+	}
+
+	kind := ErrCircularDelegation
+	if f.viaCNAME {
+		kind = ErrCircularCNAME
+	}
+
+	return &CycleError{
+		Kind:  kind,
+		Chain: append([]string{}, chain...),
+	}
 }
 
 type stack []*stackFrame
@@ -418,7 +1612,7 @@ func (r *resolver) discoverRootServers(ctx context.Context, trace *Trace) ([]str
 			continue
 		}
 
-		addrs, _ := r.referrals(resp)
+		addrs, _ := r.referrals(resp, "")
 		if len(addrs) == 0 {
 			err = errors.New("no IP addresses in root name server query")
 			continue
@@ -430,7 +1624,16 @@ func (r *resolver) discoverRootServers(ctx context.Context, trace *Trace) ([]str
 	return nil, fmt.Errorf("discover root servers: %w", err)
 }
 
-func (r *resolver) nsAddrs(fqdn string, rootAddrs []string) []string {
+// nsAddrs returns the addresses of the name servers to start resolving fqdn
+// with, and the zone that these servers are authoritative for.
+func (r *resolver) nsAddrs(fqdn string, rootAddrs []string) ([]string, string) {
+	if addrs, zone := r.zoneForwarder(fqdn); len(addrs) > 0 {
+		return addrs, zone
+	}
+	if addrs, zone := r.delegatedAddrs(fqdn); len(addrs) > 0 {
+		return addrs, zone
+	}
+
 	var tld string
 	if fqdn == "." {
 		tld = "."
@@ -443,14 +1646,14 @@ func (r *resolver) nsAddrs(fqdn string, rootAddrs []string) []string {
 
 	msg, _, _ := r.cache.Lookup(dns.Question{Name: tld}, "ns_set")
 	if msg != nil {
-		addrs, _ := r.referrals(msg)
+		addrs, _ := r.referrals(msg, "")
 		if len(addrs) > 0 {
-			return addrs
+			return addrs, tld
 		}
 	}
 
 	if fqdn == "." {
-		return rootAddrs
+		return rootAddrs, "."
 	}
 
 	// If the lookup for, say, co.uk didn't work, try .uk too
@@ -463,6 +1666,7 @@ func (r *resolver) nsAddrs(fqdn string, rootAddrs []string) []string {
 func isTerminal(resp *dns.Msg, err error) bool {
 	switch {
 	case errors.Is(err, ErrCircular),
+		errors.Is(err, ErrNotRecorded),
 		errors.Is(err, context.Canceled),
 		errors.Is(err, context.DeadlineExceeded):
 		return true
@@ -471,7 +1675,29 @@ func isTerminal(resp *dns.Msg, err error) bool {
 	}
 }
 
-func (r *resolver) referrals(m *dns.Msg) (ips, names []string) {
+// referrals returns the addresses and names that m refers to: the addresses
+// of the name servers that m delegates to, or the addresses in the answer,
+// and the names whose addresses are missing.
+//
+// If bailiwick is not empty, it is the zone of the server that has sent m.
+// Glue records for names at or below bailiwick are preferred: if there are
+// any, the glue records for other names are ignored, since the server has no
+// authority over them, and those names are returned in names instead.
+// Otherwise, all glue records are used.
+func (r *resolver) referrals(m *dns.Msg, bailiwick string) (ips, names []string) {
+	if bailiwick != "" && bailiwick != "." {
+		if trusted := inBailiwick(m, bailiwick); len(trusted.Extra) < len(m.Extra) {
+			ips, names := r.referralsIn(trusted)
+			if len(ips) > 0 {
+				return ips, names
+			}
+		}
+	}
+
+	return r.referralsIn(m)
+}
+
+func (r *resolver) referralsIn(m *dns.Msg) (ips, names []string) {
 	for _, rr := range normalize(m) {
 		switch rr := rr.(type) {
 		case *dns.A:
@@ -492,15 +1718,88 @@ func (r *resolver) referrals(m *dns.Msg) (ips, names []string) {
 	return ips, names
 }
 
+// inBailiwick returns a shallow copy of m without the A and AAAA records in
+// the additional section whose owner names are not at or below bailiwick.
+func inBailiwick(m *dns.Msg, bailiwick string) *dns.Msg {
+	filtered := make([]dns.RR, 0, len(m.Extra))
+	for _, rr := range m.Extra {
+		hdr := rr.Header()
+		if (hdr.Rrtype == dns.TypeA || hdr.Rrtype == dns.TypeAAAA) && !dns.IsSubDomain(bailiwick, hdr.Name) {
+			continue
+		}
+		filtered = append(filtered, rr)
+	}
+
+	cp := *m
+	cp.Extra = filtered
+
+	return &cp
+}
+
+// timeout returns the timeout for the query for q to the server at addr,
+// according to the TimeoutPolicy of the zone of q, the AttemptTimeoutPolicy,
+// or the TimeoutPolicy, in that order of precedence.
+func (r *resolver) timeout(q dns.Question, addr string, trace *Trace) time.Duration {
+	recordType, domainName := dns.Type(q.Qtype).String(), trimTrailingDot(q.Name)
+	if p := r.zonePolicy(q.Name); p.TimeoutPolicy != nil {
+		return p.TimeoutPolicy(recordType, domainName, addr)
+	}
+	if r.AttemptTimeoutPolicy == nil {
+		return r.TimeoutPolicy(recordType, domainName, addr)
+	}
+
+	return r.AttemptTimeoutPolicy.Timeout(TimeoutRequest{
+		RecordType:        recordType,
+		DomainName:        domainName,
+		NameServerAddress: addr,
+		Attempt:           trace.attempts(q) + 1,
+		Health:            r.health.get(addr),
+	})
+}
+
+// doQueryRetry is like doQuery, but queries the server at addr again as long
+// as it responds with SERVFAIL, up to the number of times permitted by the
+// ServFailPolicy.
+func (r *resolver) doQueryRetry(ctx context.Context, q dns.Question, addr string, trace *Trace) (resp *dns.Msg, rtt, age time.Duration, err error) {
+	policy := r.servfail
+	if p := r.zonePolicy(q.Name); p.ServFailPolicy != nil {
+		policy = *p.ServFailPolicy
+	}
+
+	delay := policy.Delay
+	for i := 0; ; i++ {
+		resp, rtt, age, err = r.doQuery(ctx, q, addr, trace)
+		if err != nil || resp == nil || resp.Rcode != dns.RcodeServerFailure {
+			return resp, rtt, age, err
+		}
+		if i >= policy.Retries || age >= 0 {
+			// Cached responses don't change by asking again.
+			return resp, rtt, age, err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return resp, rtt, age, err
+		case <-timer.C:
+		}
+		delay *= 2
+		trace.forget(q, addr)
+	}
+}
+
 // doQuery sends a single DNS query. doQuery uses the cache and timeout
 // policies as required, i. e. the response may be served from the cache
 // instead of sending a query to the server at addr.
 //
-// addr must be an ip:port pair.
+// addr must be an ip:port pair or a normalized address with a scheme; see
+// normalizeAddr.
 func (r *resolver) doQuery(ctx context.Context, q dns.Question, addr string, trace *Trace) (resp *dns.Msg, rtt, age time.Duration, err error) {
 	m := new(dns.Msg)
 	m.Question = []dns.Question{q}
-	m.RecursionDesired = q.Qtype == dns.TypeNS && q.Name == "."
+	m.RecursionDesired = q.Qtype == dns.TypeNS && q.Name == "." || r.isForwarder(addr)
+	m.CheckingDisabled = m.RecursionDesired && r.isNegativelyTrusted(q.Name)
 
 	tn := &TraceNode{
 		Server:  addr,
@@ -509,58 +1808,109 @@ func (r *resolver) doQuery(ctx context.Context, q dns.Question, addr string, tra
 
 	if trace.contains(q, addr) {
 		tn.Error = fmt.Errorf("%w: repeated query: %s %s @%s",
-			ErrCircular, dns.TypeToString[q.Qtype], q.Name, addr)
+			ErrCircular, dns.Type(q.Qtype).String(), q.Name, addr)
 		trace.add(tn)
 		return nil, 0, -1 * time.Second, tn.Error
 	}
 
-	// addr must be an ip:port pair. We need an IP address here to
-	// prevent net.Dial from using the OS resolver implicitly.
-	host, _, err := net.SplitHostPort(addr)
-	if err != nil {
-		tn.Error = fmt.Errorf("not an ip:port pair: %s", host)
-		trace.add(tn)
-		return nil, 0, -1 * time.Second, tn.Error
-	}
+	// Unless it is a Unix domain socket, addr must contain an ip:port pair.
+	// We need an IP address here to prevent net.Dial from using the OS
+	// resolver implicitly.
+	if _, ok := unixSocketPath(addr); !ok {
+		host, _, err := net.SplitHostPort(endpointHostPort(addr))
+		if err != nil {
+			tn.Error = fmt.Errorf("not an ip:port pair: %s", host)
+			trace.add(tn)
+			return nil, 0, -1 * time.Second, tn.Error
+		}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
-		tn.Error = fmt.Errorf("not an ip:port pair: %s", host)
-		trace.add(tn)
-		return nil, 0, -1 * time.Second, tn.Error
-	}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			tn.Error = fmt.Errorf("not an ip:port pair: %s", host)
+			trace.add(tn)
+			return nil, 0, -1 * time.Second, tn.Error
+		}
 
-	if ip.To4() != nil {
-		if r.ip4disabled {
-			tn.Error = fmt.Errorf("IPv4 disabled")
+		if ip.To4() != nil {
+			if r.ip4disabled {
+				tn.Error = fmt.Errorf("IPv4 disabled")
+				trace.add(tn)
+				return nil, 0, -1 * time.Second, tn.Error
+			}
+		} else if r.ip6disabled {
+			tn.Error = fmt.Errorf("IPv6 disabled")
 			trace.add(tn)
 			return nil, 0, -1 * time.Second, tn.Error
 		}
-	} else if r.ip6disabled {
-		tn.Error = fmt.Errorf("IPv6 disabled")
-		trace.add(tn)
-		return nil, 0, -1 * time.Second, tn.Error
 	}
 
-	resp, rtt, age = r.cache.Lookup(q, addr)
+	cacheStart := time.Now()
+	resp, rtt, age, tn.CacheTTL = r.cache.LookupTTL(q, addr)
+	tn.CacheTime = time.Since(cacheStart)
+	tn.CacheHit = resp != nil
 	tn.Age = age
 
 	if resp == nil {
 		age = -1 * time.Second
 		tn.Age = -1 * time.Second
 
-		to := r.TimeoutPolicy(dns.TypeToString[q.Qtype], trimTrailingDot(q.Name), addr)
+		var release func()
+		release, err = r.acquireExchangeSlot(ctx, addr)
+		if err != nil {
+			tn.Error = err
+			trace.add(tn)
+			return nil, 0, -1 * time.Second, tn.Error
+		}
+
+		to := r.timeout(q, addr, trace)
 		cancel := func() {}
 		if to > 0 {
 			ctx, cancel = context.WithTimeout(ctx, to)
 		}
 
-		resp, rtt, err = new(dns.Client).ExchangeContext(ctx, m, addr)
+		var capture *wireCapture
+		if r.wireFormat {
+			capture = &wireCapture{}
+			ctx = withWireCapture(ctx, capture)
+		}
+
+		resp, rtt, err = r.exchange.Exchange(ctx, m, addr)
 		cancel()
+		release()
+		tn.sent = true
+
+		if capture != nil {
+			tn.RawQuery, tn.RawResponse = capture.get()
+		}
 	}
+	r.stats.exchange(!tn.sent)
 	if resp != nil {
 		tn.Message = resp
 	}
+	if resp != nil && r.strict {
+		if verr := validateResponse(m, resp, addr); verr != nil {
+			if tn.RawResponse == nil && r.wireFormat {
+				tn.RawResponse, _ = resp.Pack()
+			}
+			resp, err = nil, verr
+		}
+	}
+	if tn.sent {
+		// A response that fails validation counts as a failure of the
+		// server.
+		r.health.record(addr, rtt, err)
+		if isRefusal(resp) {
+			r.health.refused(addr)
+		}
+	}
+	if r.wireFormat {
+		if tn.RawQuery == nil {
+			tn.RawQuery, _ = m.Pack()
+		}
+		if tn.RawResponse == nil && resp != nil {
+			tn.RawResponse, _ = resp.Pack()
+		}
+	}
 	tn.RTT = rtt
 	tn.Error = err
 
@@ -569,35 +1919,49 @@ func (r *resolver) doQuery(ctx context.Context, q dns.Question, addr string, tra
 
 		rs := RecordSet{
 			Name: trimTrailingDot(q.Name),
-			Type: dns.TypeToString[q.Qtype],
+			Type: dns.Type(q.Qtype).String(),
 		}
 		rs.fromResponse(resp.Copy(), addr, rtt, age, true)
 
-		ttl := r.CachePolicy(rs)
+		cachePolicy := r.CachePolicy
+		if p := r.zonePolicy(q.Name); p.CachePolicy != nil {
+			cachePolicy = p.CachePolicy
+		}
+		ttl := cachePolicy(rs)
+		if r.cacheLogFunc != nil {
+			r.cacheLogFunc(rs, ttl)
+		}
 		if ttl > 0 {
 			age = 0
 			tn.Age = 0
+			tn.CacheTTL = ttl
+			cacheStart := time.Now()
 			r.cache.Update(q, addr, resp, ttl)
 
 			if tld, _, ok := checkTLDNSSet(resp); ok {
 				r.cache.Update(dns.Question{Name: tld}, "ns_set", resp, ttl)
 			}
+			tn.CacheTime += time.Since(cacheStart)
 		}
 	}
 
 	trace.add(tn)
+	eventStreamFrom(ctx).queried(q, addr, resp, rtt, tn.CacheHit, err)
 
 	if r.logFunc != nil {
-		msg := resp
-		if resp == nil {
-			msg = m
-		}
-		r.logFunc(RecordSet{
-			Raw:        *msg,
+		rs := RecordSet{
+			Raw:        *m,
+			Name:       trimTrailingDot(q.Name),
+			Type:       dns.Type(q.Qtype).String(),
 			ServerAddr: addr,
 			RTT:        rtt,
 			Age:        age,
-		}, err)
+		}
+		if resp != nil {
+			rs.Raw = *resp
+			rs.Rcode = dns.RcodeToString[resp.Rcode]
+		}
+		r.logFunc(rs, err)
 	}
 
 	return resp, rtt, age, err
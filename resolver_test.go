@@ -3,10 +3,13 @@ package dnsresolver
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/classmarkets/go-dns-resolver/cache"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
@@ -20,7 +23,7 @@ func TestResolver_SetBootstrapServers_AddressNormalization(t *testing.T) {
 		err := r.SetBootstrapServers("127.0.0.1", "127.0.0.2:5353")
 
 		assert.NoError(t, err)
-		assert.Equal(t, r.systemServerAddrs, []string{"127.0.0.1:53", "127.0.0.2:5353"})
+		assert.Equal(t, r.config().systemServerAddrs, []string{"127.0.0.1:53", "127.0.0.2:5353"})
 	})
 	t.Run("unique", func(t *testing.T) {
 		r := New()
@@ -28,22 +31,43 @@ func TestResolver_SetBootstrapServers_AddressNormalization(t *testing.T) {
 		err := r.SetBootstrapServers("127.0.0.1", "127.0.0.1:53")
 
 		assert.NoError(t, err)
-		assert.Equal(t, r.systemServerAddrs, []string{"127.0.0.1:53"})
+		assert.Equal(t, r.config().systemServerAddrs, []string{"127.0.0.1:53"})
+	})
+	t.Run("host name", func(t *testing.T) {
+		r := New()
+
+		err := r.SetBootstrapServers("localhost:5353")
+
+		assert.NoError(t, err)
+		assert.Contains(t, r.config().systemServerAddrs, "127.0.0.1:5353")
+		assert.Empty(t, r.config().serverNames)
+	})
+	t.Run("url", func(t *testing.T) {
+		r := New()
+
+		err := r.SetBootstrapServers("tls://127.0.0.1", "tls://[::1]:8853", "https://127.0.0.2", "https://localhost:8443/resolve?x=1")
+
+		assert.NoError(t, err)
+		addrs := r.config().systemServerAddrs
+		assert.Equal(t, []string{"tls://127.0.0.1:853", "tls://[::1]:8853", "https://127.0.0.2:443/dns-query"}, addrs[:3])
+		assert.Contains(t, addrs, "https://127.0.0.1:8443/resolve")
+		assert.Equal(t, "localhost", r.config().serverNames["https://127.0.0.1:8443/resolve"])
+		assert.Empty(t, r.config().serverNames["tls://127.0.0.1:853"])
 	})
 	t.Run("invalid", func(t *testing.T) {
 		r := New()
 
-		err := r.SetBootstrapServers("127.0.0.1", "localhost:5353")
+		err := r.SetBootstrapServers("127.0.0.1", "ftp://127.0.0.1")
 
-		assert.EqualError(t, err, "not an ip address: localhost:5353")
-		assert.Len(t, r.systemServerAddrs, 0)
+		assert.EqualError(t, err, "unsupported scheme: ftp://127.0.0.1")
+		assert.Len(t, r.config().systemServerAddrs, 0)
 	})
 }
 
 func TestResolver_Query_SimpleARecord(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -68,6 +92,9 @@ func TestResolver_Query_SimpleARecord(t *testing.T) {
 
 	assert.Equal(t, "www.example.com", rs.Name)
 	assert.Equal(t, "A", rs.Type)
+	assert.Equal(t, "NOERROR", rs.Rcode)
+	assert.True(t, rs.Authoritative)
+	assert.False(t, rs.Truncated)
 	assert.Equal(t, 321*time.Second, rs.TTL)
 	assert.Equal(t, []string{"192.0.2.0", "192.0.2.1"}, rs.Values)
 	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
@@ -75,16 +102,16 @@ func TestResolver_Query_SimpleARecord(t *testing.T) {
 	assert.Greater(t, rs.RTT, time.Duration(0))
 
 	wantTrace := strings.TrimSpace(`
-? . IN NS @127.0.0.250:5354 (rtt<1ms, age=0s)
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
   ! . 321 IN NS self.test.
   ! self.test. 321 IN A 127.0.0.250
-? www.example.com. IN A @127.0.0.250:5354 (rtt<1ms, age=0s)
+? www.example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
   ! com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.100
-? www.example.com. IN A @127.0.0.100:5354 (rtt<1ms, age=-1s)
+? www.example.com. IN A @127.0.0.100:5354 (rtt<1ms)
   ! example.com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.101
-? www.example.com. IN A @127.0.0.101:5354 (rtt<1ms, age=-1s)
+? www.example.com. IN A @127.0.0.101:5354 (rtt<1ms)
   ! www.example.com. 321 IN A 192.0.2.0
   ! www.example.com. 321 IN A 192.0.2.1
 	`) + "\n"
@@ -95,7 +122,7 @@ func TestResolver_Query_SimpleARecord(t *testing.T) {
 func TestResolver_Query_Fallback(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -125,20 +152,20 @@ func TestResolver_Query_Fallback(t *testing.T) {
 	assert.Equal(t, "127.0.0.102:5354", rs.ServerAddr)
 
 	wantTrace := strings.TrimSpace(`
-? . IN NS @127.0.0.250:5354 (rtt<1ms, age=0s)
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
   ! . 321 IN NS self.test.
   ! self.test. 321 IN A 127.0.0.250
-? www.example.com. IN A @127.0.0.250:5354 (rtt<1ms, age=0s)
+? www.example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
   ! com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.100
-? www.example.com. IN A @127.0.0.100:5354 (rtt<1ms, age=-1s)
+? www.example.com. IN A @127.0.0.100:5354 (rtt<1ms)
   ! example.com. 321 IN NS ns1.test.
   ! example.com. 321 IN NS ns2.test.
   ! ns1.test. 321 IN A 127.0.0.101
   ! ns2.test. 321 IN A 127.0.0.102
-? www.example.com. IN A @127.0.0.101:5354 (rtt<1ms, age=-1s)
+? www.example.com. IN A @127.0.0.101:5354 (rtt<1ms)
   X SERVFAIL
-? www.example.com. IN A @127.0.0.102:5354 (rtt<1ms, age=-1s)
+? www.example.com. IN A @127.0.0.102:5354 (rtt<1ms)
   ! www.example.com. 321 IN A 192.0.2.0
   ! www.example.com. 321 IN A 192.0.2.1
 	`) + "\n"
@@ -146,10 +173,192 @@ func TestResolver_Query_Fallback(t *testing.T) {
 	assert.Equal(t, wantTrace, rs.Trace.Dump())
 }
 
+func TestResolver_Query_LameDelegation(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	lameSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", lameSrv.IP(), expSrv.IP())
+	lameSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative()
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.0"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"192.0.2.0"}, rs.Values)
+	assert.Equal(t, "127.0.0.102:5354", rs.ServerAddr)
+	if assert.Len(t, rs.Warnings, 1) {
+		assert.True(t, errors.Is(rs.Warnings[0], ErrLameDelegation))
+		assert.EqualError(t, rs.Warnings[0], "lame delegation: example.com. @127.0.0.101:5354")
+	}
+
+	wantTrace := strings.TrimSpace(`
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
+  ! . 321 IN NS self.test.
+  ! self.test. 321 IN A 127.0.0.250
+? www.example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
+  ! com. 321 IN NS ns1.test.
+  ! ns1.test. 321 IN A 127.0.0.100
+? www.example.com. IN A @127.0.0.100:5354 (rtt<1ms)
+  ! example.com. 321 IN NS ns1.test.
+  ! example.com. 321 IN NS ns2.test.
+  ! ns1.test. 321 IN A 127.0.0.101
+  ! ns2.test. 321 IN A 127.0.0.102
+? www.example.com. IN A @127.0.0.101:5354 (rtt<1ms)
+  X LAME
+  ~ EMPTY
+? www.example.com. IN A @127.0.0.102:5354 (rtt<1ms)
+  ! www.example.com. 321 IN A 192.0.2.0
+	`) + "\n"
+
+	assert.Equal(t, wantTrace, rs.Trace.Dump())
+}
+
+func TestResolver_Query_LameDelegation_UpwardReferral(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	lameSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", lameSrv.IP())
+	lameSrv.ExpectQuery("A www.example.com.").DelegateTo(".", rootSrv.IP())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.EqualError(t, err, "A www.example.com: servers exhausted: lame delegation: example.com. @127.0.0.101:5354")
+	assert.True(t, errors.Is(err, ErrLameDelegation))
+	assert.Len(t, rs.Warnings, 1)
+}
+
+func TestResolver_Query_ServersExhausted(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if addr == "127.0.0.101:5354" {
+				return nil, 0, fmt.Errorf("read udp: %w", os.ErrDeadlineExceeded)
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	lameSrv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.").DelegateTo("example.", "127.0.0.101", lameSrv.IP()).ViaAuthoritySection()
+	lameSrv.ExpectQuery("A www.example.").Respond().NonAuthoritative()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.example")
+	assert.EqualError(t, err, "A www.example: servers exhausted: "+
+		"read udp: i/o timeout @127.0.0.101:5354; "+
+		"lame delegation: example. @127.0.0.102:5354")
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.ErrorIs(t, err, ErrLameDelegation)
+
+	var exhausted *ServersExhaustedError
+	if assert.ErrorAs(t, err, &exhausted) {
+		assert.Equal(t, "example.", exhausted.Zone)
+		assert.Len(t, exhausted.Errors, 2)
+	}
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	lameSrv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_Query_Refused(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns1 := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	ns2 := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", ns1.IP(), ns2.IP())
+	ns1.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeRefused)
+	ns2.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeNotImplemented)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.EqualError(t, err, "A www.example.com: servers exhausted: refused by all servers: "+
+		"REFUSED @127.0.0.100:5354; NOTIMP @127.0.0.101:5354")
+	assert.ErrorIs(t, err, ErrRefused)
+
+	var exhausted *ServersExhaustedError
+	if assert.ErrorAs(t, err, &exhausted) {
+		assert.Equal(t, "example.com.", exhausted.Zone)
+		assert.Len(t, exhausted.Errors, 2)
+	}
+}
+
+func TestResolver_Query_NXDOMAIN(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeNameError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.EqualError(t, err, "A www.example.com: NXDOMAIN response")
+	assert.True(t, errors.Is(err, ErrNXDomain))
+
+	assert.Equal(t, "www.example.com", rs.Name)
+	assert.Equal(t, "NXDOMAIN", rs.Type)
+	assert.Equal(t, "NXDOMAIN", rs.Rcode)
+	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
+	assert.Empty(t, rs.Values)
+}
+
 func TestResolver_Query_CNAMEResolution(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -178,21 +387,22 @@ func TestResolver_Query_CNAMEResolution(t *testing.T) {
 	assert.Equal(t, "A", rs.Type)
 	assert.Equal(t, 321*time.Second, rs.TTL)
 	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, []string{"example.com.", "www.example.com."}, rs.Chain)
 	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
 	assert.Equal(t, rs.Age, -1*time.Second)
 	assert.Greater(t, rs.RTT, time.Duration(0))
 
 	wantTrace := strings.TrimSpace(`
-? . IN NS @127.0.0.250:5354 (rtt<1ms, age=0s)
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
   ! . 321 IN NS self.test.
   ! self.test. 321 IN A 127.0.0.250
-? example.com. IN A @127.0.0.250:5354 (rtt<1ms, age=0s)
+? example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
   ! com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.100
-? example.com. IN A @127.0.0.100:5354 (rtt<1ms, age=-1s)
+? example.com. IN A @127.0.0.100:5354 (rtt<1ms)
   ! example.com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.101
-? example.com. IN A @127.0.0.101:5354 (rtt<1ms, age=-1s)
+? example.com. IN A @127.0.0.101:5354 (rtt<1ms)
   ! example.com. 321 IN CNAME www.example.com.
   ! www.example.com. 321 IN A 192.0.2.1
 			`) + "\n"
@@ -200,10 +410,89 @@ func TestResolver_Query_CNAMEResolution(t *testing.T) {
 	assert.Equal(t, wantTrace, rs.Trace.Dump())
 }
 
+func TestResolver_Query_WithoutFollowingCNAMEs(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A example.com.").Respond().
+		Answer(
+			CNAME(t, "example.com.", 321, "www.example.com."),
+			A(t, "www.example.com.", 60, "192.0.2.1"),
+		)
+
+	rs, err := r.Query(WithoutFollowingCNAMEs(ctx), "A", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "example.com", rs.Name)
+	assert.Equal(t, "A", rs.Type)
+	assert.Equal(t, 321*time.Second, rs.TTL)
+	assert.Equal(t, []string{"www.example.com."}, rs.Values)
+	assert.Equal(t, map[string][]string{"CNAME": {"www.example.com."}}, rs.ValuesByType)
+	assert.Nil(t, rs.Chain)
+	assert.Equal(t, "127.0.0.101:5354", rs.ServerAddr)
+}
+
+func TestResolver_Query_DetectWildcards(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DetectWildcards = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A *.example.com.").AnyTimes().DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A *.example.com.").AnyTimes().DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A foo.bar.example.com.").Respond().
+		Answer(
+			A(t, "foo.bar.example.com.", 321, "192.0.2.1"),
+		)
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.2"),
+		)
+	expSrv.ExpectQuery("A *.bar.example.com.").Respond().Status(dns.RcodeNameError)
+	expSrv.ExpectQuery("A *.example.com.").Times(2).Respond().
+		Answer(
+			A(t, "*.example.com.", 321, "192.0.2.1"),
+		)
+
+	rs, err := r.Query(ctx, "A", "foo.bar.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.True(t, rs.Synthesized)
+
+	rs, err = r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.2"}, rs.Values)
+	assert.False(t, rs.Synthesized)
+}
+
 func TestResolver_Query_ZoneGap(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -244,24 +533,26 @@ func TestResolver_Query_ZoneGap(t *testing.T) {
 	assert.Equal(t, "127.0.0.102:5354", rs.ServerAddr)
 	assert.Equal(t, rs.Age, -1*time.Second)
 	assert.Greater(t, rs.RTT, time.Duration(0))
+	assert.Equal(t, 2, rs.Path.Delegations)
+	assert.Equal(t, 1, rs.Path.NSLookups)
 
 	wantTrace := strings.TrimSpace(`
-? . IN NS @127.0.0.250:5354 (rtt<1ms, age=0s)
+? . IN NS @127.0.0.250:5354 (rtt<1ms, cached)
   ! . 321 IN NS self.test.
   ! self.test. 321 IN A 127.0.0.250
-? example.com. IN A @127.0.0.250:5354 (rtt<1ms, age=0s)
+? example.com. IN A @127.0.0.250:5354 (rtt<1ms, cached)
   ! com. 321 IN NS ns1.test.
   ! ns1.test. 321 IN A 127.0.0.100
-? example.com. IN A @127.0.0.100:5354 (rtt<1ms, age=-1s)
+? example.com. IN A @127.0.0.100:5354 (rtt<1ms)
   ! example.com. 321 IN NS ns1.test.net.
-    ? ns1.test.net. IN AAAA @127.0.0.250:5354 (rtt<1ms, age=0s)
+    ? ns1.test.net. IN AAAA @127.0.0.250:5354 (rtt<1ms, cached)
       ! net. 321 IN NS ns1.test.
       ! ns1.test. 321 IN A 127.0.0.101
-    ? ns1.test.net. IN AAAA @127.0.0.101:5354 (rtt<1ms, age=-1s)
+    ? ns1.test.net. IN AAAA @127.0.0.101:5354 (rtt<1ms)
       ~ EMPTY
-    ? ns1.test.net. IN A @127.0.0.101:5354 (rtt<1ms, age=-1s)
+    ? ns1.test.net. IN A @127.0.0.101:5354 (rtt<1ms)
       ! ns1.test.net. 321 IN A 127.0.0.102
-? example.com. IN A @127.0.0.102:5354 (rtt<1ms, age=-1s)
+? example.com. IN A @127.0.0.102:5354 (rtt<1ms)
   ! example.com. 321 IN A 192.0.2.0
 	`) + "\n"
 
@@ -271,7 +562,7 @@ func TestResolver_Query_ZoneGap(t *testing.T) {
 func TestResolver_Query_NameFallback(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -341,7 +632,7 @@ func TestResolver_Query_NameFallback(t *testing.T) {
 func TestResolver_Query_DetectCycle(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 	r.DisableIP6 = true
 
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
@@ -369,14 +660,112 @@ func TestResolver_Query_DetectCycle(t *testing.T) {
 
 	rs, err := r.Query(ctx, "A", "example.com")
 	t.Logf("Trace:\n" + rs.Trace.Dump())
-	assert.EqualError(t, err, "A example.com: circular reference: repeated query: A ns1.test.net. @127.0.0.101:5354")
+	assert.EqualError(t, err, "A example.com: circular reference: CNAME loop: ns1.test.net. -> ns2.test.net. -> ns1.test.net.")
 	assert.True(t, errors.Is(err, ErrCircular))
+	assert.True(t, errors.Is(err, ErrCircularCNAME))
+	assert.False(t, errors.Is(err, ErrCircularDelegation))
+
+	var cycleErr *CycleError
+	if assert.True(t, errors.As(err, &cycleErr)) {
+		assert.Equal(t, []string{"ns1.test.net.", "ns2.test.net.", "ns1.test.net."}, cycleErr.Chain)
+	}
+}
+
+func TestResolver_Query_MaxCNAMEChain(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+	r.MaxCNAMEChain = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	netSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A example.com.").DelegateTo("example.com.", "ns1.test.net.")
+
+	rootSrv.ExpectQuery("A ns1.test.net.").DelegateTo("net.", netSrv.IP())
+	netSrv.ExpectQuery("A ns1.test.net.").Respond().
+		Answer(
+			CNAME(t, "ns1.test.net.", 321, "ns2.test.net."),
+		)
+	netSrv.ExpectQuery("A ns2.test.net.").Respond().
+		Answer(
+			CNAME(t, "ns2.test.net.", 321, "ns3.test.net."),
+			CNAME(t, "ns3.test.net.", 321, "ns4.test.net."),
+		)
+
+	rs, err := r.Query(ctx, "A", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.EqualError(t, err, "A example.com: CNAME chain too long: ns1.test.net. -> ns2.test.net. -> ns3.test.net. -> ns4.test.net.")
+	assert.True(t, errors.Is(err, ErrCNAMEChainTooLong))
+	assert.False(t, errors.Is(err, ErrCircular))
+
+	var chainErr *CNAMEChainError
+	if assert.True(t, errors.As(err, &chainErr)) {
+		assert.Equal(t, []string{"ns1.test.net.", "ns2.test.net.", "ns3.test.net.", "ns4.test.net."}, chainErr.Chain)
+	}
+
+	// Chains within a single response count as well.
+	rootSrv.ExpectQuery("A www.example.org.").AnyTimes().DelegateTo("org.", netSrv.IP())
+	netSrv.ExpectQuery("A www.example.org.").Times(2).Respond().
+		Answer(
+			CNAME(t, "www.example.org.", 321, "a.example.org."),
+			CNAME(t, "a.example.org.", 321, "b.example.org."),
+			CNAME(t, "b.example.org.", 321, "c.example.org."),
+			A(t, "c.example.org.", 321, "192.0.2.1"),
+		)
+
+	_, err = r.Query(ctx, "A", "www.example.org")
+	assert.EqualError(t, err, "A www.example.org: CNAME chain too long: www.example.org. -> a.example.org. -> b.example.org. -> c.example.org.")
+
+	r.MaxCNAMEChain = 3
+	rs, err = r.Query(ctx, "A", "www.example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+}
+
+func TestResolver_Query_DetectDelegationCycle(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.DisableIP6 = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	netSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A example.com.").DelegateTo("example.com.", "ns.example.net.")
+
+	rootSrv.ExpectQuery("A ns.example.net.").DelegateTo("net.", netSrv.IP())
+	netSrv.ExpectQuery("A ns.example.net.").DelegateTo("example.net.", "ns.example.com.")
+
+	comSrv.ExpectQuery("A ns.example.com.").DelegateTo("example.com.", "ns.example.net.")
+
+	rs, err := r.Query(ctx, "A", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.EqualError(t, err, "A example.com: circular reference: delegation loop: ns.example.net. -> ns.example.com. -> ns.example.net.")
+	assert.True(t, errors.Is(err, ErrCircular))
+	assert.True(t, errors.Is(err, ErrCircularDelegation))
+	assert.False(t, errors.Is(err, ErrCircularCNAME))
 }
 
 func TestResolver_Query_NS(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -408,10 +797,79 @@ func TestResolver_Query_NS(t *testing.T) {
 	assert.Greater(t, rs.RTT, time.Duration(0))
 }
 
+func TestResolver_Query_ANY(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("ANY example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("ANY example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("ANY example.com.").Respond().
+		Answer(
+			A(t, "example.com.", 321, "192.0.2.0"),
+			MX(t, "example.com.", 321, 10, "mx1.example.com."),
+			A(t, "example.com.", 321, "192.0.2.1"),
+			TXT(t, "example.com.", 321, "v=spf1 -all"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "ANY", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "ANY", rs.Type)
+	assert.Equal(t, []string{"192.0.2.0", "10 mx1.example.com.", "192.0.2.1", `"v=spf1 -all"`}, rs.Values)
+	assert.Equal(t, map[string][]string{
+		"A":   {"192.0.2.0", "192.0.2.1"},
+		"MX":  {"10 mx1.example.com."},
+		"TXT": {`"v=spf1 -all"`},
+	}, rs.ValuesByType)
+	assert.Empty(t, rs.Warnings)
+}
+
+func TestResolver_Query_ANY_RFC8482(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("ANY example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("ANY example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("ANY example.com.").Respond().
+		Answer(
+			HINFO(t, "example.com.", 3789, "RFC8482", ""),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "ANY", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Empty(t, rs.Values)
+	assert.Empty(t, rs.ValuesByType)
+	assert.Equal(t, []error{ErrMinimalANY}, rs.Warnings)
+}
+
 func TestResolver_Query_Caching_DefaultPolicy(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
+	r.DelegationTTL = -1
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -449,7 +907,7 @@ func TestResolver_Query_Caching_DefaultPolicy(t *testing.T) {
 func TestResolver_Query_Caching_ObeyResponderAdvice(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 	r.CachePolicy = ObeyResponderAdvice(1 * time.Minute)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
@@ -499,11 +957,107 @@ func TestResolver_Query_Caching_ObeyResponderAdvice(t *testing.T) {
 	assert.Greater(t, rs.RTT, time.Duration(0))
 }
 
+func TestResolver_Query_Caching_NoData(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(1 * time.Minute)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	soa := RR(t, dns.TypeSOA, "example.com.", 300).(*dns.SOA)
+	soa.Ns = "ns1.example.com."
+	soa.Mbox = "hostmaster.example.com."
+	soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minttl = 1, 7200, 900, 1209600, 300
+
+	rootSrv.ExpectQuery("MX www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("MX www.example.com.").Respond().
+		Authority(soa)
+	expSrv.ExpectQuery("ANY www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 600, "192.0.2.1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "MX", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.True(t, rs.NoData)
+	assert.False(t, rs.EmptyNonTerminal)
+	assert.Empty(t, rs.Values)
+	assert.Equal(t, 300*time.Second, rs.Trace.Queries[len(rs.Trace.Queries)-2].CacheTTL)
+
+	// The NODATA response is cached for the TTL of the SOA record, so the
+	// servers shouldn't receive any more queries.
+	rootSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+
+	rs, err = r.Query(ctx, "MX", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.True(t, rs.NoData)
+	assert.Empty(t, rs.Values)
+	assert.Greater(t, rs.Age, time.Duration(0))
+}
+
+func TestResolver_Query_EmptyNonTerminal(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	soa := RR(t, dns.TypeSOA, "example.com.", 300).(*dns.SOA)
+	soa.Ns = "ns1.example.com."
+	soa.Mbox = "hostmaster.example.com."
+	soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minttl = 1, 7200, 900, 1209600, 60
+
+	// The zone isn't signed, so the responses don't contain NSEC records.
+	// _tcp.example.com. doesn't own any records, unlike www.example.com.
+	rootSrv.ExpectQuery("* *.example.com.").AnyTimes().DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("SRV _tcp.example.com.").Respond().
+		Authority(soa)
+	expSrv.ExpectQuery("ANY _tcp.example.com.").Respond().
+		Authority(soa)
+	expSrv.ExpectQuery("SRV www.example.com.").Respond().
+		Authority(soa)
+	expSrv.ExpectQuery("ANY www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "SRV", "_tcp.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.True(t, rs.NoData)
+	assert.True(t, rs.EmptyNonTerminal)
+	assert.Empty(t, rs.Values)
+	assert.Contains(t, rs.Trace.Dump(), "~ NODATA (empty non-terminal)\n")
+
+	rs, err = r.Query(ctx, "SRV", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.True(t, rs.NoData)
+	assert.False(t, rs.EmptyNonTerminal)
+	assert.Empty(t, rs.Values)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
+
 func TestResolver_Referrals(t *testing.T) {
 	cases := []struct {
 		answer     []dns.RR
 		authority  []dns.RR
 		additional []dns.RR
+		bailiwick  string
 
 		ip4disabled bool
 		ip6disabled bool
@@ -511,6 +1065,44 @@ func TestResolver_Referrals(t *testing.T) {
 		wantIPs   []string
 		wantNames []string
 	}{
+		{
+			// Glue for names outside of the bailiwick of the server is
+			// ignored.
+			authority: []dns.RR{
+				NS(t, "example.com.", 300, "ns1.example.com."),
+				NS(t, "example.com.", 300, "ns.example.net."),
+				NS(t, "example.com.", 300, "ns2.example.com."),
+			},
+			additional: []dns.RR{
+				A(t, "ns.example.net.", 300, "192.0.2.66"),
+				A(t, "ns1.example.com.", 300, "192.0.2.1"),
+				A(t, "ns2.example.com.", 300, "192.0.2.2"),
+			},
+			bailiwick: "com.",
+			wantIPs:   []string{"192.0.2.1", "192.0.2.2"},
+			wantNames: []string{"ns.example.net."},
+		},
+		{
+			// Without glue in the bailiwick, other glue is used.
+			authority: []dns.RR{
+				NS(t, "example.com.", 300, "ns.example.net."),
+			},
+			additional: []dns.RR{
+				A(t, "ns.example.net.", 300, "192.0.2.66"),
+			},
+			bailiwick: "com.",
+			wantIPs:   []string{"192.0.2.66"},
+		},
+		{
+			authority: []dns.RR{
+				NS(t, "example.com.", 300, "ns.example.net."),
+			},
+			additional: []dns.RR{
+				A(t, "ns.example.net.", 300, "192.0.2.66"),
+			},
+			bailiwick: ".",
+			wantIPs:   []string{"192.0.2.66"},
+		},
 		{
 			answer: []dns.RR{
 				A(t, "ns1.example.com.", 300, "192.0.2.1"),
@@ -693,7 +1285,7 @@ func TestResolver_Referrals(t *testing.T) {
 			r.ip4disabled = tc.ip4disabled
 			r.ip6disabled = tc.ip6disabled
 
-			ips, names := r.referrals(m)
+			ips, names := r.referrals(m, tc.bailiwick)
 			assert.Equal(t, tc.wantIPs, ips, "unexpected ip set")
 			assert.Equal(t, tc.wantNames, names, "unexpected name set")
 		})
@@ -703,7 +1295,7 @@ func TestResolver_Referrals(t *testing.T) {
 func TestResolver_Query_CoUkCaching(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	ukSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -744,7 +1336,7 @@ func TestResolver_Query_CoUkCaching(t *testing.T) {
 func TestResolver_Query_PTR4(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	arpaSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -770,7 +1362,7 @@ func TestResolver_Query_PTR4(t *testing.T) {
 func TestResolver_Query_PTR6(t *testing.T) {
 	r := New()
 	r.defaultPort = "5354"
-	r.logFunc = DebugLog(t)
+	r.LogFunc = DebugLog(t)
 
 	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
 	arpaSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
@@ -792,3 +1384,295 @@ func TestResolver_Query_PTR6(t *testing.T) {
 	assert.Equal(t, "2001:db8::1", rs.Name)
 	assert.Equal(t, []string{"sample.test."}, rs.Values)
 }
+
+func TestResolver_QueryServer_CHAOS(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	srv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	version := TXT(t, "version.bind.", 0, "9.18.1")
+	version.Hdr.Class = dns.ClassCHAOS
+	srv.ExpectQuery("CH TXT version.bind.").Respond().Answer(version)
+	srv.ExpectQuery("CH TXT hostname.bind.").Respond().Status(dns.RcodeRefused)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.QueryServer(ctx, srv.IP(), "CH", "TXT", "version.bind")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, "version.bind", rs.Name)
+	assert.Equal(t, "TXT", rs.Type)
+	assert.Equal(t, "127.0.0.100:5354", rs.ServerAddr)
+	assert.Equal(t, []string{`"9.18.1"`}, rs.Values)
+
+	rs, err = r.QueryServer(ctx, srv.IP(), "CH", "TXT", "hostname.bind")
+	assert.EqualError(t, err, "TXT hostname.bind: REFUSED")
+	assert.Equal(t, "REFUSED", rs.Type)
+
+	_, err = r.QueryServer(ctx, srv.IP(), "XX", "TXT", "hostname.bind")
+	assert.EqualError(t, err, "unsupported class: XX")
+
+	srv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_Query_QueryTimeout(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.TimeoutPolicy = func(string, string, string) time.Duration { return 5 * time.Second }
+	r.QueryTimeout = 100 * time.Millisecond
+
+	// The name servers of example.com never respond.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if addr == "127.0.0.101:5354" {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", "127.0.0.101")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "error %v should wrap context.DeadlineExceeded", err)
+	assert.Less(t, int64(time.Since(start)), int64(1*time.Second))
+	assert.NoError(t, ctx.Err())
+}
+
+func TestResolver_Clone(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(0)
+	r.cache = cache.New(100)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	rootSrv.AssertNoOutstandingExpectations(t)
+
+	// The shared clone answers from the cache.
+	shared := r.Clone(true)
+	shared.QueryTimeout = time.Minute
+	assert.Zero(t, r.QueryTimeout)
+
+	rs, err := shared.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Same(t, r.httpTransport, shared.httpTransport)
+
+	// The separate clone starts with an empty cache.
+	rootSrv.ExpectQuery("NS .").Respond().
+		Answer(
+			NS(t, ".", 321, "self.test."),
+		).
+		Additional(
+			A(t, "self.test.", 321, rootSrv.IP()),
+		)
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+
+	separate := r.Clone(false)
+	rs, err = separate.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, 100, separate.cache.MaxSize())
+	assert.NotSame(t, r.httpTransport, separate.httpTransport)
+	rootSrv.AssertNoOutstandingExpectations(t)
+
+	assert.NoError(t, separate.SetForwarders("192.0.2.54"))
+	assert.Empty(t, r.config().forwarders)
+	assert.Equal(t, int64(1), r.Stats().Queries)
+}
+
+func TestResolver_Query_AuthorityAndAdditional(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	soa := RR(t, dns.TypeSOA, "example.com.", 300).(*dns.SOA)
+	soa.Ns = "ns1.example.com."
+	soa.Mbox = "hostmaster.example.com."
+	soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minttl = 1, 7200, 900, 1209600, 60
+
+	rootSrv.ExpectQuery("MX example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("MX example.com.").Respond().
+		Authority(soa).
+		Additional(
+			A(t, "ns1.example.com.", 321, "192.0.2.53"),
+		)
+
+	rs, err := r.Query(ctx, "MX", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.True(t, rs.NoData)
+	assert.False(t, rs.EmptyNonTerminal)
+	assert.Empty(t, rs.Values)
+	assert.Contains(t, rs.Trace.Dump(), "~ NODATA\n")
+
+	assert.Equal(t, []Record{{
+		Name:  "example.com",
+		Type:  "SOA",
+		TTL:   300 * time.Second,
+		Value: "ns1.example.com. hostmaster.example.com. 1 7200 900 1209600 60",
+	}}, rs.Authority)
+	assert.Equal(t, []Record{{
+		Name:  "ns1.example.com",
+		Type:  "A",
+		TTL:   321 * time.Second,
+		Value: "192.0.2.53",
+	}}, rs.Additional)
+}
+
+func TestResolver_Query_GenericType(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// The type of the first query has no name, so it can only be matched
+	// with a wildcard.
+	rootSrv.ExpectQuery("* www.example.com.").Respond().
+		Answer(
+			&dns.RFC3597{
+				Hdr:   dns.RR_Header{Name: "www.example.com.", Rrtype: 65534, Class: dns.ClassINET, Ttl: 300},
+				Rdata: "abcdef",
+			},
+		)
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 300, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "TYPE65534", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`\# 3 abcdef`}, rs.Values)
+	assert.Equal(t, map[string][]string{"TYPE65534": {`\# 3 abcdef`}}, rs.ValuesByType)
+
+	rs, err = r.Query(ctx, "TYPE1", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	_, err = r.Query(ctx, "TYPE65536", "www.example.com")
+	assert.EqualError(t, err, "unsupported record type: TYPE65536")
+}
+
+func TestResolver_Query_ServersTried(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if addr == "127.0.0.101:5354" {
+				return nil, 0, errors.New("i/o timeout")
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	ns2Srv := NewTestServer(t, "127.0.0.102:"+r.defaultPort)
+	ns3Srv := NewTestServer(t, "127.0.0.103:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", "127.0.0.101", ns2Srv.IP(), ns3Srv.IP())
+	ns2Srv.ExpectQuery("A www.example.com.").Respond().Status(dns.RcodeServerFailure)
+	ns3Srv.ExpectQuery("A www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.100"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	assert.Equal(t, "127.0.0.103:5354", rs.ServerAddr)
+	assert.Len(t, rs.ServersTried, 3)
+	assert.ElementsMatch(t, []string{"127.0.0.101:5354", "127.0.0.102:5354", "127.0.0.103:5354"}, rs.ServersTried)
+	assert.Equal(t, rs.ServerAddr, rs.ServersTried[len(rs.ServersTried)-1])
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	ns2Srv.AssertNoOutstandingExpectations(t)
+	ns3Srv.AssertNoOutstandingExpectations(t)
+}
+
+func TestResolver_Query_InBailiwickGlue(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	// The glue for ns.example.net is outside of the bailiwick of the com
+	// servers. Nothing listens on its address.
+	comSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(
+			NS(t, "example.com.", 300, "ns.example.net."),
+			NS(t, "example.com.", 300, "ns1.example.com."),
+		).
+		Additional(
+			A(t, "ns.example.net.", 300, "127.0.0.66"),
+			A(t, "ns1.example.com.", 300, expSrv.IP()),
+		)
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.10"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.10"}, rs.Values)
+	assert.Equal(t, []string{"127.0.0.101:5354"}, rs.ServersTried)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	comSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
@@ -0,0 +1,109 @@
+package dnsresolver
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// QueryRewriter maps the names that Query is called with onto the names that
+// are actually resolved, and the names in the results back; see
+// Resolver.QueryRewriter. All names are fully qualified and in lower case.
+type QueryRewriter interface {
+	// Rewrite returns the name to resolve instead of name, or name itself.
+	Rewrite(name string) string
+
+	// Restore is the inverse of Rewrite: it returns the name that appears
+	// in results instead of name, or name itself.
+	Restore(name string) string
+}
+
+type suffixRewriter struct {
+	from, to string
+}
+
+// SuffixRewriter returns a QueryRewriter that replaces the suffix from of
+// the names in question with to, and vice versa in results. For instance,
+// SuffixRewriter("staging.example.com", "example.com") resolves
+// www.staging.example.com as www.example.com. If from is ".", to is
+// appended to all names, such as an internal domain.
+func SuffixRewriter(from, to string) QueryRewriter {
+	return &suffixRewriter{
+		from: dns.CanonicalName(from),
+		to:   dns.CanonicalName(to),
+	}
+}
+
+func (s *suffixRewriter) Rewrite(name string) string {
+	return replaceSuffix(name, s.from, s.to)
+}
+
+func (s *suffixRewriter) Restore(name string) string {
+	return replaceSuffix(name, s.to, s.from)
+}
+
+// replaceSuffix replaces the suffix oldSuffix of the fully qualified name
+// with newSuffix, if name is at or below oldSuffix.
+func replaceSuffix(name, oldSuffix, newSuffix string) string {
+	if !dns.IsSubDomain(oldSuffix, name) {
+		return name
+	}
+	if name == oldSuffix {
+		return newSuffix
+	}
+	if oldSuffix != "." {
+		name = strings.TrimSuffix(name, oldSuffix)
+	}
+	if newSuffix == "." {
+		return name
+	}
+
+	return name + newSuffix
+}
+
+// rewrite returns the name to resolve instead of name.
+func (r *resolver) rewrite(name string) string {
+	if r.queryRewriter == nil {
+		return name
+	}
+
+	return dns.CanonicalName(r.queryRewriter.Rewrite(name))
+}
+
+// restoreNames maps the owner names of the records in rs, the question, and
+// Chain back to the names that Query has been called with. The trace is
+// left as it is.
+func (r *resolver) restoreNames(rs *RecordSet) {
+	if r.queryRewriter == nil {
+		return
+	}
+	restore := func(name string) string {
+		return r.queryRewriter.Restore(dns.CanonicalName(name))
+	}
+
+	msg := rs.Raw.Copy()
+	for i := range msg.Question {
+		msg.Question[i].Name = restore(msg.Question[i].Name)
+	}
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Name = restore(hdr.Name)
+			}
+		}
+	}
+	rs.Raw = *msg
+
+	if len(rs.Chain) > 0 {
+		chain := make([]string, len(rs.Chain))
+		for i, name := range rs.Chain {
+			chain[i] = restore(name)
+		}
+		rs.Chain = chain
+	}
+	for _, records := range [][]Record{rs.Authority, rs.Additional} {
+		for i := range records {
+			records[i].Name = trimTrailingDot(restore(records[i].Name + "."))
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuffixRewriter(t *testing.T) {
+	rw := SuffixRewriter("Staging.Example.com", "example.com.")
+	assert.Equal(t, "www.example.com.", rw.Rewrite("www.staging.example.com."))
+	assert.Equal(t, "example.com.", rw.Rewrite("staging.example.com."))
+	assert.Equal(t, "www.example.org.", rw.Rewrite("www.example.org."))
+	assert.Equal(t, "www.staging.example.com.", rw.Restore("www.example.com."))
+	assert.Equal(t, "www.example.org.", rw.Restore("www.example.org."))
+
+	rw = SuffixRewriter(".", "corp.example")
+	assert.Equal(t, "host.corp.example.", rw.Rewrite("host."))
+	assert.Equal(t, "host.", rw.Restore("host.corp.example."))
+	assert.Equal(t, ".", rw.Restore("corp.example."))
+}
+
+func TestResolver_QueryRewriter(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(0)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			CNAME(t, "www.example.com.", 300, "web.example.com."),
+			A(t, "web.example.com.", 300, "192.0.2.1"),
+		)
+
+	r.QueryRewriter = SuffixRewriter("staging.example.com", "example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.staging.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "www.staging.example.com", rs.Name)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, []string{"www.staging.example.com.", "web.staging.example.com."}, rs.Chain)
+	assert.Equal(t, "www.staging.example.com.", rs.Raw.Question[0].Name)
+	assert.Equal(t, "web.staging.example.com.", rs.Raw.Answer[1].Header().Name)
+	assert.Contains(t, rs.Trace.Dump(), "? www.example.com. IN A @127.0.0.250:5354")
+
+	// The rewritten name is cached.
+	rs, err = r.Query(ctx, "A", "www.staging.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 0, rs.Trace.QueryCount())
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
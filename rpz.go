@@ -0,0 +1,362 @@
+package dnsresolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// policyServer is the server address of trace nodes and record sets for
+// answers that have been replaced according to the ResponsePolicy.
+const policyServer = "policy"
+
+// PolicyAction is what a ResponsePolicy does to the answer of a query.
+type PolicyAction int
+
+// The actions correspond to those of DNS response policy zones (RPZ).
+const (
+	// PolicyPassThru leaves the answer unchanged.
+	PolicyPassThru PolicyAction = iota
+
+	// PolicyNXDomain replaces the answer with a NXDOMAIN response.
+	PolicyNXDomain
+
+	// PolicyNoData replaces the answer with an empty response.
+	PolicyNoData
+
+	// PolicyDrop causes Query to fail with ErrPolicyDrop.
+	PolicyDrop
+
+	// PolicyLocalData replaces the answer with the records of the rule.
+	PolicyLocalData
+)
+
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyPassThru:
+		return "PASSTHRU"
+	case PolicyNXDomain:
+		return "NXDOMAIN"
+	case PolicyNoData:
+		return "NODATA"
+	case PolicyDrop:
+		return "DROP"
+	case PolicyLocalData:
+		return "LOCAL-DATA"
+	default:
+		return fmt.Sprintf("PolicyAction(%d)", int(a))
+	}
+}
+
+// PolicyRule is a rule of a ResponsePolicy.
+type PolicyRule struct {
+	// Trigger is the fully qualified name that the rule applies to. If it
+	// starts with "*.", the rule applies to the names below the rest of
+	// the name instead.
+	Trigger string
+
+	Action PolicyAction
+
+	// Records replace the answer if Action is PolicyLocalData. Only the
+	// records of the type in question, or CNAME records, are used, and
+	// their owner names are replaced with the name in question.
+	Records []dns.RR
+}
+
+// ResponsePolicy filters the answers of a Resolver, such as to block the
+// names of malware or ad servers; see Resolver.ResponsePolicy.
+type ResponsePolicy interface {
+	// Check returns the rule that applies to rs, which is the result of a
+	// successful query or a NXDOMAIN response. If no rule applies, Check
+	// returns a rule with the PolicyPassThru action.
+	Check(rs RecordSet) PolicyRule
+}
+
+// The ResponsePolicyFunc type is an adapter to allow the use of ordinary
+// functions as response policies.
+type ResponsePolicyFunc func(rs RecordSet) PolicyRule
+
+// Check implements ResponsePolicy.
+func (f ResponsePolicyFunc) Check(rs RecordSet) PolicyRule {
+	return f(rs)
+}
+
+// Blocklist is a ResponsePolicy that consists of rules for particular names.
+// The rules apply to the name in question and the names of the CNAME records
+// that lead to the answer, if any, in that order. Rules for a name take
+// precedence over rules for the names below a zone, and the rules of more
+// specific zones take precedence over those of enclosing zones.
+//
+// Blocklists are safe for concurrent use.
+type Blocklist struct {
+	mu    sync.RWMutex
+	rules map[string]PolicyRule
+}
+
+// NewBlocklist returns a Blocklist that responds with NXDOMAIN for the given
+// domains and all names below them.
+func NewBlocklist(domains ...string) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, domain := range domains {
+		if err := b.block(domain); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// hostsNames are names in hosts files that must not be blocked.
+var hostsNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"broadcasthost.":         true,
+	"local.":                 true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+}
+
+// ParseBlocklist reads a list of domains, one per line, and returns a
+// Blocklist that responds with NXDOMAIN for those domains and all names
+// below them. Lines may be in the format of hosts files, i.e. start with an
+// IP address that is followed by one or more domains, as is common for
+// published blocklists. Names such as localhost are ignored then. Comments
+// start with "#".
+func ParseBlocklist(r io.Reader) (*Blocklist, error) {
+	b := &Blocklist{}
+
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := s.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			return nil, fmt.Errorf("line %d: not a domain name: %s", line, strings.TrimSpace(text))
+		}
+
+		for _, domain := range fields {
+			if hostsNames[dns.CanonicalName(domain)] {
+				continue
+			}
+			if err := b.block(domain); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// ParseRPZ reads a response policy zone in zone file format and returns the
+// equivalent Blocklist. origin is the name of the zone, which is removed
+// from the owner names of the records to determine the triggers of the
+// rules. Only QNAME triggers are supported; the actions are given by CNAME
+// records as follows:
+//
+//	CNAME .              PolicyNXDomain
+//	CNAME *.             PolicyNoData
+//	CNAME rpz-passthru.  PolicyPassThru
+//	CNAME rpz-drop.      PolicyDrop
+//
+// All other records are local data. The SOA and NS records of the zone
+// itself are ignored.
+func ParseRPZ(r io.Reader, origin string) (*Blocklist, error) {
+	origin = dns.CanonicalName(origin)
+	b := &Blocklist{rules: map[string]PolicyRule{}}
+
+	zp := dns.NewZoneParser(r, origin, "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		hdr := rr.Header()
+		owner := dns.CanonicalName(hdr.Name)
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, origin)
+		if origin == "." {
+			trigger = owner
+		}
+
+		rule, exists := b.rules[trigger]
+		rule.Trigger = trigger
+
+		action := PolicyLocalData
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch dns.CanonicalName(cname.Target) {
+			case ".":
+				action = PolicyNXDomain
+			case "*.":
+				action = PolicyNoData
+			case "rpz-passthru.":
+				action = PolicyPassThru
+			case "rpz-drop.":
+				action = PolicyDrop
+			case "rpz-tcp-only.":
+				return nil, fmt.Errorf("%s: unsupported action: %s", hdr.Name, cname.Target)
+			}
+		}
+		if exists && (rule.Action != PolicyLocalData || action != PolicyLocalData) {
+			return nil, fmt.Errorf("%s: conflicting actions", hdr.Name)
+		}
+		rule.Action = action
+		if action == PolicyLocalData {
+			rule.Records = append(rule.Records, rr)
+		}
+
+		b.rules[trigger] = rule
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// block adds rules that respond with NXDOMAIN for domain and all names below
+// it.
+func (b *Blocklist) block(domain string) error {
+	domain = dns.CanonicalName(domain)
+	if err := b.Add(PolicyRule{Trigger: domain, Action: PolicyNXDomain}); err != nil {
+		return err
+	}
+	if domain == "." {
+		return b.Add(PolicyRule{Trigger: "*.", Action: PolicyNXDomain})
+	}
+
+	return b.Add(PolicyRule{Trigger: "*." + domain, Action: PolicyNXDomain})
+}
+
+// Add adds rule to b, replacing any rule with the same trigger.
+func (b *Blocklist) Add(rule PolicyRule) error {
+	rule.Trigger = dns.CanonicalName(rule.Trigger)
+	if _, ok := dns.IsDomainName(rule.Trigger); !ok {
+		return errors.New("not a domain name: " + rule.Trigger)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rules == nil {
+		b.rules = map[string]PolicyRule{}
+	}
+	b.rules[rule.Trigger] = rule
+
+	return nil
+}
+
+// Len returns the number of rules in b.
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.rules)
+}
+
+// Check implements ResponsePolicy.
+func (b *Blocklist) Check(rs RecordSet) PolicyRule {
+	names := []string{}
+	if len(rs.Raw.Question) > 0 {
+		names = append(names, dns.CanonicalName(rs.Raw.Question[0].Name))
+	}
+	for _, name := range rs.Chain {
+		names = append(names, dns.CanonicalName(name))
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, name := range names {
+		if rule, ok := b.rules[name]; ok {
+			return rule
+		}
+		for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+			if rule, ok := b.rules["*."+name[off:]]; ok {
+				return rule
+			}
+		}
+		if rule, ok := b.rules["*."]; ok && name != "." {
+			return rule
+		}
+	}
+
+	return PolicyRule{}
+}
+
+// applyResponsePolicy replaces rs, which is the result of a query for
+// recordType, according to the ResponsePolicy, and returns the new record set
+// and error. The replacement is recorded in the trace.
+func (r *resolver) applyResponsePolicy(rs RecordSet, recordType string, err error) (RecordSet, error) {
+	if r.responsePolicy == nil || err != nil && !errors.Is(err, ErrNXDomain) {
+		return rs, err
+	}
+
+	rule := r.responsePolicy.Check(rs)
+	if rule.Action == PolicyPassThru {
+		return rs, err
+	}
+
+	q := rs.Raw.Question[0]
+	resp := new(dns.Msg)
+	resp.SetQuestion(q.Name, q.Qtype)
+	resp.Response = true
+	resp.Authoritative = true
+
+	switch rule.Action {
+	case PolicyNXDomain:
+		resp.Rcode = dns.RcodeNameError
+	case PolicyLocalData:
+		for _, rr := range rule.Records {
+			if t := rr.Header().Rrtype; t != q.Qtype && t != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	tn := &TraceNode{
+		Server:    policyServer,
+		Message:   resp,
+		Age:       -1 * time.Second,
+		Synthetic: true,
+		Policy:    &rule,
+	}
+	rs.Trace.add(tn)
+
+	out := RecordSet{
+		Raw:     dns.Msg{Question: []dns.Question{q}},
+		Name:    rs.Name,
+		Type:    recordType,
+		Age:     -1 * time.Second,
+		Trace:   rs.Trace,
+		literal: rs.literal,
+	}
+	switch rule.Action {
+	case PolicyDrop:
+		tn.Error = ErrPolicyDrop
+		return out, fmt.Errorf("%s %s: %w", recordType, rs.Name, ErrPolicyDrop)
+	case PolicyNXDomain:
+		out.fromResponse(resp, policyServer, 0, -1*time.Second, false)
+		return out, fmt.Errorf("%s %s: %w", recordType, rs.Name, ErrNXDomain)
+	default:
+		out.fromResponse(resp, policyServer, 0, -1*time.Second, false)
+		return out, nil
+	}
+}
@@ -0,0 +1,153 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	b, err := ParseBlocklist(strings.NewReader(`
+# comment
+ads.example
+0.0.0.0 tracker.example Metrics.Example. # trailing comment
+127.0.0.1 localhost
+::1 ip6-localhost
+`))
+	require.NoError(t, err)
+	assert.Equal(t, 6, b.Len())
+
+	check := func(name string) PolicyAction {
+		rs := RecordSet{Raw: dns.Msg{Question: []dns.Question{{Name: dns.Fqdn(name)}}}}
+		return b.Check(rs).Action
+	}
+	assert.Equal(t, PolicyNXDomain, check("ads.example"))
+	assert.Equal(t, PolicyNXDomain, check("www.ADS.example"))
+	assert.Equal(t, PolicyNXDomain, check("metrics.example"))
+	assert.Equal(t, PolicyPassThru, check("example"))
+	assert.Equal(t, PolicyPassThru, check("localhost"))
+	assert.Equal(t, PolicyPassThru, check("notads.example"))
+
+	_, err = ParseBlocklist(strings.NewReader("ads.example tracker.example\n"))
+	assert.Error(t, err)
+}
+
+func TestParseRPZ(t *testing.T) {
+	b, err := ParseRPZ(strings.NewReader(`
+$TTL 300
+@                 SOA  localhost. root.localhost. 1 3600 600 86400 60
+                  NS   localhost.
+ads.example       CNAME .
+*.ads.example     CNAME .
+empty.example     CNAME *.
+ok.ads.example    CNAME rpz-passthru.
+drop.example      CNAME rpz-drop.
+portal.example    A     192.0.2.80
+portal.example    AAAA  2001:db8::80
+`), "rpz.local.")
+	require.NoError(t, err)
+	assert.Equal(t, 6, b.Len())
+
+	check := func(name string) PolicyRule {
+		rs := RecordSet{Raw: dns.Msg{Question: []dns.Question{{Name: dns.Fqdn(name)}}}}
+		return b.Check(rs)
+	}
+	assert.Equal(t, PolicyNXDomain, check("ads.example").Action)
+	assert.Equal(t, PolicyNXDomain, check("a.b.ads.example").Action)
+	assert.Equal(t, PolicyPassThru, check("ok.ads.example").Action)
+	assert.Equal(t, PolicyNoData, check("empty.example").Action)
+	assert.Equal(t, PolicyDrop, check("drop.example").Action)
+	assert.Equal(t, PolicyPassThru, check("sub.drop.example").Action)
+
+	rule := check("portal.example")
+	assert.Equal(t, PolicyLocalData, rule.Action)
+	assert.Equal(t, "portal.example.", rule.Trigger)
+	assert.Len(t, rule.Records, 2)
+
+	_, err = ParseRPZ(strings.NewReader("x.example CNAME .\nx.example A 192.0.2.1\n"), "rpz.local.")
+	assert.Error(t, err)
+}
+
+func TestResolver_ResponsePolicy(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.").Respond().
+		Answer(A(t, "www.example.", 300, "192.0.2.100"))
+	rootSrv.ExpectQuery("A cdn.example.").Times(2).Respond().
+		Answer(
+			CNAME(t, "cdn.example.", 300, "tracker.ads.example."),
+			A(t, "tracker.ads.example.", 300, "192.0.2.66"),
+		)
+	rootSrv.ExpectQuery("A drop.example.").Respond().
+		Answer(A(t, "drop.example.", 300, "192.0.2.100"))
+	rootSrv.ExpectQuery("A empty.example.").Respond().
+		Answer(A(t, "empty.example.", 300, "192.0.2.100"))
+	rootSrv.ExpectQuery("A missing.portal.example.").Respond().Status(dns.RcodeNameError)
+	rootSrv.ExpectQuery("AAAA other.portal.example.").Respond()
+
+	b, err := NewBlocklist("ads.example")
+	require.NoError(t, err)
+	require.NoError(t, b.Add(PolicyRule{Trigger: "drop.example", Action: PolicyDrop}))
+	require.NoError(t, b.Add(PolicyRule{Trigger: "empty.example", Action: PolicyNoData}))
+	require.NoError(t, b.Add(PolicyRule{
+		Trigger: "*.portal.example",
+		Action:  PolicyLocalData,
+		Records: []dns.RR{A(t, "*.portal.example.", 60, "192.0.2.80")},
+	}))
+	require.NoError(t, b.Add(PolicyRule{Trigger: "www.example", Action: PolicyPassThru}))
+	r.ResponsePolicy = b
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	assert.Equal(t, "127.0.0.250:5354", rs.ServerAddr)
+
+	// The target of the CNAME record is blocked.
+	rs, err = r.Query(ctx, "A", "cdn.example")
+	assert.True(t, errors.Is(err, ErrNXDomain), "%v", err)
+	assert.Equal(t, "NXDOMAIN", rs.Rcode)
+	assert.Empty(t, rs.Values)
+	last := rs.Trace.Queries[len(rs.Trace.Queries)-1]
+	assert.True(t, last.Synthetic)
+	if assert.NotNil(t, last.Policy) {
+		assert.Equal(t, "*.ads.example.", last.Policy.Trigger)
+	}
+	assert.Contains(t, rs.Trace.Dump(), "POLICY NXDOMAIN *.ads.example.")
+
+	_, err = r.Query(ctx, "A", "drop.example")
+	assert.True(t, errors.Is(err, ErrPolicyDrop), "%v", err)
+
+	rs, err = r.Query(ctx, "A", "empty.example")
+	require.NoError(t, err)
+	assert.Empty(t, rs.Values)
+
+	// Local data replaces NXDOMAIN responses as well.
+	rs, err = r.Query(ctx, "A", "missing.portal.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.80"}, rs.Values)
+	assert.Equal(t, policyServer, rs.ServerAddr)
+
+	rs, err = r.Query(ctx, "AAAA", "other.portal.example")
+	require.NoError(t, err)
+	assert.Empty(t, rs.Values)
+
+	r.ResponsePolicy = nil
+	rs, err = r.Query(ctx, "A", "cdn.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.66"}, rs.Values)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
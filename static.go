@@ -0,0 +1,137 @@
+package dnsresolver
+
+import (
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staticServer is the server address of trace nodes and record sets for
+// queries that have been answered with static records.
+const staticServer = "static"
+
+// AddStatic adds records that answer queries locally, without querying any
+// name server, for instance to serve names of a split-horizon setup or to
+// use fake records in tests:
+//
+//	r.AddStatic(
+//		&dns.A{Hdr: dns.RR_Header{Name: "db.corp.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(10, 0, 0, 5)},
+//	)
+//
+// Once a name has static records, Query answers all queries for that name
+// with them: records of the type in question, or a NODATA response if there
+// are none. CNAME records are followed as long as their targets have static
+// records as well; otherwise the CNAME record is returned as it is. Names
+// below a name with static records are resolved as usual.
+//
+// The trace of such queries consists of a single query to the server
+// "static", which is marked as Synthetic. Only records of the IN class are
+// supported.
+func (R *Resolver) AddStatic(rrs ...dns.RR) error {
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if _, ok := dns.IsDomainName(hdr.Name); !ok || hdr.Name == "" {
+			return errors.New("not a domain name: " + hdr.Name)
+		}
+		if hdr.Class != dns.ClassINET {
+			return errors.New("unsupported class: " + dns.Class(hdr.Class).String())
+		}
+	}
+
+	R.updateConfig(func(c *config) {
+		static := make(map[string][]dns.RR, len(c.static)+len(rrs))
+		for name, rrs := range c.static {
+			static[name] = rrs
+		}
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			name := dns.CanonicalName(rr.Header().Name)
+			rr.Header().Name = name
+			static[name] = append(static[name][:len(static[name]):len(static[name])], rr)
+		}
+		c.static = static
+	})
+
+	return nil
+}
+
+// RemoveStatic removes all static records of domainName, which is resolved
+// as usual afterwards. See AddStatic.
+func (R *Resolver) RemoveStatic(domainName string) {
+	name := dns.CanonicalName(domainName)
+
+	R.updateConfig(func(c *config) {
+		if _, ok := c.static[name]; !ok {
+			return
+		}
+		static := make(map[string][]dns.RR, len(c.static))
+		for n, rrs := range c.static {
+			if n != name {
+				static[n] = rrs
+			}
+		}
+		c.static = static
+	})
+}
+
+// staticResponse returns an authoritative response to q that consists of
+// static records, or nil if there are no static records for q.Name.
+func (r *resolver) staticResponse(q dns.Question) *dns.Msg {
+	if _, ok := r.static[q.Name]; !ok {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(q.Name, q.Qtype)
+	m.Response = true
+	m.Authoritative = true
+
+	name := q.Name
+	seen := map[string]bool{}
+	for !seen[name] {
+		seen[name] = true
+
+		var cname dns.RR
+		found := false
+		for _, rr := range r.static[name] {
+			switch rrtype := rr.Header().Rrtype; {
+			case rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+				m.Answer = append(m.Answer, dns.Copy(rr))
+				found = true
+			case rrtype == dns.TypeCNAME:
+				cname = rr
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+
+		m.Answer = append(m.Answer, dns.Copy(cname))
+		name = dns.CanonicalName(cname.(*dns.CNAME).Target)
+		if !r.followCNAMEs {
+			break
+		}
+	}
+
+	return m
+}
+
+// answerStatic answers the question of rs with static records, if there are
+// any for its name.
+func (r *resolver) answerStatic(rs *RecordSet) bool {
+	resp := r.staticResponse(rs.Raw.Question[0])
+	if resp == nil {
+		return false
+	}
+
+	rs.Trace.add(&TraceNode{
+		Server:    staticServer,
+		Message:   resp,
+		Age:       -1 * time.Second,
+		Synthetic: true,
+	})
+	rs.fromResponse(resp, staticServer, 0, -1*time.Second, false)
+
+	return true
+}
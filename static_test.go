@@ -0,0 +1,80 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_AddStatic(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	// Any other query fails the test; in particular, ext.example.net. must
+	// not be resolved.
+	rootSrv.ExpectQuery("A sub.db.example.").Respond().
+		Answer(A(t, "sub.db.example.", 300, "192.0.2.100"))
+	rootSrv.ExpectQuery("A db.example.").Respond().
+		Answer(A(t, "db.example.", 300, "192.0.2.100"))
+
+	require.NoError(t, r.AddStatic(
+		A(t, "DB.example.", 60, "10.0.0.5"),
+		A(t, "db.example.", 60, "10.0.0.6"),
+		CNAME(t, "www.example.", 60, "db.example."),
+		CNAME(t, "ext.example.", 60, "ext.example.net."),
+	))
+
+	ch := A(t, "chaos.example.", 60, "10.0.0.7")
+	ch.Header().Class = dns.ClassCHAOS
+	assert.Error(t, r.AddStatic(ch))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "db.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, rs.Values)
+	assert.Equal(t, staticServer, rs.ServerAddr)
+	assert.True(t, rs.Authoritative)
+	if assert.Len(t, rs.Trace.Queries, 1) {
+		assert.True(t, rs.Trace.Queries[0].Synthetic)
+	}
+	assert.Contains(t, rs.Trace.Dump(), "@static")
+
+	rs, err = r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5", "10.0.0.6"}, rs.Values)
+
+	rs, err = r.Query(WithoutFollowingCNAMEs(ctx), "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"db.example."}, rs.Values)
+
+	// The name has static records, just not of this type.
+	rs, err = r.Query(ctx, "AAAA", "db.example")
+	require.NoError(t, err)
+	assert.Empty(t, rs.Values)
+
+	// The target of the CNAME record doesn't have static records.
+	rs, err = r.Query(ctx, "A", "ext.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ext.example.net."}, rs.Values)
+
+	rs, err = r.Query(ctx, "A", "sub.db.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+
+	r.RemoveStatic("DB.example.")
+	rs, err = r.Query(ctx, "A", "db.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.100"}, rs.Values)
+	assert.Equal(t, "127.0.0.250:5354", rs.ServerAddr)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
@@ -0,0 +1,199 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of a Resolver, as returned by
+// Resolver.Stats. All counters start at zero when the Resolver is created.
+type Stats struct {
+	// Queries is the number of calls to Query, including those made by
+	// functions like LookupMX, and Errors counts the calls that returned
+	// an error, by kind.
+	Queries int64
+	Errors  ErrorStats
+
+	// Exchanges is the number of queries that have been sent to name
+	// servers, and CacheHits the number of queries that have been answered
+	// from the cache instead.
+	Exchanges int64
+	CacheHits int64
+
+	// UDP and TCP are the number of queries that the default Transport has
+	// sent via UDP and TCP, respectively; TCP includes queries sent to Unix
+	// domain sockets and via TLS or HTTPS. TCPFallbacks is the number of
+	// queries that have been retried via TCP after a truncated response or
+	// repeated failures via UDP, and EDNSFallbacks the number of queries
+	// that have been retried without EDNS0. Custom Transports are not
+	// counted.
+	UDP           int64
+	TCP           int64
+	TCPFallbacks  int64
+	EDNSFallbacks int64
+
+	// CacheEntries is the number of responses in the cache, CacheBytes the
+	// sum of their sizes in wire format, and Delegations the number of zones
+	// in the delegation cache.
+	CacheEntries int
+	CacheBytes   int
+	Delegations  int
+
+	// DelegationHops and NSLookups are the sums of RecordSet.Path.Delegations
+	// and RecordSet.Path.NSLookups, respectively, of all calls to Query.
+	DelegationHops int64
+	NSLookups      int64
+}
+
+// ErrorStats counts the errors returned by Query, by kind.
+type ErrorStats struct {
+	NXDomain       int64 // ErrNXDomain
+	Timeout        int64 // context.DeadlineExceeded and network timeouts
+	Canceled       int64 // context.Canceled
+	Circular       int64 // ErrCircular
+	LameDelegation int64 // ErrLameDelegation
+	Other          int64
+}
+
+// stats holds the counters of a Resolver. All methods are safe for
+// concurrent use and may be called on a nil *stats.
+type stats struct {
+	queries int64
+	errors  ErrorStats
+
+	exchanges int64
+	cacheHits int64
+
+	udp           int64
+	tcp           int64
+	tcpFallbacks  int64
+	ednsFallbacks int64
+
+	delegationHops int64
+	nsLookups      int64
+}
+
+// exchange counts a query that has been sent to a name server, or answered
+// from the cache if cached is true.
+func (s *stats) exchange(cached bool) {
+	switch {
+	case s == nil:
+	case cached:
+		atomic.AddInt64(&s.cacheHits, 1)
+	default:
+		atomic.AddInt64(&s.exchanges, 1)
+	}
+}
+
+// sent counts a query that the default transport has sent via network.
+func (s *stats) sent(network string) {
+	switch {
+	case s == nil:
+	case network == "udp":
+		atomic.AddInt64(&s.udp, 1)
+	default:
+		atomic.AddInt64(&s.tcp, 1)
+	}
+}
+
+// fallback counts a query that the default transport has retried via TCP,
+// or without EDNS0 if toTCP is false.
+func (s *stats) fallback(toTCP bool) {
+	switch {
+	case s == nil:
+	case toTCP:
+		atomic.AddInt64(&s.tcpFallbacks, 1)
+	default:
+		atomic.AddInt64(&s.ednsFallbacks, 1)
+	}
+}
+
+// path adds the metrics of a single call to Query.
+func (s *stats) path(p PathMetrics) {
+	if s == nil {
+		return
+	}
+
+	atomic.AddInt64(&s.delegationHops, int64(p.Delegations))
+	atomic.AddInt64(&s.nsLookups, int64(p.NSLookups))
+}
+
+// query counts a call to Query that returned err.
+func (s *stats) query(err error) {
+	if s == nil {
+		return
+	}
+
+	atomic.AddInt64(&s.queries, 1)
+
+	var netErr net.Error
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNXDomain):
+		atomic.AddInt64(&s.errors.NXDomain, 1)
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		atomic.AddInt64(&s.errors.Timeout, 1)
+	case errors.Is(err, context.Canceled):
+		atomic.AddInt64(&s.errors.Canceled, 1)
+	case errors.Is(err, ErrCircular):
+		atomic.AddInt64(&s.errors.Circular, 1)
+	case errors.Is(err, ErrLameDelegation):
+		atomic.AddInt64(&s.errors.LameDelegation, 1)
+	default:
+		atomic.AddInt64(&s.errors.Other, 1)
+	}
+}
+
+// Stats returns a snapshot of the counters of R, which describe the health
+// of the resolver. See PublishExpvar to expose them on a debug endpoint.
+func (R *Resolver) Stats() Stats {
+	s := R.stats
+	if s == nil {
+		return Stats{}
+	}
+
+	x := Stats{
+		Queries: atomic.LoadInt64(&s.queries),
+		Errors: ErrorStats{
+			NXDomain:       atomic.LoadInt64(&s.errors.NXDomain),
+			Timeout:        atomic.LoadInt64(&s.errors.Timeout),
+			Canceled:       atomic.LoadInt64(&s.errors.Canceled),
+			Circular:       atomic.LoadInt64(&s.errors.Circular),
+			LameDelegation: atomic.LoadInt64(&s.errors.LameDelegation),
+			Other:          atomic.LoadInt64(&s.errors.Other),
+		},
+		Exchanges:     atomic.LoadInt64(&s.exchanges),
+		CacheHits:     atomic.LoadInt64(&s.cacheHits),
+		UDP:           atomic.LoadInt64(&s.udp),
+		TCP:           atomic.LoadInt64(&s.tcp),
+		TCPFallbacks:  atomic.LoadInt64(&s.tcpFallbacks),
+		EDNSFallbacks: atomic.LoadInt64(&s.ednsFallbacks),
+
+		DelegationHops: atomic.LoadInt64(&s.delegationHops),
+		NSLookups:      atomic.LoadInt64(&s.nsLookups),
+	}
+	if R.cache != nil {
+		x.CacheEntries = R.cache.Len()
+		x.CacheBytes = R.cache.Bytes()
+	}
+	if R.delegations != nil {
+		x.Delegations = R.delegations.len()
+	}
+
+	return x
+}
+
+// PublishExpvar publishes the Stats of R as an expvar variable with the
+// given name, so that they are served by the /debug/vars endpoint of the
+// expvar package, for instance. The variable reflects the counters at the
+// time it is read. Like expvar.Publish, PublishExpvar panics if name is
+// already in use.
+func (R *Resolver) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return R.Stats()
+	}))
+}
@@ -0,0 +1,113 @@
+package dnsresolver
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_Stats(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+	expSrv.ExpectQuery("A nope.example.com.").Respond().Status(dns.RcodeNameError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rs.Path.Delegations) // com, example.com
+	assert.Equal(t, 0, rs.Path.NSLookups)
+	assert.Greater(t, rs.Path.UpstreamRTT, time.Duration(0))
+	assert.GreaterOrEqual(t, rs.Path.Duration, rs.Path.UpstreamRTT)
+	_, err = r.Query(ctx, "A", "nope.example.com")
+	assert.ErrorIs(t, err, ErrNXDomain)
+
+	stats := r.Stats()
+	assert.Equal(t, int64(2), stats.Queries)
+	assert.Equal(t, ErrorStats{NXDomain: 1}, stats.Errors)
+	assert.Equal(t, int64(5), stats.Exchanges) // NS ., root, com, and example.com twice
+	assert.Equal(t, int64(1), stats.CacheHits) // NS .
+	assert.Equal(t, int64(5), stats.UDP)
+	assert.Equal(t, int64(0), stats.TCP)
+	assert.Greater(t, stats.CacheEntries, 0)
+	assert.Greater(t, stats.CacheBytes, 0)
+	assert.Equal(t, 2, stats.Delegations)
+	assert.Equal(t, int64(2), stats.DelegationHops)
+	assert.Equal(t, int64(0), stats.NSLookups)
+
+	r.PublishExpvar("dnsresolver_test")
+
+	var published Stats
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("dnsresolver_test").String()), &published))
+	assert.Equal(t, stats, published)
+}
+
+func TestResolver_Query_Timing(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+
+	// Pretend that the lookup of ns.other.test. takes 20ms and the query
+	// to the example. server 50ms.
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			resp, rtt, err := next.Exchange(ctx, m, addr)
+			switch {
+			case m.Question[0].Name == "ns.other.test.":
+				rtt = 20 * time.Millisecond
+			case addr == "127.0.0.101:5354":
+				rtt = 50 * time.Millisecond
+			}
+			return resp, rtt, err
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.").DelegateTo("example.", "ns.other.test.")
+	rootSrv.ExpectQuery("A ns.other.test.").Respond().
+		Answer(A(t, "ns.other.test.", 300, expSrv.IP()))
+	rootSrv.ExpectQuery("AAAA ns.other.test.").Respond()
+	expSrv.ExpectQuery("A www.example.").Respond().
+		Answer(A(t, "www.example.", 300, "192.0.2.100"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+
+	assert.Equal(t, "127.0.0.101:5354", rs.Path.SlowestServer)
+	assert.Equal(t, 50*time.Millisecond, rs.Path.SlowestRTT)
+	assert.GreaterOrEqual(t, rs.Path.SubqueryRTT, 20*time.Millisecond)
+	assert.Less(t, rs.Path.SubqueryRTT, rs.Path.UpstreamRTT)
+	assert.Greater(t, rs.Path.CacheTime, time.Duration(0))
+	assert.Equal(t, rs.Trace.CacheTime(), rs.Path.CacheTime)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
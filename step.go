@@ -0,0 +1,173 @@
+package dnsresolver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Step is the result of Resolver.QueryStep.
+type Step struct {
+	// RecordSet is populated from the response of the server that has
+	// responded, as for QueryServer. ServersTried lists all servers that
+	// have been queried.
+	RecordSet RecordSet
+
+	// Referral is the delegation that the response refers to, or nil if the
+	// response is authoritative or a forwarder's. Glue contains the
+	// addresses of the name servers in the referral, if any. Addresses that
+	// are within the queried zone are preferred; see QueryStep.
+	Referral *ZoneCut
+	Glue     []string
+}
+
+// QueryStep sends a query for the given record type and DNS name to the name
+// servers of zone at serverAddrs, one at a time, until one of them responds
+// usefully, and returns the response. This is a single step of iterative
+// resolution, which allows callers to implement their own strategy to follow
+// referrals, such as querying all name servers of each zone, while cache and
+// timeout policies, the ServerOrder, and tracing are applied as for Query.
+//
+// zone is the zone that the servers are supposed to be authoritative for,
+// such as "com." for the servers that the root zone has referred to. It is
+// used to discard lame responses, i.e. referrals to zone itself or to zones
+// outside of it, and to prefer glue records within zone. If zone is empty,
+// all responses are accepted.
+//
+// serverAddrs are IP addresses with optional ports, as for QueryServer. The
+// next server is tried if a server doesn't respond, or responds with
+// SERVFAIL, REFUSED, NOTIMP, or a lame response. If no server responds
+// usefully, the error wraps a ServersExhaustedError. If the response
+// indicates an error, such as NXDOMAIN, the Step is populated nevertheless,
+// and an error is returned as for QueryServer.
+//
+// CNAME records in responses are returned as they are. Follow them, if
+// required, by starting over with the target name.
+func (R *Resolver) QueryStep(ctx context.Context, zone string, serverAddrs []string, recordType, domainName string) (Step, error) {
+	rs := RecordSet{
+		Raw: dns.Msg{
+			Question: []dns.Question{
+				{
+					Name:   dns.CanonicalName(domainName),
+					Qclass: dns.ClassINET,
+				},
+			},
+		},
+		Name:    domainName,
+		Type:    recordType,
+		Age:     -1 * time.Second,
+		Trace:   R.newTrace(),
+		literal: true,
+	}
+	step := Step{}
+
+	qtype, ok := parseType(recordType)
+	if !ok {
+		step.RecordSet = rs
+		return step, fmt.Errorf("unsupported record type: %s", recordType)
+	}
+	rs.Raw.Question[0].Qtype = qtype
+
+	var err error
+	rs.Raw.Question[0].Name, err = toASCII(domainName, R.StrictIDNA)
+	if err != nil {
+		step.RecordSet = rs
+		return step, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	addrs, serverNames, err := R.normalizeAddrs(serverAddrs)
+	if err != nil {
+		step.RecordSet = rs
+		return step, err
+	}
+	if len(addrs) == 0 {
+		step.RecordSet = rs
+		return step, fmt.Errorf("%s %s: no name servers", rs.Type, rs.Name)
+	}
+
+	r := R.newResolver(R.config().withServerNames(serverNames))
+	if zone != "" {
+		zone = dns.CanonicalName(zone)
+	}
+
+	step, err = r.step(ctx, zone, addrs, rs)
+	if err != nil {
+		return step, fmt.Errorf("%s %s: %w", rs.Type, rs.Name, err)
+	}
+
+	return step, nil
+}
+
+// step queries the servers at addrs for the question in rs until one of them
+// responds usefully; see QueryStep.
+func (r *resolver) step(ctx context.Context, zone string, addrs []string, rs RecordSet) (Step, error) {
+	addrs = r.orderServers(zone, addrs)
+	if r.refusal.Demote {
+		r.demoteRefusing(addrs)
+	}
+
+	q := rs.Raw.Question[0]
+	var errs []error
+	refused := 0
+	for _, addr := range addrs {
+		resp, rtt, age, err := r.doQueryRetry(ctx, q, addr, rs.Trace)
+		rs.ServersTried = append(rs.ServersTried, addr)
+		rs.RTT = rtt
+		if isTerminal(resp, err) {
+			return Step{RecordSet: rs}, err
+		}
+		if err != nil {
+			errs = append(errs, serverError(err, addr))
+			continue
+		}
+		if isRefusal(resp) {
+			refused++
+		}
+		if isRefusal(resp) || resp.Rcode == dns.RcodeServerFailure {
+			errs = append(errs, fmt.Errorf("%s @%s", dns.RcodeToString[resp.Rcode], addr))
+			continue
+		}
+
+		step := Step{}
+		if !isAuthoritative(resp) && !r.isForwarder(addr) && resp.Rcode == dns.RcodeSuccess {
+			ips, names := r.referrals(resp, zone)
+			refZone := referralZone(resp)
+			if isLame(zone, refZone, ips, names) && cnameTarget(resp) == "" {
+				err := fmt.Errorf("%w: %s @%s", ErrLameDelegation, zone, addr)
+				rs.Trace.last.Error = err
+				rs.Warnings = append(rs.Warnings, err)
+				errs = append(errs, err)
+				continue
+			}
+			if refZone != "" {
+				step.Referral = &ZoneCut{
+					Zone:        refZone,
+					Parent:      zone,
+					Server:      addr,
+					NameServers: referralNameServers(resp, refZone),
+				}
+				step.Glue = ips
+			}
+		}
+
+		r.rememberServer(zone, addr)
+		rcodeErr := checkRcode(resp)
+		rs.fromResponse(resp, addr, rtt, age, false)
+		step.RecordSet = rs
+		if rcodeErr != nil {
+			return step, rcodeErr
+		}
+
+		return step, nil
+	}
+
+	err := &ServersExhaustedError{
+		Zone:    zone,
+		Errors:  errs,
+		refused: refused > 0 && refused == len(addrs),
+	}
+
+	return Step{RecordSet: rs}, err
+}
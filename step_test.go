@@ -0,0 +1,87 @@
+package dnsresolver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_QueryStep(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewTestServer(t, "127.0.0.250:"+r.defaultPort)
+	lameSrv := NewTestServer(t, "127.0.0.251:"+r.defaultPort)    // com., answering with an upward referral
+	failingSrv := NewTestServer(t, "127.0.0.252:"+r.defaultPort) // com., failing
+	comSrv := NewTestServer(t, "127.0.0.253:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(NS(t, "com.", 300, "a.gtld.test.")).
+		Additional(A(t, "a.gtld.test.", 300, lameSrv.IP()))
+	lameSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(NS(t, ".", 300, "root.test.")).
+		Additional(A(t, "root.test.", 300, rootSrv.IP()))
+	failingSrv.ExpectQuery("A www.example.com.").Times(2).Respond().NonAuthoritative().
+		Status(dns.RcodeServerFailure)
+	comSrv.ExpectQuery("A www.example.com.").Times(2).Respond().NonAuthoritative().
+		Authority(
+			NS(t, "example.com.", 300, "ns1.example.com."),
+			NS(t, "example.com.", 300, "ns2.example.net."),
+		).
+		Additional(
+			A(t, "ns1.example.com.", 300, expSrv.IP()),
+			A(t, "ns2.example.net.", 300, "127.0.0.102"),
+		)
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.100"))
+	expSrv.ExpectQuery("A nx.example.com.").Respond().
+		Status(dns.RcodeNameError)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	step, err := r.QueryStep(ctx, ".", []string{"127.0.0.250"}, "A", "www.example.com")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", step.RecordSet.Trace.Dump())
+	assert.Equal(t, &ZoneCut{Zone: "com.", Parent: ".", Server: "127.0.0.250:5354", NameServers: []string{"a.gtld.test."}}, step.Referral)
+	assert.Equal(t, []string{"127.0.0.251"}, step.Glue)
+	assert.Equal(t, "127.0.0.250:5354", step.RecordSet.ServerAddr)
+
+	// The lame and failing servers are skipped. Glue within com. is
+	// preferred.
+	step, err = r.QueryStep(ctx, "com.", []string{"127.0.0.251", "127.0.0.252", "127.0.0.253"}, "A", "www.example.com")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", step.RecordSet.Trace.Dump())
+	assert.Equal(t, &ZoneCut{Zone: "example.com.", Parent: "com.", Server: "127.0.0.253:5354", NameServers: []string{"ns1.example.com.", "ns2.example.net."}}, step.Referral)
+	assert.Equal(t, []string{"127.0.0.101"}, step.Glue)
+	assert.Equal(t, []string{"127.0.0.251:5354", "127.0.0.252:5354", "127.0.0.253:5354"}, step.RecordSet.ServersTried)
+	require.Len(t, step.RecordSet.Warnings, 1)
+	assert.ErrorIs(t, step.RecordSet.Warnings[0], ErrLameDelegation)
+
+	// Without a zone, all glue is accepted.
+	step, err = r.QueryStep(ctx, "", []string{"127.0.0.253"}, "A", "www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.101", "127.0.0.102"}, step.Glue)
+
+	step, err = r.QueryStep(ctx, "example.com", step.Glue, "A", "www.example.com")
+	require.NoError(t, err)
+	assert.Nil(t, step.Referral)
+	assert.True(t, step.RecordSet.Authoritative)
+	assert.Equal(t, []string{"192.0.2.100"}, step.RecordSet.Values)
+
+	step, err = r.QueryStep(ctx, "example.com", []string{"127.0.0.101"}, "A", "nx.example.com")
+	assert.ErrorIs(t, err, ErrNXDomain)
+	assert.Equal(t, "NXDOMAIN", step.RecordSet.Rcode)
+
+	_, err = r.QueryStep(ctx, "com.", []string{"127.0.0.252", "127.0.0.251"}, "A", "www.example.com")
+	assert.ErrorIs(t, err, ErrLameDelegation)
+
+	for _, srv := range []*TestServer{rootSrv, lameSrv, failingSrv, comSrv, expSrv} {
+		srv.AssertNoOutstandingExpectations(t)
+	}
+}
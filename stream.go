@@ -0,0 +1,156 @@
+package dnsresolver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EventKind identifies the kind of an Event.
+type EventKind int
+
+const (
+	// EventQuery is emitted when a name server has responded to a query,
+	// or the response has been served from the cache.
+	EventQuery EventKind = iota + 1
+
+	// EventServerFailed is emitted when a query to a name server has
+	// failed, either without a response, such as due to a timeout, or
+	// with a SERVFAIL, REFUSED, or NOTIMP response.
+	EventServerFailed
+
+	// EventDelegation is emitted when a referral to a zone closer to the
+	// name in question has been followed.
+	EventDelegation
+
+	// EventAnswer is emitted when resolution has completed. It is the last
+	// event.
+	EventAnswer
+)
+
+// Event describes the progress of a query; see Resolver.QueryStream.
+type Event struct {
+	Kind EventKind
+
+	// Question, Server, Response, RTT, and Cached describe the query for
+	// EventQuery and EventServerFailed, as in a TraceNode. Nested queries,
+	// such as for the addresses of name servers, are included. Response is
+	// nil if no response has been received.
+	Question dns.Question
+	Server   string
+	Response *dns.Msg
+	RTT      time.Duration
+	Cached   bool
+
+	// ZoneCut is the delegation that has been followed for
+	// EventDelegation.
+	ZoneCut ZoneCut
+
+	// RecordSet is the result of the query for EventAnswer.
+	RecordSet RecordSet
+
+	// Err is the reason for the failure for EventServerFailed, if no
+	// response has been received, and the error returned by Query for
+	// EventAnswer.
+	Err error
+}
+
+// QueryStream is like Query, but reports the progress of resolution while it
+// is underway, which is useful to render it live, such as in a web-based
+// "dig +trace". Events are sent on the returned channel as they happen, and
+// the channel is closed after the final EventAnswer, which carries the
+// RecordSet and the error that Query would have returned.
+//
+// The caller must receive all events until the channel is closed, or cancel
+// ctx; resolution waits for each event to be received. If ctx is done,
+// remaining events are dropped, including EventAnswer.
+func (R *Resolver) QueryStream(ctx context.Context, recordType, domainName string) <-chan Event {
+	s := &eventStream{
+		ctx: ctx,
+		ch:  make(chan Event, 16),
+	}
+
+	go func() {
+		rs, err := R.Query(withEventStream(ctx, s), recordType, domainName)
+		s.emit(Event{Kind: EventAnswer, RecordSet: rs, Err: err})
+		s.close()
+	}()
+
+	return s.ch
+}
+
+type eventStreamKey struct{}
+
+func withEventStream(ctx context.Context, s *eventStream) context.Context {
+	return context.WithValue(ctx, eventStreamKey{}, s)
+}
+
+// eventStreamFrom returns the eventStream of ctx, or nil.
+func eventStreamFrom(ctx context.Context) *eventStream {
+	s, _ := ctx.Value(eventStreamKey{}).(*eventStream)
+	return s
+}
+
+// eventStream sends the events of QueryStream. Queries that are still in
+// flight when the stream is closed, such as those that have lost a Happy
+// Eyeballs race, may try to emit events afterwards, which are dropped.
+type eventStream struct {
+	ctx context.Context
+
+	mu     sync.Mutex
+	ch     chan Event
+	closed bool
+}
+
+// emit sends e unless s has been closed or its context is done. It is a
+// no-op if s is nil.
+func (s *eventStream) emit(e Event) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+	case <-s.ctx.Done():
+	}
+}
+
+// queried emits the outcome of a query to a name server.
+func (s *eventStream) queried(q dns.Question, addr string, resp *dns.Msg, rtt time.Duration, cached bool, err error) {
+	if s == nil {
+		return
+	}
+
+	e := Event{
+		Kind:     EventQuery,
+		Question: q,
+		Server:   addr,
+		RTT:      rtt,
+		Cached:   cached,
+		Err:      err,
+	}
+	if resp != nil {
+		e.Response = resp.Copy()
+	}
+	if err != nil || resp == nil || isRefusal(resp) || resp.Rcode == dns.RcodeServerFailure {
+		e.Kind = EventServerFailed
+	}
+
+	s.emit(e)
+}
+
+func (s *eventStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	close(s.ch)
+}
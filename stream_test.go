@@ -0,0 +1,93 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_QueryStream(t *testing.T) {
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	r.Use(func(next Exchanger) Exchanger {
+		return ExchangerFunc(func(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+			if addr == "127.0.0.251:5354" { // com., failing
+				return nil, 0, errors.New("i/o timeout")
+			}
+			return next.Exchange(ctx, m, addr)
+		})
+	})
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.252:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").Respond().NonAuthoritative().
+		Authority(NS(t, "com.", 300, "a.gtld.test."), NS(t, "com.", 300, "b.gtld.test.")).
+		Additional(A(t, "a.gtld.test.", 300, "127.0.0.251"), A(t, "b.gtld.test.", 300, comSrv.IP()))
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP()).ViaAuthoritySection()
+	expSrv.ExpectQuery("A www.example.com.").Times(2).Respond().
+		Answer(A(t, "www.example.com.", 300, "192.0.2.100"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var events []Event
+	for e := range r.QueryStream(ctx, "A", "www.example.com") {
+		events = append(events, e)
+	}
+	require.NotEmpty(t, events)
+
+	var (
+		kinds   []EventKind
+		servers []string
+		zones   []string
+	)
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+		switch e.Kind {
+		case EventQuery, EventServerFailed:
+			servers = append(servers, e.Server)
+		case EventDelegation:
+			zones = append(zones, e.ZoneCut.Zone)
+		}
+	}
+	assert.Equal(t, []EventKind{
+		EventQuery,        // bootstrap
+		EventQuery,        // root
+		EventDelegation,   // com.
+		EventServerFailed, // a.gtld.test.
+		EventQuery,        // b.gtld.test.
+		EventDelegation,   // example.com.
+		EventQuery,        // ns1.example.com.
+		EventAnswer,
+	}, kinds)
+	assert.Equal(t, []string{"127.0.0.250:5354", "127.0.0.250:5354", "127.0.0.251:5354", "127.0.0.252:5354", "127.0.0.101:5354"}, servers)
+	assert.Equal(t, []string{"com.", "example.com."}, zones)
+	assert.EqualError(t, events[3].Err, "i/o timeout")
+	assert.Equal(t, ZoneCut{Zone: "com.", Parent: ".", Server: "127.0.0.250:5354", NameServers: []string{"a.gtld.test.", "b.gtld.test."}}, events[2].ZoneCut)
+
+	last := events[len(events)-1]
+	require.NoError(t, last.Err)
+	assert.Equal(t, []string{"192.0.2.100"}, last.RecordSet.Values)
+
+	// The bootstrap response is cached.
+	events = events[:0]
+	for e := range r.QueryStream(ctx, "A", "www.example.com") {
+		events = append(events, e)
+	}
+	require.NotEmpty(t, events)
+	assert.True(t, events[0].Cached)
+	assert.Equal(t, EventAnswer, events[len(events)-1].Kind)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+	comSrv.AssertNoOutstandingExpectations(t)
+	expSrv.AssertNoOutstandingExpectations(t)
+}
@@ -0,0 +1,103 @@
+package dnsresolver
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// SVCBRecord is a parsed SVCB or HTTPS record, as described in RFC 9460.
+type SVCBRecord struct {
+	// Priority is the SvcPriority of the record. Zero indicates AliasMode,
+	// in which case Target is an alias for the queried name and all other
+	// parameters are empty.
+	Priority uint16
+
+	// Target is the fully qualified TargetName of the record, including the
+	// trailing dot. A value of "." means that the owner name itself is the
+	// target (in ServiceMode) or that the service is not available (in
+	// AliasMode).
+	Target string
+
+	// ALPN contains the protocol identifiers of the "alpn" parameter, such
+	// as "h2" and "h3".
+	ALPN []string
+
+	// NoDefaultALPN is true if the "no-default-alpn" parameter is present.
+	NoDefaultALPN bool
+
+	// Port is the value of the "port" parameter, or zero if absent.
+	Port uint16
+
+	// IPv4Hint and IPv6Hint contain the addresses of the "ipv4hint" and
+	// "ipv6hint" parameters, respectively.
+	IPv4Hint []net.IP
+	IPv6Hint []net.IP
+
+	// ECHConfig contains the raw ECHConfigList of the "ech" parameter
+	// (called "echconfig" in earlier drafts and in Params), if any.
+	ECHConfig []byte
+
+	// Params contains all parameters of the record, including the ones
+	// above, in presentation format and keyed by parameter name, such as
+	// "alpn" or "key65333".
+	Params map[string]string
+
+	// TTL is the time-to-live of the record.
+	TTL time.Duration
+}
+
+// SVCB returns the parsed SVCB or HTTPS records in rs, in the order sent by
+// the server. Records of any other type are ignored.
+func (rs RecordSet) SVCB() []SVCBRecord {
+	var records []SVCBRecord
+
+	for _, rr := range rs.records() {
+		var svcb *dns.SVCB
+		switch rr := rr.(type) {
+		case *dns.SVCB:
+			svcb = rr
+		case *dns.HTTPS:
+			svcb = &rr.SVCB
+		default:
+			continue
+		}
+
+		records = append(records, parseSVCB(svcb))
+	}
+
+	return records
+}
+
+func parseSVCB(rr *dns.SVCB) SVCBRecord {
+	x := SVCBRecord{
+		Priority: rr.Priority,
+		Target:   rr.Target,
+		TTL:      time.Duration(rr.Hdr.Ttl) * time.Second,
+	}
+
+	for _, kv := range rr.Value {
+		if x.Params == nil {
+			x.Params = map[string]string{}
+		}
+		x.Params[kv.Key().String()] = kv.String()
+
+		switch kv := kv.(type) {
+		case *dns.SVCBAlpn:
+			x.ALPN = append([]string{}, kv.Alpn...)
+		case *dns.SVCBNoDefaultAlpn:
+			x.NoDefaultALPN = true
+		case *dns.SVCBPort:
+			x.Port = kv.Port
+		case *dns.SVCBIPv4Hint:
+			x.IPv4Hint = append([]net.IP{}, kv.Hint...)
+		case *dns.SVCBIPv6Hint:
+			x.IPv6Hint = append([]net.IP{}, kv.Hint...)
+		case *dns.SVCBECHConfig:
+			x.ECHConfig = append([]byte{}, kv.ECH...)
+		}
+	}
+
+	return x
+}
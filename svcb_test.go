@@ -0,0 +1,65 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordSet_SVCB(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	https, err := dns.NewRR(`example.com. 321 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1,192.0.2.2 ipv6hint=2001:db8::1 key65333=foo`)
+	require.NoError(t, err)
+	alias, err := dns.NewRR(`example.com. 321 IN HTTPS 0 cdn.example.net.`)
+	require.NoError(t, err)
+
+	rootSrv.ExpectQuery("HTTPS example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("HTTPS example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("HTTPS example.com.").Respond().
+		Answer(https, alias)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "HTTPS", "example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	require.NoError(t, err)
+
+	assert.Equal(t, []SVCBRecord{
+		{
+			Priority: 1,
+			Target:   ".",
+			ALPN:     []string{"h3", "h2"},
+			Port:     8443,
+			IPv4Hint: []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4()},
+			IPv6Hint: []net.IP{net.ParseIP("2001:db8::1")},
+			Params: map[string]string{
+				"alpn":     "h3,h2",
+				"port":     "8443",
+				"ipv4hint": "192.0.2.1,192.0.2.2",
+				"ipv6hint": "2001:db8::1",
+				"key65333": "foo",
+			},
+			TTL: 321 * time.Second,
+		},
+		{
+			Priority: 0,
+			Target:   "cdn.example.net.",
+			TTL:      321 * time.Second,
+		},
+	}, rs.SVCB())
+}
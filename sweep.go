@@ -0,0 +1,101 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxSweepSize is the maximum number of addresses that LookupPTRRange
+// queries.
+const maxSweepSize = 1 << 16
+
+// LookupPTRRange reverse-resolves every address in the CIDR block cidr, such
+// as "192.0.2.0/24" or "2001:db8::/120", and returns the PTR values for each
+// address that has any. Addresses without PTR records are omitted.
+//
+// At most concurrency queries are in flight at the same time; if concurrency
+// is less than one, the addresses are queried one after another. All queries
+// use this resolver's cache, so the delegations of the reverse zones are only
+// resolved repeatedly if the CachePolicy doesn't cache them.
+//
+// Blocks with more than 65536 addresses are rejected.
+//
+// If any query fails for a reason other than NXDOMAIN, the remaining queries
+// are still sent, and the first such error is returned along with all
+// results.
+func (r *Resolver) LookupPTRRange(ctx context.Context, cidr string, concurrency int) (map[string][]string, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("%s: block too large: more than %d addresses", cidr, maxSweepSize)
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		results  = map[string][]string{}
+		sem      = make(chan struct{}, concurrency)
+	)
+
+	for ip := ipnet.IP; ipnet.Contains(ip); ip = nextIP(ip) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return results, ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			rs, err := r.Query(ctx, "PTR", ip)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case errors.Is(err, ErrNXDomain):
+			case err != nil:
+				if firstErr == nil {
+					firstErr = err
+				}
+			case len(rs.Values) > 0:
+				results[ip] = rs.Values
+			}
+		}(ip.String())
+	}
+
+	wg.Wait()
+
+	return results, firstErr
+}
+
+// nextIP returns the address following ip. The result is all zeros if ip is
+// the last address of its family.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,71 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolver_LookupPTRRange(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	arpaSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("PTR 0.2.0.192.in-addr.arpa.").DelegateTo("in-addr.arpa.", arpaSrv.IP())
+	arpaSrv.ExpectQuery("PTR 0.2.0.192.in-addr.arpa.").Respond().Status(dns.RcodeNameError)
+	arpaSrv.ExpectQuery("PTR 1.2.0.192.in-addr.arpa.").Respond().
+		Answer(
+			PTR(t, "1.2.0.192.in-addr.arpa.", 321, "one.example.com."),
+		)
+	arpaSrv.ExpectQuery("PTR 2.2.0.192.in-addr.arpa.").Respond().
+		Answer(
+			PTR(t, "2.2.0.192.in-addr.arpa.", 321, "two.example.com."),
+			PTR(t, "2.2.0.192.in-addr.arpa.", 321, "deux.example.com."),
+		)
+	arpaSrv.ExpectQuery("PTR 3.2.0.192.in-addr.arpa.").Respond()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	names, err := r.LookupPTRRange(ctx, "192.0.2.0/30", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"192.0.2.1": {"one.example.com."},
+		"192.0.2.2": {"two.example.com.", "deux.example.com."},
+	}, names)
+}
+
+func TestResolver_LookupPTRRange_TooLarge(t *testing.T) {
+	r := New()
+
+	_, err := r.LookupPTRRange(context.Background(), "10.0.0.0/8", 10)
+	assert.EqualError(t, err, "10.0.0.0/8: block too large: more than 65536 addresses")
+}
+
+func TestNextIP(t *testing.T) {
+	cases := []struct {
+		ip, want string
+	}{
+		{"192.0.2.0", "192.0.2.1"},
+		{"192.0.2.255", "192.0.3.0"},
+		{"255.255.255.255", "0.0.0.0"},
+		{"2001:db8::ffff", "2001:db8::1:0"},
+	}
+
+	for _, tc := range cases {
+		ip := net.ParseIP(tc.ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		assert.Equal(t, tc.want, nextIP(ip).String())
+	}
+}
@@ -0,0 +1,89 @@
+package dnsresolver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrPinMismatch is returned by the VerifyConnection function of
+// configurations created by PinSPKI if the certificate of a name server
+// doesn't match any of the pins. ErrPinMismatch may be wrapped and must be
+// tested for with errors.Is.
+var ErrPinMismatch = errors.New("certificate doesn't match any SPKI pin")
+
+// PinSPKI returns a copy of cfg, which may be nil, that accepts the
+// certificate of a name server only if the SHA-256 digest of a
+// SubjectPublicKeyInfo matches one of pins. Pins are base64-encoded, as in
+// RFC 7469 and RFC 7858, section 4.2, and can be computed with:
+//
+//	openssl x509 -noout -pubkey | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+//
+// The pins are checked in addition to the verification of the certificate
+// chain, and any certificate of a verified chain may match, so a pin may
+// refer to an intermediate or root CA as well. If cfg.InsecureSkipVerify is
+// true, the chain isn't verified, and the server's own certificate must
+// match, which allows for self-signed certificates of private servers.
+//
+// Use the result as Resolver.TLSConfig, or return it from
+// Resolver.TLSConfigFunc for the servers it applies to.
+func PinSPKI(cfg *tls.Config, pins ...string) (*tls.Config, error) {
+	if len(pins) == 0 {
+		return nil, errors.New("no SPKI pins")
+	}
+	digests := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: want base64-encoded SHA-256 digest", pin)
+		}
+		digests = append(digests, digest)
+	}
+
+	if cfg != nil {
+		cfg = cfg.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	verify := cfg.VerifyConnection
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if !matchSPKI(cs, digests) {
+			return ErrPinMismatch
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+
+		return nil
+	}
+
+	return cfg, nil
+}
+
+// matchSPKI reports whether a certificate of cs matches one of digests:
+// any certificate of the verified chains or, if the chain hasn't been
+// verified, the server's own certificate.
+func matchSPKI(cs tls.ConnectionState, digests [][]byte) bool {
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+		certs = cs.PeerCertificates[:1]
+	}
+
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, digest := range digests {
+			if subtle.ConstantTimeCompare(sum[:], digest) == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package dnsresolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinSPKI(t *testing.T) {
+	_, err := PinSPKI(nil)
+	assert.Error(t, err)
+	_, err = PinSPKI(nil, "not base64!")
+	assert.Error(t, err)
+	_, err = PinSPKI(nil, base64.StdEncoding.EncodeToString([]byte("too short")))
+	assert.Error(t, err)
+
+	// The certificate of httptest servers is self-signed and valid for
+	// 127.0.0.1.
+	certSrv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	certSrv.StartTLS()
+	certSrv.Close()
+	cert := certSrv.Certificate()
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	dotSrv := &dns.Server{
+		Listener: tls.NewListener(ln, certSrv.TLS.Clone()),
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg).SetReply(req)
+			m.RecursionAvailable = true
+			m.Answer = []dns.RR{A(t, req.Question[0].Name, 300, "192.0.2.1")}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	dotSrv.NotifyStartedFunc = func() { close(started) }
+	go dotSrv.ActivateAndServe()
+	defer dotSrv.Shutdown()
+	<-started
+
+	addr := "tls://" + ln.Addr().String()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	mustPin := func(cfg *tls.Config, pins ...string) *tls.Config {
+		cfg, err := PinSPKI(cfg, pins...)
+		require.NoError(t, err)
+		return cfg
+	}
+
+	testCases := []struct {
+		name      string
+		tlsConfig *tls.Config
+		wantErr   bool
+	}{
+		{name: "verified", tlsConfig: mustPin(&tls.Config{RootCAs: roots}, otherPin, pin)},
+		{name: "self-signed", tlsConfig: mustPin(&tls.Config{InsecureSkipVerify: true}, pin)},
+		{name: "mismatch", tlsConfig: mustPin(&tls.Config{RootCAs: roots}, otherPin), wantErr: true},
+		{name: "untrusted", tlsConfig: mustPin(nil, pin), wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			r := New()
+			r.LogFunc = DebugLog(t)
+			r.TLSConfig = tc.tlsConfig
+			require.NoError(t, r.SetBootstrapServers(addr))
+			require.NoError(t, r.SetForwarders(addr))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			defer cancel()
+
+			rs, err := r.Query(ctx, "A", "www.example.com")
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+		})
+	}
+
+	var calls []string
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.TLSConfig = mustPin(&tls.Config{RootCAs: roots}, otherPin)
+	r.TLSConfigFunc = func(addr, serverName string) *tls.Config {
+		calls = append(calls, addr+" "+serverName)
+		if addr == "tls://"+ln.Addr().String() {
+			return mustPin(&tls.Config{RootCAs: roots}, pin)
+		}
+		return nil
+	}
+	require.NoError(t, r.SetBootstrapServers(addr))
+	require.NoError(t, r.SetForwarders(addr))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, []string{addr + " "}, calls)
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"regexp"
 	"strings"
 	"time"
@@ -19,8 +20,42 @@ import (
 // servers.
 type Trace struct {
 	Queries []*TraceNode
-	stack   []*TraceNode
-	seen    map[string]struct{}
+
+	// Truncated is the number of queries that have been omitted from the
+	// trace because the limits set by Resolver.MaxTraceDepth or
+	// Resolver.MaxTraceQueries have been reached. Dump indicates omitted
+	// queries with lines starting with an ellipsis.
+	Truncated int
+
+	stack []*traceFrame
+	seen  map[string]struct{}
+	last  *TraceNode
+
+	// rootLast is the last query added at the top level, or nil if it has
+	// been omitted. rootTruncated is the number of omitted queries that
+	// belong to the top level.
+	rootLast      *TraceNode
+	rootTruncated int
+
+	size     int // number of retained nodes
+	maxDepth int // if <= 0, unlimited
+	maxSize  int // if <= 0, unlimited
+}
+
+// traceFrame is an element of Trace.stack. node is nil if the query that
+// caused the nested queries has been omitted from the trace.
+type traceFrame struct {
+	node *TraceNode
+	last *TraceNode
+}
+
+// newTrace returns a trace that retains at most maxDepth levels of nested
+// queries and at most maxSize queries in total.
+func newTrace(maxDepth, maxSize int) *Trace {
+	return &Trace{
+		maxDepth: maxDepth,
+		maxSize:  maxSize,
+	}
 }
 
 func (t *Trace) contains(q dns.Question, addr string) bool {
@@ -28,13 +63,34 @@ func (t *Trace) contains(q dns.Question, addr string) bool {
 	return ok
 }
 
+// forget causes contains to report false for q and addr again, so that
+// the query may be repeated.
+func (t *Trace) forget(q dns.Question, addr string) {
+	delete(t.seen, addr+q.String())
+}
+
+// attempts returns the number of servers that have been queried for q.
+func (t *Trace) attempts(q dns.Question) int {
+	suffix := q.String()
+
+	n := 0
+	for k := range t.seen {
+		if strings.HasSuffix(k, suffix) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// push causes subsequent queries to be added as children of the query that
+// has been added last at the current level.
 func (t *Trace) push() {
-	if len(t.stack) == 0 {
-		t.stack = append(t.stack, t.Queries[len(t.Queries)-1])
-	} else {
-		root := t.stack[len(t.stack)-1]
-		t.stack = append(t.stack, root.Children[len(root.Children)-1])
+	parent := t.rootLast
+	if len(t.stack) > 0 {
+		parent = t.stack[len(t.stack)-1].last
 	}
+	t.stack = append(t.stack, &traceFrame{node: parent})
 }
 
 func (t *Trace) pop() {
@@ -48,12 +104,112 @@ func (t *Trace) add(n *TraceNode) {
 		t.seen = make(map[string]struct{})
 	}
 	t.seen[n.Server+n.Message.Question[0].String()] = struct{}{}
+	t.last = n
 
-	if len(t.stack) == 0 {
-		t.Queries = append(t.Queries, n)
+	var frame *traceFrame
+	if len(t.stack) > 0 {
+		frame = t.stack[len(t.stack)-1]
+	}
+
+	omit := frame != nil && frame.node == nil ||
+		t.maxDepth > 0 && len(t.stack) >= t.maxDepth ||
+		t.maxSize > 0 && t.size >= t.maxSize
+
+	if omit {
+		t.Truncated++
+		t.truncate()
+		n = nil
 	} else {
-		root := t.stack[len(t.stack)-1]
-		root.Children = append(root.Children, n)
+		t.size++
+		if frame == nil {
+			t.Queries = append(t.Queries, n)
+		} else {
+			frame.node.Children = append(frame.node.Children, n)
+		}
+	}
+
+	if frame == nil {
+		t.rootLast = n
+	} else {
+		frame.last = n
+	}
+}
+
+// truncate records an omitted query with the closest ancestor that is part of
+// the trace, so Dump can indicate it at the right place.
+func (t *Trace) truncate() {
+	for i := len(t.stack) - 1; i >= 0; i-- {
+		if n := t.stack[i].node; n != nil {
+			n.truncated++
+			return
+		}
+	}
+	t.rootTruncated++
+}
+
+// fork returns an empty trace for queries that are sent concurrently with
+// those in t, and that will be added to t later with adopt. Queries that
+// have already been added to t are considered by contains.
+func (t *Trace) fork() *Trace {
+	sub := &Trace{
+		seen:     make(map[string]struct{}, len(t.seen)),
+		maxDepth: t.maxDepth,
+		maxSize:  t.maxSize,
+	}
+	for k := range t.seen {
+		sub.seen[k] = struct{}{}
+	}
+
+	if sub.maxDepth > 0 {
+		sub.maxDepth -= len(t.stack)
+		if sub.maxDepth < 1 {
+			sub.maxDepth = 1
+		}
+	}
+	if sub.maxSize > 0 {
+		sub.maxSize -= t.size
+		if sub.maxSize < 1 {
+			sub.maxSize = 1
+		}
+	}
+
+	return sub
+}
+
+// adopt adds the queries in sub, which has been created with fork, at the
+// current level of t.
+func (t *Trace) adopt(sub *Trace) {
+	for k := range sub.seen {
+		t.seen[k] = struct{}{}
+	}
+	t.Truncated += sub.Truncated
+	t.size += sub.size
+
+	var frame *traceFrame
+	if len(t.stack) > 0 {
+		frame = t.stack[len(t.stack)-1]
+	}
+
+	switch {
+	case frame == nil:
+		t.Queries = append(t.Queries, sub.Queries...)
+		t.rootTruncated += sub.rootTruncated
+	case frame.node != nil:
+		frame.node.Children = append(frame.node.Children, sub.Queries...)
+		frame.node.truncated += sub.rootTruncated
+	default:
+		t.Truncated += sub.size
+		t.size -= sub.size
+		t.truncate()
+	}
+}
+
+// append adds the queries in other to the end of t.
+func (t *Trace) append(other *Trace) {
+	if other != nil {
+		t.Queries = append(t.Queries, other.Queries...)
+		t.Truncated += other.Truncated
+		t.rootTruncated += other.rootTruncated
 	}
 }
 
@@ -64,17 +220,254 @@ func (t *Trace) add(n *TraceNode) {
 //
 // Lines starting with a question mark indicate DNS requests. Lines starting
 // with an exclamation mark indicate DNS responses. Lines starting with an X
-// indicate network errors.
+// indicate network errors or unusable responses, such as lame delegations.
+// Lines starting with an ellipsis indicate queries that have been omitted
+// from the trace; see Truncated.
+//
+// Dump omits EDNS OPT records. Use DumpWith for more or less detailed
+// output.
 func (t *Trace) Dump() string {
+	return t.DumpWith(DumpOptions{})
+}
+
+// DumpFormat selects the level of detail of Trace.DumpWith.
+type DumpFormat int
+
+const (
+	// DumpDefault is the format of Trace.Dump: one line per query and one
+	// line per record of each response.
+	DumpDefault DumpFormat = iota
+
+	// DumpCompact writes a single line per query, which summarizes the
+	// response. It is suitable for logs.
+	DumpCompact
+
+	// DumpVerbose is like DumpDefault, but also includes the ID, status,
+	// header flags, and size of each response, as well as EDNS OPT records.
+	DumpVerbose
+
+	// DumpDig mimics the output of "dig +trace", so that traces can be
+	// compared with dig runs: the records of each response in presentation
+	// format, followed by a line with the size of the response, the server,
+	// and the round-trip time. Like dig, DumpDig omits the additional
+	// section and nested queries, such as those for the addresses of name
+	// servers.
+	DumpDig
+)
+
+// DumpOptions control the output of Trace.DumpWith.
+type DumpOptions struct {
+	Format DumpFormat
+
+	// OmitAdditional omits the records in the additional section of
+	// responses, which are usually glue records. EDNS OPT records are still
+	// included by DumpVerbose.
+	OmitAdditional bool
+}
+
+// DumpWith is like Dump, but allows to customize the output; see
+// DumpOptions. Like that of Dump, the output may change between releases of
+// this package without notice.
+func (t *Trace) DumpWith(opts DumpOptions) string {
 	buf := &bytes.Buffer{}
 
+	if opts.Format == DumpDig {
+		for _, n := range t.Queries {
+			n.dumpDig(buf)
+		}
+
+		return buf.String()
+	}
+
 	for _, n := range t.Queries {
-		n.dump(buf, 0)
+		n.dump(buf, 0, opts)
 	}
+	dumpTruncated(buf, 0, t.rootTruncated)
 
 	return buf.String()
 }
 
+// QueryCount returns the number of queries that have actually been sent to
+// name servers, excluding responses served from the cache and queries that
+// have been skipped, for instance because they would have caused a cycle.
+//
+// Like all summary statistics, QueryCount only takes queries into account
+// that have not been omitted from the trace; see Truncated.
+func (t *Trace) QueryCount() int {
+	count := 0
+	t.walk(func(n *TraceNode, _ int) {
+		if n.sent {
+			count++
+		}
+	})
+
+	return count
+}
+
+// CacheHits returns the number of responses that have been served from the
+// cache.
+func (t *Trace) CacheHits() int {
+	count := 0
+	t.walk(func(n *TraceNode, _ int) {
+		if n.CacheHit {
+			count++
+		}
+	})
+
+	return count
+}
+
+// TotalRTT returns the sum of the round-trip times of all queries that have
+// been sent to name servers. The sum can exceed the wall-clock time of the
+// query if some of them have been sent concurrently, for instance to resolve
+// the addresses of several name servers at once, or to race name servers with
+// Resolver.HappyEyeballsDelay; see PathMetrics.Duration for the time that the
+// query took.
+func (t *Trace) TotalRTT() time.Duration {
+	var total time.Duration
+	t.walk(func(n *TraceNode, _ int) {
+		if n.sent {
+			total += n.RTT
+		}
+	})
+
+	return total
+}
+
+// CacheTime returns the total time that has been spent looking up responses
+// in the cache and adding them to it, including the time spent waiting for
+// other queries that access the cache concurrently.
+func (t *Trace) CacheTime() time.Duration {
+	var total time.Duration
+	t.walk(func(n *TraceNode, _ int) {
+		total += n.CacheTime
+	})
+
+	return total
+}
+
+// nestedRTT returns the sum of the round-trip times of the queries that have
+// been sent to name servers below the top level of the trace.
+func (t *Trace) nestedRTT() time.Duration {
+	var total time.Duration
+	t.walk(func(n *TraceNode, depth int) {
+		if n.sent && depth > 0 {
+			total += n.RTT
+		}
+	})
+
+	return total
+}
+
+// slowest returns the query with the largest round-trip time that has been
+// sent to a name server, or nil.
+func (t *Trace) slowest() *TraceNode {
+	var slowest *TraceNode
+	t.walk(func(n *TraceNode, _ int) {
+		if n.sent && (slowest == nil || n.RTT > slowest.RTT) {
+			slowest = n
+		}
+	})
+
+	return slowest
+}
+
+// MaxDepth returns the maximum nesting depth of the trace. A trace without
+// queries has depth zero; a trace without nested queries, such as those
+// necessary to resolve the addresses of name servers, has depth one.
+func (t *Trace) MaxDepth() int {
+	deepest := 0
+	t.walk(func(_ *TraceNode, depth int) {
+		if depth+1 > deepest {
+			deepest = depth + 1
+		}
+	})
+
+	return deepest
+}
+
+// Servers returns the addresses of all name servers that queries have been
+// sent to, in the order in which they have been contacted first.
+func (t *Trace) Servers() []string {
+	var addrs []string
+	seen := map[string]bool{}
+	t.walk(func(n *TraceNode, _ int) {
+		if n.sent && !seen[n.Server] {
+			seen[n.Server] = true
+			addrs = append(addrs, n.Server)
+		}
+	})
+
+	return addrs
+}
+
+// Walk calls fn for each query of the trace in depth-first order, i.e. each
+// query is followed by its nested queries, such as those for the addresses
+// of name servers, before the next query at the same level. depth is zero
+// for the top-level queries in t.Queries, one for their children, and so
+// on. If fn returns false, Walk stops.
+func (t *Trace) Walk(fn func(n *TraceNode, depth int) bool) {
+	if t == nil {
+		return
+	}
+
+	var visit func(nodes []*TraceNode, depth int) bool
+	visit = func(nodes []*TraceNode, depth int) bool {
+		for _, n := range nodes {
+			if n == nil {
+				continue
+			}
+			if !fn(n, depth) || !visit(n.Children, depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	visit(t.Queries, 0)
+}
+
+// walk calls fn for each node of the trace in depth-first order.
+func (t *Trace) walk(fn func(n *TraceNode, depth int)) {
+	t.Walk(func(n *TraceNode, depth int) bool {
+		fn(n, depth)
+		return true
+	})
+}
+
+// Flatten returns all queries of the trace in the order of Walk.
+func (t *Trace) Flatten() []*TraceNode {
+	var nodes []*TraceNode
+	t.walk(func(n *TraceNode, _ int) {
+		nodes = append(nodes, n)
+	})
+
+	return nodes
+}
+
+// Find returns the first query in the order of Walk for the question q that
+// has been sent to, or answered from the cache for, the name server at
+// server, or nil. Names are compared case-insensitively. If q.Qclass is
+// zero, queries for any class match, and if server is empty, queries to any
+// server match.
+func (t *Trace) Find(q dns.Question, server string) *TraceNode {
+	var found *TraceNode
+	t.Walk(func(n *TraceNode, _ int) bool {
+		if n.Message == nil || len(n.Message.Question) == 0 {
+			return true
+		}
+		if server != "" && n.Server != server {
+			return true
+		}
+		if nq := n.Message.Question[0]; nq.Qtype == q.Qtype && (q.Qclass == 0 || nq.Qclass == q.Qclass) && strings.EqualFold(nq.Name, q.Name) {
+			found = n
+			return false
+		}
+		return true
+	})
+
+	return found
+}
+
 type TraceNode struct {
 	Server string
 
@@ -83,49 +476,260 @@ type TraceNode struct {
 	Error   error
 	Age     time.Duration
 
+	// CacheTime is the time spent looking up the response in the cache
+	// and adding it to the cache, including waiting for locks.
+	CacheTime time.Duration
+
+	// CacheHit is true if the response has been served from the cache
+	// instead of querying Server. CacheTTL is the time that remains until
+	// the cached response expires, or, if the response has just been added
+	// to the cache, the duration for which it is cached. CacheTTL is zero
+	// if the response isn't cached.
+	CacheHit bool
+	CacheTTL time.Duration
+
+	// RawQuery and RawResponse are the query and the response in wire
+	// format if Resolver.RetainWireFormat is set, and nil otherwise. The
+	// default Transport retains the messages exactly as they have been sent
+	// and received, including responses that can't be parsed. For responses
+	// from the cache and from custom Transports, the messages are packed
+	// again, which may not reproduce the original bytes.
+	RawQuery    []byte
+	RawResponse []byte
+
 	Children []*TraceNode
+
+	// Synthetic is true if the response has been created locally from the
+	// records added with Resolver.AddStatic, or according to the
+	// Resolver's ResponsePolicy, without querying any server.
+	Synthetic bool
+
+	// Policy is the rule of the ResponsePolicy that has caused the
+	// response to be replaced, or nil.
+	Policy *PolicyRule
+
+	// truncated is the number of nested queries that have been omitted from
+	// the trace.
+	truncated int
+
+	// sent is true if the query has actually been sent to Server, i.e. it
+	// has neither been skipped nor been answered from the cache.
+	sent bool
 }
 
-func (n *TraceNode) dump(w io.Writer, depth int) {
-	if depth > 20 {
-		return
-	}
+func (n *TraceNode) dump(w io.Writer, depth int, opts DumpOptions) {
 	if n == nil {
 		return
 	}
 
 	msg := n.Message
+	indent := strings.Repeat(" ", depth*4)
 
-	io.WriteString(w, strings.Repeat(" ", depth*4))
-	if n.RTT < 1*time.Millisecond {
-		fmt.Fprintf(w, "? %s @%s (rtt<1ms, age=%v)\n", n.fmt(&msg.Question[0]), n.Server, n.Age)
+	io.WriteString(w, indent)
+	fmt.Fprintf(w, "? %s @%s (%s)", n.fmt(&msg.Question[0]), n.Server, n.timing())
+
+	if opts.Format == DumpCompact {
+		fmt.Fprintf(w, " %s\n", n.summary())
 	} else {
-		fmt.Fprintf(w, "? %s @%s (rtt=%v, age=%v)\n", n.fmt(&msg.Question[0]), n.Server, n.RTT, n.Age)
+		io.WriteString(w, "\n")
+		n.dumpResponse(w, indent, opts)
+	}
+
+	for _, c := range n.Children {
+		c.dump(w, depth+1, opts)
+	}
+	dumpTruncated(w, depth+1, n.truncated)
+}
+
+// timing describes the round-trip time of the query and whether the
+// response is cached, such as "rtt=20ms", "rtt<1ms, cached", or
+// "cached, 42s left".
+func (n *TraceNode) timing() string {
+	if n.CacheHit {
+		return fmt.Sprintf("cached, %v left", n.CacheTTL.Round(time.Second))
+	}
+
+	s := fmt.Sprintf("rtt=%v", n.RTT)
+	if n.RTT < 1*time.Millisecond {
+		s = "rtt<1ms"
+	}
+	if n.CacheTTL > 0 {
+		s += ", cached"
 	}
 
+	return s
+}
+
+// dumpResponse writes the outcome of the query and the records of the
+// response, one per line.
+func (n *TraceNode) dumpResponse(w io.Writer, indent string, opts DumpOptions) {
+	msg := n.Message
+
+	if opts.Format == DumpVerbose && msg.Response {
+		io.WriteString(w, indent)
+		fmt.Fprintf(w, "  ; id: %d, status: %s, flags: %s, size: %d bytes\n",
+			msg.Id, dns.RcodeToString[msg.Rcode], msgFlags(msg), msg.Len())
+	}
+
+	if n.Policy != nil {
+		io.WriteString(w, indent)
+		fmt.Fprintf(w, "  ~ POLICY %s %s\n", n.Policy.Action, n.Policy.Trigger)
+	}
 	if n.Error != nil {
-		io.WriteString(w, strings.Repeat(" ", depth*4))
-		if errors.Is(n.Error, ErrCircular) {
-			fmt.Fprintf(w, "  X CYCLE\n")
-		} else {
-			fmt.Fprintf(w, "  X %v\n", n.Error)
-		}
+		io.WriteString(w, indent)
+		fmt.Fprintf(w, "  X %s\n", n.errorString())
 	}
 	if msg.Rcode != dns.RcodeSuccess {
-		io.WriteString(w, strings.Repeat(" ", depth*4))
+		io.WriteString(w, indent)
 		fmt.Fprintf(w, "  X %s\n", dns.RcodeToString[msg.Rcode])
 	} else if empty(msg) {
-		io.WriteString(w, strings.Repeat(" ", depth*4))
+		io.WriteString(w, indent)
 		fmt.Fprintf(w, "  ~ EMPTY\n")
+	} else if isNoData(msg) {
+		io.WriteString(w, indent)
+		fmt.Fprintf(w, "  ~ %s\n", noDataString(msg))
 	}
 
-	for _, rr := range append(append(msg.Answer, msg.Ns...), msg.Extra...) {
-		io.WriteString(w, strings.Repeat(" ", depth*4))
+	for i, rr := range append(append(append([]dns.RR{}, msg.Answer...), msg.Ns...), msg.Extra...) {
+		if opt, ok := rr.(*dns.OPT); ok {
+			if opts.Format == DumpVerbose {
+				io.WriteString(w, indent)
+				fmt.Fprintf(w, "  ! %s\n", optString(opt))
+			}
+			continue
+		}
+		if opts.OmitAdditional && i >= len(msg.Answer)+len(msg.Ns) {
+			continue
+		}
+		io.WriteString(w, indent)
 		fmt.Fprintf(w, "  ! %v\n", n.fmt(rr))
 	}
+}
+
+// dumpDig writes the response in the format of "dig +trace".
+func (n *TraceNode) dumpDig(w io.Writer) {
+	if n == nil {
+		return
+	}
+
+	msg := n.Message
+	server := n.Server
+	if host, port, err := net.SplitHostPort(endpointHostPort(n.Server)); err == nil {
+		server = fmt.Sprintf("%s#%s(%s)", host, port, host)
+	}
+
+	if !msg.Response {
+		reason := "no response"
+		if n.Error != nil {
+			reason = n.errorString()
+		}
+		fmt.Fprintf(w, ";; communications error to %s: %s\n\n", server, reason)
+		return
+	}
+
+	for _, rr := range append(append([]dns.RR{}, msg.Answer...), msg.Ns...) {
+		fmt.Fprintln(w, rr.String())
+	}
+
+	size := len(n.RawResponse)
+	if size == 0 {
+		size = msg.Len()
+	}
+	fmt.Fprintf(w, ";; Received %d bytes from %s in %d ms\n\n", size, server, n.RTT.Milliseconds())
+}
+
+// summary describes the outcome of the query in a few words, for
+// DumpCompact.
+func (n *TraceNode) summary() string {
+	msg := n.Message
+
+	switch {
+	case n.Error != nil:
+		return "X " + n.errorString()
+	case !msg.Response:
+		return "X no response"
+	case msg.Rcode != dns.RcodeSuccess:
+		return "X " + dns.RcodeToString[msg.Rcode]
+	case empty(msg):
+		return "~ EMPTY"
+	case isNoData(msg):
+		return "~ " + noDataString(msg)
+	}
 
-	for _, n := range n.Children {
-		n.dump(w, depth+1)
+	extra := 0
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra++
+		}
+	}
+
+	return fmt.Sprintf("! answer=%d authority=%d additional=%d", len(msg.Answer), len(msg.Ns), extra)
+}
+
+// noDataString describes the NODATA response m.
+func noDataString(m *dns.Msg) string {
+	if isEmptyNonTerminal(m) {
+		return "NODATA (empty non-terminal)"
+	}
+
+	return "NODATA"
+}
+
+func (n *TraceNode) errorString() string {
+	switch {
+	case errors.Is(n.Error, ErrCircular):
+		return "CYCLE"
+	case errors.Is(n.Error, ErrLameDelegation):
+		return "LAME"
+	default:
+		return n.Error.Error()
+	}
+}
+
+// msgFlags returns the header flags of m that are set, in the style of dig.
+func msgFlags(m *dns.Msg) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{
+		{m.Response, "qr"},
+		{m.Authoritative, "aa"},
+		{m.Truncated, "tc"},
+		{m.RecursionDesired, "rd"},
+		{m.RecursionAvailable, "ra"},
+		{m.AuthenticatedData, "ad"},
+		{m.CheckingDisabled, "cd"},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	return strings.Join(flags, " ")
+}
+
+// optString formats the EDNS OPT pseudo-record on a single line.
+func optString(opt *dns.OPT) string {
+	s := fmt.Sprintf("OPT version=%d udp=%d", opt.Version(), opt.UDPSize())
+	if opt.Do() {
+		s += " flags=do"
+	}
+	for _, o := range opt.Option {
+		s += " " + spaces.ReplaceAllString(o.String(), " ")
+	}
+
+	return s
+}
+
+func dumpTruncated(w io.Writer, depth, count int) {
+	switch {
+	case count == 1:
+		io.WriteString(w, strings.Repeat(" ", depth*4))
+		fmt.Fprintf(w, "… 1 query truncated\n")
+	case count > 1:
+		io.WriteString(w, strings.Repeat(" ", depth*4))
+		fmt.Fprintf(w, "… %d queries truncated\n", count)
 	}
 }
 
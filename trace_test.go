@@ -0,0 +1,292 @@
+package dnsresolver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace_Statistics(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.CachePolicy = ObeyResponderAdvice(time.Minute)
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 4, rs.Trace.QueryCount())
+	assert.Equal(t, 0, rs.Trace.CacheHits())
+	assert.Equal(t, 1, rs.Trace.MaxDepth())
+	assert.Greater(t, rs.Trace.TotalRTT(), time.Duration(0))
+	assert.Equal(t, []string{
+		"127.0.0.250:5354",
+		"127.0.0.100:5354",
+		"127.0.0.101:5354",
+	}, rs.Trace.Servers())
+
+	rs, err = r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, rs.Trace.QueryCount())
+	assert.Greater(t, rs.Trace.CacheHits(), 0)
+	assert.Contains(t, rs.Trace.Dump(), "? www.example.com. IN A @127.0.0.101:5354 (cached, 5m21s left)")
+	assert.Equal(t, time.Duration(0), rs.Trace.TotalRTT())
+	assert.Empty(t, rs.Trace.Servers())
+
+	var empty *Trace
+	assert.Equal(t, 0, empty.QueryCount())
+	assert.Equal(t, 0, empty.MaxDepth())
+}
+
+func TestTrace_MaxDepth(t *testing.T) {
+	trace := &Trace{
+		Queries: []*TraceNode{
+			{Server: "a", sent: true},
+			{Server: "b", sent: true, Children: []*TraceNode{
+				{Server: "c", sent: true},
+				{Server: "a", sent: true, Children: []*TraceNode{
+					{Server: "d", Age: 5 * time.Second, CacheHit: true},
+				}},
+			}},
+		},
+	}
+
+	assert.Equal(t, 3, trace.MaxDepth())
+	assert.Equal(t, 4, trace.QueryCount())
+	assert.Equal(t, 1, trace.CacheHits())
+	assert.Equal(t, []string{"a", "b", "c"}, trace.Servers())
+}
+
+func TestTrace_Walk(t *testing.T) {
+	msg := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		return m
+	}
+
+	trace := &Trace{
+		Queries: []*TraceNode{
+			{Server: "a", Message: msg("www.example.com.", dns.TypeA)},
+			nil,
+			{Server: "b", Message: msg("www.example.com.", dns.TypeA), Children: []*TraceNode{
+				{Server: "c", Message: msg("ns1.example.com.", dns.TypeAAAA)},
+				{Server: "a", Children: []*TraceNode{
+					{Server: "d", Message: msg("NS1.example.com.", dns.TypeA)},
+				}},
+			}},
+			{Server: "e"},
+		},
+	}
+
+	var visited []string
+	trace.Walk(func(n *TraceNode, depth int) bool {
+		visited = append(visited, fmt.Sprintf("%s%d", n.Server, depth))
+		return n.Server != "d"
+	})
+	assert.Equal(t, []string{"a0", "b0", "c1", "a1", "d2"}, visited)
+
+	var servers []string
+	for _, n := range trace.Flatten() {
+		servers = append(servers, n.Server)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "a", "d", "e"}, servers)
+
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	assert.Same(t, trace.Queries[0], trace.Find(q, ""))
+	assert.Same(t, trace.Queries[2], trace.Find(q, "b"))
+	assert.Nil(t, trace.Find(q, "c"))
+	assert.Same(t, trace.Queries[2].Children[1].Children[0], trace.Find(dns.Question{Name: "ns1.example.com.", Qtype: dns.TypeA}, ""))
+	assert.Nil(t, trace.Find(dns.Question{Name: "ns1.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}, ""))
+
+	var empty *Trace
+	assert.Empty(t, empty.Flatten())
+	assert.Nil(t, empty.Find(q, ""))
+}
+
+func TestTrace_Limits(t *testing.T) {
+	node := func(name string) *TraceNode {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		return &TraceNode{Server: "192.0.2.1:53", Message: m}
+	}
+
+	trace := newTrace(2, 5)
+	trace.add(node("a."))
+	trace.push()
+	trace.add(node("b."))
+	trace.push()
+	trace.add(node("c.")) // too deep
+	trace.push()
+	trace.add(node("d.")) // parent omitted
+	trace.pop()
+	trace.pop()
+	trace.add(node("e."))
+	trace.pop()
+	trace.add(node("f."))
+	trace.add(node("g."))
+	trace.add(node("h.")) // too many
+	trace.add(node("i.")) // too many
+
+	assert.Equal(t, 4, trace.Truncated)
+	assert.Equal(t, strings.TrimSpace(`
+? a. IN A @192.0.2.1:53 (rtt<1ms)
+  ~ EMPTY
+    ? b. IN A @192.0.2.1:53 (rtt<1ms)
+      ~ EMPTY
+        … 2 queries truncated
+    ? e. IN A @192.0.2.1:53 (rtt<1ms)
+      ~ EMPTY
+? f. IN A @192.0.2.1:53 (rtt<1ms)
+  ~ EMPTY
+? g. IN A @192.0.2.1:53 (rtt<1ms)
+  ~ EMPTY
+… 2 queries truncated
+`)+"\n", trace.Dump())
+}
+
+func TestResolver_MaxTraceQueries(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.MaxTraceQueries = 2
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	comSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.101:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("com.", comSrv.IP())
+	comSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	assert.Len(t, rs.Trace.Queries, 2)
+	assert.Equal(t, 2, rs.Trace.Truncated)
+	assert.True(t, strings.HasSuffix(rs.Trace.Dump(), "\n… 2 queries truncated\n"))
+}
+
+func TestTrace_DumpWith(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+
+	referral := new(dns.Msg)
+	referral.SetReply(q)
+	referral.Id = 1234
+	referral.Ns = []dns.RR{NS(t, "example.com.", 300, "ns1.example.com.")}
+	referral.Extra = []dns.RR{A(t, "ns1.example.com.", 300, "192.0.2.53")}
+	referral.SetEdns0(1232, true)
+
+	trace := &Trace{
+		Queries: []*TraceNode{
+			{Server: "192.0.2.1:53", Message: referral, RTT: 20 * time.Millisecond, Age: -1 * time.Second},
+			{Server: "192.0.2.53:53", Message: q, Error: ErrLameDelegation, Age: -1 * time.Second},
+		},
+	}
+
+	assert.Equal(t, strings.TrimSpace(`
+? www.example.com. IN A @192.0.2.1:53 (rtt=20ms)
+  ! example.com. 300 IN NS ns1.example.com.
+  ! ns1.example.com. 300 IN A 192.0.2.53
+? www.example.com. IN A @192.0.2.53:53 (rtt<1ms)
+  X LAME
+  ~ EMPTY
+`)+"\n", trace.Dump())
+
+	assert.Equal(t, strings.TrimSpace(`
+? www.example.com. IN A @192.0.2.1:53 (rtt=20ms) ! answer=0 authority=1 additional=1
+? www.example.com. IN A @192.0.2.53:53 (rtt<1ms) X LAME
+`)+"\n", trace.DumpWith(DumpOptions{Format: DumpCompact}))
+
+	assert.Equal(t, strings.TrimSpace(`
+? www.example.com. IN A @192.0.2.1:53 (rtt=20ms)
+  ; id: 1234, status: NOERROR, flags: qr rd, size: 115 bytes
+  ! example.com. 300 IN NS ns1.example.com.
+  ! OPT version=0 udp=1232 flags=do
+? www.example.com. IN A @192.0.2.53:53 (rtt<1ms)
+  X LAME
+  ~ EMPTY
+`)+"\n", trace.DumpWith(DumpOptions{Format: DumpVerbose, OmitAdditional: true}))
+
+	assert.Equal(t, strings.Join([]string{
+		"example.com.\t300\tIN\tNS\tns1.example.com.",
+		";; Received 115 bytes from 192.0.2.1#53(192.0.2.1) in 20 ms",
+		"",
+		";; communications error to 192.0.2.53#53(192.0.2.53): LAME",
+		"",
+	}, "\n")+"\n", trace.DumpWith(DumpOptions{Format: DumpDig}))
+}
+
+func TestResolver_RetainWireFormat(t *testing.T) {
+	r := New()
+	r.defaultPort = "5354"
+	r.LogFunc = DebugLog(t)
+	r.RetainWireFormat = true
+
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	expSrv := NewTestServer(t, "127.0.0.100:"+r.defaultPort)
+
+	r.SetBootstrapServers(rootSrv.IP())
+
+	rootSrv.ExpectQuery("A www.example.com.").DelegateTo("example.com.", expSrv.IP())
+	expSrv.ExpectQuery("A www.example.com.").Respond().
+		Answer(
+			A(t, "www.example.com.", 321, "192.0.2.1"),
+		)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	t.Logf("Trace:\n" + rs.Trace.Dump())
+	assert.NoError(t, err)
+
+	nodes := 0
+	rs.Trace.walk(func(n *TraceNode, _ int) {
+		nodes++
+
+		var query, resp dns.Msg
+		if assert.NoError(t, query.Unpack(n.RawQuery)) {
+			assert.Equal(t, n.Message.Question, query.Question)
+			assert.NotNil(t, query.IsEdns0(), "query has been retained as sent")
+		}
+		if assert.NoError(t, resp.Unpack(n.RawResponse)) {
+			assert.Equal(t, n.Message.String(), resp.String())
+		}
+	})
+	assert.Equal(t, 3, nodes)
+}
@@ -0,0 +1,54 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unixScheme is the prefix of the addresses of name servers that listen on a
+// Unix domain socket, such as unix:///run/dnsproxy.sock.
+const unixScheme = "unix://"
+
+// unixSocketPath returns the path of the Unix domain socket that addr refers
+// to, and false if addr isn't of the form unix:///path.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixScheme) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(addr, unixScheme), true
+}
+
+// normalizeUnixAddr returns addr in canonical form if it is the address of a
+// Unix domain socket. The path must be absolute.
+func normalizeUnixAddr(addr string) (string, bool) {
+	path, ok := unixSocketPath(addr)
+	if !ok || !filepath.IsAbs(path) {
+		return "", false
+	}
+
+	return unixScheme + filepath.Clean(path), true
+}
+
+// dialUnix connects to the name server listening on the Unix domain socket
+// at path. Messages are framed as for DNS over TCP, with a two byte length
+// prefix.
+func dialUnix(ctx context.Context, path string) (*dns.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns.Conn{Conn: streamConn{conn}}, nil
+}
+
+// streamConn hides that *net.UnixConn implements net.PacketConn, which
+// would cause dns.Conn to send and receive messages without a length prefix.
+type streamConn struct {
+	net.Conn
+}
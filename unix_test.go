@@ -0,0 +1,50 @@
+package dnsresolver
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: ln,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			m := new(dns.Msg).SetReply(req)
+			m.RecursionAvailable = true
+			m.Answer = []dns.RR{A(t, req.Question[0].Name, 300, "192.0.2.1")}
+			w.WriteMsg(m)
+		}),
+	}
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	<-started
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+
+	assert.Error(t, r.SetForwarders("unix://dns.sock"))
+	require.NoError(t, r.SetBootstrapServers("unix://"+path))
+	require.NoError(t, r.SetForwarders("unix://"+path))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	rs, err := r.Query(ctx, "A", "www.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+	assert.Equal(t, "unix://"+path, rs.ServerAddr)
+	assert.Equal(t, int64(1), r.Stats().TCP)
+}
@@ -0,0 +1,116 @@
+package dnsresolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxTTL is the largest valid TTL (RFC 2181, section 8).
+const maxTTL = 1<<31 - 1
+
+// validateResponse checks the response resp from the server at addr to the
+// query m for records that Resolver.StrictResponses rejects, and returns a
+// *MalformedResponseError for the first offending record.
+func validateResponse(m, resp *dns.Msg, addr string) error {
+	fail := func(section string, rr dns.RR, format string, args ...interface{}) error {
+		return &MalformedResponseError{
+			Server:  addr,
+			Section: section,
+			Record:  rr,
+			Reason:  fmt.Sprintf(format, args...),
+		}
+	}
+
+	q := m.Question[0]
+	switch {
+	case len(resp.Question) == 0 && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError:
+		// Servers may omit the question from error responses.
+		return nil
+	case len(resp.Question) != 1:
+		return fail("QUESTION", nil, "%d questions", len(resp.Question))
+	case !strings.EqualFold(resp.Question[0].Name, q.Name) ||
+		resp.Question[0].Qtype != q.Qtype ||
+		resp.Question[0].Qclass != q.Qclass:
+		rq := resp.Question[0]
+		return fail("QUESTION", nil, "question %s %s %s doesn't match the query", rq.Name, dns.Class(rq.Qclass), dns.Type(rq.Qtype))
+	}
+
+	for _, section := range []struct {
+		name string
+		rrs  []dns.RR
+	}{
+		{"ANSWER", resp.Answer},
+		{"AUTHORITY", resp.Ns},
+		{"ADDITIONAL", resp.Extra},
+	} {
+		for _, rr := range section.rrs {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue // the TTL and class of OPT records have other meanings
+			}
+			if hdr.Ttl > maxTTL {
+				return fail(section.name, rr, "TTL exceeds %d (RFC 2181, section 8)", maxTTL)
+			}
+			if q.Qclass != dns.ClassANY && hdr.Class != q.Qclass {
+				return fail(section.name, rr, "class %s doesn't match the query", dns.Class(hdr.Class))
+			}
+		}
+	}
+
+	// Records in the ANSWER section must belong to the name in question or
+	// to the targets of the CNAME records that it is an alias of.
+	// Unlike cnameChain, owner names are compared case-insensitively.
+	target := dns.CanonicalName(q.Name)
+	owners := map[string]bool{target: true}
+	for more := true; more; {
+		more = false
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && dns.CanonicalName(cname.Hdr.Name) == target {
+				if next := dns.CanonicalName(cname.Target); !owners[next] {
+					target, owners[next], more = next, true, true
+				}
+			}
+		}
+	}
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		owner := dns.CanonicalName(hdr.Name)
+		switch {
+		case hdr.Rrtype == dns.TypeDNAME:
+			if !dns.IsSubDomain(owner, dns.CanonicalName(q.Name)) {
+				return fail("ANSWER", rr, "DNAME record doesn't apply to the question")
+			}
+			continue
+		case !owners[owner]:
+			return fail("ANSWER", rr, "owner name doesn't match the question")
+		}
+
+		switch hdr.Rrtype {
+		case q.Qtype, dns.TypeCNAME, dns.TypeRRSIG:
+		default:
+			if q.Qtype != dns.TypeANY {
+				return fail("ANSWER", rr, "type %s doesn't match the query", dns.Type(hdr.Rrtype))
+			}
+		}
+	}
+
+	// The AUTHORITY section may only refer to the zones that contain the
+	// name in question, or the last target of a CNAME chain.
+	for _, rr := range resp.Ns {
+		hdr := rr.Header()
+		switch hdr.Rrtype {
+		case dns.TypeNS, dns.TypeSOA, dns.TypeDS:
+			owner := dns.CanonicalName(hdr.Name)
+			if !dns.IsSubDomain(owner, target) && !dns.IsSubDomain(owner, dns.CanonicalName(q.Name)) {
+				return fail("AUTHORITY", rr, "zone %s doesn't contain %s", owner, target)
+			}
+		case dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+		default:
+			return fail("AUTHORITY", rr, "unexpected type %s", dns.Type(hdr.Rrtype))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateResponse(t *testing.T) {
+	query := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+
+	reply := func(f func(m *dns.Msg)) *dns.Msg {
+		m := new(dns.Msg).SetReply(query)
+		f(m)
+		return m
+	}
+
+	testCases := []struct {
+		name    string
+		resp    *dns.Msg
+		section string
+		reason  string
+	}{
+		{
+			name: "valid",
+			resp: reply(func(m *dns.Msg) {
+				m.Answer = []dns.RR{
+					RR(t, dns.TypeCNAME, "WWW.example.com.", 300),
+					A(t, "example.net.", 300, "192.0.2.1"),
+				}
+				m.Answer[0].(*dns.CNAME).Target = "example.net."
+				m.Ns = []dns.RR{NS(t, "net.", 300, "a.gtld.test.")}
+				m.SetEdns0(1232, false)
+			}),
+		},
+		{
+			name:    "no question",
+			resp:    reply(func(m *dns.Msg) { m.Question = nil }),
+			section: "QUESTION",
+			reason:  "0 questions",
+		},
+		{
+			name: "no question in error",
+			resp: reply(func(m *dns.Msg) { m.Question = nil; m.Rcode = dns.RcodeRefused }),
+		},
+		{
+			name:    "other question",
+			resp:    reply(func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA }),
+			section: "QUESTION",
+			reason:  "question www.example.com. IN AAAA doesn't match the query",
+		},
+		{
+			name:    "unrelated answer",
+			resp:    reply(func(m *dns.Msg) { m.Answer = []dns.RR{A(t, "evil.test.", 300, "192.0.2.1")} }),
+			section: "ANSWER",
+			reason:  "owner name doesn't match the question",
+		},
+		{
+			name:    "unexpected type",
+			resp:    reply(func(m *dns.Msg) { m.Answer = []dns.RR{RR(t, dns.TypeTXT, "www.example.com.", 300)} }),
+			section: "ANSWER",
+			reason:  "type TXT doesn't match the query",
+		},
+		{
+			name: "class",
+			resp: reply(func(m *dns.Msg) {
+				m.Answer = []dns.RR{A(t, "www.example.com.", 300, "192.0.2.1")}
+				m.Answer[0].Header().Class = dns.ClassCHAOS
+			}),
+			section: "ANSWER",
+			reason:  "class CH doesn't match the query",
+		},
+		{
+			name:    "ttl",
+			resp:    reply(func(m *dns.Msg) { m.Extra = []dns.RR{A(t, "ns.example.com.", 1<<31, "192.0.2.1")} }),
+			section: "ADDITIONAL",
+			reason:  "TTL exceeds 2147483647 (RFC 2181, section 8)",
+		},
+		{
+			name:    "unrelated referral",
+			resp:    reply(func(m *dns.Msg) { m.Ns = []dns.RR{NS(t, "example.net.", 300, "ns.example.net.")} }),
+			section: "AUTHORITY",
+			reason:  "zone example.net. doesn't contain www.example.com.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateResponse(query, tc.resp, "192.0.2.53:53")
+			if tc.section == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var merr *MalformedResponseError
+			require.True(t, errors.As(err, &merr), "%v", err)
+			assert.True(t, errors.Is(err, ErrMalformedResponse))
+			assert.Equal(t, "192.0.2.53:53", merr.Server)
+			assert.Equal(t, tc.section, merr.Section)
+			assert.Equal(t, tc.reason, merr.Reason)
+		})
+	}
+}
+
+func TestResolver_StrictResponses(t *testing.T) {
+	rootSrv := NewRootServer(t, "127.0.0.250:5354")
+
+	// Each resolver discovers the root servers on its own.
+	rootSrv.ExpectQuery("NS .").Respond().
+		Answer(NS(t, ".", 321, "self.test.")).
+		Additional(A(t, "self.test.", 321, rootSrv.IP()))
+	rootSrv.ExpectQuery("A www.example.").Times(2).Respond().
+		Answer(
+			A(t, "www.example.", 300, "192.0.2.1"),
+			A(t, "evil.test.", 300, "192.0.2.66"),
+		)
+
+	newResolver := func(strict bool) *Resolver {
+		r := New()
+		r.LogFunc = DebugLog(t)
+		r.StrictResponses = strict
+		r.defaultPort = "5354"
+		r.SetBootstrapServers(rootSrv.IP())
+		return r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rs, err := newResolver(false).Query(ctx, "A", "www.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, rs.Values)
+
+	r := newResolver(true)
+	_, err = r.Query(ctx, "A", "www.example")
+	var merr *MalformedResponseError
+	require.True(t, errors.As(err, &merr), "%v", err)
+	assert.Equal(t, "ANSWER", merr.Section)
+	assert.Equal(t, "evil.test.", merr.Record.Header().Name)
+	t.Log(err)
+
+	// The rejected response counts as a failure of the server.
+	h := r.health.get(rootSrv.IP() + ":5354")
+	assert.Equal(t, int64(2), h.Exchanges)
+	assert.Equal(t, int64(1), h.Failures)
+	assert.Equal(t, 1, h.ConsecutiveFailures)
+
+	rootSrv.AssertNoOutstandingExpectations(t)
+}
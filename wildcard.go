@@ -0,0 +1,93 @@
+package dnsresolver
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// isSynthesized reports whether m contains an RRSIG record in its ANSWER
+// section whose label count is smaller than the number of labels of its
+// owner name, which means that the signed records have been synthesized
+// from a wildcard (RFC 4035, section 5.3.4).
+func isSynthesized(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok || strings.HasPrefix(sig.Hdr.Name, "*.") {
+			continue
+		}
+		if int(sig.Labels) < dns.CountLabel(sig.Hdr.Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// probeWildcard reports whether the answer in rs, which has been received
+// from the server at addr that is authoritative for zone, looks like it has
+// been synthesized from a wildcard. The wildcard owners below zone are
+// queried at addr, closest to the question first, until one of them has
+// records of the type in question. The answer is considered synthesized if
+// these records have the same values as the answer.
+func (r *resolver) probeWildcard(ctx context.Context, rs RecordSet, zone, addr string) bool {
+	q := rs.Raw.Question[0]
+	if zone == "" {
+		zone = "."
+	}
+
+	want := sortedValues(rs)
+
+	labels := dns.SplitDomainName(q.Name)
+	for i := 1; i < len(labels); i++ {
+		parent := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(zone, parent) {
+			break
+		}
+
+		probe := dns.Question{
+			Name:   "*." + parent,
+			Qtype:  q.Qtype,
+			Qclass: q.Qclass,
+		}
+		resp, _, _, err := r.doQuery(ctx, probe, addr, rs.Trace)
+		if isTerminal(resp, err) {
+			return false
+		}
+		if err != nil || resp.Rcode != dns.RcodeSuccess {
+			continue
+		}
+
+		wildcard := RecordSet{
+			Raw:     dns.Msg{Question: []dns.Question{probe}},
+			literal: rs.literal,
+		}
+		wildcard.fromResponse(resp, addr, 0, 0, false)
+		if len(wildcard.Values) == 0 {
+			continue
+		}
+
+		got := sortedValues(wildcard)
+		if len(got) != len(want) {
+			return false
+		}
+		for j := range got {
+			if got[j] != want[j] {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+func sortedValues(rs RecordSet) []string {
+	values := append([]string{}, rs.Values...)
+	sort.Strings(values)
+
+	return values
+}
@@ -0,0 +1,31 @@
+package dnsresolver
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSynthesized(t *testing.T) {
+	rrsig := func(s string) dns.RR {
+		rr, err := dns.NewRR(s)
+		require.NoError(t, err)
+		return rr
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	m.Answer = []dns.RR{
+		A(t, "www.example.com.", 300, "192.0.2.1"),
+		rrsig("www.example.com. 300 IN RRSIG A 13 3 300 20300101000000 20200101000000 12345 example.com. AAAA"),
+	}
+	assert.False(t, isSynthesized(m))
+
+	m.Answer[1] = rrsig("www.example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA")
+	assert.True(t, isSynthesized(m))
+
+	m.Answer[1] = rrsig("*.example.com. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 12345 example.com. AAAA")
+	assert.False(t, isSynthesized(m))
+}
@@ -0,0 +1,149 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneWalk is the result of Resolver.WalkZone.
+type ZoneWalk struct {
+	// Zone is the zone that has been walked. The trailing dot is omitted.
+	Zone string
+
+	// Names contains the fully qualified names in the zone, in the
+	// canonical order of the NSEC chain (RFC 4034, section 6.1), starting
+	// with Zone itself. Names includes the owner names of delegations, but
+	// no names below them.
+	Names []string
+
+	// Types maps each name in Names to the record types that it owns
+	// according to its NSEC record, such as "A", "MX", "RRSIG", "NSEC".
+	Types map[string][]string
+
+	// Trace contains all queries that have been sent for the walk.
+	Trace *Trace
+}
+
+// WalkZone enumerates the names in zone by following the chain of NSEC
+// records of a DNSSEC-signed zone (RFC 4034, section 4): each NSEC record
+// names the next name in the zone, and the last one refers back to the zone
+// apex. This is useful for security audits, to find names that are not
+// supposed to be published.
+//
+// The name servers of zone are queried for the NSEC record of each name,
+// one after another, and the next server is tried if a server fails. Zones
+// that are signed with NSEC3 (RFC 5155) can't be walked this way, since
+// their NSEC3 records contain hashes instead of names. If zone isn't signed,
+// is signed with NSEC3, or its servers don't serve NSEC records on request,
+// as is the case for servers that synthesize them on the fly, the error wraps
+// ErrNoNSEC.
+//
+// Only walk zones that you are permitted to enumerate. Large zones require
+// as many queries as they have names; use ctx to limit the duration of the
+// walk. If an error occurs during the walk, the names found so far are
+// returned along with the error.
+func (R *Resolver) WalkZone(ctx context.Context, zone string) (ZoneWalk, error) {
+	fqdn := dns.CanonicalName(zone)
+	walk := ZoneWalk{
+		Zone:  trimTrailingDot(fqdn),
+		Types: map[string][]string{},
+		Trace: R.newTrace(),
+	}
+
+	addrs, err := R.zoneServers(ctx, fqdn, walk.Trace)
+	if err != nil {
+		return walk, fmt.Errorf("walk zone %s: %w", walk.Zone, err)
+	}
+
+	seen := map[string]bool{}
+	name := fqdn
+	for !seen[name] {
+		seen[name] = true
+
+		nsec, err := R.queryNSEC(ctx, name, addrs, walk.Trace)
+		if err != nil {
+			return walk, fmt.Errorf("walk zone %s: %w", walk.Zone, err)
+		}
+
+		walk.Names = append(walk.Names, nsec.Hdr.Name)
+		var types []string
+		for _, t := range nsec.TypeBitMap {
+			types = append(types, dns.Type(t).String())
+		}
+		walk.Types[nsec.Hdr.Name] = types
+
+		next := dns.CanonicalName(nsec.NextDomain)
+		if !dns.IsSubDomain(fqdn, next) {
+			return walk, fmt.Errorf("walk zone %s: NSEC record of %s refers to %s outside of the zone", walk.Zone, nsec.Hdr.Name, next)
+		}
+		name = next
+	}
+
+	if name != fqdn {
+		return walk, fmt.Errorf("walk zone %s: %w: NSEC chain loops back to %s", walk.Zone, ErrCircular, name)
+	}
+
+	return walk, nil
+}
+
+// zoneServers returns the addresses of the name servers of the zone fqdn.
+func (R *Resolver) zoneServers(ctx context.Context, fqdn string, trace *Trace) ([]string, error) {
+	rs, err := R.Query(ctx, "NS", fqdn)
+	trace.append(rs.Trace)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, rr := range rs.records() {
+		if ns, ok := rr.(*dns.NS); ok {
+			x, _ := R.lookupAddrs(ctx, ns.Ns, trace)
+			addrs = append(addrs, x...)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses for the name servers")
+	}
+
+	return addrs, nil
+}
+
+// queryNSEC asks the servers at addrs for the NSEC record of name, until one
+// of them responds.
+func (R *Resolver) queryNSEC(ctx context.Context, name string, addrs []string, trace *Trace) (*dns.NSEC, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		rs, err := R.QueryServer(WithoutFollowingCNAMEs(ctx), addr, "IN", "NSEC", name)
+		trace.append(rs.Trace)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		// The NSEC record of a delegation belongs to the parent zone, but
+		// servers may respond with a referral that includes it in the
+		// AUTHORITY section instead of answering.
+		for _, section := range [][]dns.RR{rs.Raw.Answer, rs.Raw.Ns} {
+			for _, rr := range section {
+				if nsec, ok := rr.(*dns.NSEC); ok && dns.CanonicalName(nsec.Hdr.Name) == name {
+					nsec = dns.Copy(nsec).(*dns.NSEC)
+					nsec.Hdr.Name = name
+					return nsec, nil
+				}
+			}
+		}
+
+		for _, rr := range rs.Raw.Ns {
+			if _, ok := rr.(*dns.NSEC3); ok {
+				return nil, fmt.Errorf("%w: %s: zone is signed with NSEC3", ErrNoNSEC, trimTrailingDot(name))
+			}
+		}
+
+		return nil, fmt.Errorf("%w: %s", ErrNoNSEC, trimTrailingDot(name))
+	}
+
+	return nil, lastErr
+}
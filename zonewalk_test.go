@@ -0,0 +1,78 @@
+package dnsresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolver_WalkZone(t *testing.T) {
+	nsec := func(name, next string, types ...uint16) *dns.NSEC {
+		return &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: next,
+			TypeBitMap: types,
+		}
+	}
+	chain := map[string]*dns.NSEC{
+		"example.":     nsec("example.", "A.example.", dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeNSEC),
+		"a.example.":   nsec("A.example.", "sub.example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC),
+		"sub.example.": nsec("sub.example.", "z.example.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC),
+		"z.example.":   nsec("z.example.", "example.", dns.TypeTXT, dns.TypeRRSIG, dns.TypeNSEC),
+	}
+
+	r := New()
+	r.LogFunc = DebugLog(t)
+	r.defaultPort = "5354"
+	rootSrv := NewRootServer(t, "127.0.0.250:"+r.defaultPort)
+	srv := NewTestServer(t, "127.0.0.100:"+r.defaultPort) // example. and nsec3.
+	r.SetBootstrapServers(rootSrv.IP())
+
+	for _, zone := range []string{"example.", "nsec3."} {
+		rootSrv.ExpectQuery("* "+zone).AnyTimes().DelegateTo(zone, srv.IP()).ViaAuthoritySection()
+		rootSrv.ExpectQuery("* *."+zone).AnyTimes().DelegateTo(zone, srv.IP()).ViaAuthoritySection()
+		srv.ExpectQuery("NS " + zone).AnyTimes().Respond().
+			Answer(NS(t, zone, 300, "ns.example."))
+	}
+	srv.ExpectQuery("A ns.example.").AnyTimes().Respond().
+		Answer(A(t, "ns.example.", 300, srv.IP()))
+	srv.ExpectQuery("AAAA ns.example.").AnyTimes().Respond()
+
+	for name, rr := range chain {
+		if name == "sub.example." {
+			// referral with the NSEC record in the AUTHORITY section
+			srv.ExpectQuery("NSEC "+name).Respond().NonAuthoritative().
+				Authority(NS(t, name, 300, "ns.other.test."), rr)
+			continue
+		}
+		srv.ExpectQuery("NSEC " + name).Respond().Answer(rr)
+	}
+	srv.ExpectQuery("NSEC nsec3.").Respond().
+		Authority(&dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: "1234567890abcdef1234567890abcdef.nsec3.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			HashLength: 20,
+			NextDomain: "1234567890abcdef1234567890abcdeg",
+		})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	walk, err := r.WalkZone(ctx, "example")
+	require.NoError(t, err)
+	t.Logf("Trace:\n%s", walk.Trace.Dump())
+
+	assert.Equal(t, "example", walk.Zone)
+	assert.Equal(t, []string{"example.", "a.example.", "sub.example.", "z.example."}, walk.Names)
+	assert.Equal(t, []string{"TXT", "RRSIG", "NSEC"}, walk.Types["z.example."])
+
+	_, err = r.WalkZone(ctx, "nsec3")
+	assert.True(t, errors.Is(err, ErrNoNSEC), "%v", err)
+
+	srv.AssertNoOutstandingExpectations(t)
+}